@@ -12,11 +12,13 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/syncs"
 	"github.com/hashicorp/go-multierror"
 	"github.com/jessevdk/go-flags"
 	"golang.org/x/term"
@@ -30,7 +32,7 @@ import (
 
 type options struct {
 	PositionalArgs struct {
-		AdHocCmd string `positional-arg-name:"command" description:"run ad-hoc command on target hosts"`
+		AdHocCmd string `positional-arg-name:"command" description:"run ad-hoc command on target hosts, or spot command: rollback, facts"`
 	} `positional-args:"yes" positional-optional:"yes"`
 
 	PlaybookFile    string        `short:"p" long:"playbook" env:"SPOT_PLAYBOOK" description:"playbook file" default:"spot.yml"`
@@ -56,6 +58,13 @@ type options struct {
 
 	Local bool `long:"local" description:"run all commands locally without SSH"`
 
+	Rollback bool `no-flag:"yes"` // set by "rollback" spot command, switches release commands back to the previous release
+	Facts    bool `no-flag:"yes"` // set by "facts" spot command, prints facts of the target hosts
+
+	// facts cache
+	FactsCache string        `long:"facts-cache" env:"SPOT_FACTS_CACHE" description:"file to keep gathered facts between runs"`
+	FactsTTL   time.Duration `long:"facts-ttl" env:"SPOT_FACTS_TTL" description:"time to use facts from the cache file" default:"1h"`
+
 	// secrets
 	SecretsProvider SecretsProvider `group:"secrets" namespace:"secrets" env-namespace:"SPOT_SECRETS"`
 
@@ -68,6 +77,7 @@ type options struct {
 
 	NoColor bool   `long:"no-color" env:"SPOT_NO_COLOR" description:"disable color output"`
 	Dry     bool   `long:"dry" description:"dry run"`
+	Check   bool   `long:"check" description:"check mode, dry run with conditions and check_safe commands evaluated"`
 	Verbose []bool `short:"v" long:"verbose" description:"verbosity level"`
 	Dbg     bool   `long:"dbg" description:"debug mode"`
 }
@@ -132,9 +142,13 @@ func main() {
 }
 
 func run(opts options) error {
-	if opts.Dry {
+	setSpotCommand(&opts)
+	if opts.Dry && !opts.Check {
 		printDryRunWarn(opts.Dbg)
 	}
+	if opts.Check {
+		printCheckModeWarn(opts.Dbg)
+	}
 	if opts.Local {
 		printLocalRunWarn(opts.Dbg)
 	}
@@ -163,6 +177,10 @@ func run(opts options) error {
 		return fmt.Errorf("can't make runner: %w", err)
 	}
 
+	if opts.Facts {
+		return runFacts(ctx, opts.Targets, r, os.Stdout)
+	}
+
 	if opts.PositionalArgs.AdHocCmd != "" { // run ad-hoc command
 		if r.Playbook, err = setAdHocSSH(opts, pbook); err != nil {
 			return fmt.Errorf("can't setup ad-hoc ssh params: %w", err)
@@ -185,6 +203,8 @@ func run(opts options) error {
 
 // runTasks runs all tasks in playbook by default or a single task if specified in command line
 func runTasks(ctx context.Context, taskNames, targets []string, r *runner.Process) error {
+	tr := newTaskRunner(r, targets)
+
 	// run specified tasks if there is any
 	if len(taskNames) > 0 {
 		resolved, err := resolveTaskNames(taskNames, r.Playbook)
@@ -192,10 +212,8 @@ func runTasks(ctx context.Context, taskNames, targets []string, r *runner.Proces
 			return err
 		}
 		for _, taskName := range resolved {
-			for _, targetName := range targetsForTask(targets, taskName, r.Playbook) {
-				if err := runTaskForTarget(ctx, r, taskName, targetName); err != nil {
-					return err
-				}
+			if err := tr.run(ctx, taskName); err != nil {
+				return err
 			}
 		}
 		return nil
@@ -203,15 +221,137 @@ func runTasks(ctx context.Context, taskNames, targets []string, r *runner.Proces
 
 	// run all tasks in playbook if no task specified
 	for _, task := range r.Playbook.AllTasks() {
-		for _, targetName := range targetsForTask(targets, task.Name, r.Playbook) {
-			if err := runTaskForTarget(ctx, r, task.Name, targetName); err != nil {
+		if err := tr.run(ctx, task.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taskRunner runs tasks with their dependencies (depends_on) on the task's targets.
+// Each task runs once per target, even if several tasks depend on it. Dependencies of a task
+// are independent of each other and run concurrently if concurrency is allowed.
+type taskRunner struct {
+	proc    *runner.Process
+	targets []string
+
+	mu   sync.Mutex
+	runs map[[2]string]*taskRun // runs by task and target
+}
+
+// taskRun is a single run of the task on the target, shared by all tasks depending on it
+type taskRun struct {
+	done chan struct{}
+	err  error
+}
+
+func newTaskRunner(r *runner.Process, targets []string) *taskRunner {
+	proc := *r
+	if proc.Concurrency > 1 {
+		// dependencies running concurrently share the playbook and update it after each run
+		proc.Playbook = &syncPlaybook{Playbook: r.Playbook}
+	}
+	return &taskRunner{proc: &proc, targets: targets, runs: make(map[[2]string]*taskRun)}
+}
+
+// run runs task's dependencies first and then the task itself on all its targets
+func (tr *taskRunner) run(ctx context.Context, taskName string) error {
+	tsk, err := tr.proc.Playbook.Task(taskName)
+	if err != nil {
+		return fmt.Errorf("can't get task %q: %w", taskName, err)
+	}
+
+	switch {
+	case len(tsk.Depends) == 1 || (len(tsk.Depends) > 1 && tr.proc.Concurrency <= 1):
+		for _, dep := range tsk.Depends {
+			if err := tr.run(ctx, dep); err != nil {
 				return err
 			}
 		}
+	case len(tsk.Depends) > 1:
+		wg := syncs.NewErrSizedGroup(tr.proc.Concurrency, syncs.Context(ctx), syncs.Preemptive)
+		for _, dep := range tsk.Depends {
+			wg.Go(func() error { return tr.run(ctx, dep) })
+		}
+		if err := wg.Wait(); err != nil {
+			return err
+		}
+	}
+
+	for _, targetName := range targetsForTask(tr.targets, taskName, tr.proc.Playbook) {
+		if err := tr.runOnce(ctx, taskName, targetName); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// runOnce runs the task on the target unless it already ran or is running, in which case it waits for the result
+func (tr *taskRunner) runOnce(ctx context.Context, taskName, targetName string) error {
+	key := [2]string{strings.ToLower(taskName), targetName}
+	tr.mu.Lock()
+	tRun, ok := tr.runs[key]
+	if ok {
+		tr.mu.Unlock()
+		log.Printf("[DEBUG] task %q for target %q already started, waiting for it", taskName, targetName)
+		select {
+		case <-tRun.done:
+			return tRun.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	tRun = &taskRun{done: make(chan struct{})}
+	tr.runs[key] = tRun
+	tr.mu.Unlock()
+
+	tRun.err = runTaskForTarget(ctx, tr.proc, taskName, targetName)
+	close(tRun.done)
+	return tRun.err
+}
+
+// syncPlaybook serializes access to the playbook shared by tasks running concurrently
+type syncPlaybook struct {
+	runner.Playbook
+	mu sync.RWMutex
+}
+
+func (p *syncPlaybook) AllTasks() []config.Task {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Playbook.AllTasks()
+}
+
+func (p *syncPlaybook) Task(name string) (*config.Task, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Playbook.Task(name)
+}
+
+func (p *syncPlaybook) TasksByTag(tag string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Playbook.TasksByTag(tag)
+}
+
+func (p *syncPlaybook) TargetHosts(name string) ([]config.Destination, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Playbook.TargetHosts(name)
+}
+
+func (p *syncPlaybook) UpdateTasksTargets(vars map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Playbook.UpdateTasksTargets(vars)
+}
+
+func (p *syncPlaybook) UpdateRegisteredVars(vars map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Playbook.UpdateRegisteredVars(vars)
+}
+
 // resolveTaskNames resolves each task name as either an exact task name or a tag.
 // if an exact task name match is found, it is used directly. otherwise, all tasks with a matching tag
 // are included in playbook order. returns error if no match found for any name.
@@ -253,6 +393,21 @@ func resolveTaskNames(taskNames []string, pbook runner.Playbook) ([]string, erro
 	return result, nil
 }
 
+// setSpotCommand sets the mode of the spot command passed in place of the ad-hoc command, i.e. "spot rollback"
+// or "spot facts". Only the exact command name is matched, so an ad-hoc command with the same name can be run
+// with its path or arguments, i.e. "spot ./rollback".
+func setSpotCommand(opts *options) {
+	switch opts.PositionalArgs.AdHocCmd {
+	case "rollback":
+		opts.Rollback = true
+	case "facts":
+		opts.Facts = true
+	default:
+		return
+	}
+	opts.PositionalArgs.AdHocCmd = ""
+}
+
 func runAdHoc(ctx context.Context, targets []string, r *runner.Process) error {
 	errs := new(multierror.Error)
 	r.Verbose = true // always verbose for ad-hoc
@@ -264,6 +419,20 @@ func runAdHoc(ctx context.Context, targets []string, r *runner.Process) error {
 	return errs.ErrorOrNil()
 }
 
+// runFacts gathers facts of all hosts of the targets and prints them
+func runFacts(ctx context.Context, targets []string, r *runner.Process, wr io.Writer) error {
+	for _, targetName := range targets {
+		facts, err := r.GatherFacts(ctx, targetName)
+		if err != nil {
+			return fmt.Errorf("can't gather facts for target %q: %w", targetName, err)
+		}
+		if _, err := io.WriteString(wr, runner.FormatFacts(facts)); err != nil {
+			return fmt.Errorf("can't write facts: %w", err)
+		}
+	}
+	return nil
+}
+
 // runGen generates a destination report for the tasks' targets
 func runGen(opts options, r *runner.Process) (err error) {
 	taskNames := opts.TaskNames
@@ -324,6 +493,15 @@ func printDryRunWarn(dbg bool) {
 	fmt.Print(msg)
 }
 
+func printCheckModeWarn(dbg bool) {
+	if dbg {
+		log.Printf("[WARN] check mode, no changes will be made and only check_safe commands will be executed")
+		return
+	}
+	msg := color.New(color.FgHiRed).SprintfFunc()("check mode - no changes will be made and only check_safe commands will be executed\n")
+	fmt.Print(msg)
+}
+
 func printLocalRunWarn(dbg bool) {
 	if dbg {
 		log.Printf("[WARN] local mode enabled - all commands will run locally without SSH")
@@ -424,6 +602,16 @@ func makeRunner(opts options, pbook *config.PlayBook) (*runner.Process, error) {
 		connector = connector.WithAgentForwarding()
 	}
 
+	inputs, err := envVars(opts.Env, opts.EnvFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read environment variables: %w", err)
+	}
+
+	factsCache, err := expandPath(opts.FactsCache)
+	if err != nil {
+		return nil, fmt.Errorf("can't expand facts cache path %q: %w", opts.FactsCache, err)
+	}
+
 	r := runner.Process{
 		Concurrency: opts.Concurrent,
 		Connector:   connector,
@@ -434,12 +622,16 @@ func makeRunner(opts options, pbook *config.PlayBook) (*runner.Process, error) {
 		Verbose:     len(opts.Verbose) > 0,
 		Verbose2:    len(opts.Verbose) > 1,
 		Dry:         opts.Dry,
+		Check:       opts.Check,
 		Local:       opts.Local,
+		Rollback:    opts.Rollback,
 		SSHShell:    opts.SSHShell,
 		SSHTempDir:  opts.SSHTempDir,
+		FactsCache:  runner.NewFactsCache(factsCache, opts.FactsTTL),
+		Inputs:      inputs,
 	}
-	log.Printf("[DEBUG] runner created: concurrency:%d, connector: %s, ssh_shell:%q, verbose:%v, dry:%v, only:%v, skip:%v",
-		r.Concurrency, r.Connector, r.SSHShell, r.Verbose, r.Dry, r.Only, r.Skip)
+	log.Printf("[DEBUG] runner created: concurrency:%d, connector: %s, ssh_shell:%q, verbose:%v, dry:%v, check:%v, "+
+		"rollback:%v, only:%v, skip:%v", r.Concurrency, r.Connector, r.SSHShell, r.Verbose, r.Dry, r.Check, r.Rollback, r.Only, r.Skip)
 
 	return &r, nil
 }
@@ -450,8 +642,8 @@ func runTaskForTarget(ctx context.Context, r *runner.Process, taskName, targetNa
 	if err != nil {
 		return fmt.Errorf("can't run task %q for target %q: %w", taskName, targetName, err)
 	}
-	log.Printf("[INFO] completed: hosts:%d, commands:%d in %v\n",
-		res.Hosts, res.Commands, time.Since(st).Truncate(100*time.Millisecond))
+	log.Printf("[INFO] completed: hosts:%d, commands:%d, changed:%d, skipped:%d, failed:%d in %v\n",
+		res.Hosts, res.Commands, res.Changed, res.Skipped, res.Failed, time.Since(st).Truncate(100*time.Millisecond))
 	r.Playbook.UpdateTasksTargets(res.Vars)         // for dynamic targets
 	r.Playbook.UpdateRegisteredVars(res.Registered) // for registered vars, cross-task
 	return nil
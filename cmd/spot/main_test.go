@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
@@ -340,6 +342,190 @@ func Test_runFailed(t *testing.T) {
 	assert.ErrorContains(t, err, `failed command "show content"`)
 }
 
+func Test_runRollback(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"20240101000000.000000", "20240102000000.000000"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "releases", name), 0o750))
+	}
+	require.NoError(t, os.Symlink(filepath.Join(dir, "releases", "20240102000000.000000"), filepath.Join(dir, "current")))
+	marker := filepath.Join(dir, "marker.txt")
+	pbFile := filepath.Join(dir, "spot.yml")
+	pb := fmt.Sprintf(`tasks:
+  - name: deploy
+    commands:
+      - name: build
+        script: echo build > %s
+      - name: release
+        release: {dir: %s, src: dist}
+`, marker, dir)
+	require.NoError(t, os.WriteFile(pbFile, []byte(pb), 0o600))
+
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		PlaybookFile: pbFile,
+		TaskNames:    []string{"deploy"},
+		Targets:      []string{"localhost"},
+		Local:        true,
+	}
+	opts.PositionalArgs.AdHocCmd = "rollback"
+	setupLog(true)
+	require.NoError(t, run(opts))
+
+	link, err := os.Readlink(filepath.Join(dir, "current"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "releases", "20240101000000.000000"), link)
+	assert.NoFileExists(t, marker, "only release commands run on rollback")
+}
+
+func Test_setSpotCommand(t *testing.T) {
+	tbl := []struct {
+		cmd, adHoc      string
+		rollback, facts bool
+	}{
+		{cmd: "rollback", rollback: true},
+		{cmd: "facts", facts: true},
+		{cmd: "facts -a", adHoc: "facts -a"},
+		{cmd: "./rollback", adHoc: "./rollback"},
+		{cmd: "rollback --force", adHoc: "rollback --force"},
+		{cmd: "ls -la", adHoc: "ls -la"},
+		{},
+	}
+	for _, tt := range tbl {
+		opts := options{}
+		opts.PositionalArgs.AdHocCmd = tt.cmd
+		setSpotCommand(&opts)
+		assert.Equal(t, tt.adHoc, opts.PositionalArgs.AdHocCmd, tt.cmd)
+		assert.Equal(t, tt.rollback, opts.Rollback, tt.cmd)
+		assert.Equal(t, tt.facts, opts.Facts, tt.cmd)
+	}
+}
+
+func Test_runFacts(t *testing.T) {
+	dir := t.TempDir()
+	marker, cacheFile := filepath.Join(dir, "marker.txt"), filepath.Join(dir, "facts.json")
+	pbFile := filepath.Join(dir, "spot.yml")
+	pb := fmt.Sprintf(`gather_facts: true
+tasks:
+  - name: deploy
+    commands:
+      - name: print
+        script: echo $SPOT_FACT_OS > %s
+`, marker)
+	require.NoError(t, os.WriteFile(pbFile, []byte(pb), 0o600))
+
+	opts := options{
+		SSHUser:      "test",
+		SSHKey:       "testdata/test_ssh_key",
+		PlaybookFile: pbFile,
+		Targets:      []string{"localhost"},
+		Local:        true,
+		FactsCache:   cacheFile,
+		FactsTTL:     time.Hour,
+	}
+	setupLog(true)
+	require.NoError(t, run(opts))
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, runtime.GOOS+"\n", string(data))
+	assert.FileExists(t, cacheFile)
+
+	pbook, _, err := makePlaybook(opts, "")
+	require.NoError(t, err)
+	r, err := makeRunner(opts, pbook)
+	require.NoError(t, err)
+	buf := bytes.Buffer{}
+	require.NoError(t, runFacts(context.Background(), opts.Targets, r, &buf))
+	assert.Contains(t, buf.String(), "localhost (localhost:0)\n")
+	assert.Contains(t, buf.String(), "  SPOT_FACT_OS="+runtime.GOOS+"\n")
+
+	opts.PositionalArgs.AdHocCmd = "facts"
+	require.NoError(t, run(opts))
+}
+
+func Test_runDependsOn(t *testing.T) {
+	setup := func(t *testing.T, sleep string) (pbFile, logFile string) {
+		dir := t.TempDir()
+		logFile = filepath.Join(dir, "tasks.log")
+		pbFile = filepath.Join(dir, "spot.yml")
+		pb := fmt.Sprintf(`tasks:
+  - name: deploy
+    depends_on: [build, migrate]
+    commands:
+      - name: deploy
+        script: echo deploy >> %[1]s
+  - name: migrate
+    depends_on: [prepare]
+    commands:
+      - name: migrate
+        script: sleep %[2]s && echo migrate >> %[1]s
+  - name: build
+    depends_on: [prepare]
+    commands:
+      - name: build
+        script: sleep %[2]s && echo build >> %[1]s
+  - name: prepare
+    commands:
+      - name: prepare
+        script: echo prepare >> %[1]s
+`, logFile, sleep)
+		require.NoError(t, os.WriteFile(pbFile, []byte(pb), 0o600))
+		return pbFile, logFile
+	}
+
+	readLog := func(t *testing.T, logFile string) []string {
+		data, err := os.ReadFile(logFile)
+		require.NoError(t, err)
+		return strings.Fields(string(data))
+	}
+
+	setupLog(true)
+
+	t.Run("selected task with dependencies", func(t *testing.T) {
+		pbFile, logFile := setup(t, "0")
+		opts := options{SSHUser: "test", SSHKey: "testdata/test_ssh_key", PlaybookFile: pbFile,
+			TaskNames: []string{"deploy"}, Targets: []string{"localhost"}, Local: true, Concurrent: 1}
+		require.NoError(t, run(opts))
+		assert.Equal(t, []string{"prepare", "build", "migrate", "deploy"}, readLog(t, logFile))
+	})
+
+	t.Run("all tasks, each runs once", func(t *testing.T) {
+		pbFile, logFile := setup(t, "0")
+		opts := options{SSHUser: "test", SSHKey: "testdata/test_ssh_key", PlaybookFile: pbFile,
+			Targets: []string{"localhost"}, Local: true, Concurrent: 1}
+		require.NoError(t, run(opts))
+		assert.Equal(t, []string{"prepare", "build", "migrate", "deploy"}, readLog(t, logFile))
+	})
+
+	t.Run("concurrent dependencies", func(t *testing.T) {
+		pbFile, logFile := setup(t, "0.5")
+		opts := options{SSHUser: "test", SSHKey: "testdata/test_ssh_key", PlaybookFile: pbFile,
+			TaskNames: []string{"deploy"}, Targets: []string{"localhost"}, Local: true, Concurrent: 2}
+		st := time.Now()
+		require.NoError(t, run(opts))
+		assert.Less(t, time.Since(st), 900*time.Millisecond, "build and migrate run concurrently")
+		res := readLog(t, logFile)
+		require.Len(t, res, 4)
+		assert.Equal(t, "prepare", res[0])
+		assert.ElementsMatch(t, []string{"build", "migrate"}, res[1:3])
+		assert.Equal(t, "deploy", res[3])
+	})
+
+	t.Run("failed dependency stops the task", func(t *testing.T) {
+		pbFile, logFile := setup(t, "0")
+		data, err := os.ReadFile(pbFile) // nolint
+		require.NoError(t, err)
+		data = []byte(strings.Replace(string(data), "echo prepare", "false && echo prepare", 1))
+		require.NoError(t, os.WriteFile(pbFile, data, 0o600))
+		opts := options{SSHUser: "test", SSHKey: "testdata/test_ssh_key", PlaybookFile: pbFile,
+			TaskNames: []string{"deploy"}, Targets: []string{"localhost"}, Local: true, Concurrent: 1}
+		err = run(opts)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `can't run task "prepare"`)
+		assert.NoFileExists(t, logFile)
+	})
+}
+
 func Test_runNoConfig(t *testing.T) {
 	opts := options{
 		SSHUser:      "test",
@@ -2,37 +2,61 @@ package config
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-pkgz/stringutils"
 	"gopkg.in/yaml.v3"
+
+	"github.com/umputun/spot/pkg/expr"
+	"github.com/umputun/spot/pkg/jsonpath"
 )
 
 // Cmd defines a single command. Yaml parsing is custom, because we want to allow "copy" to accept both single and multiple values
 type Cmd struct {
-	Name        string            `yaml:"name" toml:"name"`
-	Copy        CopyInternal      `yaml:"copy" toml:"copy"`
-	MCopy       []CopyInternal    `yaml:"mcopy" toml:"mcopy"` // multiple copy commands, implemented internally
-	Sync        SyncInternal      `yaml:"sync" toml:"sync"`
-	MSync       []SyncInternal    `yaml:"msync" toml:"msync"` // multiple sync commands, implemented internally
-	Delete      DeleteInternal    `yaml:"delete" toml:"delete"`
-	MDelete     []DeleteInternal  `yaml:"mdelete" toml:"mdelete"` // multiple delete commands, implemented internally
-	Wait        WaitInternal      `yaml:"wait" toml:"wait"`
-	Line        LineInternal      `yaml:"line" toml:"line"` // line manipulation command
-	Script      string            `yaml:"script" toml:"script,multiline"`
-	Echo        string            `yaml:"echo" toml:"echo"`
-	Environment map[string]string `yaml:"env" toml:"env"`
-	Options     CmdOptions        `yaml:"options" toml:"options,omitempty"`
-	Condition   string            `yaml:"cond" toml:"cond,omitempty"`
-	Register    []string          `yaml:"register" toml:"register"` // register variables from command
-	OnExit      string            `yaml:"on_exit" toml:"on_exit"`   // script to run on exit
+	Name         string            `yaml:"name" toml:"name"`
+	Copy         CopyInternal      `yaml:"copy" toml:"copy"`
+	MCopy        []CopyInternal    `yaml:"mcopy" toml:"mcopy"` // multiple copy commands, implemented internally
+	Sync         SyncInternal      `yaml:"sync" toml:"sync"`
+	MSync        []SyncInternal    `yaml:"msync" toml:"msync"` // multiple sync commands, implemented internally
+	Delete       DeleteInternal    `yaml:"delete" toml:"delete"`
+	MDelete      []DeleteInternal  `yaml:"mdelete" toml:"mdelete"` // multiple delete commands, implemented internally
+	Wait         WaitInternal      `yaml:"wait" toml:"wait"`
+	Line         LineInternal      `yaml:"line" toml:"line"`           // line manipulation command
+	Block        BlockInternal     `yaml:"block" toml:"block"`         // managed block of lines
+	Template     TemplateInternal  `yaml:"template" toml:"template"`   // render go template and copy the result
+	Unarchive    UnarchiveInternal `yaml:"unarchive" toml:"unarchive"` // extract archive to the remote directory
+	Fetch        FetchInternal     `yaml:"fetch" toml:"fetch"`         // download url on the remote host
+	Service      ServiceInternal   `yaml:"service" toml:"service"`     // manage systemd service
+	File         FileInternal      `yaml:"file" toml:"file"`           // file or directory state
+	MFile        []FileInternal    `yaml:"mfile" toml:"mfile"`         // multiple file commands, implemented internally
+	Git          GitInternal       `yaml:"git" toml:"git"`             // checkout git repository
+	Release      ReleaseInternal   `yaml:"release" toml:"release"`     // deploy to release directory and switch current link
+	Cron         CronInternal      `yaml:"cron" toml:"cron"`           // named entry in crontab or cron.d file
+	Call         CallInternal      `yaml:"call" toml:"call"`           // run commands of another task on the same host
+	Script       string            `yaml:"script" toml:"script,multiline"`
+	Echo         string            `yaml:"echo" toml:"echo"`
+	Environment  map[string]string `yaml:"env" toml:"env"`
+	Options      CmdOptions        `yaml:"options" toml:"options,omitempty"`
+	Condition    string            `yaml:"cond" toml:"cond,omitempty"`
+	When         string            `yaml:"when" toml:"when,omitempty"`                 // expression evaluated locally, skip command if false
+	Register     []string          `yaml:"register" toml:"register"`                   // register variables from command
+	RegisterJSON map[string]string `yaml:"register_json" toml:"register_json"`         // register variables from json output by path
+	OnExit       string            `yaml:"on_exit" toml:"on_exit"`                     // script to run on exit
+	FailedWhen   string            `yaml:"failed_when" toml:"failed_when,omitempty"`   // expression to decide if command failed
+	ChangedWhen  string            `yaml:"changed_when" toml:"changed_when,omitempty"` // expression to decide if command changed anything
+	Notify       []string          `yaml:"notify" toml:"notify,omitempty"`             // handlers to run if command changed anything
+	Loop         LoopInternal      `yaml:"loop" toml:"loop,omitempty"`                 // run command for each item
 
 	Secrets    map[string]string `yaml:"-" toml:"-"` // loaded secrets, filled by playbook
 	SSHShell   string            `yaml:"-" toml:"-"` // shell to use for ssh commands, filled by playbook
@@ -49,6 +73,10 @@ type CmdOptions struct {
 	SudoPassword string   `yaml:"sudo_password" toml:"sudo_password"` // secret key for sudo password
 	Secrets      []string `yaml:"secrets" toml:"secrets"`             // list of secrets (keys) to load
 	OnlyOn       []string `yaml:"only_on" toml:"only_on"`             // only run on these hosts
+	CheckSafe    bool     `yaml:"check_safe" toml:"check_safe"`       // command has no side effects, run it in check mode
+	GoTemplate   bool     `yaml:"go_template" toml:"go_template"`     // render go templates in command fields
+	RunOnce      bool     `yaml:"run_once" toml:"run_once"`           // run on the first selected host only, share results
+	DelegateTo   string   `yaml:"delegate_to" toml:"delegate_to"`     // run on this host instead of the current one
 }
 
 // CopyInternal defines copy command, implemented internally
@@ -77,20 +105,166 @@ type DeleteInternal struct {
 	Exclude   []string `yaml:"exclude" toml:"exclude"`
 }
 
-// WaitInternal defines wait command, implemented internally
+// WaitInternal defines wait command, implemented internally. Waits for the command to succeed,
+// for the http endpoint to respond or for the tcp port to accept connections.
 type WaitInternal struct {
 	Timeout       time.Duration `yaml:"timeout" toml:"timeout"`
 	CheckDuration time.Duration `yaml:"interval" toml:"interval"`
 	Command       string        `yaml:"cmd" toml:"cmd,multiline"`
+	HTTP          WaitHTTP      `yaml:"http" toml:"http"` // http check
+	TCP           string        `yaml:"tcp" toml:"tcp"`   // tcp check, host:port
+}
+
+// WaitHTTP defines http check of wait command
+type WaitHTTP struct {
+	URL     string            `yaml:"url" toml:"url"`
+	Status  int               `yaml:"status" toml:"status"`   // expected status code, any 2xx if not set
+	Body    string            `yaml:"body" toml:"body"`       // regex the response body should match
+	Headers map[string]string `yaml:"headers" toml:"headers"` // request headers, secrets are available in values
+}
+
+// IsSet checks if any of the wait checks is set
+func (w WaitInternal) IsSet() bool {
+	return w.Command != "" || w.HTTP.URL != "" || w.TCP != ""
+}
+
+// LoopInternal defines items the command runs for, one run per item. Items are a literal list,
+// a comma or newline separated variable, i.e. registered by previous command, or local files matching the glob.
+// In yaml the list of items can be set directly, i.e. loop: [a, b, c]
+type LoopInternal struct {
+	Items []string `yaml:"items" toml:"items"` // literal list of items
+	Var   string   `yaml:"var" toml:"var"`     // variable with comma or newline separated items
+	Glob  string   `yaml:"glob" toml:"glob"`   // local files matching the pattern
+}
+
+// IsSet checks if any source of loop items is set
+func (l LoopInternal) IsSet() bool {
+	return len(l.Items) > 0 || l.Var != "" || l.Glob != ""
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler interface, allows a list of items instead of the full loop definition
+func (l *LoopInternal) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&l.Items)
+	}
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			if key := value.Content[i].Value; !slices.Contains([]string{"items", "var", "glob"}, key) {
+				return fmt.Errorf("unknown loop field %q, must be one of items, var or glob", key)
+			}
+		}
+	}
+	type plain LoopInternal // prevent recursion
+	return value.Decode((*plain)(l))
 }
 
 // LineInternal defines line manipulation command, implemented internally
 type LineInternal struct {
-	File    string `yaml:"file" toml:"file"`       // target file path
-	Match   string `yaml:"match" toml:"match"`     // regex pattern to match
-	Delete  bool   `yaml:"delete" toml:"delete"`   // delete matching lines
-	Replace string `yaml:"replace" toml:"replace"` // replace matching lines with this
-	Append  string `yaml:"append" toml:"append"`   // append this line if pattern not found
+	File         string `yaml:"file" toml:"file"`                   // target file path
+	Match        string `yaml:"match" toml:"match"`                 // regex pattern to match
+	Delete       bool   `yaml:"delete" toml:"delete"`               // delete matching lines
+	Replace      string `yaml:"replace" toml:"replace"`             // replace matching lines with this
+	Backrefs     bool   `yaml:"backrefs" toml:"backrefs"`           // expand $1, ${name} in replace with match groups
+	Append       string `yaml:"append" toml:"append"`               // append this line if pattern not found
+	InsertAfter  string `yaml:"insert_after" toml:"insert_after"`   // insert this line after the last matching line
+	InsertBefore string `yaml:"insert_before" toml:"insert_before"` // insert this line before the last matching line
+}
+
+// BlockInternal defines block command, manages a block of lines delimited by marker lines, implemented internally
+type BlockInternal struct {
+	File         string `yaml:"file" toml:"file"`                   // target file path
+	Content      string `yaml:"content" toml:"content,multiline"`   // block content, without markers
+	Marker       string `yaml:"marker" toml:"marker"`               // marker line template, {mark} replaced by BEGIN and END
+	InsertAfter  string `yaml:"insert_after" toml:"insert_after"`   // insert new block after the last line matching regex, or BOF/EOF
+	InsertBefore string `yaml:"insert_before" toml:"insert_before"` // insert new block before the last line matching regex, or BOF/EOF
+	Delete       bool   `yaml:"delete" toml:"delete"`               // remove the block
+}
+
+// TemplateInternal defines template command, renders local go template file and copies the result to the remote host
+type TemplateInternal struct {
+	Source string `yaml:"src" toml:"src"`     // local template file
+	Dest   string `yaml:"dst" toml:"dst"`     // destination file on the remote host
+	Mode   string `yaml:"mode" toml:"mode"`   // optional octal file mode, e.g. 0644
+	Owner  string `yaml:"owner" toml:"owner"` // optional owner as user or user:group
+}
+
+// FetchInternal defines fetch command, downloads url to the file on the remote host with curl or wget
+type FetchInternal struct {
+	URL      string            `yaml:"url" toml:"url"`
+	Dest     string            `yaml:"dst" toml:"dst"`
+	Checksum string            `yaml:"checksum" toml:"checksum"` // sha256:<hex> or sha512:<hex>
+	Headers  map[string]string `yaml:"headers" toml:"headers"`   // request headers, values can refer to secrets
+	Force    bool              `yaml:"force" toml:"force"`       // download even if the destination exists, without checksum only
+}
+
+// ServiceInternal defines service command, manages systemd service state, implemented internally
+type ServiceInternal struct {
+	Name         string `yaml:"name" toml:"name"`                   // service (unit) name, e.g. nginx or nginx.service
+	State        string `yaml:"state" toml:"state"`                 // started, stopped, restarted or reloaded
+	Enabled      *bool  `yaml:"enabled" toml:"enabled"`             // enable or disable the service, unchanged if not set
+	DaemonReload bool   `yaml:"daemon_reload" toml:"daemon_reload"` // run systemctl daemon-reload first
+	Unit         string `yaml:"unit" toml:"unit"`                   // local unit file to install to /etc/systemd/system
+}
+
+// FileInternal defines file command, ensures the state of a file, directory or link, implemented internally
+type FileInternal struct {
+	Path    string `yaml:"path" toml:"path"`
+	State   string `yaml:"state" toml:"state"`     // directory, absent, touch or link
+	Source  string `yaml:"src" toml:"src"`         // link target, for link state only
+	Mode    string `yaml:"mode" toml:"mode"`       // optional octal mode, e.g. 0755
+	Owner   string `yaml:"owner" toml:"owner"`     // optional owner user
+	Group   string `yaml:"group" toml:"group"`     // optional owner group
+	Recurse bool   `yaml:"recurse" toml:"recurse"` // apply mode, owner and group to the directory content
+}
+
+// GitInternal defines git command, checks out the repository on the remote host, implemented internally
+type GitInternal struct {
+	Repo      string `yaml:"repo" toml:"repo"`
+	Dest      string `yaml:"dest" toml:"dest"`             // destination directory on the remote host
+	Ref       string `yaml:"ref" toml:"ref"`               // branch, tag or commit sha, remote HEAD if not set
+	Depth     int    `yaml:"depth" toml:"depth"`           // shallow fetch depth, full history if not set
+	KeySecret string `yaml:"key_secret" toml:"key_secret"` // secret with the deploy (ssh private) key
+}
+
+// CronInternal defines cron command, manages named entry in the user's crontab or in /etc/cron.d file,
+// implemented internally
+type CronInternal struct {
+	Name     string   `yaml:"name" toml:"name"`         // entry name, used in the marker comments
+	Schedule string   `yaml:"schedule" toml:"schedule"` // five time fields or @keyword, i.e. @daily
+	Job      string   `yaml:"job" toml:"job"`           // command to run
+	User     string   `yaml:"user" toml:"user"`         // crontab owner, or user to run as for cron.d file (root if not set)
+	File     string   `yaml:"file" toml:"file"`         // /etc/cron.d file name or absolute path, user's crontab if not set
+	Env      []string `yaml:"env" toml:"env"`           // environment lines, NAME=value, set before the entry
+	State    string   `yaml:"state" toml:"state"`       // present (default) or absent
+}
+
+// CallInternal defines call command, runs commands of another task inline, on the same host and connection
+type CallInternal struct {
+	Task string            `yaml:"task" toml:"task"` // name of the task to call
+	Args map[string]string `yaml:"args" toml:"args"` // arguments, passed to the called task as environment variables
+}
+
+// ReleaseInternal defines release command, deploys to a new timestamped release directory and switches
+// the current link to it, implemented internally
+type ReleaseInternal struct {
+	Dir             string   `yaml:"dir" toml:"dir"`                           // base directory with releases and current link
+	Source          string   `yaml:"src" toml:"src"`                           // local directory to sync or archive to extract
+	Exclude         []string `yaml:"exclude" toml:"exclude"`                   // exclude files matching patterns
+	StripComponents int      `yaml:"strip_components" toml:"strip_components"` // strip leading path components of archive
+	Check           string   `yaml:"check" toml:"check"`                       // script run in the new release before switch
+	Keep            int      `yaml:"keep" toml:"keep"`                         // number of releases to keep, 5 if not set
+}
+
+// UnarchiveInternal defines unarchive command, extracts tar, tar.gz, tar.zst or zip archive to the remote directory
+type UnarchiveInternal struct {
+	Source          string   `yaml:"src" toml:"src"`                           // archive file, local unless remote is set
+	Dest            string   `yaml:"dst" toml:"dst"`                           // destination directory on the remote host
+	Remote          bool     `yaml:"remote" toml:"remote"`                     // archive is already on the remote host
+	StripComponents int      `yaml:"strip_components" toml:"strip_components"` // strip leading path components
+	Exclude         []string `yaml:"exclude" toml:"exclude"`                   // exclude files matching patterns
+	Creates         string   `yaml:"creates" toml:"creates"`                   // skip extraction if this path exists
+	Mode            string   `yaml:"mode" toml:"mode"`                         // optional octal mode of the destination dir
+	Owner           string   `yaml:"owner" toml:"owner"`                       // optional owner as user or user:group
 }
 
 // GetScript returns a script string and an io.Reader based on the command being single line or multiline.
@@ -147,6 +321,28 @@ func (cmd *Cmd) GetCondition() (command string, rdr io.Reader, inverted bool) {
 	return cmd.scriptCommand(cond), nil, inverted
 }
 
+// GetChecksum returns the checksum algorithm (sha256 or sha512) and lowercase hex sum of the fetch command.
+// Empty values are returned if the checksum is not set.
+func (cmd *Cmd) GetChecksum() (algo, sum string, err error) {
+	if cmd.Fetch.Checksum == "" {
+		return "", "", nil
+	}
+	algo, sum, ok := strings.Cut(cmd.Fetch.Checksum, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid checksum %q, must be sha256:<hex> or sha512:<hex>", cmd.Fetch.Checksum)
+	}
+	algo, sum = strings.ToLower(strings.TrimSpace(algo)), strings.ToLower(strings.TrimSpace(sum))
+	sizes := map[string]int{"sha256": 64, "sha512": 128}
+	size, ok := sizes[algo]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported checksum algorithm %q, must be sha256 or sha512", algo)
+	}
+	if _, e := hex.DecodeString(sum); e != nil || len(sum) != size {
+		return "", "", fmt.Errorf("invalid %s checksum %q, must be %d hex characters", algo, sum, size)
+	}
+	return algo, sum, nil
+}
+
 // scriptCommand concatenates all script lines in commands into one a string to be executed by shell.
 // Empty string is returned if no script is defined.
 func (cmd *Cmd) scriptCommand(inp string) string {
@@ -347,6 +543,7 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(any) error) error {
 		{"copy", &cmd.Copy, &cmd.MCopy},
 		{"sync", &cmd.Sync, &cmd.MSync},
 		{"delete", &cmd.Delete, &cmd.MDelete},
+		{"file", &cmd.File, &cmd.MFile},
 	}
 
 	// helper function to check if a field is special, matching by filed name (yaml tag)
@@ -400,7 +597,7 @@ func (cmd *Cmd) UnmarshalYAML(unmarshal func(any) error) error {
 		}
 	}
 
-	// copy, sync and delete are special cases, as they can be either a struct or a list of structs
+	// copy, sync, delete and file are special cases, as they can be either a struct or a list of structs
 	for _, sf := range specialFlds {
 		if err := unmarshalField(sf.fld, sf.destSingle); err != nil {
 			if err := unmarshalField(sf.fld, sf.destSlice); err != nil {
@@ -446,12 +643,23 @@ func (cmd *Cmd) validate() error {
 		{"mdelete", func() bool { return len(cmd.MDelete) > 0 }},
 		{"sync", func() bool { return cmd.Sync.Source != "" && cmd.Sync.Dest != "" }},
 		{"msync", func() bool { return len(cmd.MSync) > 0 }},
-		{"wait", func() bool { return cmd.Wait.Command != "" }},
+		{"wait", func() bool { return cmd.Wait.IsSet() }},
 		{"line", func() bool {
-			return cmd.Line.File != "" && cmd.Line.Match != "" &&
-				(cmd.Line.Delete || cmd.Line.Replace != "" || cmd.Line.Append != "")
+			return cmd.Line.File != "" && cmd.Line.Match != "" && (cmd.Line.Delete || cmd.Line.Replace != "" ||
+				cmd.Line.Append != "" || cmd.Line.InsertAfter != "" || cmd.Line.InsertBefore != "")
 		}},
 		{"echo", func() bool { return cmd.Echo != "" }},
+		{"block", func() bool { return cmd.Block.File != "" && (cmd.Block.Content != "" || cmd.Block.Delete) }},
+		{"template", func() bool { return cmd.Template.Source != "" && cmd.Template.Dest != "" }},
+		{"unarchive", func() bool { return cmd.Unarchive.Source != "" && cmd.Unarchive.Dest != "" }},
+		{"fetch", func() bool { return cmd.Fetch.URL != "" && cmd.Fetch.Dest != "" }},
+		{"service", func() bool { return cmd.Service.Name != "" }},
+		{"file", func() bool { return cmd.File.Path != "" }},
+		{"mfile", func() bool { return len(cmd.MFile) > 0 }},
+		{"git", func() bool { return cmd.Git.Repo != "" && cmd.Git.Dest != "" }},
+		{"release", func() bool { return cmd.Release.Dir != "" && cmd.Release.Source != "" }},
+		{"cron", func() bool { return cmd.Cron.Name != "" }},
+		{"call", func() bool { return cmd.Call.Task != "" }},
 	}
 
 	setCmds := make([]string, 0, 2)
@@ -475,6 +683,214 @@ func (cmd *Cmd) validate() error {
 	if cmd.Script == "" && len(cmd.Register) > 0 {
 		return fmt.Errorf("register is only allowed with script command")
 	}
+	if cmd.Script == "" && len(cmd.RegisterJSON) > 0 {
+		return fmt.Errorf("register_json is only allowed with script command")
+	}
+	for name, path := range cmd.RegisterJSON {
+		if _, err := jsonpath.Parse(path); err != nil {
+			return fmt.Errorf("invalid register_json for %s: %w", name, err)
+		}
+	}
+
+	lineOps := 0
+	for _, set := range []bool{cmd.Line.Delete, cmd.Line.Replace != "", cmd.Line.Append != "",
+		cmd.Line.InsertAfter != "", cmd.Line.InsertBefore != ""} {
+		if set {
+			lineOps++
+		}
+	}
+	if lineOps > 1 {
+		return fmt.Errorf("only one of line delete, replace, append, insert_after and insert_before is allowed")
+	}
+	if cmd.Line.Backrefs && cmd.Line.Replace == "" {
+		return fmt.Errorf("line backrefs is only allowed with replace")
+	}
+
+	if cmd.Block.InsertAfter != "" && cmd.Block.InsertBefore != "" {
+		return fmt.Errorf("only one of block insert_after and insert_before is allowed")
+	}
+	if cmd.Block.Marker != "" && !strings.Contains(cmd.Block.Marker, "{mark}") {
+		return fmt.Errorf("block marker %q must contain {mark}", cmd.Block.Marker)
+	}
+
+	if cmd.Template.Mode != "" {
+		if _, err := strconv.ParseUint(cmd.Template.Mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid template mode %q, must be octal", cmd.Template.Mode)
+		}
+	}
+
+	if cmd.Unarchive.StripComponents < 0 {
+		return fmt.Errorf("unarchive strip_components can't be negative")
+	}
+	if cmd.Unarchive.Mode != "" {
+		if _, err := strconv.ParseUint(cmd.Unarchive.Mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid unarchive mode %q, must be octal", cmd.Unarchive.Mode)
+		}
+	}
+
+	if _, _, err := cmd.GetChecksum(); err != nil {
+		return err
+	}
+
+	if cmd.Service.Name != "" {
+		if !slices.Contains([]string{"", "started", "stopped", "restarted", "reloaded"}, cmd.Service.State) {
+			return fmt.Errorf("invalid service state %q, must be one of started, stopped, restarted or reloaded", cmd.Service.State)
+		}
+		if cmd.Service.State == "" && cmd.Service.Enabled == nil && !cmd.Service.DaemonReload && cmd.Service.Unit == "" {
+			return fmt.Errorf("service %q requires state, enabled, daemon_reload or unit", cmd.Service.Name)
+		}
+	}
+
+	if cmd.Git.Depth < 0 {
+		return fmt.Errorf("git depth can't be negative")
+	}
+	if cmd.Git.KeySecret != "" && !slices.Contains(cmd.Options.Secrets, cmd.Git.KeySecret) {
+		return fmt.Errorf("git key_secret %q must be listed in options.secrets", cmd.Git.KeySecret)
+	}
+
+	if err := cmd.Wait.validate(); err != nil {
+		return err
+	}
+
+	if cmd.Options.DelegateTo != "" && cmd.Options.Local {
+		return fmt.Errorf("delegate_to can't be used with local option")
+	}
+	if cmd.Options.DelegateTo != "" && cmd.Call.Task != "" {
+		return fmt.Errorf("delegate_to can't be used with call command")
+	}
+
+	loopSources := 0
+	for _, set := range []bool{len(cmd.Loop.Items) > 0, cmd.Loop.Var != "", cmd.Loop.Glob != ""} {
+		if set {
+			loopSources++
+		}
+	}
+	if loopSources > 1 {
+		return fmt.Errorf("only one of loop items, var and glob is allowed")
+	}
+	if cmd.Loop.Glob != "" {
+		if _, err := filepath.Match(cmd.Loop.Glob, ""); err != nil {
+			return fmt.Errorf("invalid loop glob %q: %w", cmd.Loop.Glob, err)
+		}
+	}
+
+	if cmd.Cron.Name != "" {
+		if err := cmd.Cron.validate(); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Release.Keep < 0 {
+		return fmt.Errorf("release keep can't be negative")
+	}
+	if cmd.Release.StripComponents < 0 {
+		return fmt.Errorf("release strip_components can't be negative")
+	}
+
+	files := cmd.MFile
+	if cmd.File.Path != "" {
+		files = []FileInternal{cmd.File}
+	}
+	for _, f := range files {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+
+	exprs := []struct{ name, val string }{{"when", cmd.When}, {"failed_when", cmd.FailedWhen}, {"changed_when", cmd.ChangedWhen}}
+	for _, e := range exprs {
+		if e.val == "" {
+			continue
+		}
+		if _, err := expr.Parse(e.val); err != nil {
+			return fmt.Errorf("invalid %s: %w", e.name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks only one of wait cmd, http and tcp is set and http options are used with url only.
+// Url and tcp address may be templated, they are checked on execution.
+func (w WaitInternal) validate() error {
+	checks := 0
+	for _, set := range []bool{w.Command != "", w.HTTP.URL != "", w.TCP != ""} {
+		if set {
+			checks++
+		}
+	}
+	if checks > 1 {
+		return fmt.Errorf("only one of wait cmd, http and tcp is allowed")
+	}
+	if w.HTTP.URL == "" && (w.HTTP.Status != 0 || w.HTTP.Body != "" || len(w.HTTP.Headers) > 0) {
+		return fmt.Errorf("wait http url is required")
+	}
+	if w.HTTP.Body != "" {
+		if _, err := regexp.Compile(w.HTTP.Body); err != nil {
+			return fmt.Errorf("invalid wait http body regex %q: %w", w.HTTP.Body, err)
+		}
+	}
+	return nil
+}
+
+var (
+	reCronFile     = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	reCronSchedule = regexp.MustCompile(`^(@(reboot|yearly|annually|monthly|weekly|daily|midnight|hourly)|(\S+\s+){4}\S+)$`)
+)
+
+// validate checks cron entry fields required for its state. Schedule is checked for the number of fields only,
+// it may be templated.
+func (c CronInternal) validate() error {
+	if strings.ContainsAny(c.Name, "\n\r") {
+		return fmt.Errorf("cron name %q can't be multiline", c.Name)
+	}
+	if !slices.Contains([]string{"", "present", "absent"}, c.State) {
+		return fmt.Errorf("invalid cron state %q for %s, must be present or absent", c.State, c.Name)
+	}
+	if c.File != "" && !filepath.IsAbs(c.File) && !reCronFile.MatchString(c.File) {
+		return fmt.Errorf("invalid cron file %q for %s, only letters, digits, _ and - are allowed in cron.d names", c.File, c.Name)
+	}
+	if c.State == "absent" {
+		return nil
+	}
+	if c.Schedule == "" || c.Job == "" {
+		return fmt.Errorf("cron schedule and job are required for %s", c.Name)
+	}
+	if strings.ContainsAny(c.Job, "\n\r") {
+		return fmt.Errorf("cron job for %s can't be multiline, use a script file instead", c.Name)
+	}
+	if !reCronSchedule.MatchString(strings.TrimSpace(c.Schedule)) {
+		return fmt.Errorf("invalid cron schedule %q for %s, must be five fields or @keyword", c.Schedule, c.Name)
+	}
+	for _, e := range c.Env {
+		if k, _, ok := strings.Cut(e, "="); !ok || strings.TrimSpace(k) == "" {
+			return fmt.Errorf("invalid cron env %q for %s, must be NAME=value", e, c.Name)
+		}
+	}
+	return nil
+}
+
+// validate checks file command state and the fields allowed for it
+func (f FileInternal) validate() error {
+	if f.Path == "" {
+		return fmt.Errorf("file path is required")
+	}
+	if !slices.Contains([]string{"directory", "absent", "touch", "link"}, f.State) {
+		return fmt.Errorf("invalid file state %q for %s, must be one of directory, absent, touch or link", f.State, f.Path)
+	}
+	if (f.State == "link") != (f.Source != "") {
+		return fmt.Errorf("file src is required for link state and allowed for it only, %s", f.Path)
+	}
+	if f.Recurse && f.State != "directory" {
+		return fmt.Errorf("file recurse is only allowed with directory state, %s", f.Path)
+	}
+	if (f.State == "absent" || f.State == "link") && (f.Mode != "" || f.Owner != "" || f.Group != "") {
+		return fmt.Errorf("file mode, owner and group are not allowed with %s state, %s", f.State, f.Path)
+	}
+	if f.Mode != "" {
+		if _, err := strconv.ParseUint(f.Mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid file mode %q for %s, must be octal", f.Mode, f.Path)
+		}
+	}
 	return nil
 }
 
@@ -471,6 +471,31 @@ delete:
 				MDelete: []DeleteInternal{{Location: "source1"}, {Location: "source2"}},
 			},
 		},
+		{
+			name: "file multiple sets",
+			yamlInput: `
+name: test
+file:
+  - {path: /srv/app, state: directory, mode: "0755", owner: app, recurse: true}
+  - {path: /srv/app/current, state: link, src: /srv/app/releases/1}
+`,
+			expectedCmd: Cmd{
+				Name: "test",
+				MFile: []FileInternal{{Path: "/srv/app", State: "directory", Mode: "0755", Owner: "app", Recurse: true},
+					{Path: "/srv/app/current", State: "link", Source: "/srv/app/releases/1"}},
+			},
+		},
+		{
+			name: "simple file",
+			yamlInput: `
+name: test
+file: {path: /var/log/app, state: directory, group: adm}
+`,
+			expectedCmd: Cmd{
+				Name: "test",
+				File: FileInternal{Path: "/var/log/app", State: "directory", Group: "adm"},
+			},
+		},
 		{
 			name: "simple copy",
 			yamlInput: `
@@ -696,6 +721,33 @@ copy:
 	}
 }
 
+func TestLoopInternal_UnmarshalYAML(t *testing.T) {
+	tbl := []struct {
+		name, yml string
+		expected  LoopInternal
+		err       string
+	}{
+		{"list of items", "loop: [a, b, c]", LoopInternal{Items: []string{"a", "b", "c"}}, ""},
+		{"items", "loop: {items: [a, b]}", LoopInternal{Items: []string{"a", "b"}}, ""},
+		{"var", "loop: {var: SERVICES}", LoopInternal{Var: "SERVICES"}, ""},
+		{"glob", "loop: {glob: \"conf/*.conf\"}", LoopInternal{Glob: "conf/*.conf"}, ""},
+		{"unknown field", "loop: {files: \"*.conf\"}", LoopInternal{}, `unknown loop field "files"`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmd Cmd
+			err := yaml.Unmarshal([]byte("name: test\nscript: echo {ITEM}\n"+tt.yml), &cmd)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, cmd.Loop)
+		})
+	}
+}
+
 func TestCmd_validate(t *testing.T) {
 	tbl := []struct {
 		name        string
@@ -710,14 +762,124 @@ func TestCmd_validate(t *testing.T) {
 		{"only msync", Cmd{MSync: []SyncInternal{{Source: "source", Dest: "dest"}}}, ""},
 		{"only wait", Cmd{Wait: WaitInternal{Command: "command"}}, ""},
 		{"only line", Cmd{Line: LineInternal{File: "/etc/bashrc", Match: "^PS1=", Delete: true}}, ""},
+		{"line insert_after", Cmd{Line: LineInternal{File: "/etc/app.conf", Match: "^host=", InsertAfter: "port=80"}}, ""},
+		{"line replace with backrefs", Cmd{Line: LineInternal{File: "/etc/app.conf", Match: "^(port)=", Replace: "$1=80", Backrefs: true}}, ""},
+		{"line with multiple operations", Cmd{Line: LineInternal{File: "/etc/app.conf", Match: "^port=", Delete: true, Append: "port=80"}},
+			"only one of line delete, replace, append, insert_after and insert_before is allowed"},
+		{"line backrefs without replace", Cmd{Line: LineInternal{File: "/etc/app.conf", Match: "^port=", Append: "port=80", Backrefs: true}},
+			"line backrefs is only allowed with replace"},
 		{"line without operation", Cmd{Line: LineInternal{File: "/etc/bashrc", Match: "^PS1="}},
-			"one of [script, copy, mcopy, delete, mdelete, sync, msync, wait, line, echo] must be set"},
+			"one of [script, copy, mcopy, delete, mdelete, sync, msync, wait, line, echo, block, template, unarchive, fetch, service, file, mfile, git, release, cron, call] must be set"},
 		{"multiple fields set", Cmd{Script: "example_script", Copy: CopyInternal{Source: "source", Dest: "dest"}},
 			"only one of [script, copy] is allowed"},
-		{"nothing set", Cmd{}, "one of [script, copy, mcopy, delete, mdelete, sync, msync, wait, line, echo] must be set"},
+		{"nothing set", Cmd{}, "one of [script, copy, mcopy, delete, mdelete, sync, msync, wait, line, echo, block, template, unarchive, fetch, service, file, mfile, git, release, cron, call] must be set"},
 		{"script with register", Cmd{Script: "example_script", Register: []string{"a", "b"}}, ""},
 		{"unexpected register", Cmd{Copy: CopyInternal{Source: "source", Dest: "dest"}, Register: []string{"a", "b"}},
 			"register is only allowed with script command"},
+		{"script with register_json", Cmd{Script: "kubectl get pods -o json", RegisterJSON: map[string]string{"POD": "$.items[0].metadata.name"}}, ""},
+		{"unexpected register_json", Cmd{Echo: "{}", RegisterJSON: map[string]string{"POD": "$.name"}},
+			"register_json is only allowed with script command"},
+		{"invalid register_json path", Cmd{Script: "example_script", RegisterJSON: map[string]string{"POD": "items[0]"}},
+			`invalid register_json for POD: can't parse path "items[0]": must start with $`},
+		{"script with failed_when and changed_when",
+			Cmd{Script: "example_script", FailedWhen: "exit_code > 1", ChangedWhen: `stdout contains "updated"`}, ""},
+		{"invalid failed_when", Cmd{Script: "example_script", FailedWhen: "exit_code = 1"},
+			`invalid failed_when: can't parse expression "exit_code = 1": unexpected character '=' at position 10`},
+		{"invalid changed_when", Cmd{Script: "example_script", ChangedWhen: "(true"},
+			`invalid changed_when: can't parse expression "(true": missing closing parenthesis for position 0`},
+		{"script with when", Cmd{Script: "example_script", When: `env.ENV == "prod" && host.tags contains "db"`}, ""},
+		{"delegate_to", Cmd{Script: "example_script", Options: CmdOptions{DelegateTo: "lb", RunOnce: true}}, ""},
+		{"delegate_to with local", Cmd{Script: "example_script", Options: CmdOptions{DelegateTo: "lb", Local: true}},
+			"delegate_to can't be used with local option"},
+		{"delegate_to with call", Cmd{Call: CallInternal{Task: "t"}, Options: CmdOptions{DelegateTo: "lb"}},
+			"delegate_to can't be used with call command"},
+		{"invalid when", Cmd{Script: "example_script", When: `env.ENV == `},
+			`invalid when: can't parse expression "env.ENV == ": unexpected end of expression`},
+		{"only block", Cmd{Block: BlockInternal{File: "/etc/hosts", Content: "10.0.0.1 db", InsertAfter: "^127"}}, ""},
+		{"block delete", Cmd{Block: BlockInternal{File: "/etc/hosts", Delete: true, Marker: "## {mark} db"}}, ""},
+		{"block with both insert positions", Cmd{Block: BlockInternal{File: "/etc/hosts", Content: "x", InsertAfter: "a", InsertBefore: "b"}},
+			"only one of block insert_after and insert_before is allowed"},
+		{"block marker without mark", Cmd{Block: BlockInternal{File: "/etc/hosts", Content: "x", Marker: "# spot"}},
+			`block marker "# spot" must contain {mark}`},
+		{"only template", Cmd{Template: TemplateInternal{Source: "app.tmpl", Dest: "/etc/app.conf", Mode: "0640", Owner: "app:app"}}, ""},
+		{"template with invalid mode", Cmd{Template: TemplateInternal{Source: "app.tmpl", Dest: "/etc/app.conf", Mode: "rw-r"}},
+			`invalid template mode "rw-r", must be octal`},
+		{"only unarchive", Cmd{Unarchive: UnarchiveInternal{Source: "app.tar.gz", Dest: "/srv/app", StripComponents: 1}}, ""},
+		{"unarchive with negative strip", Cmd{Unarchive: UnarchiveInternal{Source: "app.tar.gz", Dest: "/srv/app", StripComponents: -1}},
+			"unarchive strip_components can't be negative"},
+		{"unarchive with invalid mode", Cmd{Unarchive: UnarchiveInternal{Source: "app.zip", Dest: "/srv/app", Mode: "755x"}},
+			`invalid unarchive mode "755x", must be octal`},
+		{"only fetch", Cmd{Fetch: FetchInternal{URL: "https://example.com/app", Dest: "/usr/local/bin/app",
+			Checksum: "SHA256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}}, ""},
+		{"fetch with invalid checksum", Cmd{Fetch: FetchInternal{URL: "https://example.com/app", Dest: "/tmp/app",
+			Checksum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}}, `invalid checksum "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", must be sha256:<hex> or sha512:<hex>`},
+		{"fetch with unsupported checksum", Cmd{Fetch: FetchInternal{URL: "https://example.com/app", Dest: "/tmp/app",
+			Checksum: "md5:d41d8cd98f00b204e9800998ecf8427e"}}, `unsupported checksum algorithm "md5", must be sha256 or sha512`},
+		{"fetch with short checksum", Cmd{Fetch: FetchInternal{URL: "https://example.com/app", Dest: "/tmp/app",
+			Checksum: "sha512:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}}, `invalid sha512 checksum "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", must be 128 hex characters`},
+		{"only service", Cmd{Service: ServiceInternal{Name: "nginx", State: "started", Enabled: &[]bool{true}[0]}}, ""},
+		{"service with invalid state", Cmd{Service: ServiceInternal{Name: "nginx", State: "running"}},
+			`invalid service state "running", must be one of started, stopped, restarted or reloaded`},
+		{"service without action", Cmd{Service: ServiceInternal{Name: "nginx"}},
+			`service "nginx" requires state, enabled, daemon_reload or unit`},
+		{"only file", Cmd{File: FileInternal{Path: "/srv/app", State: "directory", Mode: "0750", Recurse: true}}, ""},
+		{"only mfile", Cmd{MFile: []FileInternal{{Path: "/srv/a", State: "touch"}, {Path: "/srv/b", State: "absent"}}}, ""},
+		{"file with invalid state", Cmd{File: FileInternal{Path: "/srv/app", State: "dir"}},
+			`invalid file state "dir" for /srv/app, must be one of directory, absent, touch or link`},
+		{"file link without src", Cmd{File: FileInternal{Path: "/srv/current", State: "link"}},
+			"file src is required for link state and allowed for it only, /srv/current"},
+		{"file recurse without directory", Cmd{MFile: []FileInternal{{Path: "/srv/a", State: "touch", Recurse: true}}},
+			"file recurse is only allowed with directory state, /srv/a"},
+		{"file absent with mode", Cmd{File: FileInternal{Path: "/srv/a", State: "absent", Mode: "0644"}},
+			"file mode, owner and group are not allowed with absent state, /srv/a"},
+		{"file link with owner", Cmd{File: FileInternal{Path: "/srv/current", State: "link", Source: "/srv/r1", Owner: "app"}},
+			"file mode, owner and group are not allowed with link state, /srv/current"},
+		{"only git", Cmd{Git: GitInternal{Repo: "git@github.com:org/app.git", Dest: "/srv/app", Ref: "v1.2.3", Depth: 1,
+			KeySecret: "DEPLOY_KEY"}, Options: CmdOptions{Secrets: []string{"DEPLOY_KEY"}}}, ""},
+		{"git with negative depth", Cmd{Git: GitInternal{Repo: "/srv/repo.git", Dest: "/srv/app", Depth: -1}},
+			"git depth can't be negative"},
+		{"git key secret not loaded", Cmd{Git: GitInternal{Repo: "git@github.com:org/app.git", Dest: "/srv/app",
+			KeySecret: "DEPLOY_KEY"}}, `git key_secret "DEPLOY_KEY" must be listed in options.secrets`},
+		{"file with invalid mode", Cmd{File: FileInternal{Path: "/srv/a", State: "touch", Mode: "u+x"}},
+			`invalid file mode "u+x" for /srv/a, must be octal`},
+		{"wait http", Cmd{Wait: WaitInternal{HTTP: WaitHTTP{URL: "http://localhost:8080/ping", Status: 200, Body: "pong"}}}, ""},
+		{"wait tcp", Cmd{Wait: WaitInternal{TCP: "localhost:5432"}}, ""},
+		{"wait cmd and tcp", Cmd{Wait: WaitInternal{Command: "true", TCP: "localhost:5432"}},
+			"only one of wait cmd, http and tcp is allowed"},
+		{"wait http options without url", Cmd{Wait: WaitInternal{TCP: "localhost:80", HTTP: WaitHTTP{Status: 200}}},
+			"wait http url is required"},
+		{"wait http invalid body regex", Cmd{Wait: WaitInternal{HTTP: WaitHTTP{URL: "http://localhost", Body: "("}}},
+			"invalid wait http body regex \"(\": error parsing regexp: missing closing ): `(`"},
+		{"only cron", Cmd{Cron: CronInternal{Name: "backup", Schedule: "*/5 * * * *", Job: "/usr/local/bin/backup",
+			Env: []string{"MAILTO=ops@example.com"}}}, ""},
+		{"cron in file with keyword schedule", Cmd{Cron: CronInternal{Name: "cleanup", Schedule: "@daily", Job: "rm -rf /tmp/app",
+			File: "app-cleanup", User: "app"}}, ""},
+		{"cron absent", Cmd{Cron: CronInternal{Name: "backup", State: "absent"}}, ""},
+		{"cron absent in absolute file", Cmd{Cron: CronInternal{Name: "backup", State: "absent", File: "/etc/crontab"}}, ""},
+		{"cron without job", Cmd{Cron: CronInternal{Name: "backup", Schedule: "@daily"}},
+			"cron schedule and job are required for backup"},
+		{"cron invalid schedule", Cmd{Cron: CronInternal{Name: "backup", Schedule: "*/5 * *", Job: "backup"}},
+			`invalid cron schedule "*/5 * *" for backup, must be five fields or @keyword`},
+		{"cron invalid state", Cmd{Cron: CronInternal{Name: "backup", State: "disabled"}},
+			`invalid cron state "disabled" for backup, must be present or absent`},
+		{"cron invalid file", Cmd{Cron: CronInternal{Name: "backup", State: "absent", File: "app.cron"}},
+			`invalid cron file "app.cron" for backup, only letters, digits, _ and - are allowed in cron.d names`},
+		{"cron invalid env", Cmd{Cron: CronInternal{Name: "backup", Schedule: "@daily", Job: "backup", Env: []string{"MAILTO"}}},
+			`invalid cron env "MAILTO" for backup, must be NAME=value`},
+		{"cron multiline job", Cmd{Cron: CronInternal{Name: "backup", Schedule: "@daily", Job: "backup\nrm -rf /"}},
+			"cron job for backup can't be multiline, use a script file instead"},
+		{"only call", Cmd{Call: CallInternal{Task: "deploy_service", Args: map[string]string{"SERVICE": "api"}}}, ""},
+		{"call with script", Cmd{Call: CallInternal{Task: "deploy_service"}, Script: "echo 1"}, "only one of [script, call] is allowed"},
+		{"script with loop", Cmd{Script: "echo {ITEM}", Loop: LoopInternal{Items: []string{"a", "b"}}}, ""},
+		{"loop with items and var", Cmd{Script: "echo {ITEM}", Loop: LoopInternal{Items: []string{"a"}, Var: "SERVICES"}},
+			"only one of loop items, var and glob is allowed"},
+		{"loop with invalid glob", Cmd{Script: "echo {ITEM}", Loop: LoopInternal{Glob: "conf/[a-"}},
+			`invalid loop glob "conf/[a-": syntax error in pattern`},
+		{"only release", Cmd{Release: ReleaseInternal{Dir: "/srv/app", Source: "dist", Check: "./app --version", Keep: 3}}, ""},
+		{"release with negative keep", Cmd{Release: ReleaseInternal{Dir: "/srv/app", Source: "dist", Keep: -1}},
+			"release keep can't be negative"},
+		{"release with negative strip", Cmd{Release: ReleaseInternal{Dir: "/srv/app", Source: "app.tar.gz", StripComponents: -1}},
+			"release strip_components can't be negative"},
 	}
 
 	for _, tt := range tbl {
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// includeCacheTTL defines how long the downloaded include is used from the cache without fetching it again
+const includeCacheTTL = time.Hour
+
+// includer loads tasks and targets from included playbooks, recursively.
+// It tracks where each task and target came from to report conflicts with both sources.
+type includer struct {
+	stack      []string          // locations being loaded, used to detect include cycles
+	loaded     map[string]bool   // locations already loaded, the same file included twice is loaded once
+	taskFrom   map[string]string // task name to the location it was loaded from
+	targetFrom map[string]string // target name to the location it was loaded from
+	tasks      []Task
+	targets    map[string]Target
+}
+
+// loadIncludes loads tasks and targets from the playbooks listed in the include section.
+// Included tasks go before the playbook's own tasks, in the order of includes. Task and target names
+// must be unique across the playbook and all included files. Relative local sources of commands from
+// included local files are resolved against the directory of the included file.
+func (p *PlayBook) loadIncludes(fname string) error {
+	inc := &includer{
+		stack:      []string{fname},
+		loaded:     map[string]bool{fname: true},
+		taskFrom:   make(map[string]string),
+		targetFrom: make(map[string]string),
+		targets:    make(map[string]Target),
+	}
+	for _, t := range p.Tasks {
+		inc.taskFrom[t.Name] = fname
+	}
+	for name := range p.Targets {
+		inc.targetFrom[name] = fname
+	}
+
+	if err := inc.load(fname, p.Include); err != nil {
+		return err
+	}
+
+	p.Tasks = append(inc.tasks, p.Tasks...)
+	if len(inc.targets) > 0 && p.Targets == nil {
+		p.Targets = make(map[string]Target)
+	}
+	for name, t := range inc.targets {
+		p.Targets[name] = t
+	}
+	log.Printf("[DEBUG] loaded %d tasks and %d targets from includes", len(inc.tasks), len(inc.targets))
+	return nil
+}
+
+// load reads all includes of the parent location, nested includes are loaded before the tasks of the including file
+func (inc *includer) load(parent string, includes []string) error {
+	for _, incl := range includes {
+		if strings.TrimSpace(incl) == "" {
+			return fmt.Errorf("empty include in %s", parent)
+		}
+		loc := resolveInclude(parent, incl)
+		if slices.Contains(inc.stack, loc) {
+			return fmt.Errorf("include cycle detected: %s -> %s", strings.Join(inc.stack, " -> "), loc)
+		}
+		if inc.loaded[loc] {
+			log.Printf("[DEBUG] include %s already loaded, skip", loc)
+			continue
+		}
+		inc.loaded[loc] = true
+
+		pb, err := readInclude(loc)
+		if err != nil {
+			return err
+		}
+
+		inc.stack = append(inc.stack, loc)
+		if err := inc.load(loc, pb.Include); err != nil {
+			return err
+		}
+		inc.stack = inc.stack[:len(inc.stack)-1]
+
+		for i := range pb.Tasks {
+			tsk := pb.Tasks[i]
+			if from, ok := inc.taskFrom[tsk.Name]; ok {
+				return fmt.Errorf("task %q from %s conflicts with the task from %s", tsk.Name, loc, from)
+			}
+			inc.taskFrom[tsk.Name] = loc
+			if !isURL(loc) {
+				rebaseSources(filepath.Dir(loc), &tsk)
+			}
+			inc.tasks = append(inc.tasks, tsk)
+		}
+		for name, t := range pb.Targets {
+			if from, ok := inc.targetFrom[name]; ok {
+				return fmt.Errorf("target %q from %s conflicts with the target from %s", name, loc, from)
+			}
+			inc.targetFrom[name] = loc
+			inc.targets[name] = t
+		}
+		log.Printf("[INFO] included %d tasks and %d targets from %s", len(pb.Tasks), len(pb.Targets), loc)
+	}
+	return nil
+}
+
+// resolveInclude makes the location of include relative to the location of the including file.
+// Relative includes of a remote playbook are resolved against its url.
+func resolveInclude(parent, incl string) string {
+	switch {
+	case isURL(incl):
+		return incl
+	case isURL(parent):
+		base, err := url.Parse(parent)
+		if err != nil {
+			return incl
+		}
+		ref, err := url.Parse(incl)
+		if err != nil {
+			return incl
+		}
+		return base.ResolveReference(ref).String()
+	case filepath.IsAbs(incl):
+		return incl
+	default:
+		return filepath.Join(filepath.Dir(parent), incl)
+	}
+}
+
+// readInclude reads and parses included playbook from a local file or url.
+// Only include, targets and tasks are allowed in included files, everything else belongs to the main playbook.
+func readInclude(loc string) (*PlayBook, error) {
+	var data []byte
+	var err error
+	if isURL(loc) {
+		data, err = readIncludeURL(loc)
+	} else {
+		data, err = os.ReadFile(loc) // nolint
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read include %s: %w", loc, err)
+	}
+
+	name := loc
+	if isURL(loc) {
+		if u, e := url.Parse(loc); e == nil {
+			name = u.Path
+		}
+	}
+
+	res := &PlayBook{}
+	switch ext := path.Ext(name); ext {
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(res); err != nil {
+			return nil, fmt.Errorf("can't unmarshal toml include %s: %w", loc, err)
+		}
+	case ".yml", ".yaml", "":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true) // strict mode, fail on unknown fields
+		if err = decoder.Decode(res); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("can't unmarshal yaml include %s: %w", loc, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown include format %s", loc)
+	}
+
+	if res.User != "" || res.SSHKey != "" || res.SSHShell != "" || res.SSHTempDir != "" || res.LocalShell != "" ||
+		res.Inventory != "" || len(res.Vars) > 0 || res.GatherFacts {
+		return nil, fmt.Errorf("only include, targets and tasks are allowed in included playbook %s", loc)
+	}
+	return res, nil
+}
+
+// readIncludeURL downloads included playbook and keeps it in the user's cache directory.
+// The cached copy is used while it is fresh, and as a fallback if the download fails.
+func readIncludeURL(loc string) ([]byte, error) {
+	cacheFile := ""
+	if dir, err := os.UserCacheDir(); err == nil {
+		sum := sha256.Sum256([]byte(loc))
+		cacheFile = filepath.Join(dir, "spot", "includes", hex.EncodeToString(sum[:]))
+		if fi, err := os.Stat(cacheFile); err == nil && time.Since(fi.ModTime()) < includeCacheTTL {
+			log.Printf("[DEBUG] use cached include %s from %s", loc, cacheFile)
+			return os.ReadFile(cacheFile) // nolint
+		}
+	}
+
+	data, err := fetchInclude(loc)
+	if err != nil {
+		if cacheFile == "" {
+			return nil, err
+		}
+		cached, cacheErr := os.ReadFile(cacheFile) // nolint
+		if cacheErr != nil {
+			return nil, err
+		}
+		log.Printf("[WARN] can't download include %s, using cached copy: %v", loc, err)
+		return cached, nil
+	}
+
+	if cacheFile != "" {
+		if err := os.MkdirAll(filepath.Dir(cacheFile), 0o700); err != nil {
+			log.Printf("[WARN] can't make include cache directory: %v", err)
+			return data, nil
+		}
+		if err := os.WriteFile(cacheFile, data, 0o600); err != nil {
+			log.Printf("[WARN] can't cache include %s: %v", loc, err)
+		}
+	}
+	return data, nil
+}
+
+func fetchInclude(loc string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(loc)
+	if err != nil {
+		return nil, fmt.Errorf("can't get include from http %s: %w", loc, err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't get include from http %s, status: %s", loc, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read include from http %s: %w", loc, err)
+	}
+	return data, nil
+}
+
+// rebaseSources resolves relative local sources of the task's commands against the directory of the included file.
+// Paths starting with variables, templates or home directory are left as is.
+func rebaseSources(dir string, tsk *Task) {
+	rebase := func(p *string) {
+		if *p == "" || filepath.IsAbs(*p) || strings.HasPrefix(*p, "$") || strings.HasPrefix(*p, "{") ||
+			strings.HasPrefix(*p, "~") {
+			return
+		}
+		*p = filepath.Join(dir, *p)
+	}
+	rebaseCopy := func(c *CopyInternal) {
+		if c.Direction == "pull" {
+			rebase(&c.Dest) // pulled files land locally, destination is local
+			return
+		}
+		rebase(&c.Source)
+	}
+
+	for _, cmds := range [][]Cmd{tsk.Commands, tsk.Handlers} {
+		for i := range cmds {
+			c := &cmds[i]
+			rebaseCopy(&c.Copy)
+			for j := range c.MCopy {
+				rebaseCopy(&c.MCopy[j])
+			}
+			rebase(&c.Sync.Source)
+			for j := range c.MSync {
+				rebase(&c.MSync[j].Source)
+			}
+			rebase(&c.Template.Source)
+			if !c.Unarchive.Remote {
+				rebase(&c.Unarchive.Source)
+			}
+			rebase(&c.Release.Source)
+			rebase(&c.Service.Unit)
+			rebase(&c.Loop.Glob)
+		}
+	}
+}
+
+func isURL(loc string) bool {
+	return strings.HasPrefix(loc, "http://") || strings.HasPrefix(loc, "https://")
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlayBook_Include(t *testing.T) {
+	t.Run("local includes", func(t *testing.T) {
+		c, err := New("testdata/include/playbook.yml", nil, nil)
+		require.NoError(t, err)
+		require.Len(t, c.Tasks, 3)
+		assert.Equal(t, "common", c.Tasks[0].Name, "nested include goes first")
+		assert.Equal(t, "deploy", c.Tasks[1].Name)
+		assert.Equal(t, "main", c.Tasks[2].Name, "own tasks go last")
+
+		assert.Len(t, c.Targets, 2)
+		assert.Equal(t, "staging", c.Targets["staging"].Name)
+		assert.Equal(t, "h2.example.com", c.Targets["staging"].Hosts[0].Host)
+		assert.Equal(t, "h1.example.com", c.Targets["prod"].Hosts[0].Host)
+
+		cmds := c.Tasks[1].Commands
+		assert.Equal(t, "/bin/sh", cmds[0].SSHShell, "included commands get shell")
+		lib := filepath.Join("testdata", "include", "lib")
+		assert.Equal(t, filepath.Join(lib, "files/app.conf"), cmds[0].Copy.Source)
+		assert.Equal(t, "/var/log/app.log", cmds[1].Copy.Source, "pull source is remote")
+		assert.Equal(t, filepath.Join(lib, "logs/app.log"), cmds[1].Copy.Dest, "pull destination is local")
+		assert.Equal(t, filepath.Join(lib, "static"), cmds[2].Sync.Source)
+		assert.Equal(t, "/abs/tmpl.conf", cmds[3].Template.Source, "absolute path kept")
+		assert.Equal(t, filepath.Join(lib, "dist/app.tar.gz"), cmds[4].Unarchive.Source)
+		assert.Equal(t, "/tmp/app.tar.gz", cmds[5].Unarchive.Source, "remote archive kept")
+		assert.Equal(t, "$HOME/app.conf", cmds[6].Copy.Source, "variable kept")
+		assert.Equal(t, filepath.Join(lib, "units/app.service"), cmds[7].Service.Unit)
+		assert.Equal(t, filepath.Join(lib, "conf.d/*.conf"), cmds[8].Loop.Glob)
+		assert.Equal(t, "{item}", cmds[8].Copy.Source, "template kept")
+	})
+
+	t.Run("playbook with includes only", func(t *testing.T) {
+		c, err := New("testdata/include/only-includes.yml", nil, nil)
+		require.NoError(t, err)
+		require.Len(t, c.Tasks, 1)
+		assert.Equal(t, "common", c.Tasks[0].Name)
+	})
+
+	t.Run("task conflict", func(t *testing.T) {
+		_, err := New("testdata/include/conflict.yml", nil, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `task "common" from testdata/include/lib/common.toml conflicts with `+
+			`the task from testdata/include/conflict.yml`)
+	})
+
+	t.Run("target conflict", func(t *testing.T) {
+		_, err := New("testdata/include/target-conflict.yml", nil, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `target "staging" from testdata/include/lib/deploy.yml conflicts with `+
+			`the target from testdata/include/target-conflict.yml`)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		_, err := New("testdata/include/cycle.yml", nil, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "include cycle detected: testdata/include/cycle.yml -> "+
+			"testdata/include/cycle2.yml -> testdata/include/cycle.yml")
+	})
+
+	t.Run("not allowed field", func(t *testing.T) {
+		_, err := New("testdata/include/bad-field.yml", nil, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "only include, targets and tasks are allowed in included playbook")
+	})
+
+	t.Run("missing include", func(t *testing.T) {
+		tmp := filepath.Join(t.TempDir(), "playbook.yml")
+		require.NoError(t, os.WriteFile(tmp, []byte("include: [missing.yml]\n"), 0o600))
+		_, err := New(tmp, nil, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't read include "+filepath.Join(filepath.Dir(tmp), "missing.yml"))
+	})
+}
+
+func TestPlayBook_IncludeURL(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir()) // cache dir on macOS
+
+	var hits int32
+	var fail atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/lib/tasks.yml":
+			_, _ = w.Write([]byte("include: [common.yml]\ntasks:\n  - name: remote\n    commands:\n" +
+				"      - name: copy\n        copy: {src: files/a.conf, dst: /etc/a.conf}\n"))
+		case "/lib/common.yml":
+			_, _ = w.Write([]byte("tasks:\n  - name: remote-common\n    commands:\n      - name: c\n        script: echo 1\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	writePlaybook := func(t *testing.T, incl string) string {
+		fname := filepath.Join(t.TempDir(), "playbook.yml")
+		data := "include: [" + incl + "]\ntasks:\n  - name: local\n    commands:\n      - name: c\n        script: echo 1\n"
+		require.NoError(t, os.WriteFile(fname, []byte(data), 0o600))
+		return fname
+	}
+
+	t.Run("download and cache", func(t *testing.T) {
+		fname := writePlaybook(t, ts.URL+"/lib/tasks.yml")
+		c, err := New(fname, nil, nil)
+		require.NoError(t, err)
+		require.Len(t, c.Tasks, 3)
+		assert.Equal(t, "remote-common", c.Tasks[0].Name, "relative include resolved against url")
+		assert.Equal(t, "remote", c.Tasks[1].Name)
+		assert.Equal(t, "files/a.conf", c.Tasks[1].Commands[0].Copy.Source, "url sources are not rebased")
+		assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+		_, err = New(fname, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&hits), "second load uses cache")
+	})
+
+	t.Run("stale cache used if download fails", func(t *testing.T) {
+		cacheDir, err := os.UserCacheDir()
+		require.NoError(t, err)
+		files, err := filepath.Glob(filepath.Join(cacheDir, "spot", "includes", "*"))
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+		old := time.Now().Add(-2 * includeCacheTTL)
+		for _, f := range files {
+			require.NoError(t, os.Chtimes(f, old, old))
+		}
+
+		fail.Store(true)
+		defer fail.Store(false)
+		c, err := New(writePlaybook(t, ts.URL+"/lib/tasks.yml"), nil, nil)
+		require.NoError(t, err)
+		assert.Len(t, c.Tasks, 3)
+	})
+
+	t.Run("download failed without cache", func(t *testing.T) {
+		_, err := New(writePlaybook(t, ts.URL+"/lib/missing.yml"), nil, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "status: 404 Not Found")
+	})
+}
+
+func TestResolveInclude(t *testing.T) {
+	tbl := []struct {
+		parent, incl, exp string
+	}{
+		{"/a/b/playbook.yml", "lib/x.yml", "/a/b/lib/x.yml"},
+		{"playbook.yml", "lib/x.yml", "lib/x.yml"},
+		{"/a/b/playbook.yml", "../x.yml", "/a/x.yml"},
+		{"/a/b/playbook.yml", "/etc/x.yml", "/etc/x.yml"},
+		{"/a/b/playbook.yml", "https://example.com/x.yml", "https://example.com/x.yml"},
+		{"https://example.com/lib/a.yml", "b.yml", "https://example.com/lib/b.yml"},
+		{"https://example.com/lib/a.yml", "../b.yml", "https://example.com/b.yml"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.incl, func(t *testing.T) {
+			assert.Equal(t, tt.exp, resolveInclude(tt.parent, tt.incl))
+		})
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,14 +26,17 @@ import (
 
 // PlayBook defines the top-level config object
 type PlayBook struct {
-	User       string            `yaml:"user" toml:"user"`               // ssh user
-	SSHKey     string            `yaml:"ssh_key" toml:"ssh_key"`         // ssh key
-	SSHShell   string            `yaml:"ssh_shell" toml:"ssh_shell"`     // ssh shell to use
-	SSHTempDir string            `yaml:"ssh_temp" toml:"ssh_temp"`       // ssh temp dir to use
-	LocalShell string            `yaml:"local_shell" toml:"local_shell"` // local shell to use
-	Inventory  string            `yaml:"inventory" toml:"inventory"`     // inventory file or url
-	Targets    map[string]Target `yaml:"targets" toml:"targets"`         // list of targets/environments
-	Tasks      []Task            `yaml:"tasks" toml:"tasks"`             // list of tasks
+	User        string            `yaml:"user" toml:"user"`                 // ssh user
+	SSHKey      string            `yaml:"ssh_key" toml:"ssh_key"`           // ssh key
+	SSHShell    string            `yaml:"ssh_shell" toml:"ssh_shell"`       // ssh shell to use
+	SSHTempDir  string            `yaml:"ssh_temp" toml:"ssh_temp"`         // ssh temp dir to use
+	LocalShell  string            `yaml:"local_shell" toml:"local_shell"`   // local shell to use
+	Inventory   string            `yaml:"inventory" toml:"inventory"`       // inventory file or url
+	Targets     map[string]Target `yaml:"targets" toml:"targets"`           // list of targets/environments
+	Tasks       []Task            `yaml:"tasks" toml:"tasks"`               // list of tasks
+	Include     []string          `yaml:"include" toml:"include"`           // list of playbooks to include tasks and targets from
+	Vars        map[string]string `yaml:"vars" toml:"vars"`                 // variables for all tasks, lowest precedence
+	GatherFacts bool              `yaml:"gather_facts" toml:"gather_facts"` // gather facts of hosts for all tasks
 
 	inventory       *InventoryData    // loaded inventory
 	overrides       *Overrides        // overrides passed from cli
@@ -47,45 +52,61 @@ type SecretsProvider interface {
 // SimplePlayBook defines simplified top-level config
 // It is used for unmarshalling only, and result used to make the usual PlayBook
 type SimplePlayBook struct {
-	User       string     `yaml:"user" toml:"user"`                 // ssh user
-	SSHKey     string     `yaml:"ssh_key" toml:"ssh_key"`           // ssh key
-	SSHShell   string     `yaml:"ssh_shell" toml:"ssh_shell"`       // ssh shell to uses
-	SSHTempDir string     `yaml:"ssh_temp" toml:"ssh_temp"`         // ssh temp dir to use
-	LocalShell string     `yaml:"local_shell" toml:"local_shell"`   // local shell to use
-	Inventory  string     `yaml:"inventory" toml:"inventory"`       // inventory file or url
-	Targets    []string   `yaml:"targets" toml:"targets"`           // list of names
-	Target     string     `yaml:"target" toml:"target"`             // a single target to run task on
-	Task       []Cmd      `yaml:"task" toml:"task"`                 // single task is a list of commands
-	Options    CmdOptions `yaml:"options" toml:"options,omitempty"` // options for all commands
+	User        string            `yaml:"user" toml:"user"`                 // ssh user
+	SSHKey      string            `yaml:"ssh_key" toml:"ssh_key"`           // ssh key
+	SSHShell    string            `yaml:"ssh_shell" toml:"ssh_shell"`       // ssh shell to uses
+	SSHTempDir  string            `yaml:"ssh_temp" toml:"ssh_temp"`         // ssh temp dir to use
+	LocalShell  string            `yaml:"local_shell" toml:"local_shell"`   // local shell to use
+	Inventory   string            `yaml:"inventory" toml:"inventory"`       // inventory file or url
+	Targets     []string          `yaml:"targets" toml:"targets"`           // list of names
+	Target      string            `yaml:"target" toml:"target"`             // a single target to run task on
+	Task        []Cmd             `yaml:"task" toml:"task"`                 // single task is a list of commands
+	Options     CmdOptions        `yaml:"options" toml:"options,omitempty"` // options for all commands
+	Vars        map[string]string `yaml:"vars" toml:"vars"`                 // variables for all commands
+	GatherFacts bool              `yaml:"gather_facts" toml:"gather_facts"` // gather facts of hosts before the commands
 }
 
 // Task defines multiple commands runs together
 type Task struct {
-	Name     string     `yaml:"name" toml:"name"` // name of task, mandatory
-	User     string     `yaml:"user" toml:"user"`
-	Commands []Cmd      `yaml:"commands" toml:"commands"`
-	OnError  string     `yaml:"on_error" toml:"on_error"`
-	Targets  []string   `yaml:"targets" toml:"targets"`           // optional list of targets to run task on, names or groups
-	Tags     []string   `yaml:"tags" toml:"tags"`                 // optional tags for task filtering
-	Options  CmdOptions `yaml:"options" toml:"options,omitempty"` // options for all commands
+	Name        string            `yaml:"name" toml:"name"` // name of task, mandatory
+	User        string            `yaml:"user" toml:"user"`
+	Commands    []Cmd             `yaml:"commands" toml:"commands"`
+	Handlers    []Cmd             `yaml:"handlers" toml:"handlers"` // commands to run at the end of the task, if notified
+	OnError     string            `yaml:"on_error" toml:"on_error"`
+	Targets     []string          `yaml:"targets" toml:"targets"`           // optional list of targets to run task on, names or groups
+	Tags        []string          `yaml:"tags" toml:"tags"`                 // optional tags for task filtering
+	Depends     []string          `yaml:"depends_on" toml:"depends_on"`     // optional list of tasks to run before this one
+	Inputs      []Input           `yaml:"inputs" toml:"inputs"`             // optional arguments of the task, passed by call command
+	Vars        map[string]string `yaml:"vars" toml:"vars"`                 // variables for all commands of the task
+	Options     CmdOptions        `yaml:"options" toml:"options,omitempty"` // options for all commands
+	GatherFacts bool              `yaml:"gather_facts" toml:"gather_facts"` // gather facts of hosts before the commands
+}
+
+// Input defines an argument of the task. Arguments are set as environment variables of the task's commands
+type Input struct {
+	Name     string `yaml:"name" toml:"name"`         // name of the argument, mandatory
+	Required bool   `yaml:"required" toml:"required"` // argument must be passed
+	Default  string `yaml:"default" toml:"default"`   // value used if argument is not passed
 }
 
 // Target defines hosts to run commands on
 type Target struct {
-	Name   string        `yaml:"-" toml:"-"`           // name of target, set from the map key
-	Hosts  []Destination `yaml:"hosts" toml:"hosts"`   // direct list of hosts to run commands on, no need to use inventory
-	Groups []string      `yaml:"groups" toml:"groups"` // list of groups to run commands on, matches to inventory
-	Names  []string      `yaml:"names" toml:"names"`   // list of host names to run commands on, matches to inventory
-	Tags   []string      `yaml:"tags" toml:"tags"`     // list of tags to run commands on, matches to inventory
+	Name   string            `yaml:"-" toml:"-"`           // name of target, set from the map key
+	Hosts  []Destination     `yaml:"hosts" toml:"hosts"`   // direct list of hosts to run commands on, no need to use inventory
+	Groups []string          `yaml:"groups" toml:"groups"` // list of groups to run commands on, matches to inventory
+	Names  []string          `yaml:"names" toml:"names"`   // list of host names to run commands on, matches to inventory
+	Tags   []string          `yaml:"tags" toml:"tags"`     // list of tags to run commands on, matches to inventory
+	Vars   map[string]string `yaml:"vars" toml:"vars"`     // variables for all hosts of the target
 }
 
 // Destination defines destination info
 type Destination struct {
-	Name string   `yaml:"name" toml:"name"`
-	Host string   `yaml:"host" toml:"host"`
-	Port int      `yaml:"port" toml:"port"`
-	User string   `yaml:"user" toml:"user"`
-	Tags []string `yaml:"tags" toml:"tags"`
+	Name string            `yaml:"name" toml:"name"`
+	Host string            `yaml:"host" toml:"host"`
+	Port int               `yaml:"port" toml:"port"`
+	User string            `yaml:"user" toml:"user"`
+	Tags []string          `yaml:"tags" toml:"tags"`
+	Vars map[string]string `yaml:"vars" toml:"vars" json:",omitempty"` // host variables, merged with group and target ones
 }
 
 // Overrides defines override for task passed from cli
@@ -100,8 +121,9 @@ type Overrides struct {
 
 // InventoryData defines inventory data format
 type InventoryData struct {
-	Groups map[string][]Destination `yaml:"groups" toml:"groups"`
-	Hosts  []Destination            `yaml:"hosts" toml:"hosts"`
+	Groups    map[string][]Destination     `yaml:"groups" toml:"groups"`
+	Hosts     []Destination                `yaml:"hosts" toml:"hosts"`
+	GroupVars map[string]map[string]string `yaml:"group_vars" toml:"group_vars"` // variables by group, "all" for all hosts
 }
 
 const (
@@ -151,6 +173,12 @@ func New(fname string, overrides *Overrides, secProvider SecretsProvider) (res *
 		return nil, fmt.Errorf("can't unmarshal config: %w", err)
 	}
 
+	if len(res.Include) > 0 {
+		if err = res.loadIncludes(fname); err != nil {
+			return nil, fmt.Errorf("can't load includes of %s: %w", fname, err)
+		}
+	}
+
 	if err = res.checkConfig(); err != nil {
 		return nil, fmt.Errorf("config %s is invalid: %w", fname, err)
 	}
@@ -158,36 +186,53 @@ func New(fname string, overrides *Overrides, secProvider SecretsProvider) (res *
 	log.Printf("[INFO] playbook loaded with %d tasks", len(res.Tasks))
 
 	for i, tsk := range res.Tasks {
-		for j, c := range tsk.Commands {
-			// set shell (remote and local) for all commands in the task
-			res.Tasks[i].Commands[j].SSHShell = res.remoteShell()
-			res.Tasks[i].Commands[j].SSHTempDir = res.sshTempDir()
-			res.Tasks[i].Commands[j].LocalShell = res.localShell()
-
-			// append task's secret keys to all the commands
-			res.Tasks[i].Commands[j].Options.Secrets = append(res.Tasks[i].Commands[j].Options.Secrets, tsk.Options.Secrets...)
-			// append task's only_on to all the commands
-			res.Tasks[i].Commands[j].Options.OnlyOn = append(res.Tasks[i].Commands[j].Options.OnlyOn, tsk.Options.OnlyOn...)
-
-			// set bool options for all commands in the task, but only if they are set in the task to true to avoid overriding
-			if tsk.Options.Local {
-				res.Tasks[i].Commands[j].Options.Local = tsk.Options.Local
-			}
-			if tsk.Options.NoAuto {
-				res.Tasks[i].Commands[j].Options.NoAuto = tsk.Options.NoAuto
-			}
-			if tsk.Options.IgnoreErrors {
-				res.Tasks[i].Commands[j].Options.IgnoreErrors = tsk.Options.IgnoreErrors
-			}
-			if tsk.Options.Sudo {
-				res.Tasks[i].Commands[j].Options.Sudo = tsk.Options.Sudo
-			}
-			// propagate sudo_password from task to commands if not already set in command
-			if tsk.Options.SudoPassword != "" && res.Tasks[i].Commands[j].Options.SudoPassword == "" {
-				res.Tasks[i].Commands[j].Options.SudoPassword = tsk.Options.SudoPassword
-			}
+		// handlers are commands too and get the same shell and options from the task
+		for _, cmds := range [][]Cmd{res.Tasks[i].Commands, res.Tasks[i].Handlers} {
+			for j := range cmds {
+				c := &cmds[j]
+				// set shell (remote and local) for all commands in the task
+				c.SSHShell = res.remoteShell()
+				c.SSHTempDir = res.sshTempDir()
+				c.LocalShell = res.localShell()
+
+				// append task's secret keys to all the commands
+				c.Options.Secrets = append(c.Options.Secrets, tsk.Options.Secrets...)
+				// append task's only_on to all the commands
+				c.Options.OnlyOn = append(c.Options.OnlyOn, tsk.Options.OnlyOn...)
+
+				// set bool options for all commands in the task, but only if they are set in the task to true to avoid overriding
+				if tsk.Options.Local {
+					c.Options.Local = tsk.Options.Local
+				}
+				if tsk.Options.NoAuto {
+					c.Options.NoAuto = tsk.Options.NoAuto
+				}
+				if tsk.Options.IgnoreErrors {
+					c.Options.IgnoreErrors = tsk.Options.IgnoreErrors
+				}
+				if tsk.Options.Sudo {
+					c.Options.Sudo = tsk.Options.Sudo
+				}
+				if tsk.Options.CheckSafe {
+					c.Options.CheckSafe = tsk.Options.CheckSafe
+				}
+				if tsk.Options.GoTemplate {
+					c.Options.GoTemplate = tsk.Options.GoTemplate
+				}
+				if tsk.Options.RunOnce {
+					c.Options.RunOnce = tsk.Options.RunOnce
+				}
+				// propagate sudo_password from task to commands if not already set in command
+				if tsk.Options.SudoPassword != "" && c.Options.SudoPassword == "" {
+					c.Options.SudoPassword = tsk.Options.SudoPassword
+				}
+				// propagate delegate_to to commands running on the host, local and call commands run elsewhere
+				if tsk.Options.DelegateTo != "" && c.Options.DelegateTo == "" && !c.Options.Local && c.Call.Task == "" {
+					c.Options.DelegateTo = tsk.Options.DelegateTo
+				}
 
-			log.Printf("[DEBUG] load command %q (task: %s)", c.Name, tsk.Name)
+				log.Printf("[DEBUG] load command %q (task: %s)", c.Name, tsk.Name)
+			}
 		}
 	}
 
@@ -268,7 +313,7 @@ func unmarshalPlaybookFile(fname string, data []byte, overrides *Overrides, res
 	}
 
 	errs := new(multierror.Error)
-	if err = unmarshal(data, res, true); err == nil && len(res.Tasks) > 0 {
+	if err = unmarshal(data, res, true); err == nil && (len(res.Tasks) > 0 || len(res.Include) > 0) {
 		return nil // success, this is full PlayBook config
 	}
 	errs = multierror.Append(errs, err)
@@ -284,8 +329,9 @@ func unmarshalPlaybookFile(fname string, data []byte, overrides *Overrides, res
 		res.SSHShell = simple.SSHShell
 		res.SSHTempDir = simple.SSHTempDir
 		res.LocalShell = simple.LocalShell
+		res.Vars = simple.Vars
 		// simple playbook is a single task; carry its options so they propagate to all commands
-		res.Tasks = []Task{{Commands: simple.Task, Options: simple.Options}}
+		res.Tasks = []Task{{Commands: simple.Task, Options: simple.Options, GatherFacts: simple.GatherFacts}}
 		res.Tasks[0].Name = "default" // we have only one task, set it as default
 
 		hasInventory := simple.Inventory != "" || (overrides != nil && overrides.Inventory != "") || os.Getenv(inventoryEnv) != ""
@@ -366,6 +412,8 @@ func (p *PlayBook) Task(name string) (*Task, error) {
 	}
 
 	res.Name = name
+	res.Vars = mergeVars(p.Vars, res.Vars) // task vars override playbook vars
+	res.GatherFacts = res.GatherFacts || p.GatherFacts
 
 	// apply overrides of user
 	if p.overrides != nil && p.overrides.User != "" {
@@ -375,11 +423,13 @@ func (p *PlayBook) Task(name string) (*Task, error) {
 	// apply overrides of environment variables, to each command
 	if p.overrides != nil && p.overrides.Environment != nil {
 		for envKey, envVal := range p.overrides.Environment {
-			for cmdIdx := range res.Commands {
-				if res.Commands[cmdIdx].Environment == nil {
-					res.Commands[cmdIdx].Environment = make(map[string]string)
+			for _, cmds := range [][]Cmd{res.Commands, res.Handlers} {
+				for cmdIdx := range cmds {
+					if cmds[cmdIdx].Environment == nil {
+						cmds[cmdIdx].Environment = make(map[string]string)
+					}
+					cmds[cmdIdx].Environment[envKey] = envVal
 				}
-				res.Commands[cmdIdx].Environment[envKey] = envVal
 			}
 		}
 	}
@@ -423,11 +473,13 @@ func (p *PlayBook) TargetHosts(name string) ([]Destination, error) {
 		return nil, err
 	}
 
+	targetVars := p.Targets[name].Vars
 	for i, h := range res {
 		if h.Port == 0 {
 			h.Port = 22 // the default port is 22 if not set
 		}
 		h.User = userOverride(h.User)
+		h.Vars = mergeVars(targetVars, h.Vars) // host and group vars override target vars
 		res[i] = h
 	}
 
@@ -476,16 +528,18 @@ func (p *PlayBook) UpdateRegisteredVars(vars map[string]string) {
 	log.Printf("[DEBUG] update registered vars %+v", vars)
 	for k, v := range vars {
 		for _, tsk := range p.Tasks {
-			for i, c := range tsk.Commands {
-				env := c.Environment
-				if env == nil {
-					env = make(map[string]string)
-				}
-				if _, ok := env[k]; ok { // don't allow override already set vars. TODO: not sure if this is correct
-					continue
+			for _, cmds := range [][]Cmd{tsk.Commands, tsk.Handlers} {
+				for i, c := range cmds {
+					env := c.Environment
+					if env == nil {
+						env = make(map[string]string)
+					}
+					if _, ok := env[k]; ok { // don't allow override already set vars. TODO: not sure if this is correct
+						continue
+					}
+					env[k] = v
+					cmds[i].Environment = env
 				}
-				env[k] = v
-				tsk.Commands[i].Environment = env
 			}
 		}
 	}
@@ -544,6 +598,16 @@ func (p *PlayBook) loadInventory(loc string) (*InventoryData, error) {
 		return nil, fmt.Errorf("group %q is reserved for all hosts", allHostsGrp)
 	}
 
+	// merge vars of hosts with vars of their groups, host vars override group vars and group vars override "all" vars
+	for key, g := range data.Groups {
+		for i := range g {
+			g[i].Vars = mergeVars(data.GroupVars[allHostsGrp], data.GroupVars[key], g[i].Vars)
+		}
+	}
+	for i := range data.Hosts {
+		data.Hosts[i].Vars = mergeVars(data.GroupVars[allHostsGrp], data.Hosts[i].Vars)
+	}
+
 	if len(data.Groups) > 0 {
 		// create group "all" with all hosts from all groups
 		data.Groups[allHostsGrp] = []Destination{}
@@ -603,6 +667,14 @@ func (p *PlayBook) checkConfig() error {
 		names[t.Name] = true
 	}
 
+	if err := p.checkDependencies(); err != nil {
+		return err
+	}
+
+	if err := p.checkCalls(); err != nil {
+		return err
+	}
+
 	// check what all commands have a single type set
 	for _, t := range p.Tasks {
 		if len(t.Commands) == 0 {
@@ -613,6 +685,9 @@ func (p *PlayBook) checkConfig() error {
 				return fmt.Errorf("task %q rejected, invalid command %q: %w", t.Name, c.Name, err)
 			}
 		}
+		if err := t.checkHandlers(); err != nil {
+			return fmt.Errorf("task %q rejected, %w", t.Name, err)
+		}
 	}
 
 	// check what target set is not called "all"
@@ -625,12 +700,148 @@ func (p *PlayBook) checkConfig() error {
 	return nil
 }
 
+// checkDependencies makes sure all tasks in depends_on are defined and there are no dependency cycles
+func (p *PlayBook) checkDependencies() error {
+	deps := make(map[string][]string, len(p.Tasks))
+	for _, t := range p.Tasks {
+		deps[t.Name] = t.Depends
+	}
+	for _, t := range p.Tasks {
+		for _, d := range t.Depends {
+			if _, ok := deps[d]; !ok {
+				return fmt.Errorf("task %q depends on unknown task %q", t.Name, d)
+			}
+		}
+	}
+
+	const visiting, visited = 1, 2
+	state := make(map[string]int, len(p.Tasks))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		switch state[name] {
+		case visiting:
+			start := slices.Index(path, name) // cycle starts at the first occurrence of the task
+			return fmt.Errorf("task dependency cycle %s", strings.Join(path[start:], " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, d := range deps[name] {
+			if err := visit(d, path); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, t := range p.Tasks {
+		if err := visit(t.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCalls validates task inputs and makes sure all tasks used by call commands are defined and get valid arguments
+func (p *PlayBook) checkCalls() error {
+	tasks := make(map[string]Task, len(p.Tasks))
+	for _, t := range p.Tasks {
+		tasks[t.Name] = t
+		inputs := make(map[string]bool, len(t.Inputs))
+		for _, in := range t.Inputs {
+			if in.Name == "" {
+				return fmt.Errorf("task %q rejected, input name is required", t.Name)
+			}
+			if inputs[in.Name] {
+				return fmt.Errorf("task %q rejected, duplicate input %q", t.Name, in.Name)
+			}
+			if in.Required && in.Default != "" {
+				return fmt.Errorf("task %q rejected, input %q can't be required and have default", t.Name, in.Name)
+			}
+			inputs[in.Name] = true
+		}
+	}
+
+	for _, t := range p.Tasks {
+		for _, c := range slices.Concat(t.Commands, t.Handlers) {
+			if c.Call.Task == "" {
+				continue
+			}
+			called, ok := tasks[c.Call.Task]
+			if !ok {
+				return fmt.Errorf("task %q rejected, command %q calls unknown task %q", t.Name, c.Name, c.Call.Task)
+			}
+			if _, err := called.InputValues(c.Call.Args); err != nil {
+				return fmt.Errorf("task %q rejected, command %q: %w", t.Name, c.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// InputValues returns values of the task inputs for the given arguments, with defaults for arguments not passed.
+// Returns error if a required input is missing, or if the task declares inputs and an argument is not one of them.
+// Arguments of the task without inputs are returned as is.
+func (t *Task) InputValues(args map[string]string) (map[string]string, error) {
+	res := make(map[string]string, len(args)+len(t.Inputs))
+	declared := make(map[string]bool, len(t.Inputs))
+	for _, in := range t.Inputs {
+		declared[in.Name] = true
+		v, ok := args[in.Name]
+		switch {
+		case ok:
+			res[in.Name] = v
+		case in.Required:
+			return nil, fmt.Errorf("missing required argument %q for task %q", in.Name, t.Name)
+		default:
+			res[in.Name] = in.Default
+		}
+	}
+	for k, v := range args {
+		if len(t.Inputs) > 0 && !declared[k] {
+			return nil, fmt.Errorf("unknown argument %q for task %q", k, t.Name)
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+// checkHandlers validates task's handlers and makes sure all handlers notified by commands are defined
+func (t *Task) checkHandlers() error {
+	handlers := make(map[string]bool, len(t.Handlers))
+	for _, h := range t.Handlers {
+		if h.Name == "" {
+			return fmt.Errorf("handler name is required")
+		}
+		if handlers[h.Name] {
+			return fmt.Errorf("duplicate handler name %q", h.Name)
+		}
+		if len(h.Notify) > 0 {
+			return fmt.Errorf("handler %q can't notify other handlers", h.Name)
+		}
+		if err := h.validate(); err != nil {
+			return fmt.Errorf("invalid handler %q: %w", h.Name, err)
+		}
+		handlers[h.Name] = true
+	}
+
+	for _, c := range t.Commands {
+		for _, n := range c.Notify {
+			if !handlers[n] {
+				return fmt.Errorf("command %q notifies unknown handler %q", c.Name, n)
+			}
+		}
+	}
+	return nil
+}
+
 // loadSecrets loads secrets from secrets provider and stores them in secrets map
 func (p *PlayBook) loadSecrets() error {
 	// check if secrets are defined in playbook
 	secretsCount := 0
 	for _, t := range p.Tasks {
-		for _, c := range t.Commands {
+		for _, c := range slices.Concat(t.Commands, t.Handlers) {
 			if c.Options.NoAuto {
 				continue // skip commands with noauto flag
 			}
@@ -651,19 +862,21 @@ func (p *PlayBook) loadSecrets() error {
 
 	// collect Secrets from all command's, retrieve them from provider and store in the secrets map
 	for _, t := range p.Tasks {
-		for i, c := range t.Commands {
-			for _, key := range c.Options.Secrets {
-				val, err := p.secretsProvider.Get(key)
-				if err != nil {
-					return fmt.Errorf("can't get secret %q defined in task %q, command %q: %w", key, t.Name, c.Name, err)
-				}
-				p.secrets[key] = val // store secret in the secrets map of playbook
-				if c.Secrets == nil {
-					c.Secrets = make(map[string]string)
+		for _, cmds := range [][]Cmd{t.Commands, t.Handlers} {
+			for i, c := range cmds {
+				for _, key := range c.Options.Secrets {
+					val, err := p.secretsProvider.Get(key)
+					if err != nil {
+						return fmt.Errorf("can't get secret %q defined in task %q, command %q: %w", key, t.Name, c.Name, err)
+					}
+					p.secrets[key] = val // store secret in the secrets map of playbook
+					if c.Secrets == nil {
+						c.Secrets = make(map[string]string)
+					}
+					c.Secrets[key] = val // store secret in the secrets map of command
 				}
-				c.Secrets[key] = val // store secret in the secrets map of command
+				cmds[i] = c
 			}
-			t.Commands[i] = c
 		}
 	}
 	return nil
@@ -702,3 +915,19 @@ func (p *PlayBook) localShell() string {
 	}
 	return "/bin/sh"
 }
+
+// mergeVars merges sets of variables into a new map, values from the later sets override the earlier ones.
+// Returns nil if there are no variables at all.
+func mergeVars(sets ...map[string]string) map[string]string {
+	var res map[string]string
+	for _, vars := range sets {
+		if len(vars) == 0 {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]string, len(vars))
+		}
+		maps.Copy(res, vars)
+	}
+	return res
+}
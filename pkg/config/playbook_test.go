@@ -279,6 +279,26 @@ func TestPlaybook_New(t *testing.T) {
 			Secrets: []string{"SEC1", "SEC2", "SEC11", "SEC12"}}, p.Tasks[0].Commands[4].Options)
 	})
 
+	t.Run("playbook with handlers", func(t *testing.T) {
+		secProvider := &mocks.SecretsProviderMock{
+			GetFunc: func(key string) (string, error) { return "VAL_" + key, nil },
+		}
+		p, err := New("testdata/playbook-with-handlers.yml", nil, secProvider)
+		require.NoError(t, err)
+		require.Len(t, p.Tasks, 1)
+		tsk := p.Tasks[0]
+		assert.Equal(t, []string{"reload nginx", "check site"}, tsk.Commands[1].Notify)
+		require.Len(t, tsk.Handlers, 2)
+		assert.Equal(t, "reload nginx", tsk.Handlers[0].Name)
+		assert.Equal(t, "systemctl reload nginx", tsk.Handlers[0].Script)
+
+		// task options, shell and secrets applied to handlers the same way as to commands
+		assert.Equal(t, CmdOptions{Sudo: true, Secrets: []string{"SEC1"}}, tsk.Handlers[0].Options)
+		assert.Equal(t, "/bin/sh", tsk.Handlers[1].SSHShell)
+		assert.Equal(t, map[string]string{"SEC1": "VAL_SEC1"}, tsk.Handlers[1].Secrets)
+		assert.Equal(t, map[string]string{"FOO": "bar"}, tsk.Handlers[1].Environment)
+	})
+
 	t.Run("playbook prohibited all target", func(t *testing.T) {
 		_, err := New("testdata/playbook-with-all-group.yml", nil, nil)
 		require.ErrorContains(t, err, "config testdata/playbook-with-all-group.yml is invalid: target \"all\" is reserved for all hosts")
@@ -811,6 +831,72 @@ func TestPlayBook_checkConfig(t *testing.T) {
 			},
 			expectedErr: `task "task1" rejected, invalid command "c1": only one of [script, delete] is allowed`,
 		},
+		{
+			name: "valid handlers",
+			playbook: PlayBook{
+				Tasks: []Task{{
+					Name:     "task1",
+					Commands: []Cmd{{Name: "c1", Script: "example_script", Notify: []string{"h1"}}},
+					Handlers: []Cmd{{Name: "h1", Script: "restart"}},
+				}},
+			},
+			expectedErr: "",
+		},
+		{
+			name: "unknown handler",
+			playbook: PlayBook{
+				Tasks: []Task{{
+					Name:     "task1",
+					Commands: []Cmd{{Name: "c1", Script: "example_script", Notify: []string{"h2"}}},
+					Handlers: []Cmd{{Name: "h1", Script: "restart"}},
+				}},
+			},
+			expectedErr: `task "task1" rejected, command "c1" notifies unknown handler "h2"`,
+		},
+		{
+			name: "duplicate handler",
+			playbook: PlayBook{
+				Tasks: []Task{{
+					Name:     "task1",
+					Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Name: "h1", Script: "restart"}, {Name: "h1", Script: "reload"}},
+				}},
+			},
+			expectedErr: `task "task1" rejected, duplicate handler name "h1"`,
+		},
+		{
+			name: "handler without name",
+			playbook: PlayBook{
+				Tasks: []Task{{
+					Name:     "task1",
+					Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Script: "restart"}},
+				}},
+			},
+			expectedErr: `task "task1" rejected, handler name is required`,
+		},
+		{
+			name: "invalid handler",
+			playbook: PlayBook{
+				Tasks: []Task{{
+					Name:     "task1",
+					Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Name: "h1"}},
+				}},
+			},
+			expectedErr: `task "task1" rejected, invalid handler "h1": one of [script, copy, mcopy, delete, mdelete, sync, msync, wait, line, echo, block, template, unarchive, fetch, service, file, mfile, git, release, cron, call] must be set`,
+		},
+		{
+			name: "handler notifies handler",
+			playbook: PlayBook{
+				Tasks: []Task{{
+					Name:     "task1",
+					Commands: []Cmd{{Name: "c1", Script: "example_script"}},
+					Handlers: []Cmd{{Name: "h1", Script: "restart", Notify: []string{"h1"}}},
+				}},
+			},
+			expectedErr: `task "task1" rejected, handler "h1" can't notify other handlers`,
+		},
 		{
 			name: "no commands",
 			playbook: PlayBook{
@@ -823,6 +909,102 @@ func TestPlayBook_checkConfig(t *testing.T) {
 			},
 			expectedErr: `task "task1" has no commands`,
 		},
+		{
+			name: "valid dependencies",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "deploy", Depends: []string{"build", "migrate"}, Commands: []Cmd{{Script: "deploy"}}},
+					{Name: "build", Commands: []Cmd{{Script: "build"}}},
+					{Name: "migrate", Depends: []string{"build"}, Commands: []Cmd{{Script: "migrate"}}},
+				},
+			},
+		},
+		{
+			name: "unknown dependency",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "deploy", Depends: []string{"build"}, Commands: []Cmd{{Script: "deploy"}}},
+				},
+			},
+			expectedErr: `task "deploy" depends on unknown task "build"`,
+		},
+		{
+			name: "dependency cycle",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "deploy", Depends: []string{"build"}, Commands: []Cmd{{Script: "deploy"}}},
+					{Name: "build", Depends: []string{"prepare"}, Commands: []Cmd{{Script: "build"}}},
+					{Name: "prepare", Depends: []string{"build"}, Commands: []Cmd{{Script: "prepare"}}},
+				},
+			},
+			expectedErr: "task dependency cycle build -> prepare -> build",
+		},
+		{
+			name: "self dependency",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "deploy", Depends: []string{"deploy"}, Commands: []Cmd{{Script: "deploy"}}},
+				},
+			},
+			expectedErr: "task dependency cycle deploy -> deploy",
+		},
+		{
+			name: "valid call",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "main", Commands: []Cmd{{Name: "c1", Call: CallInternal{Task: "svc", Args: map[string]string{"SERVICE": "api"}}}}},
+					{Name: "svc", Inputs: []Input{{Name: "SERVICE", Required: true}, {Name: "PORT", Default: "80"}},
+						Commands: []Cmd{{Script: "echo $SERVICE"}}},
+				},
+			},
+		},
+		{
+			name: "call unknown task",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "main", Commands: []Cmd{{Name: "c1", Call: CallInternal{Task: "svc"}}}},
+				},
+			},
+			expectedErr: `task "main" rejected, command "c1" calls unknown task "svc"`,
+		},
+		{
+			name: "call without required argument",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "main", Commands: []Cmd{{Name: "c1", Call: CallInternal{Task: "svc"}}}},
+					{Name: "svc", Inputs: []Input{{Name: "SERVICE", Required: true}}, Commands: []Cmd{{Script: "echo $SERVICE"}}},
+				},
+			},
+			expectedErr: `task "main" rejected, command "c1": missing required argument "SERVICE" for task "svc"`,
+		},
+		{
+			name: "call with unknown argument",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "main", Commands: []Cmd{{Name: "c1", Call: CallInternal{Task: "svc", Args: map[string]string{"PORT": "80"}}}}},
+					{Name: "svc", Inputs: []Input{{Name: "SERVICE"}}, Commands: []Cmd{{Script: "echo $SERVICE"}}},
+				},
+			},
+			expectedErr: `task "main" rejected, command "c1": unknown argument "PORT" for task "svc"`,
+		},
+		{
+			name: "required input with default",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "svc", Inputs: []Input{{Name: "SERVICE", Required: true, Default: "api"}}, Commands: []Cmd{{Script: "echo"}}},
+				},
+			},
+			expectedErr: `task "svc" rejected, input "SERVICE" can't be required and have default`,
+		},
+		{
+			name: "duplicate input",
+			playbook: PlayBook{
+				Tasks: []Task{
+					{Name: "svc", Inputs: []Input{{Name: "SERVICE"}, {Name: "SERVICE"}}, Commands: []Cmd{{Script: "echo"}}},
+				},
+			},
+			expectedErr: `task "svc" rejected, duplicate input "SERVICE"`,
+		},
 	}
 
 	for _, tt := range tbl {
@@ -932,3 +1114,116 @@ func TestPlayBook_SSHTempDir(t *testing.T) {
 		})
 	}
 }
+
+func TestPlayBook_Vars(t *testing.T) {
+	dir := t.TempDir()
+	inventory := `
+group_vars:
+  all: {region: us-east, level: all}
+  web: {level: group, role: web}
+groups:
+  web:
+    - {host: "h1.example.com", name: "h1", vars: {level: host}}
+    - {host: "h2.example.com", name: "h2"}
+hosts:
+  - {host: "h3.example.com", name: "h3"}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "inventory.yml"), []byte(inventory), 0o600))
+	playbook := `
+inventory: ` + filepath.Join(dir, "inventory.yml") + `
+vars: {app: spot, level: playbook, env: prod}
+targets:
+  web:
+    groups: [web]
+    vars: {level: target, port: "8080", role: target}
+tasks:
+  - name: task1
+    vars: {level: task, env: dev}
+    commands:
+      - {name: cmd1, script: echo 1}
+  - name: task2
+    commands:
+      - {name: cmd1, script: echo 1}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "playbook.yml"), []byte(playbook), 0o600))
+
+	c, err := New(filepath.Join(dir, "playbook.yml"), nil, nil)
+	require.NoError(t, err)
+
+	t.Run("inventory vars", func(t *testing.T) {
+		web := c.inventory.Groups["web"]
+		require.Len(t, web, 2)
+		assert.Equal(t, map[string]string{"region": "us-east", "level": "host", "role": "web"}, web[0].Vars)
+		assert.Equal(t, map[string]string{"region": "us-east", "level": "group", "role": "web"}, web[1].Vars)
+		assert.Equal(t, map[string]string{"region": "us-east", "level": "all"}, c.inventory.Hosts[0].Vars)
+		assert.Equal(t, web[0].Vars, c.inventory.Groups["all"][0].Vars, "all group keeps vars of the host's group")
+	})
+
+	t.Run("target vars", func(t *testing.T) {
+		hosts, err := c.TargetHosts("web")
+		require.NoError(t, err)
+		require.Len(t, hosts, 2)
+		assert.Equal(t, map[string]string{"region": "us-east", "level": "host", "role": "web", "port": "8080"}, hosts[0].Vars)
+		assert.Equal(t, map[string]string{"region": "us-east", "level": "group", "role": "web", "port": "8080"}, hosts[1].Vars)
+
+		hosts, err = c.TargetHosts("h3")
+		require.NoError(t, err)
+		require.Len(t, hosts, 1)
+		assert.Equal(t, map[string]string{"region": "us-east", "level": "all"}, hosts[0].Vars)
+
+		hosts, err = c.TargetHosts("h4.example.com")
+		require.NoError(t, err)
+		require.Len(t, hosts, 1)
+		assert.Nil(t, hosts[0].Vars)
+	})
+
+	t.Run("task vars", func(t *testing.T) {
+		tsk, err := c.Task("task1")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"app": "spot", "level": "task", "env": "dev"}, tsk.Vars)
+		assert.Equal(t, map[string]string{"level": "task", "env": "dev"}, c.Tasks[0].Vars, "original task not changed")
+
+		tsk, err = c.Task("task2")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"app": "spot", "level": "playbook", "env": "prod"}, tsk.Vars)
+	})
+}
+
+func TestPlayBook_GatherFacts(t *testing.T) {
+	dir := t.TempDir()
+	playbook := `
+tasks:
+  - name: task1
+    gather_facts: true
+    commands:
+      - {name: cmd1, script: echo 1}
+  - name: task2
+    commands:
+      - {name: cmd1, script: echo 1}
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "playbook.yml"), []byte(playbook), 0o600))
+	c, err := New(filepath.Join(dir, "playbook.yml"), nil, nil)
+	require.NoError(t, err)
+
+	tsk, err := c.Task("task1")
+	require.NoError(t, err)
+	assert.True(t, tsk.GatherFacts)
+	tsk, err = c.Task("task2")
+	require.NoError(t, err)
+	assert.False(t, tsk.GatherFacts)
+
+	c.GatherFacts = true
+	tsk, err = c.Task("task2")
+	require.NoError(t, err)
+	assert.True(t, tsk.GatherFacts, "playbook level applies to all tasks")
+
+	t.Run("simple playbook", func(t *testing.T) {
+		simple := "gather_facts: true\ntask:\n  - {name: cmd1, script: echo 1}\n"
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "simple.yml"), []byte(simple), 0o600))
+		c, err := New(filepath.Join(dir, "simple.yml"), nil, nil)
+		require.NoError(t, err)
+		tsk, err := c.Task("default")
+		require.NoError(t, err)
+		assert.True(t, tsk.GatherFacts)
+	})
+}
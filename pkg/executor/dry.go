@@ -4,16 +4,28 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+
+	"github.com/fatih/color"
+	"github.com/pmezard/go-difflib/difflib"
 )
 
+// maxDiffSize is the maximum size of a file to show the diff for
+const maxDiffSize = 1024 * 1024
+
 // Dry is an executor for dry run, just prints commands and files to be copied, synced, deleted.
 // Useful for debugging and testing, doesn't actually execute anything.
+// If reader is set, it is used to read the current state of remote files and show the diff the real run would make.
 type Dry struct {
-	logs Logs
+	logs    Logs
+	reader  Interface
+	changed bool // set if the real run would change something
 }
 
 // NewDry creates new executor for dry run
@@ -21,9 +33,23 @@ func NewDry(logs Logs) *Dry {
 	return &Dry{logs: logs}
 }
 
+// WithReader sets executor used to read remote files, i.e. connected Remote or Local.
+// Dry executor uses it for Stat, Download and PlanSync only and never changes anything with it.
+func (ex *Dry) WithReader(rd Interface) *Dry {
+	ex.reader = rd
+	return ex
+}
+
+// Changed reports if any of the operations passed to the executor would change something in the real run.
+// Commands are not executed, so any of them counts as a change.
+func (ex *Dry) Changed() bool {
+	return ex.changed
+}
+
 // Run shows the command content, doesn't execute it
 func (ex *Dry) Run(_ context.Context, cmd string, _ *RunOpts) (out []string, err error) {
 	log.Printf("[DEBUG] run %s", cmd)
+	ex.changed = true
 	var stdoutBuf bytes.Buffer
 	mwr := io.MultiWriter(ex.logs.Out, &stdoutBuf)
 	mwr.Write([]byte(cmd)) // nolint
@@ -36,7 +62,7 @@ func (ex *Dry) Run(_ context.Context, cmd string, _ *RunOpts) (out []string, err
 }
 
 // Upload doesn't actually upload, just prints the command
-func (ex *Dry) Upload(_ context.Context, local, remote string, opts *UpDownOpts) (err error) {
+func (ex *Dry) Upload(ctx context.Context, local, remote string, opts *UpDownOpts) (err error) {
 	var mkdir bool
 	var exclude []string
 
@@ -63,6 +89,42 @@ func (ex *Dry) Upload(_ context.Context, local, remote string, opts *UpDownOpts)
 		if err := scanner.Err(); err != nil {
 			return err
 		}
+		return nil
+	}
+
+	if ex.reader == nil {
+		ex.changed = true
+		return nil
+	}
+
+	// show diff for each uploaded file, matched the same way as the real upload does
+	matches, err := filepath.Glob(local)
+	if err != nil {
+		return fmt.Errorf("failed to expand glob pattern %s: %w", local, err)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("source file %q not found", local)
+	}
+	for _, match := range matches {
+		relPath, e := filepath.Rel(filepath.Dir(local), match)
+		if e != nil {
+			return fmt.Errorf("failed to build relative path for %s: %w", match, e)
+		}
+		fi, e := os.Stat(match)
+		if e != nil || fi.IsDir() || isExcluded(relPath, false, exclude) {
+			continue
+		}
+		content, e := os.ReadFile(match) // nolint
+		if e != nil {
+			return fmt.Errorf("failed to read %s: %w", match, e)
+		}
+		remoteFile := remote
+		if len(matches) > 1 {
+			remoteFile = filepath.Join(remote, filepath.Base(match))
+		}
+		if e := ex.Diff(ctx, remoteFile, content); e != nil {
+			return e
+		}
 	}
 	return nil
 }
@@ -82,15 +144,52 @@ func (ex *Dry) Download(_ context.Context, remote, local string, opts *UpDownOpt
 	return nil
 }
 
-// Sync doesn't sync anything, just prints the command
-func (ex *Dry) Sync(_ context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
+// Sync doesn't sync anything, just prints the command. With reader set it shows added, changed and deleted files,
+// in verbose mode with the diff for each file, and returns files the real sync would upload.
+func (ex *Dry) Sync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error) {
 	del := opts != nil && opts.Delete
 	exclude := []string{}
 	if opts != nil {
 		exclude = opts.Exclude
 	}
 	log.Printf("[DEBUG] sync %s to %s, delete: %v, exlcude: %v", localDir, remoteDir, del, exclude) // nolint
-	return nil, nil
+	if ex.reader == nil {
+		ex.changed = true
+		return nil, nil
+	}
+
+	plan, err := ex.reader.PlanSync(ctx, localDir, remoteDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Added)+len(plan.Changed)+len(plan.Deleted) > 0 {
+		ex.changed = true
+	}
+	ex.logs.Info.Printf("sync %s to %s: added %d, changed %d, deleted %d\n",
+		localDir, remoteDir, len(plan.Added), len(plan.Changed), len(plan.Deleted))
+	for _, f := range plan.Added {
+		ex.logs.Info.Printf("%s\n", ex.colorize(color.FgGreen, "+ "+f))
+	}
+	for _, f := range plan.Changed {
+		ex.logs.Info.Printf("%s\n", ex.colorize(color.FgYellow, "~ "+f))
+	}
+	for _, f := range plan.Deleted {
+		ex.logs.Info.Printf("%s\n", ex.colorize(color.FgRed, "- "+f))
+	}
+
+	uploads := slices.Concat(plan.Added, plan.Changed)
+	if ex.logs.verbose {
+		for _, f := range uploads {
+			content, e := os.ReadFile(filepath.Join(localDir, f)) // nolint
+			if e != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", f, e)
+			}
+			if e := ex.Diff(ctx, filepath.Join(remoteDir, f), content); e != nil {
+				return nil, e
+			}
+		}
+	}
+	return uploads, nil
 }
 
 // Delete doesn't delete anything, just prints the command
@@ -106,6 +205,182 @@ func (ex *Dry) Delete(_ context.Context, remoteFile string, opts *DeleteOpts) (e
 	return nil
 }
 
+// Mkdir doesn't create anything, just prints the command
+func (ex *Dry) Mkdir(_ context.Context, remoteDir string) error {
+	log.Printf("[DEBUG] mkdir %s", remoteDir)
+	ex.changed = true
+	ex.logs.Out.Write([]byte("mkdir -p " + remoteDir)) // nolint
+	return nil
+}
+
+// Touch doesn't create anything, just prints the command
+func (ex *Dry) Touch(_ context.Context, remoteFile string) error {
+	log.Printf("[DEBUG] touch %s", remoteFile)
+	ex.changed = true
+	ex.logs.Out.Write([]byte("touch " + remoteFile)) // nolint
+	return nil
+}
+
+// Chmod doesn't change anything, just prints the command
+func (ex *Dry) Chmod(_ context.Context, remoteFile string, mode os.FileMode) error {
+	log.Printf("[DEBUG] chmod %s %s", remoteFile, mode)
+	ex.changed = true
+	ex.logs.Out.Write([]byte(fmt.Sprintf("chmod %04o %s", UnixMode(mode), remoteFile))) // nolint
+	return nil
+}
+
+// Stat returns file info from the reader, if set. Otherwise, reports all files as missing.
+func (ex *Dry) Stat(ctx context.Context, remoteFile string) (os.FileInfo, error) {
+	log.Printf("[DEBUG] stat %s", remoteFile)
+	if ex.reader == nil {
+		return nil, os.ErrNotExist
+	}
+	return ex.reader.Stat(ctx, remoteFile)
+}
+
+// PlanSync returns sync plan from the reader, if set. Otherwise, returns an empty plan.
+func (ex *Dry) PlanSync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) (SyncPlan, error) {
+	if ex.reader == nil {
+		return SyncPlan{}, nil
+	}
+	return ex.reader.PlanSync(ctx, localDir, remoteDir, opts)
+}
+
+// Diff shows unified diff between the current content of the remote file and the given content.
+// A missing remote file is shown as a new one. Does nothing if the reader is not set.
+func (ex *Dry) Diff(ctx context.Context, remoteFile string, content []byte) error {
+	return ex.DiffFunc(ctx, remoteFile, func([]byte) ([]byte, error) { return content, nil })
+}
+
+// DiffFunc shows unified diff between the current content of the remote file and the content made by
+// the change function from the current one. The content of a missing remote file is empty, a file which can't be
+// read is reported as changed without the diff. Does nothing if the reader is not set.
+func (ex *Dry) DiffFunc(ctx context.Context, remoteFile string, change func(current []byte) ([]byte, error)) error {
+	if ex.reader == nil {
+		return nil
+	}
+
+	fi, err := ex.reader.Stat(ctx, remoteFile)
+	if err != nil && !os.IsNotExist(err) {
+		ex.unreadable(remoteFile, err)
+		return nil
+	}
+	exists := err == nil
+	if exists && fi.IsDir() {
+		return fmt.Errorf("remote %s is a directory", remoteFile)
+	}
+	if exists && fi.Size() > maxDiffSize {
+		ex.changed = true // can't tell without reading the file, assume it differs
+		ex.logs.Info.Printf("file %s is too large to show the diff\n", remoteFile)
+		return nil
+	}
+
+	var current []byte
+	if exists {
+		if current, err = ex.download(ctx, remoteFile); err != nil {
+			ex.unreadable(remoteFile, err)
+			return nil
+		}
+	}
+	content, err := change(current)
+	if err != nil {
+		return fmt.Errorf("failed to make new content of %s: %w", remoteFile, err)
+	}
+	return ex.diff(remoteFile, current, content, exists)
+}
+
+// DiffContent shows unified diff between the current and the new content of something which is not a plain file,
+// i.e. a crontab read with a command. The name is used in the diff header only.
+func (ex *Dry) DiffContent(name string, current, content []byte) error {
+	return ex.diff(name, current, content, true)
+}
+
+// diff shows unified diff between the current and the new content of the remote file and marks it as changed
+// if they differ. The current content of a missing file is shown as /dev/null.
+func (ex *Dry) diff(remoteFile string, current, content []byte, exists bool) error {
+	if exists && bytes.Equal(current, content) {
+		ex.logs.Info.Printf("no changes in %s\n", remoteFile)
+		return nil
+	}
+
+	ex.changed = true
+	switch {
+	case len(content) > maxDiffSize:
+		ex.logs.Info.Printf("file %s is too large to show the diff\n", remoteFile)
+		return nil
+	case bytes.IndexByte(current, 0) >= 0 || bytes.IndexByte(content, 0) >= 0:
+		ex.logs.Info.Printf("binary file %s differs\n", remoteFile)
+		return nil
+	}
+
+	fromFile := "a" + remoteFile
+	if !exists {
+		fromFile = "/dev/null"
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(current)),
+		B:        difflib.SplitLines(string(content)),
+		FromFile: fromFile,
+		ToFile:   "b" + remoteFile,
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to make diff for %s: %w", remoteFile, err)
+	}
+
+	lines := []string{}
+	for line := range strings.SplitSeq(strings.TrimSuffix(diff, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---"):
+			line = ex.colorize(color.Bold, line)
+		case strings.HasPrefix(line, "+"):
+			line = ex.colorize(color.FgGreen, line)
+		case strings.HasPrefix(line, "-"):
+			line = ex.colorize(color.FgRed, line)
+		case strings.HasPrefix(line, "@@"):
+			line = ex.colorize(color.FgCyan, line)
+		}
+		lines = append(lines, line)
+	}
+	ex.logs.Info.Printf("%s\n", strings.Join(lines, "\n"))
+	return nil
+}
+
+// unreadable reports the remote file which can't be read, i.e. readable by root only, as changed.
+// Dry run doesn't use sudo to read files, so the diff can't be shown, but it is not a reason to fail.
+func (ex *Dry) unreadable(remoteFile string, err error) {
+	log.Printf("[DEBUG] can't read %s: %v", remoteFile, err)
+	ex.changed = true // can't tell without reading the file, assume it differs
+	ex.logs.Info.Printf("can't read %s to show the diff\n", remoteFile)
+}
+
+// download reads the remote file with the reader, via a local temporary copy
+func (ex *Dry) download(ctx context.Context, remoteFile string) ([]byte, error) {
+	tmpDir, err := os.MkdirTemp("", "spot-dry")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	tmpFile := filepath.Join(tmpDir, filepath.Base(remoteFile))
+	if err = ex.reader.Download(ctx, remoteFile, tmpFile, &UpDownOpts{Force: true}); err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", remoteFile, err)
+	}
+	data, err := os.ReadFile(tmpFile) // nolint
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", tmpFile, err)
+	}
+	return data, nil
+}
+
+// colorize returns the string in the given color, unless logs are monochrome
+func (ex *Dry) colorize(attr color.Attribute, s string) string {
+	if ex.logs.monochrome {
+		return s
+	}
+	return color.New(attr).Sprint(s)
+}
+
 // Close doesn't do anything
 func (ex *Dry) Close() error {
 	return nil
@@ -3,8 +3,10 @@ package executor
 import (
 	"bytes"
 	"context"
+	"errors"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -99,3 +101,158 @@ func TestDryOperations(t *testing.T) {
 		})
 	}
 }
+
+func TestDry_UploadDiff(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "new.conf")
+	require.NoError(t, os.WriteFile(src, []byte("line1\nline2 changed\nline3\npassword=secret123\n"), 0o600))
+
+	t.Run("changed file", func(t *testing.T) {
+		dst := filepath.Join(tmpDir, "existing.conf")
+		require.NoError(t, os.WriteFile(dst, []byte("line1\nline2\nline3\n"), 0o600))
+		stdout := captureStdOut(t, func() {
+			logs := MakeLogs(false, true, []string{"secret123"}).WithHost("host1.example.com", "host1")
+			dry := NewDry(logs).WithReader(NewLocal(logs))
+			require.NoError(t, dry.Upload(context.Background(), src, dst, nil))
+		})
+		t.Log(stdout)
+		assert.Contains(t, stdout, "--- a"+dst)
+		assert.Contains(t, stdout, "+++ b"+dst)
+		assert.Contains(t, stdout, "-line2\n")
+		assert.Contains(t, stdout, "+line2 changed\n")
+		assert.Contains(t, stdout, "+password=****\n")
+		assert.NotContains(t, stdout, "secret123")
+
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "line1\nline2\nline3\n", string(data), "remote file should not be modified")
+	})
+
+	t.Run("new file", func(t *testing.T) {
+		dst := filepath.Join(tmpDir, "missing.conf")
+		stdout := captureStdOut(t, func() {
+			logs := MakeLogs(false, true, nil).WithHost("host1.example.com", "host1")
+			dry := NewDry(logs).WithReader(NewLocal(logs))
+			require.NoError(t, dry.Upload(context.Background(), src, dst, nil))
+		})
+		assert.Contains(t, stdout, "--- /dev/null")
+		assert.Contains(t, stdout, "+line1\n")
+		_, err := os.Stat(dst)
+		assert.True(t, os.IsNotExist(err), "remote file should not be created")
+	})
+
+	t.Run("no changes", func(t *testing.T) {
+		stdout := captureStdOut(t, func() {
+			logs := MakeLogs(false, true, nil).WithHost("host1.example.com", "host1")
+			dry := NewDry(logs).WithReader(NewLocal(logs))
+			require.NoError(t, dry.Upload(context.Background(), src, src, nil))
+		})
+		assert.Contains(t, stdout, "no changes in "+src)
+	})
+
+	t.Run("binary file", func(t *testing.T) {
+		bin := filepath.Join(tmpDir, "file.bin")
+		require.NoError(t, os.WriteFile(bin, []byte{0x01, 0x00, 0x02}, 0o600))
+		stdout := captureStdOut(t, func() {
+			logs := MakeLogs(false, true, nil).WithHost("host1.example.com", "host1")
+			dry := NewDry(logs).WithReader(NewLocal(logs))
+			require.NoError(t, dry.Upload(context.Background(), bin, filepath.Join(tmpDir, "missing.bin"), nil))
+		})
+		assert.Contains(t, stdout, "binary file")
+	})
+
+	t.Run("unreadable file", func(t *testing.T) {
+		var changed bool
+		stdout := captureStdOut(t, func() {
+			logs := MakeLogs(false, true, nil).WithHost("host1.example.com", "host1")
+			dry := NewDry(logs).WithReader(noReadLocal{NewLocal(logs)})
+			require.NoError(t, dry.Upload(context.Background(), src, src, nil))
+			changed = dry.Changed()
+		})
+		assert.Contains(t, stdout, "can't read "+src+" to show the diff")
+		assert.True(t, changed, "unreadable file reported as changed")
+	})
+
+	t.Run("remote is a directory", func(t *testing.T) {
+		logs := MakeLogs(false, true, nil).WithHost("host1.example.com", "host1")
+		dry := NewDry(logs).WithReader(NewLocal(logs))
+		err := dry.Upload(context.Background(), src, t.TempDir(), nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "is a directory")
+	})
+}
+
+func TestDry_DiffFunc(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(dst, []byte("127.0.0.1 localhost\n"), 0o600))
+
+	stdout := captureStdOut(t, func() {
+		logs := MakeLogs(false, true, nil).WithHost("host1.example.com", "host1")
+		dry := NewDry(logs).WithReader(NewLocal(logs))
+		err := dry.DiffFunc(context.Background(), dst, func(current []byte) ([]byte, error) {
+			return append(current, []byte("10.0.0.1 db\n")...), nil
+		})
+		require.NoError(t, err)
+	})
+	assert.Contains(t, stdout, "+10.0.0.1 db\n")
+	assert.Contains(t, stdout, " 127.0.0.1 localhost\n")
+
+	logs := MakeLogs(false, true, nil)
+	dry := NewDry(logs).WithReader(NewLocal(logs))
+	err := dry.DiffFunc(context.Background(), dst, func([]byte) ([]byte, error) { return nil, errors.New("bad change") })
+	require.EqualError(t, err, "failed to make new content of "+dst+": bad change")
+}
+
+func TestDry_DiffContent(t *testing.T) {
+	var changed, same bool
+	stdout := captureStdOut(t, func() {
+		logs := MakeLogs(false, true, nil)
+		dry := NewDry(logs)
+		require.NoError(t, dry.DiffContent("crontab app", []byte("@reboot true\n"), []byte("@reboot true\n")))
+		same = dry.Changed()
+		require.NoError(t, dry.DiffContent("crontab app", []byte("@reboot true\n"), []byte("@reboot true\n@daily true\n")))
+		changed = dry.Changed()
+	})
+	assert.False(t, same)
+	assert.True(t, changed)
+	assert.Contains(t, stdout, "no changes in crontab app")
+	assert.Contains(t, stdout, "--- acrontab app")
+	assert.Contains(t, stdout, "+@daily true\n")
+}
+
+func TestDry_SyncPlan(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "same.txt"), []byte("same"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "changed.txt"), []byte("new content"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "added.txt"), []byte("added"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "changed.txt"), []byte("old"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "deleted.txt"), []byte("deleted"), 0o600))
+	local := NewLocal(MakeLogs(false, true, nil))
+	require.NoError(t, local.Upload(context.Background(), filepath.Join(src, "same.txt"), filepath.Join(dst, "same.txt"), nil))
+
+	var files []string
+	stdout := captureStdOut(t, func() {
+		logs := MakeLogs(false, true, nil).WithHost("host1.example.com", "host1")
+		dry := NewDry(logs).WithReader(NewLocal(logs))
+		var err error
+		files, err = dry.Sync(context.Background(), src, dst, &SyncOpts{Delete: true})
+		require.NoError(t, err)
+	})
+	t.Log(stdout)
+	assert.ElementsMatch(t, []string{"added.txt", "changed.txt"}, files)
+	assert.Contains(t, stdout, "added 1, changed 1, deleted 1")
+	assert.Contains(t, stdout, "+ added.txt")
+	assert.Contains(t, stdout, "~ changed.txt")
+	assert.Contains(t, stdout, "- deleted.txt")
+	assert.NotContains(t, stdout, "same.txt")
+
+	_, err := os.Stat(filepath.Join(dst, "deleted.txt"))
+	require.NoError(t, err, "nothing should be deleted in dry mode")
+}
+
+// noReadLocal is a local executor which can't download files, like a remote one for files readable by root only
+type noReadLocal struct{ *Local }
+
+func (noReadLocal) Download(context.Context, string, string, *UpDownOpts) error {
+	return os.ErrPermission
+}
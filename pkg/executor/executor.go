@@ -4,9 +4,14 @@ package executor
 
 import (
 	"context"
+	"errors"
+	"os"
+	"os/exec"
 	"path"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // Interface is an interface for the executor.
@@ -17,9 +22,21 @@ type Interface interface {
 	Download(ctx context.Context, remote, local string, opts *UpDownOpts) (err error)
 	Sync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) ([]string, error)
 	Delete(ctx context.Context, remoteFile string, opts *DeleteOpts) (err error)
+	Stat(ctx context.Context, remoteFile string) (os.FileInfo, error)
+	PlanSync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) (SyncPlan, error)
+	Mkdir(ctx context.Context, remoteDir string) error
+	Touch(ctx context.Context, remoteFile string) error
+	Chmod(ctx context.Context, remoteFile string, mode os.FileMode) error
 	Close() error
 }
 
+// SyncPlan lists files a sync would change. Paths are relative to the synced directories.
+type SyncPlan struct {
+	Added   []string // files missing in destination
+	Changed []string // files different in destination
+	Deleted []string // files and directories missing in source, set only if sync deletes
+}
+
 // RunOpts is a struct for run options.
 type RunOpts struct {
 	Verbose bool // print more info to primary stdout
@@ -44,6 +61,54 @@ type DeleteOpts struct {
 	Exclude   []string // exclude files matching the given patterns
 }
 
+// UnixMode returns the permission bits of the file mode in the unix numeric form used by chmod,
+// with setuid (04000), setgid (02000) and sticky (01000) bits
+func UnixMode(mode os.FileMode) uint32 {
+	res := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		res |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		res |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		res |= 0o1000
+	}
+	return res
+}
+
+// FileMode returns the file mode for the unix numeric mode used by chmod, i.e. 04755 or 01777
+func FileMode(mode uint32) os.FileMode {
+	res := os.FileMode(mode & 0o777)
+	if mode&0o4000 != 0 {
+		res |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		res |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		res |= os.ModeSticky
+	}
+	return res
+}
+
+// ExitCode returns the exit status of a failed command run by any executor. It returns 0 for nil error
+// and -1 if the error doesn't carry an exit status, e.g. connection or session failures.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus()
+	}
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) {
+		return execErr.ExitCode()
+	}
+	return -1
+}
+
 // normalizeSlashes converts windows separators to forward slashes,
 // exclude patterns and remote paths always use forward slashes.
 func normalizeSlashes(s string) string { return strings.ReplaceAll(s, `\`, "/") }
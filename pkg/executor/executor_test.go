@@ -2,8 +2,11 @@ package executor
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
 	"testing"
 	"time"
 
@@ -80,6 +83,34 @@ func Test_isExcludedSubPath(t *testing.T) {
 	}
 }
 
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, -1, ExitCode(errors.New("connection refused")))
+
+	err := exec.Command("sh", "-c", "exit 5").Run()
+	require.Error(t, err)
+	assert.Equal(t, 5, ExitCode(err))
+	assert.Equal(t, 5, ExitCode(fmt.Errorf("wrapped: %w", err)))
+}
+
+func TestUnixMode(t *testing.T) {
+	tbl := []struct {
+		unix uint32
+		mode os.FileMode
+	}{
+		{0o644, 0o644},
+		{0o4755, os.ModeSetuid | 0o755},
+		{0o2750, os.ModeSetgid | 0o750},
+		{0o1777, os.ModeSticky | 0o777},
+		{0o7700, os.ModeSetuid | os.ModeSetgid | os.ModeSticky | 0o700},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.unix, UnixMode(tt.mode), "%04o", tt.unix)
+		assert.Equal(t, tt.mode, FileMode(tt.unix), "%04o", tt.unix)
+	}
+	assert.Equal(t, uint32(0o755), UnixMode(os.ModeDir|0o755), "type bits ignored")
+}
+
 func Test_isWithinOneSecond(t *testing.T) {
 	now := time.Now()
 	testCases := []struct {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -26,7 +27,8 @@ func NewLocal(logs Logs) *Local {
 	return &Local{logs: logs}
 }
 
-// Run executes command on local hostAddr, inside the shell
+// Run executes command on local hostAddr, inside the shell.
+// On a non-zero exit the output collected so far is returned along with the error.
 func (l *Local) Run(ctx context.Context, cmd string, _ *RunOpts) (out []string, err error) {
 	shell := func() string {
 		if strings.HasPrefix(cmd, "sh -c") {
@@ -54,15 +56,15 @@ func (l *Local) Run(ctx context.Context, cmd string, _ *RunOpts) (out []string,
 	var stdoutBuf bytes.Buffer
 	mwr := io.MultiWriter(outLog, &stdoutBuf)
 	command.Stdout, command.Stderr = mwr, errLog
-	err = command.Run()
-	if err != nil {
-		return nil, err
-	}
+	runErr := command.Run()
 
 	scanner := bufio.NewScanner(&stdoutBuf)
 	for scanner.Scan() {
 		out = append(out, scanner.Text())
 	}
+	if runErr != nil {
+		return out, runErr
+	}
 	return out, scanner.Err()
 }
 
@@ -151,7 +153,7 @@ func (l *Local) Download(ctx context.Context, src, dst string, opts *UpDownOpts)
 	return l.Upload(ctx, src, dst, opts) // same as upload for local
 }
 
-// Sync directories from src to dst
+// Sync directories from src to dst. Files with the same size, mode and modification time are skipped.
 func (l *Local) Sync(ctx context.Context, src, dst string, opts *SyncOpts) ([]string, error) {
 	excl := []string{}
 	if opts != nil {
@@ -171,6 +173,73 @@ func (l *Local) Sync(ctx context.Context, src, dst string, opts *SyncOpts) ([]st
 	return copiedFiles, nil
 }
 
+// PlanSync compares files in src and dst directories and returns what sync would change.
+// Files are compared by size and modification time. Nothing is copied or deleted.
+func (l *Local) PlanSync(ctx context.Context, src, dst string, opts *SyncOpts) (SyncPlan, error) {
+	excl := []string{}
+	if opts != nil {
+		excl = opts.Exclude
+	}
+
+	res := SyncPlan{}
+	err := filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || isExcluded(relPath, false, excl) {
+			return nil
+		}
+		dstInfo, err := os.Stat(filepath.Join(dst, relPath))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			res.Added = append(res.Added, relPath)
+		case err != nil:
+			return err
+		case dstInfo.Size() != info.Size() || !isWithinOneSecond(dstInfo.ModTime(), info.ModTime()):
+			res.Changed = append(res.Changed, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return SyncPlan{}, err
+	}
+
+	if opts == nil || !opts.Delete {
+		return res, nil
+	}
+
+	err = filepath.Walk(dst, func(dstPath string, info os.FileInfo, err error) error {
+		if errors.Is(err, os.ErrNotExist) && dstPath == dst {
+			return filepath.SkipDir // nothing to delete, destination doesn't exist yet
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dst, dstPath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(src, relPath)); errors.Is(err, os.ErrNotExist) {
+			res.Deleted = append(res.Deleted, relPath)
+			if info.IsDir() {
+				return filepath.SkipDir // the whole directory is deleted
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	return res, nil
+}
+
 // Delete file or directory
 func (l *Local) Delete(ctx context.Context, remoteFile string, opts *DeleteOpts) (err error) {
 	recursive := opts != nil && opts.Recursive
@@ -186,6 +255,36 @@ func (l *Local) Delete(ctx context.Context, remoteFile string, opts *DeleteOpts)
 	return l.deletePath(ctx, remoteFile, exclude)
 }
 
+// Stat returns file info for the local file
+func (l *Local) Stat(_ context.Context, file string) (os.FileInfo, error) {
+	return os.Stat(file)
+}
+
+// Mkdir creates the local directory with all missing parents, like mkdir -p
+func (l *Local) Mkdir(_ context.Context, dir string) error {
+	return os.MkdirAll(dir, 0o777) // nolint gosec, the same as mkdir -p, subject to umask
+}
+
+// Touch creates an empty local file if it doesn't exist. Existing file is not modified.
+func (l *Local) Touch(_ context.Context, file string) error {
+	fh, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0o666) // nolint gosec, the same as touch, subject to umask
+	if err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// Chmod sets the mode of the local file, including setuid, setgid and sticky bits
+func (l *Local) Chmod(_ context.Context, file string, mode os.FileMode) error {
+	return os.Chmod(file, mode)
+}
+
+// Dial connects to the address from the local host
+func (l *Local) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
 // Close does nothing for local
 func (l *Local) Close() error { return nil }
 
@@ -212,7 +311,7 @@ func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string
 		dstPath := filepath.Join(dst, relPath)
 		if info.IsDir() {
 			if _, err := os.Stat(dstPath); errors.Is(err, os.ErrNotExist) {
-				err := os.Mkdir(dstPath, info.Mode())
+				err := os.MkdirAll(dstPath, info.Mode())
 				if err != nil {
 					return err
 				}
@@ -220,12 +319,21 @@ func (l *Local) syncSrcToDst(ctx context.Context, src, dst string, excl []string
 			return nil
 		}
 
+		// skip unchanged files the same way remote sync does, by size and modification time
+		if dstInfo, err := os.Stat(dstPath); err == nil && dstInfo.Size() == info.Size() &&
+			isWithinOneSecond(dstInfo.ModTime(), info.ModTime()) && dstInfo.Mode() == info.Mode() {
+			return nil
+		}
+
 		if err := fileutils.CopyFile(srcPath, dstPath); err != nil {
 			return err
 		}
 		if err := os.Chmod(dstPath, info.Mode()); err != nil {
 			return err
 		}
+		if err := os.Chtimes(dstPath, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
 		copiedFiles = append(copiedFiles, relPath)
 		return nil
 	})
@@ -307,7 +415,8 @@ func (l *Local) copyFile(src, dst string) error {
 		return err
 	}
 
-	return nil
+	// keep modification time, same as remote upload does. this allows skipping unchanged files next time
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
 }
 
 func (l *Local) deletePath(ctx context.Context, src string, excl []string) error {
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"slices"
@@ -42,6 +43,13 @@ func TestRun(t *testing.T) {
 		require.Error(t, e)
 	})
 
+	t.Run("output and exit code on failure", func(t *testing.T) {
+		out, e := l.Run(ctx, "echo partial; exit 3", nil)
+		require.Error(t, e)
+		assert.Equal(t, []string{"partial"}, out)
+		assert.Equal(t, 3, ExitCode(e))
+	})
+
 	t.Run("multi line out success", func(t *testing.T) {
 		// prepare the test environment
 		_, err := l.Run(ctx, "mkdir -p /tmp/st", &RunOpts{Verbose: true})
@@ -912,6 +920,118 @@ func TestLocal_UploadMultiFileCanceled(t *testing.T) {
 	assert.Empty(t, entries, "no files should be copied once the context is canceled")
 }
 
+func TestLocal_Stat(t *testing.T) {
+	l := &Local{}
+	fi, err := l.Stat(context.Background(), "testdata/data1.txt")
+	require.NoError(t, err)
+	assert.False(t, fi.IsDir())
+	assert.Positive(t, fi.Size())
+
+	_, err = l.Stat(context.Background(), "testdata/not-found.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLocal_MkdirTouchChmod(t *testing.T) {
+	ctx := context.Background()
+	l := &Local{}
+	dir := filepath.Join(t.TempDir(), "a", "b")
+	require.NoError(t, l.Mkdir(ctx, dir))
+	require.NoError(t, l.Mkdir(ctx, dir), "existing directory")
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.True(t, fi.IsDir())
+
+	file := filepath.Join(dir, "f.txt")
+	require.NoError(t, l.Touch(ctx, file))
+	require.NoError(t, os.WriteFile(file, []byte("data"), 0o600))
+	require.NoError(t, l.Touch(ctx, file))
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data), "existing file not modified")
+
+	require.NoError(t, l.Chmod(ctx, dir, os.ModeSticky|0o777))
+	fi, err = os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0o1777), UnixMode(fi.Mode()))
+
+	assert.Error(t, l.Touch(ctx, filepath.Join(dir, "missing", "f.txt")))
+	assert.Error(t, l.Chmod(ctx, filepath.Join(dir, "missing"), 0o644))
+}
+
+func TestLocal_Dial(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	l := &Local{}
+	_, err = l.Dial(context.Background(), "tcp", addr)
+	require.Error(t, err, "nothing listens on the closed port")
+
+	lis, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer lis.Close()
+	conn, err := l.Dial(context.Background(), "tcp", addr)
+	require.NoError(t, err)
+	assert.NoError(t, conn.Close())
+}
+
+func TestLocal_SyncUnchanged(t *testing.T) {
+	src := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "nested", "dst")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "d1"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "d1", "f1.txt"), []byte("content1"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "f2.txt"), []byte("content2"), 0o600))
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "f2.txt"), mtime, mtime))
+
+	l := &Local{}
+	copied, err := l.Sync(context.Background(), src, dst, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"d1/f1.txt", "f2.txt"}, copied)
+	fi, err := os.Stat(filepath.Join(dst, "f2.txt"))
+	require.NoError(t, err)
+	assert.True(t, fi.ModTime().Equal(mtime), "modification time preserved")
+
+	copied, err = l.Sync(context.Background(), src, dst, nil)
+	require.NoError(t, err)
+	assert.Empty(t, copied, "unchanged files skipped")
+
+	require.NoError(t, os.WriteFile(filepath.Join(src, "f2.txt"), []byte("content22"), 0o600))
+	copied, err = l.Sync(context.Background(), src, dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"f2.txt"}, copied)
+}
+
+func TestLocal_PlanSync(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "d1"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "d1", "added.txt"), []byte("added"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "changed.txt"), []byte("new content"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "excluded.txt"), []byte("excluded"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "changed.txt"), []byte("old"), 0o600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dst, "extra", "sub"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "extra", "sub", "f.txt"), []byte("f"), 0o600))
+
+	l := &Local{}
+	plan, err := l.PlanSync(context.Background(), src, dst, &SyncOpts{Exclude: []string{"excluded.txt"}})
+	require.NoError(t, err)
+	assert.Equal(t, SyncPlan{Added: []string{"d1/added.txt"}, Changed: []string{"changed.txt"}}, plan)
+
+	plan, err = l.PlanSync(context.Background(), src, dst, &SyncOpts{Delete: true, Exclude: []string{"excluded.txt"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"extra"}, plan.Deleted, "deleted directory listed once")
+
+	plan, err = l.PlanSync(context.Background(), src, filepath.Join(dst, "not-exists"), &SyncOpts{Delete: true})
+	require.NoError(t, err)
+	assert.Len(t, plan.Added, 3)
+	assert.Empty(t, plan.Deleted)
+
+	// nothing touched
+	_, err = os.Stat(filepath.Join(dst, "extra", "sub", "f.txt"))
+	require.NoError(t, err)
+}
+
 func TestClose(t *testing.T) {
 	l := &Local{}
 	err := l.Close()
@@ -37,9 +37,12 @@ type Logs struct {
 // WithHost creates a new Logs with the given hostAddr name for each LogWriter.
 func (l Logs) WithHost(hostAddr, hostName string) Logs {
 	return Logs{
-		Info: l.Info.WithHost(hostAddr, hostName),
-		Out:  l.Out.WithHost(hostAddr, hostName),
-		Err:  l.Err.WithHost(hostAddr, hostName),
+		Info:       l.Info.WithHost(hostAddr, hostName),
+		Out:        l.Out.WithHost(hostAddr, hostName),
+		Err:        l.Err.WithHost(hostAddr, hostName),
+		verbose:    l.verbose,
+		secrets:    l.secrets,
+		monochrome: l.monochrome,
 	}
 }
 
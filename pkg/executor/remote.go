@@ -201,6 +201,38 @@ func (ex *Remote) Sync(ctx context.Context, localDir, remoteDir string, opts *Sy
 	return unmatchedFiles, nil
 }
 
+// PlanSync compares local and remote files the same way Sync does and returns what Sync would change.
+// Nothing is uploaded or deleted.
+func (ex *Remote) PlanSync(ctx context.Context, localDir, remoteDir string, opts *SyncOpts) (SyncPlan, error) {
+	localFiles, err := ex.getLocalFilesProperties(localDir)
+	if err != nil {
+		return SyncPlan{}, fmt.Errorf("failed to get local files properties for %s: %w", localDir, err)
+	}
+
+	excl := []string{}
+	if opts != nil {
+		excl = opts.Exclude
+	}
+	remoteFiles, err := ex.getRemoteFilesProperties(ctx, remoteDir, excl)
+	if err != nil {
+		return SyncPlan{}, fmt.Errorf("failed to get remote files properties for %s: %w", remoteDir, err)
+	}
+
+	res := SyncPlan{}
+	unmatchedFiles, deletedFiles := ex.findUnmatchedFiles(localFiles, remoteFiles, excl)
+	for _, file := range unmatchedFiles {
+		if _, ok := remoteFiles[file]; ok {
+			res.Changed = append(res.Changed, file)
+			continue
+		}
+		res.Added = append(res.Added, file)
+	}
+	if opts != nil && opts.Delete {
+		res.Deleted = deletedFiles
+	}
+	return res, nil
+}
+
 // Delete file on remote server. Recursively if recursive is true.
 // if a file or directory does not exist, returns nil, i.e. no error.
 func (ex *Remote) Delete(ctx context.Context, remoteFile string, opts *DeleteOpts) (err error) {
@@ -326,7 +358,87 @@ func (ex *Remote) Delete(ctx context.Context, remoteFile string, opts *DeleteOpt
 	return nil
 }
 
+// Dial connects to the address from the remote host, through the ssh connection.
+// Nothing has to be installed on the remote host for it.
+func (ex *Remote) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if ex.client == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+	return ex.client.DialContext(ctx, network, addr)
+}
+
+// Stat returns file info for the remote file. The error matches os.ErrNotExist if the file doesn't exist.
+func (ex *Remote) Stat(_ context.Context, remoteFile string) (os.FileInfo, error) {
+	if ex.client == nil {
+		return nil, fmt.Errorf("client is not connected")
+	}
+
+	sftpClient, err := sftp.NewClient(ex.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sftp client: %v", err)
+	}
+	defer sftpClient.Close()
+
+	return sftpClient.Stat(remoteFile)
+}
+
+// Mkdir creates the remote directory with all missing parents, like mkdir -p. Existing directory is not an error.
+func (ex *Remote) Mkdir(_ context.Context, remoteDir string) error {
+	if ex.client == nil {
+		return fmt.Errorf("client is not connected")
+	}
+
+	sftpClient, err := sftp.NewClient(ex.client)
+	if err != nil {
+		return fmt.Errorf("failed to create sftp client: %v", err)
+	}
+	defer sftpClient.Close()
+
+	if err := sftpClient.MkdirAll(remoteDir); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", remoteDir, err)
+	}
+	return nil
+}
+
+// Touch creates an empty remote file if it doesn't exist. Existing file is not modified.
+func (ex *Remote) Touch(_ context.Context, remoteFile string) error {
+	if ex.client == nil {
+		return fmt.Errorf("client is not connected")
+	}
+
+	sftpClient, err := sftp.NewClient(ex.client)
+	if err != nil {
+		return fmt.Errorf("failed to create sftp client: %v", err)
+	}
+	defer sftpClient.Close()
+
+	fh, err := sftpClient.OpenFile(remoteFile, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", remoteFile, err)
+	}
+	return fh.Close()
+}
+
+// Chmod sets the mode of the remote file, including setuid, setgid and sticky bits
+func (ex *Remote) Chmod(_ context.Context, remoteFile string, mode os.FileMode) error {
+	if ex.client == nil {
+		return fmt.Errorf("client is not connected")
+	}
+
+	sftpClient, err := sftp.NewClient(ex.client)
+	if err != nil {
+		return fmt.Errorf("failed to create sftp client: %v", err)
+	}
+	defer sftpClient.Close()
+
+	if err := sftpClient.Chmod(remoteFile, mode); err != nil {
+		return fmt.Errorf("failed to chmod %s: %w", remoteFile, err)
+	}
+	return nil
+}
+
 // sshRun executes command on remote server. context close sends interrupt signal to the remote process.
+// On a non-zero exit the output collected so far is returned along with the error.
 func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string) (out []string, err error) {
 	log.Printf("[DEBUG] run ssh command %q on %s", command, client.RemoteAddr().String())
 	session, err := client.NewSession()
@@ -349,7 +461,7 @@ func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string
 	select {
 	case err = <-done:
 		if err != nil {
-			return nil, fmt.Errorf("failed to run command on remote server: %w", err)
+			err = fmt.Errorf("failed to run command on remote server: %w", err)
 		}
 	case <-ctx.Done():
 		if err = session.Signal(ssh.SIGINT); err != nil {
@@ -363,7 +475,7 @@ func (ex *Remote) sshRun(ctx context.Context, client *ssh.Client, command string
 			out = append(out, line)
 		}
 	}
-	return out, nil
+	return out, err
 }
 
 type sftpReq struct {
@@ -632,6 +632,39 @@ func TestExecuter_Delete(t *testing.T) {
 	})
 }
 
+func TestExecuter_MkdirTouchChmod(t *testing.T) {
+	ctx := context.Background()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10, MakeLogs(true, false, nil))
+	require.NoError(t, err)
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	require.NoError(t, err)
+	defer sess.Close()
+
+	require.NoError(t, sess.Mkdir(ctx, "/tmp/file.dest/a/b"))
+	require.NoError(t, sess.Mkdir(ctx, "/tmp/file.dest/a/b"), "existing directory")
+	require.NoError(t, sess.Touch(ctx, "/tmp/file.dest/a/b/f.txt"))
+	require.NoError(t, sess.Chmod(ctx, "/tmp/file.dest/a", os.ModeSticky|0o777))
+	require.NoError(t, sess.Chmod(ctx, "/tmp/file.dest/a/b/f.txt", os.ModeSetuid|0o755))
+
+	fi, err := sess.Stat(ctx, "/tmp/file.dest/a")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0o1777), UnixMode(fi.Mode()))
+	fi, err = sess.Stat(ctx, "/tmp/file.dest/a/b/f.txt")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0o4755), UnixMode(fi.Mode()))
+	assert.Equal(t, int64(0), fi.Size())
+
+	_, err = sess.Run(ctx, "echo data > /tmp/file.dest/a/b/f.txt", nil)
+	require.NoError(t, err)
+	require.NoError(t, sess.Touch(ctx, "/tmp/file.dest/a/b/f.txt"))
+	out, err := sess.Run(ctx, "cat /tmp/file.dest/a/b/f.txt", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data"}, out, "existing file not modified")
+}
+
 func TestExecuter_DeleteWithExclude(t *testing.T) {
 	ctx := context.Background()
 	hostAndPort, teardown := startTestContainer(t)
@@ -689,6 +722,35 @@ func TestExecuter_DeleteWithExclude(t *testing.T) {
 	})
 }
 
+func TestExecuter_Dial(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	hostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	logs := MakeLogs(true, false, nil)
+	c, err := NewConnector("testdata/test_ssh_key", time.Second*10, logs)
+	require.NoError(t, err)
+	sess, err := c.Connect(ctx, hostAndPort, "h1", "test")
+	require.NoError(t, err)
+	defer sess.Close()
+
+	// sshd listens on 2222 inside the container, reachable from the remote host only
+	conn, err := sess.Dial(ctx, "tcp", "localhost:2222")
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "SSH-", string(buf))
+	require.NoError(t, conn.Close())
+
+	_, err = sess.Dial(ctx, "tcp", "localhost:1")
+	require.Error(t, err)
+
+	_, err = (&Remote{}).Dial(ctx, "tcp", "localhost:2222")
+	require.EqualError(t, err, "client is not connected")
+}
+
 func TestRemote_CloseNoSession(t *testing.T) {
 	sess := &Remote{}
 	err := sess.Close()
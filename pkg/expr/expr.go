@@ -0,0 +1,569 @@
+// Package expr implements a small expression language evaluated locally, without running anything on remote hosts.
+// It is used by command options like failed_when and changed_when, for example:
+//
+//	exit_code != 0 && !(stdout contains "already exists")
+//
+// Supported literals are strings (double or single quoted), numbers, true/false and lists like ["a", "b"].
+// Identifiers are resolved from the Vars map, dotted names (env.FOO) look up a key inside a nested map.
+// Operators: || && ! (also "or", "and", "not"), == != < <= > >=, contains, in and matches (=~) for regex.
+package expr
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Vars is a set of values available to the expression. Values can be strings, bools, numbers,
+// string slices, or nested maps (map[string]string or map[string]any) accessed with dotted names.
+type Vars map[string]any
+
+// Expr is a parsed expression, ready to be evaluated multiple times
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses an expression string and returns Expr or a parsing error
+func Parse(s string) (*Expr, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse expression %q: %w", s, err)
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("can't parse expression %q: %w", s, err)
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("can't parse expression %q: unexpected %q at position %d", s, p.peek().val, p.peek().pos)
+	}
+	return &Expr{src: s, root: root}, nil
+}
+
+// Eval parses and evaluates an expression in one step, returning the truthiness of the result
+func Eval(s string, vars Vars) (bool, error) {
+	e, err := Parse(s)
+	if err != nil {
+		return false, err
+	}
+	return e.Eval(vars)
+}
+
+// Eval evaluates the expression with the given vars and returns the truthiness of the result
+func (e *Expr) Eval(vars Vars) (bool, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return false, fmt.Errorf("can't evaluate expression %q: %w", e.src, err)
+	}
+	return truthy(v), nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string { return e.src }
+
+// token kinds
+const (
+	tkIdent = iota
+	tkString
+	tkNumber
+	tkOp
+)
+
+type token struct {
+	kind int
+	val  string
+	pos  int
+}
+
+// lex splits the input into tokens
+func lex(s string) ([]token, error) {
+	var res []token
+	twoCharOps := []string{"&&", "||", "==", "!=", "<=", ">=", "=~"}
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '"' || ch == '\'':
+			str, n, err := lexString(s[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%w at position %d", err, i)
+			}
+			res = append(res, token{kind: tkString, val: str, pos: i})
+			i += n
+		case ch >= '0' && ch <= '9' || (ch == '-' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' && expectsOperand(res)):
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			res = append(res, token{kind: tkNumber, val: s[i:j], pos: i})
+			i = j
+		case isIdentStart(ch):
+			j := i + 1
+			for j < len(s) && (isIdentStart(s[j]) || s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			res = append(res, token{kind: tkIdent, val: s[i:j], pos: i})
+			i = j
+		default:
+			matched := false
+			for _, op := range twoCharOps {
+				if strings.HasPrefix(s[i:], op) {
+					res = append(res, token{kind: tkOp, val: op, pos: i})
+					i += 2
+					matched = true
+					break
+				}
+			}
+			if matched {
+				continue
+			}
+			if !strings.ContainsRune("()[],!<>", rune(ch)) {
+				return nil, fmt.Errorf("unexpected character %q at position %d", ch, i)
+			}
+			res = append(res, token{kind: tkOp, val: string(ch), pos: i})
+			i++
+		}
+	}
+	return res, nil
+}
+
+// lexString reads a quoted string, returning the unquoted value and the number of consumed bytes
+func lexString(s string) (val string, n int, err error) {
+	quote := s[0]
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			default:
+				sb.WriteByte(s[i])
+			}
+		case s[i] == quote:
+			return sb.String(), i + 1, nil
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+func isIdentStart(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '_'
+}
+
+// expectsOperand reports whether the next token should be an operand, used to tell negative numbers from minus
+func expectsOperand(toks []token) bool {
+	if len(toks) == 0 {
+		return true
+	}
+	last := toks[len(toks)-1]
+	return last.kind == tkOp && last.val != ")" && last.val != "]"
+}
+
+// parser is a recursive descent parser producing the node tree
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) done() bool { return p.pos >= len(p.toks) }
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{}
+	}
+	return p.toks[p.pos]
+}
+
+// accept consumes the next token if it is an operator or keyword from the list
+func (p *parser) accept(vals ...string) (string, bool) {
+	if p.done() {
+		return "", false
+	}
+	t := p.toks[p.pos]
+	if t.kind != tkOp && t.kind != tkIdent {
+		return "", false
+	}
+	for _, v := range vals {
+		if t.val == v {
+			p.pos++
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{x: x}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *parser) parseCmp() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "=~", "contains", "matches", "in")
+	if !ok {
+		return left, nil
+	}
+	if op == "=~" {
+		op = "matches"
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op == "matches" {
+		if lit, isLit := right.(literalNode); isLit {
+			re, e := regexp.Compile(toString(lit.val))
+			if e != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", toString(lit.val), e)
+			}
+			return binaryNode{op: op, left: left, right: right, re: re}, nil
+		}
+	}
+	return binaryNode{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.done() {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	switch t.kind {
+	case tkString:
+		return literalNode{val: t.val}, nil
+	case tkNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.val, t.pos)
+		}
+		return literalNode{val: f}, nil
+	case tkIdent:
+		switch t.val {
+		case "true":
+			return literalNode{val: true}, nil
+		case "false":
+			return literalNode{val: false}, nil
+		case "and", "or", "not", "contains", "matches", "in":
+			return nil, fmt.Errorf("unexpected %q at position %d", t.val, t.pos)
+		}
+		return identNode{name: t.val}, nil
+	}
+
+	switch t.val {
+	case "(":
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, fmt.Errorf("missing closing parenthesis for position %d", t.pos)
+		}
+		return x, nil
+	case "[":
+		lst := listNode{}
+		if _, ok := p.accept("]"); ok {
+			return lst, nil
+		}
+		for {
+			it, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			lst.items = append(lst.items, it)
+			if _, ok := p.accept(","); ok {
+				continue
+			}
+			if _, ok := p.accept("]"); ok {
+				return lst, nil
+			}
+			return nil, fmt.Errorf("missing closing bracket for position %d", t.pos)
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.val, t.pos)
+}
+
+// node is an element of the parsed expression tree
+type node interface {
+	eval(vars Vars) (any, error)
+}
+
+type literalNode struct{ val any }
+
+func (n literalNode) eval(Vars) (any, error) { return n.val, nil }
+
+type identNode struct{ name string }
+
+// eval resolves identifier from vars. A dotted name is looked up as is first, and then as a key inside
+// a nested map. A missing key inside an existing nested map resolves to an empty string, so env.FOO == ""
+// can be used to check for unset values, while an unknown top-level name is an error to catch typos.
+func (n identNode) eval(vars Vars) (any, error) {
+	if v, ok := vars[n.name]; ok {
+		return v, nil
+	}
+	elems := strings.Split(n.name, ".")
+	var cur any = map[string]any(vars)
+	for i, el := range elems {
+		switch m := cur.(type) {
+		case map[string]any:
+			v, ok := m[el]
+			if !ok {
+				if i == 0 {
+					return nil, fmt.Errorf("unknown variable %q", n.name)
+				}
+				return "", nil
+			}
+			cur = v
+		case Vars:
+			v, ok := m[el]
+			if !ok {
+				return "", nil
+			}
+			cur = v
+		case map[string]string:
+			return m[strings.Join(elems[i:], ".")], nil
+		default:
+			return nil, fmt.Errorf("can't access %q in %q, not a map", el, strings.Join(elems[:i], "."))
+		}
+	}
+	return cur, nil
+}
+
+type listNode struct{ items []node }
+
+func (n listNode) eval(vars Vars) (any, error) {
+	res := make([]string, 0, len(n.items))
+	for _, it := range n.items {
+		v, err := it.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, toString(v))
+	}
+	return res, nil
+}
+
+type unaryNode struct{ x node }
+
+func (n unaryNode) eval(vars Vars) (any, error) {
+	v, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+	re          *regexp.Regexp // precompiled regex for matches with a literal pattern
+}
+
+func (n binaryNode) eval(vars Vars) (any, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// short-circuit logical operators, the right side is not evaluated if not needed
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, e := n.right.eval(vars)
+		if e != nil {
+			return nil, e
+		}
+		return truthy(right), nil
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, e := n.right.eval(vars)
+		if e != nil {
+			return nil, e
+		}
+		return truthy(right), nil
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return compare(left, right) == 0, nil
+	case "!=":
+		return compare(left, right) != 0, nil
+	case "<":
+		return compare(left, right) < 0, nil
+	case "<=":
+		return compare(left, right) <= 0, nil
+	case ">":
+		return compare(left, right) > 0, nil
+	case ">=":
+		return compare(left, right) >= 0, nil
+	case "contains":
+		return contains(left, right), nil
+	case "in":
+		return contains(right, left), nil
+	case "matches":
+		re := n.re
+		if re == nil {
+			if re, err = regexp.Compile(toString(right)); err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", toString(right), err)
+			}
+		}
+		return re.MatchString(toString(left)), nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+// compare compares two values numerically if both are numbers (or numeric strings), otherwise as strings
+func compare(a, b any) int {
+	if af, ok := toNumber(a); ok {
+		if bf, ok := toNumber(b); ok {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(toString(a), toString(b))
+}
+
+// contains checks if a list contains the element, or if a string contains the substring
+func contains(container, elem any) bool {
+	switch c := container.(type) {
+	case []string:
+		for _, v := range c {
+			if compare(v, elem) == 0 {
+				return true
+			}
+		}
+		return false
+	case []any:
+		for _, v := range c {
+			if compare(v, elem) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.Contains(toString(container), toString(elem))
+}
+
+func toNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+func toString(v any) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case bool:
+		return strconv.FormatBool(s)
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case []string:
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// truthy returns the boolean meaning of a value. Empty strings, "false", "0", zero numbers and empty lists are false.
+func truthy(v any) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	case string:
+		s := strings.TrimSpace(b)
+		return s != "" && s != "0" && !strings.EqualFold(s, "false")
+	case float64:
+		return b != 0
+	case int:
+		return b != 0
+	case int64:
+		return b != 0
+	case []string:
+		return len(b) > 0
+	case []any:
+		return len(b) > 0
+	}
+	return true
+}
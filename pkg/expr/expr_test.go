@@ -0,0 +1,113 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEval(t *testing.T) {
+	vars := Vars{
+		"exit_code": 2,
+		"stdout":    "line1\nalready exists\nline3",
+		"changed":   true,
+		"tags":      []string{"web", "db"},
+		"env":       map[string]string{"ENV": "prod", "COUNT": "10"},
+		"host":      map[string]any{"name": "h1", "port": 22, "tags": []string{"db"}},
+	}
+
+	tbl := []struct {
+		name string
+		inp  string
+		res  bool
+	}{
+		{"literal true", "true", true},
+		{"literal false", "false", false},
+		{"number equal", "exit_code == 2", true},
+		{"number not equal", "exit_code != 0", true},
+		{"number less", "exit_code < 3", true},
+		{"number greater or equal", "exit_code >= 3", false},
+		{"negative number", "exit_code > -1", true},
+		{"string equal", `env.ENV == "prod"`, true},
+		{"string single quoted", `env.ENV == 'prod'`, true},
+		{"numeric string compare", "env.COUNT > 9", true},
+		{"missing key in map is empty", `env.NOPE == ""`, true},
+		{"contains substring", `stdout contains "already exists"`, true},
+		{"not contains", `!(stdout contains "error")`, true},
+		{"list contains", `tags contains "db"`, true},
+		{"nested list contains", `host.tags contains "db"`, true},
+		{"in list literal", `env.ENV in ["prod", "stage"]`, true},
+		{"in list literal miss", `env.ENV in ["dev", "stage"]`, false},
+		{"matches", `stdout matches "^line\\d"`, true},
+		{"matches op", `env.ENV =~ "^pr"`, true},
+		{"and", `exit_code != 0 && changed`, true},
+		{"or", `exit_code == 0 || env.ENV == "prod"`, true},
+		{"words", `not changed or exit_code == 2 and env.ENV == "prod"`, true},
+		{"precedence", `true || false && false`, true},
+		{"parens", `(true || false) && false`, false},
+		{"nested map number", "host.port == 22", true},
+		{"truthy string", "env.ENV", true},
+		{"falsy empty", "env.NOPE", false},
+		{"double not", "!!changed", true},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Eval(tt.inp, vars)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestEval_ShortCircuit(t *testing.T) {
+	// the right side refers to an unknown variable, but it is never evaluated
+	res, err := Eval(`false && unknown == 1`, Vars{})
+	require.NoError(t, err)
+	assert.False(t, res)
+
+	res, err = Eval(`true || unknown == 1`, Vars{})
+	require.NoError(t, err)
+	assert.True(t, res)
+}
+
+func TestEval_Errors(t *testing.T) {
+	tbl := []struct {
+		name string
+		inp  string
+		err  string
+	}{
+		{"unknown variable", "foo == 1", `can't evaluate expression "foo == 1": unknown variable "foo"`},
+		{"not a map", "exit_code.foo == 1", `can't evaluate expression "exit_code.foo == 1": can't access "foo" in "exit_code", not a map`},
+		{"unterminated string", `env.A == "abc`, `can't parse expression "env.A == \"abc": unterminated string at position 9`},
+		{"bad char", "exit_code = 1", `can't parse expression "exit_code = 1": unexpected character '=' at position 10`},
+		{"missing paren", "(true", `can't parse expression "(true": missing closing parenthesis for position 0`},
+		{"trailing token", "true false", `can't parse expression "true false": unexpected "false" at position 5`},
+		{"empty", "", `can't parse expression "": unexpected end of expression`},
+		{"bad regex", `stdout matches "("`, "can't parse expression \"stdout matches \\\"(\\\"\": invalid regex \"(\": " +
+			"error parsing regexp: missing closing ): `(`"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Eval(tt.inp, Vars{"exit_code": 1, "env": map[string]string{}, "stdout": ""})
+			require.Error(t, err)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestParse_Reuse(t *testing.T) {
+	e, err := Parse("exit_code > 1")
+	require.NoError(t, err)
+	assert.Equal(t, "exit_code > 1", e.String())
+
+	res, err := e.Eval(Vars{"exit_code": 0})
+	require.NoError(t, err)
+	assert.False(t, res)
+
+	res, err = e.Eval(Vars{"exit_code": 2})
+	require.NoError(t, err)
+	assert.True(t, res)
+}
@@ -0,0 +1,239 @@
+// Package jsonpath implements a subset of JSONPath to extract values from a decoded JSON document, for example:
+//
+//	$.items[0].metadata.name
+//	$.items[*].metadata['creation-timestamp']
+//	$..image
+//
+// Paths start with $ for the document root. Supported steps are children by name (.name, ['name'] or ["name"]),
+// array elements by index ([0], negative index counts from the end), wildcards (.* and [*]) for all elements
+// of an array or values of an object, and recursive descent (..name, ..*) for values at any depth.
+// Documents are values made by encoding/json, i.e. map[string]any, []any, string, float64 or json.Number, bool and nil.
+package jsonpath
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Path is a parsed JSONPath, ready to be applied to multiple documents
+type Path struct {
+	src   string
+	steps []step
+}
+
+type stepKind int
+
+const (
+	stepChild    stepKind = iota // child of object by name
+	stepIndex                    // element of array by index
+	stepWildcard                 // all elements of array or values of object
+	stepDescend                  // values by name at any depth, all values at any depth if name is empty
+)
+
+type step struct {
+	kind  stepKind
+	name  string
+	index int
+}
+
+// Parse parses JSONPath string and returns Path or a parsing error
+func Parse(s string) (*Path, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("can't parse path %q: must start with $", s)
+	}
+	p := &Path{src: s}
+	for pos := 1; pos < len(s); {
+		st, next, err := parseStep(s, pos)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse path %q: %w", s, err)
+		}
+		p.steps = append(p.steps, st)
+		pos = next
+	}
+	return p, nil
+}
+
+// parseStep parses a single step starting at pos, returns the step and position after it
+func parseStep(s string, pos int) (st step, next int, err error) {
+	switch {
+	case strings.HasPrefix(s[pos:], ".."):
+		name, next := readName(s, pos+2)
+		if name == "" {
+			return step{}, 0, fmt.Errorf("missing name after .. at position %d", pos)
+		}
+		if name == "*" {
+			name = ""
+		}
+		return step{kind: stepDescend, name: name}, next, nil
+	case s[pos] == '.':
+		name, next := readName(s, pos+1)
+		if name == "" {
+			return step{}, 0, fmt.Errorf("missing name after . at position %d", pos)
+		}
+		if name == "*" {
+			return step{kind: stepWildcard}, next, nil
+		}
+		return step{kind: stepChild, name: name}, next, nil
+	case s[pos] == '[' && pos+1 < len(s) && (s[pos+1] == '\'' || s[pos+1] == '"'):
+		// quoted name may contain any characters except the quote itself
+		closing := strings.IndexByte(s[pos+2:], s[pos+1])
+		if closing < 0 {
+			return step{}, 0, fmt.Errorf("missing closing quote at position %d", pos+1)
+		}
+		next := pos + 2 + closing + 1
+		if next >= len(s) || s[next] != ']' {
+			return step{}, 0, fmt.Errorf("missing ] after quoted name at position %d", next)
+		}
+		return step{kind: stepChild, name: s[pos+2 : pos+2+closing]}, next + 1, nil
+	case s[pos] == '[':
+		end := strings.IndexByte(s[pos:], ']')
+		if end < 0 {
+			return step{}, 0, fmt.Errorf("missing ] for [ at position %d", pos)
+		}
+		inner := strings.TrimSpace(s[pos+1 : pos+end])
+		if inner == "*" {
+			return step{kind: stepWildcard}, pos + end + 1, nil
+		}
+		idx, err := strconv.Atoi(inner)
+		if err != nil {
+			return step{}, 0, fmt.Errorf("invalid index %q at position %d", inner, pos)
+		}
+		return step{kind: stepIndex, index: idx}, pos + end + 1, nil
+	}
+	return step{}, 0, fmt.Errorf("unexpected %q at position %d", s[pos], pos)
+}
+
+// readName reads a name of a child, up to the next step
+func readName(s string, pos int) (name string, next int) {
+	end := pos
+	for end < len(s) && s[end] != '.' && s[end] != '[' {
+		end++
+	}
+	return s[pos:end], end
+}
+
+// String returns the source of the path
+func (p *Path) String() string { return p.src }
+
+// Multi returns true if the path may match several values, i.e. has wildcards or recursive descent
+func (p *Path) Multi() bool {
+	for _, st := range p.steps {
+		if st.kind == stepWildcard || st.kind == stepDescend {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the value matched by the path in the document. For paths with wildcards or recursive descent
+// it returns all matched values as []any, possibly empty. For other paths it returns error if nothing matched.
+func (p *Path) Get(doc any) (any, error) {
+	multi := p.Multi()
+	matched := []any{doc}
+	for i, st := range p.steps {
+		next := []any{}
+		for _, v := range matched {
+			next = append(next, st.apply(v)...)
+		}
+		if len(next) == 0 && !multi {
+			return nil, fmt.Errorf("path %q not found, no value for %s", p.src, p.describe(i))
+		}
+		matched = next
+	}
+	if multi {
+		return matched, nil
+	}
+	return matched[0], nil
+}
+
+// describe returns the part of the path up to and including step i, for error messages
+func (p *Path) describe(i int) string {
+	var sb strings.Builder
+	sb.WriteString("$")
+	for _, st := range p.steps[:i+1] {
+		switch st.kind {
+		case stepChild:
+			sb.WriteString("." + st.name)
+		case stepIndex:
+			sb.WriteString("[" + strconv.Itoa(st.index) + "]")
+		}
+	}
+	return sb.String()
+}
+
+// apply returns values matched by the step in v
+func (st step) apply(v any) []any {
+	switch st.kind {
+	case stepChild:
+		if m, ok := v.(map[string]any); ok {
+			if child, ok := m[st.name]; ok {
+				return []any{child}
+			}
+		}
+	case stepIndex:
+		if arr, ok := v.([]any); ok {
+			idx := st.index
+			if idx < 0 {
+				idx += len(arr)
+			}
+			if idx >= 0 && idx < len(arr) {
+				return []any{arr[idx]}
+			}
+		}
+	case stepWildcard:
+		return children(v)
+	case stepDescend:
+		res := []any{}
+		descend(v, func(key string, val any) {
+			if st.name == "" || key == st.name {
+				res = append(res, val)
+			}
+		})
+		return res
+	}
+	return nil
+}
+
+// children returns elements of array or values of object sorted by key, nil for other values
+func children(v any) []any {
+	switch v := v.(type) {
+	case []any:
+		return v
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		res := make([]any, 0, len(v))
+		for _, k := range keys {
+			res = append(res, v[k])
+		}
+		return res
+	}
+	return nil
+}
+
+// descend calls fn for every value nested in v, in document order with object keys sorted.
+// key is the name of the value in the parent object, empty for array elements.
+func descend(v any, fn func(key string, val any)) {
+	switch v := v.(type) {
+	case []any:
+		for _, el := range v {
+			fn("", el)
+			descend(el, fn)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			fn(k, v[k])
+			descend(v[k], fn)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPath_Get(t *testing.T) {
+	var doc any
+	err := json.Unmarshal([]byte(`{
+		"kind": "List",
+		"items": [
+			{"metadata": {"name": "web", "labels": {"app.kubernetes.io/name": "web"}}, "spec": {"image": "nginx:1.25"}},
+			{"metadata": {"name": "db"}, "spec": {"image": "postgres:16", "replicas": 1}}
+		],
+		"status": {"ready": true, "phase": null, "ips": ["10.0.0.1", "10.0.0.2"]}
+	}`), &doc)
+	require.NoError(t, err)
+
+	tbl := []struct {
+		name string
+		path string
+		res  any
+	}{
+		{"root", "$", doc},
+		{"child", "$.kind", "List"},
+		{"nested child", "$.items[0].metadata.name", "web"},
+		{"bracket child", "$['kind']", "List"},
+		{"double quoted child", `$.items[0].metadata.labels["app.kubernetes.io/name"]`, "web"},
+		{"negative index", "$.items[-1].metadata.name", "db"},
+		{"bool", "$.status.ready", true},
+		{"null", "$.status.phase", nil},
+		{"number", "$.items[1].spec.replicas", float64(1)},
+		{"object", "$.items[1].spec", map[string]any{"image": "postgres:16", "replicas": float64(1)}},
+		{"array", "$.status.ips", []any{"10.0.0.1", "10.0.0.2"}},
+		{"wildcard", "$.items[*].metadata.name", []any{"web", "db"}},
+		{"dot wildcard", "$.status.ips.*", []any{"10.0.0.1", "10.0.0.2"}},
+		{"wildcard on object sorted by key", "$.items[1].spec.*", []any{"postgres:16", float64(1)}},
+		{"recursive descent", "$..image", []any{"nginx:1.25", "postgres:16"}},
+		{"recursive descent nothing matched", "$..nope", []any{}},
+		{"wildcard nothing matched", "$.kind[*]", []any{}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse(tt.path)
+			require.NoError(t, err)
+			assert.Equal(t, tt.path, p.String())
+			res, err := p.Get(doc)
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		for path, errMsg := range map[string]string{
+			"$.nope":                   `path "$.nope" not found, no value for $.nope`,
+			"$.items[5].metadata.name": `path "$.items[5].metadata.name" not found, no value for $.items[5]`,
+			"$.items[0].metadata.nope": `path "$.items[0].metadata.nope" not found, no value for $.items[0].metadata.nope`,
+			"$.kind.name":              `path "$.kind.name" not found, no value for $.kind.name`,
+		} {
+			p, err := Parse(path)
+			require.NoError(t, err)
+			_, err = p.Get(doc)
+			assert.EqualError(t, err, errMsg)
+		}
+	})
+}
+
+func TestParse_Errors(t *testing.T) {
+	tbl := []struct {
+		path string
+		err  string
+	}{
+		{"items[0]", `can't parse path "items[0]": must start with $`},
+		{"", `can't parse path "": must start with $`},
+		{"$.", `can't parse path "$.": missing name after . at position 1`},
+		{"$..", `can't parse path "$..": missing name after .. at position 1`},
+		{"$.items[0", `can't parse path "$.items[0": missing ] for [ at position 7`},
+		{"$.items[a]", `can't parse path "$.items[a]": invalid index "a" at position 7`},
+		{"$['name", `can't parse path "$['name": missing closing quote at position 2`},
+		{"$['name'x", `can't parse path "$['name'x": missing ] after quoted name at position 8`},
+		{"$x", `can't parse path "$x": unexpected 'x' at position 1`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := Parse(tt.path)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestPath_Multi(t *testing.T) {
+	for path, multi := range map[string]bool{"$.a.b[0]": false, "$.a[*]": true, "$.a.*": true, "$..a": true, "$": false} {
+		p, err := Parse(path)
+		require.NoError(t, err)
+		assert.Equal(t, multi, p.Multi(), path)
+	}
+}
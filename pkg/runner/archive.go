@@ -0,0 +1,444 @@
+package runner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/umputun/spot/pkg/executor"
+)
+
+// extractAndSync extracts the local archive to the local directory and syncs it to the remote destination.
+// Symbolic links from the archive are created on the remote host after the sync. Returns true if anything changed.
+func (ec *execCmd) extractAndSync(ctx context.Context, archive, localDir, dst string, strip int, exclude []string) (bool, error) {
+	links, err := extractArchive(archive, localDir, strip)
+	if err != nil {
+		return false, ec.errorFmt("can't extract archive %s: %w", archive, err)
+	}
+	synced, err := ec.syncDir(ctx, localDir, dst, exclude)
+	if err != nil {
+		return false, err
+	}
+	linked, err := ec.makeLinks(ctx, dst, links, exclude)
+	if err != nil {
+		return false, err
+	}
+	return synced || linked, nil
+}
+
+// unarchiveRemote extracts the archive already on the remote host with the script made by unarchiveScript.
+// Returns true if the destination was changed.
+func (ec *execCmd) unarchiveRemote(ctx context.Context, src, dst string) (bool, error) {
+	script, err := unarchiveScript(src, dst, ec.uniqueTmp(tmpRemoteDirPrefix), ec.cmd.Unarchive.StripComponents,
+		ec.cmd.Unarchive.Exclude)
+	if err != nil {
+		return false, ec.errorFmt("can't extract archive %s: %w", src, err)
+	}
+	c, _, teardown, err := ec.prepScript(ctx, "", strings.NewReader(script))
+	if err != nil {
+		return false, ec.errorFmt("can't prepare unarchive script on %s: %w", ec.hostAddr, err)
+	}
+	defer func() {
+		if tErr := teardown(); tErr != nil {
+			log.Printf("[WARN] can't teardown unarchive script on %s: %v", ec.hostAddr, tErr)
+		}
+	}()
+	if ec.cmd.Options.Sudo {
+		c = ec.wrapWithSudo(c)
+	}
+	out, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose})
+	if err != nil {
+		return false, ec.errorFmt("can't extract archive %s to %s on %s: %w", src, dst, ec.hostAddr, err)
+	}
+	return slices.Contains(out, "spot-unarchive-changed"), nil
+}
+
+// unarchiveScript makes the shell script extracting the remote archive with tar or unzip to the stage directory,
+// stripping leading path components and removing excluded paths. The result is copied to the destination only
+// if any of the extracted files, links or directories differs from it, and spot-unarchive-changed line is printed.
+// Exclude patterns are shell globs matched against paths after stripping.
+func unarchiveScript(archive, dst, stage string, strip int, exclude []string) (string, error) {
+	lines := []string{
+		"set -e",
+		"archive=" + shellQuote(archive),
+		"dest=" + shellQuote(dst),
+		"stage=" + shellQuote(stage),
+		`trap 'rm -rf "$stage"' EXIT`,
+		`mkdir -p -m 700 "$stage/raw"`,
+	}
+	// -o extracts files owned by the user running the script, not by the owner stored in the archive
+	switch archiveFormat(archive) {
+	case "tar":
+		lines = append(lines, `tar -x -o -f "$archive" -C "$stage/raw"`)
+	case "tar.gz":
+		lines = append(lines, `tar -x -o -z -f "$archive" -C "$stage/raw"`)
+	case "tar.zst":
+		lines = append(lines, `zstd -d -c -q "$archive" > "$stage/archive.tar"`, `tar -x -o -f "$stage/archive.tar" -C "$stage/raw"`)
+	case "zip":
+		lines = append(lines, `unzip -q -o "$archive" -d "$stage/raw"`)
+	default:
+		return "", fmt.Errorf("unsupported archive format of %s, must be tar, tar.gz, tar.zst or zip", archive)
+	}
+
+	lines = append(lines, `out="$stage/raw"`)
+	if strip > 0 {
+		// content of directories at the strip depth is merged, entries above it are dropped as tar does
+		lines = append(lines,
+			`mkdir -p "$stage/out"`,
+			fmt.Sprintf(`find "$stage/raw" -mindepth %d -maxdepth %d -type d | while IFS= read -r d; do`, strip, strip),
+			`  cp -a "$d/." "$stage/out/" || exit 1`,
+			`done`,
+			`out="$stage/out"`,
+		)
+	}
+	if len(exclude) > 0 {
+		globs := make([]string, 0, len(exclude))
+		for _, ex := range exclude {
+			globs = append(globs, shellGlob(ex))
+		}
+		lines = append(lines, fmt.Sprintf(`(cd "$out" && rm -rf -- %s)`, strings.Join(globs, " ")))
+	}
+
+	lines = append(lines,
+		`changed=$(cd "$out" && find . | while IFS= read -r f; do`,
+		`  if [ -L "$f" ]; then`,
+		`    [ -L "$dest/$f" ] && [ "$(readlink "$f")" = "$(readlink "$dest/$f")" ] || { echo 1; break; }`,
+		`  elif [ -d "$f" ]; then`,
+		`    [ -d "$dest/$f" ] || { echo 1; break; }`,
+		`  else`,
+		`    cmp -s "$f" "$dest/$f" || { echo 1; break; }`,
+		`  fi`,
+		`done)`,
+		`if [ -n "$changed" ]; then`,
+		`  mkdir -p "$dest"`,
+		`  cp -a "$out/." "$dest/"`,
+		`  echo spot-unarchive-changed`,
+		`fi`,
+	)
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// shellGlob quotes the glob pattern for the shell, keeping *, ? and [...] unquoted for the expansion
+func shellGlob(pattern string) string {
+	var sb strings.Builder
+	for _, r := range pattern {
+		if strings.ContainsRune("*?[]", r) {
+			sb.WriteRune(r)
+			continue
+		}
+		sb.WriteString(shellQuote(string(r)))
+	}
+	return sb.String()
+}
+
+// archiveLink is a symbolic link from the archive, created on the remote host after the files are synced
+type archiveLink struct {
+	path   string // slash separated path relative to the destination, after stripping
+	target string // link target, relative to the directory of the link
+}
+
+// makeLinks creates symbolic links from the archive in the remote destination. Links matching exclude patterns
+// are skipped the same way as sync skips files, links with the same target are kept. Returns true if any link
+// was (or would be) created.
+func (ec *execCmd) makeLinks(ctx context.Context, dst string, links []archiveLink, exclude []string) (bool, error) {
+	lines := []string{
+		"set -e",
+		`link() {`,
+		`  [ "$(readlink "$1")" = "$2" ] && return 0`,
+		`  mkdir -p "$(dirname "$1")"`,
+		`  rm -f "$1"`,
+		`  ln -s "$2" "$1"`,
+		`  echo spot-link-changed`,
+		`}`,
+	}
+	count := 0
+	for _, l := range links {
+		if excludedPath(l.path, exclude) {
+			continue
+		}
+		// not using filepath.Join because we want to keep the linux slash
+		lines = append(lines, fmt.Sprintf("link %s %s", shellQuote(strings.TrimSuffix(dst, "/")+"/"+l.path), shellQuote(l.target)))
+		count++
+	}
+	if count == 0 {
+		return false, nil
+	}
+	out, err := ec.exec.Run(ctx, ec.shellCmd(strings.Join(lines, "\n")), &executor.RunOpts{Verbose: ec.verbose})
+	if err != nil {
+		return false, ec.errorFmt("can't create links in %s on %s: %w", dst, ec.hostAddr, err)
+	}
+	return isDry(ec.exec) || slices.Contains(out, "spot-link-changed"), nil
+}
+
+// excludedPath checks if the slash separated path or any of its parent directories matches one of the exclude
+// patterns, the same way sync matches excluded files
+func excludedPath(p string, exclude []string) bool {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+		for _, ex := range exclude {
+			if match, err := path.Match(ex, sub); err == nil && match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// archiveFormat returns the format of the archive detected by the file extension, empty for unsupported ones
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar.zst") || strings.HasSuffix(name, ".tzst"):
+		return "tar.zst"
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// extractArchive extracts tar, tar.gz, tar.zst or zip archive to the local directory, detecting the format by
+// the file extension. Leading path components are stripped from all entries, modes and modification times are kept.
+// Hard links are extracted as files. Symbolic links are not written to the directory but returned, to be created
+// on the remote host, and links pointing outside the directory are rejected. Other special files are rejected too.
+func extractArchive(archive, dir string, strip int) ([]archiveLink, error) {
+	format := archiveFormat(archive)
+	if format == "zip" {
+		return extractZip(archive, dir, strip)
+	}
+
+	fh, err := os.Open(archive) // nolint
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close() // nolint ro file
+
+	var rd io.Reader
+	switch format {
+	case "tar":
+		rd = fh
+	case "tar.gz":
+		gz, e := gzip.NewReader(fh)
+		if e != nil {
+			return nil, e
+		}
+		defer gz.Close() // nolint
+		rd = gz
+	case "tar.zst":
+		zr, e := zstd.NewReader(fh)
+		if e != nil {
+			return nil, e
+		}
+		defer zr.Close()
+		rd = zr
+	default:
+		return nil, fmt.Errorf("unsupported archive format of %s, must be tar, tar.gz, tar.zst or zip", archive)
+	}
+
+	links := []archiveLink{}
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractEntry(dir, hdr.Name, strip, hdr.FileInfo().Mode(), hdr.ModTime, nil)
+		case tar.TypeReg:
+			err = extractEntry(dir, hdr.Name, strip, hdr.FileInfo().Mode(), hdr.ModTime, tr)
+		case tar.TypeLink:
+			err = extractHardLink(dir, hdr.Name, hdr.Linkname, strip)
+		case tar.TypeSymlink:
+			var link archiveLink
+			var ok bool
+			if link, ok, err = symlinkEntry(hdr.Name, hdr.Linkname, strip); ok {
+				links = append(links, link)
+			}
+		case tar.TypeXGlobalHeader:
+			continue // pax global header, not a file
+		default:
+			err = fmt.Errorf("unsupported entry %q of type %q in archive", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return links, os.MkdirAll(dir, 0o750) // empty archive extracts to an empty directory
+}
+
+// isArchive checks if the file name has one of the archive extensions supported by extractArchive
+func isArchive(name string) bool {
+	return archiveFormat(name) != ""
+}
+
+// extractZip extracts zip archive to the local directory, see extractArchive
+func extractZip(archive, dir string, strip int) ([]archiveLink, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close() // nolint ro file
+
+	links := []archiveLink{}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			if err := extractEntry(dir, f.Name, strip, mode, f.Modified, nil); err != nil {
+				return nil, err
+			}
+			continue
+		case mode&os.ModeSymlink != 0:
+			target, err := readZipEntry(f)
+			if err != nil {
+				return nil, err
+			}
+			link, ok, err := symlinkEntry(f.Name, string(target), strip)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				links = append(links, link)
+			}
+			continue
+		case !mode.IsRegular():
+			return nil, fmt.Errorf("unsupported entry %q of mode %s in archive", f.Name, mode)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = extractEntry(dir, f.Name, strip, mode, f.Modified, rc)
+		rc.Close() // nolint ro file
+		if err != nil {
+			return nil, err
+		}
+	}
+	return links, os.MkdirAll(dir, 0o750) // empty archive extracts to an empty directory
+}
+
+// readZipEntry reads the content of a small zip entry, i.e. the target of a link
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close() // nolint ro file
+	return io.ReadAll(io.LimitReader(rc, 4096))
+}
+
+// entryPath returns the slash separated path of the archive entry with strip leading components removed.
+// Returns false if all components are stripped, rejects paths pointing outside the directory.
+func entryPath(name string, strip int) (string, bool, error) {
+	parts := []string{}
+	for p := range strings.SplitSeq(filepath.ToSlash(name), "/") {
+		switch p {
+		case "", ".":
+			continue
+		case "..":
+			return "", false, fmt.Errorf("invalid path %q in archive", name)
+		}
+		parts = append(parts, p)
+	}
+	if len(parts) <= strip {
+		return "", false, nil
+	}
+	return strings.Join(parts[strip:], "/"), true, nil
+}
+
+// symlinkEntry makes the link of the archive entry. Returns false if the entry is stripped completely,
+// rejects absolute targets and targets pointing outside the directory.
+func symlinkEntry(name, target string, strip int) (archiveLink, bool, error) {
+	p, ok, err := entryPath(name, strip)
+	if err != nil || !ok {
+		return archiveLink{}, false, err
+	}
+	resolved := path.Join(path.Dir(p), filepath.ToSlash(target))
+	if path.IsAbs(target) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return archiveLink{}, false, fmt.Errorf("link %q in archive points outside of the destination to %q", name, target)
+	}
+	return archiveLink{path: p, target: target}, true, nil
+}
+
+// extractHardLink extracts the hard link entry as a link to the file extracted before, so it is synced as a file
+func extractHardLink(dir, name, target string, strip int) error {
+	p, ok, err := entryPath(name, strip)
+	if err != nil || !ok {
+		return err
+	}
+	t, ok, err := entryPath(target, strip)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("hard link %q in archive points to stripped %q", name, target)
+	}
+	dst, src := filepath.Join(dir, filepath.FromSlash(p)), filepath.Join(dir, filepath.FromSlash(t))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return err
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err != nil {
+		return fmt.Errorf("can't extract hard link %q in archive: %w", name, err)
+	}
+	return nil
+}
+
+// extractEntry writes a single archive entry to the local directory. Directory entries have nil reader.
+// Entries with all components stripped are skipped, entries pointing outside the directory are rejected.
+func extractEntry(dir, name string, strip int, mode os.FileMode, mtime time.Time, rd io.Reader) error {
+	p, ok, err := entryPath(name, strip)
+	if err != nil || !ok {
+		return err
+	}
+	target := filepath.Join(dir, filepath.FromSlash(p))
+
+	if rd == nil {
+		if err := os.MkdirAll(target, 0o750); err != nil {
+			return err
+		}
+		return os.Chmod(target, mode.Perm()|0o700) // keep the directory accessible for the sync
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600) // nolint
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, rd); err != nil { // nolint gosec, archive is provided by the playbook author
+		fh.Close() // nolint
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, mode.Perm()|0o400); err != nil { // keep the file readable for the sync
+		return err
+	}
+	return os.Chtimes(target, mtime, mtime)
+}
@@ -0,0 +1,54 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_isArchive(t *testing.T) {
+	for name, expected := range map[string]bool{"app.tar": true, "app.tar.gz": true, "APP.TGZ": true, "app.tar.zst": true,
+		"app.tzst": true, "app.zip": true, "dist": false, "app.gz": false, "app.tar/dist": false} {
+		assert.Equal(t, expected, isArchive(name), name)
+	}
+}
+
+func Test_entryPath(t *testing.T) {
+	tbl := []struct {
+		name  string
+		strip int
+		path  string
+		ok    bool
+		err   string
+	}{
+		{"app/bin/run", 0, "app/bin/run", true, ""},
+		{"./app/bin/run", 1, "bin/run", true, ""},
+		{"app/", 1, "", false, ""},
+		{"app/../../etc/passwd", 0, "", false, `invalid path "app/../../etc/passwd" in archive`},
+	}
+	for _, tt := range tbl {
+		p, ok, err := entryPath(tt.name, tt.strip)
+		if tt.err != "" {
+			require.EqualError(t, err, tt.err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.path, p, tt.name)
+		assert.Equal(t, tt.ok, ok, tt.name)
+	}
+}
+
+func Test_excludedPath(t *testing.T) {
+	exclude := []string{"*.log", "cache", "docs/*.md"}
+	assert.True(t, excludedPath("app.log", exclude))
+	assert.True(t, excludedPath("cache/data/f.bin", exclude), "parent directory excluded")
+	assert.True(t, excludedPath("docs/readme.md", exclude))
+	assert.False(t, excludedPath("docs/img/logo.png", exclude))
+	assert.False(t, excludedPath("app/bin", exclude))
+}
+
+func Test_shellGlob(t *testing.T) {
+	assert.Equal(t, `'d''i''r'' ''a''/'*'.''l''o''g'`, shellGlob("dir a/*.log"))
+	assert.Equal(t, `'f'?['a''b']`, shellGlob("f?[ab]"))
+}
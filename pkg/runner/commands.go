@@ -4,21 +4,31 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math"
 	mr "math/rand"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/umputun/spot/pkg/config"
 	"github.com/umputun/spot/pkg/executor"
+	"github.com/umputun/spot/pkg/expr"
+	"github.com/umputun/spot/pkg/jsonpath"
 )
 
 // execCmd is a single command execution on a target host. It prepares the command, executes it and returns details.
@@ -27,6 +37,8 @@ type execCmd struct {
 	cmd       config.Cmd
 	hostAddr  string
 	hostName  string
+	hostTags  []string          // inventory tags of the host
+	hostVars  map[string]string // vars of the host, merged with group and target vars
 	tsk       *config.Task
 	exec      executor.Interface
 	verbose   bool
@@ -34,6 +46,8 @@ type execCmd struct {
 	sshShell  string
 	sshTmpDir string
 	onExit    string
+	checker   executor.Interface // real executor for read-only checks, i.e. conditions, set in check mode only
+	rollback  bool               // release commands roll back to the previous release instead of deploying
 }
 
 type execCmdResp struct {
@@ -42,6 +56,32 @@ type execCmdResp struct {
 	vars       map[string]string
 	onExit     execCmd
 	registered map[string]string
+	status     cmdStatus
+	stdout     []string // script output, without setvar lines
+	exitCode   int      // exit code of the failed script, 0 on success and -1 if not known
+}
+
+// cmdStatus is the outcome of a command execution on a host
+type cmdStatus int
+
+const (
+	cmdOk      cmdStatus = iota // command completed without changing anything
+	cmdChanged                  // command completed and changed something on the host
+	cmdSkipped                  // command skipped by condition
+	cmdFailed                   // command failed, but errors are ignored
+)
+
+func (s cmdStatus) String() string {
+	switch s {
+	case cmdChanged:
+		return "changed"
+	case cmdSkipped:
+		return "skipped"
+	case cmdFailed:
+		return "failed"
+	default:
+		return "ok"
+	}
 }
 
 type execCmdErr struct {
@@ -64,6 +104,7 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 	}
 	if !cond {
 		resp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
+		resp.status = cmdSkipped
 		return resp, nil
 	}
 
@@ -116,9 +157,16 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 	resp.verbose = scr
 
 	out, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose})
+	for _, line := range out {
+		if !strings.HasPrefix(line, "setvar ") {
+			resp.stdout = append(resp.stdout, line)
+		}
+	}
 	if err != nil {
+		resp.exitCode = executor.ExitCode(err)
 		return resp, ec.errorFmt("can't run script on %s: %w", ec.hostAddr, err)
 	}
+	resp.status = cmdChanged // scripts can do anything, reported as changed unless changed_when says otherwise
 
 	// collect setvar output to vars and latter it will be set to the environment. This is needed for the next commands.
 	// setenv output is in the format of "setenv foo=bar" and it is appended to the output by the script itself.
@@ -166,9 +214,77 @@ func (ec *execCmd) Script(ctx context.Context) (resp execCmdResp, err error) {
 		}
 	}
 
+	// register_json extracts values from json output, nothing to parse in dry run as the script is not executed
+	if len(ec.cmd.RegisterJSON) > 0 && !isDry(ec.exec) {
+		vars, err := registerJSON(ec.cmd.RegisterJSON, resp.stdout, tmpl)
+		if err != nil {
+			return resp, ec.errorFmt("can't register json output of %q on %s: %w", ec.cmd.Name, ec.hostAddr, err)
+		}
+		maps.Copy(resp.vars, vars)
+		maps.Copy(resp.registered, vars)
+	}
+
 	return resp, nil
 }
 
+// registerJSON parses script output as json and extracts variables by paths. Variable names may be templated.
+// Strings are set as is, numbers, booleans and null (as empty string) in their json form, and nested objects
+// and arrays, including all values matched by wildcards, as json strings.
+func registerJSON(paths map[string]string, stdout []string, tmpl templater) (map[string]string, error) {
+	out := strings.TrimSpace(strings.Join(stdout, "\n"))
+	if out == "" {
+		return nil, fmt.Errorf("output is empty, expected json")
+	}
+	dec := json.NewDecoder(strings.NewReader(out))
+	dec.UseNumber() // keep numbers as they are in the output, i.e. large ids
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("output is not valid json: %w", err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("output is not valid json: unexpected data after json value at offset %d", dec.InputOffset())
+	}
+
+	res := make(map[string]string, len(paths))
+	for name, jp := range paths {
+		p, err := jsonpath.Parse(jp)
+		if err != nil {
+			return nil, err
+		}
+		v, err := p.Get(doc)
+		if err != nil {
+			return nil, err
+		}
+		val, err := jsonString(v)
+		if err != nil {
+			return nil, fmt.Errorf("can't encode value of %s: %w", jp, err)
+		}
+		res[tmpl.apply(name)] = val
+	}
+	return res, nil
+}
+
+// jsonString returns value decoded from json as a variable value, scalars as is and others as json
+func jsonString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
 // Copy uploads a single file or multiple files (if wildcard is used) to a target host.
 // if sudo option is set, it will make a temporary directory and upload the files there,
 // then move it to the final destination with sudo script execution.
@@ -208,8 +324,22 @@ func (ec *execCmd) Copy(ctx context.Context) (resp execCmdResp, err error) {
 	return ec.copyPush(ctx, src, dst)
 }
 
-// copyPush uploads files from local machine to remote host
+// copyPush uploads files from local machine to remote host.
+// Destination files are stat-ed before and after the upload to detect if anything changed.
 func (ec *execCmd) copyPush(ctx context.Context, src, dst string) (resp execCmdResp, err error) {
+	dstFiles := pushDestinations(src, dst)
+	remoteStat := func(f string) (os.FileInfo, error) { return ec.exec.Stat(ctx, f) }
+	before, beforeOk := filesStamp(dstFiles, remoteStat)
+	defer func() {
+		if err != nil {
+			return
+		}
+		after, afterOk := filesStamp(dstFiles, remoteStat)
+		if !beforeOk || !afterOk || before != after {
+			resp.status = cmdChanged
+		}
+	}()
+
 	if !ec.cmd.Options.Sudo {
 		// if sudo is not set, we can use the original destination and upload the file directly
 		resp.details = fmt.Sprintf(" {copy: %s -> %s}", src, dst)
@@ -232,8 +362,13 @@ func (ec *execCmd) copyPush(ctx context.Context, src, dst string) (resp execCmdR
 	// not using filepath.Join because we want to keep the linux slash, see https://github.com/umputun/spot/issues/144
 	tmpDest := tmpRemoteDir + "/" + filepath.Base(dst)
 
-	// upload to a temporary directory with mkdir
-	err = ec.exec.Upload(ctx, src, tmpDest, &executor.UpDownOpts{Mkdir: true, Force: true, Exclude: ec.cmd.Copy.Exclude})
+	// upload to a temporary directory with mkdir. Dry run shows the diff against the final destination instead,
+	// as the temporary one doesn't exist.
+	uploadDest := tmpDest
+	if isDry(ec.exec) {
+		uploadDest = dst
+	}
+	err = ec.exec.Upload(ctx, src, uploadDest, &executor.UpDownOpts{Mkdir: true, Force: true, Exclude: ec.cmd.Copy.Exclude})
 	if err != nil {
 		return resp, ec.errorFmt("can't copy file to %s: %w", ec.hostAddr, err)
 	}
@@ -275,8 +410,21 @@ func (ec *execCmd) copyPush(ctx context.Context, src, dst string) (resp execCmdR
 	return resp, nil
 }
 
-// copyPull downloads files from remote host to local machine
+// copyPull downloads files from remote host to local machine.
+// Local destination files are stat-ed before and after the download to detect if anything changed.
 func (ec *execCmd) copyPull(ctx context.Context, src, dst string) (resp execCmdResp, err error) {
+	dstFiles := pullDestinations(src, dst)
+	before, beforeOk := filesStamp(dstFiles, os.Stat)
+	defer func() {
+		if err != nil {
+			return
+		}
+		after, afterOk := filesStamp(pullDestinations(src, dst), os.Stat)
+		if !beforeOk || !afterOk || before != after {
+			resp.status = cmdChanged
+		}
+	}()
+
 	if !ec.cmd.Options.Sudo {
 		// direct download without sudo
 		resp.details = fmt.Sprintf(" {copy: %s <- %s, direction: pull}", dst, src)
@@ -347,238 +495,1478 @@ func (ec *execCmd) copyPull(ctx context.Context, src, dst string) (resp execCmdR
 	return resp, nil
 }
 
-// Mcopy uploads or downloads multiple files to/from a target host. It calls copy function for each file.
-func (ec *execCmd) Mcopy(ctx context.Context) (resp execCmdResp, err error) {
-	msgs := []string{}
+// Template renders a local go template file and uploads the result to a target host the same way copy does.
+// The template gets environment and registered variables and SPOT_* values as top-level fields, secrets as .Secrets
+// and the inventory host as .Host. The file is uploaded only if the rendered content differs from the remote one.
+// Optional mode and owner are applied to the destination file.
+func (ec *execCmd) Template(ctx context.Context) (resp execCmdResp, err error) {
 	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
-	for _, c := range ec.cmd.MCopy {
-		src := tmpl.apply(c.Source)
-		dst := tmpl.apply(c.Dest)
-		arrow := "->"
-		if c.Direction == "pull" {
-			arrow = "<-"
+	src := tmpl.apply(ec.cmd.Template.Source)
+	dst := tmpl.apply(ec.cmd.Template.Dest)
+	resp.details = fmt.Sprintf(" {template: %s -> %s}", src, dst)
+
+	rendered, err := ec.renderTemplate(src, ec.templateData(tmpl))
+	if err != nil {
+		return resp, ec.errorFmt("can't render template %s: %w", src, err)
+	}
+
+	var mode os.FileMode
+	if ec.cmd.Template.Mode != "" {
+		m, e := strconv.ParseUint(ec.cmd.Template.Mode, 8, 32)
+		if e != nil {
+			return resp, ec.errorFmt("invalid template mode %q: %w", ec.cmd.Template.Mode, e)
 		}
-		msgs = append(msgs, fmt.Sprintf("%s %s %s", src, arrow, dst))
-		ecSingle := ec
-		ecSingle.cmd.Copy = config.CopyInternal{Source: src, Dest: dst, Direction: c.Direction, Mkdir: c.Mkdir,
-			Force: c.Force, ChmodX: c.ChmodX, Exclude: c.Exclude}
-		if _, err := ecSingle.Copy(ctx); err != nil {
-			return resp, ec.errorFmt("can't copy file to %s: %w", ec.hostAddr, err)
+		mode = os.FileMode(m)
+	}
+
+	dstInfo, statErr := ec.exec.Stat(ctx, dst)
+	if !ec.sameContent(ctx, dst, dstInfo, statErr, rendered) {
+		perm := os.FileMode(0o644) // new files are created readable by everyone, as with the default umask
+		switch {
+		case mode != 0:
+			perm = mode
+		case statErr == nil:
+			perm = dstInfo.Mode().Perm() // keep the mode of the existing file
+		}
+		cpResp, e := ec.uploadContent(ctx, dst, rendered, perm)
+		if e != nil {
+			return resp, e
 		}
+		resp.status = cpResp.status
+		dstInfo, statErr = ec.exec.Stat(ctx, dst)
 	}
-	resp.details = fmt.Sprintf(" {copy: %s}", strings.Join(msgs, ", "))
-	return resp, nil
-}
 
-// Sync synchronizes files from a source to a destination on a target host.
-func (ec *execCmd) Sync(ctx context.Context) (resp execCmdResp, err error) {
-	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
-	src := tmpl.apply(ec.cmd.Sync.Source)
-	dst := tmpl.apply(ec.cmd.Sync.Dest)
-	resp.details = fmt.Sprintf(" {sync: %s -> %s}", src, dst)
-	opts := &executor.SyncOpts{Delete: ec.cmd.Sync.Delete, Exclude: ec.cmd.Sync.Exclude}
-	if _, err := ec.exec.Sync(ctx, src, dst, opts); err != nil {
-		return resp, ec.errorFmt("can't sync files on %s: %w", ec.hostAddr, err)
+	if mode != 0 && (statErr != nil || dstInfo.Mode().Perm() != mode) && !(isDry(ec.exec) && os.IsNotExist(statErr)) {
+		chmodCmd := ec.wrapWithSudo(fmt.Sprintf("chmod %04o %s", mode, shellQuote(dst)))
+		if _, e := ec.exec.Run(ctx, chmodCmd, &executor.RunOpts{Verbose: ec.verbose}); e != nil {
+			return resp, ec.errorFmt("can't chmod %s on %s: %w", dst, ec.hostAddr, e)
+		}
+		resp.status = cmdChanged
 	}
-	return resp, nil
-}
 
-// Msync synchronizes multiple locations from a source to a destination on a target host.
-func (ec *execCmd) Msync(ctx context.Context) (resp execCmdResp, err error) {
-	msgs := []string{}
-	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
-	for _, c := range ec.cmd.MSync {
-		src := tmpl.apply(c.Source)
-		dst := tmpl.apply(c.Dest)
-		msgs = append(msgs, fmt.Sprintf("%s -> %s", src, dst))
-		ecSingle := ec
-		ecSingle.cmd.Sync = config.SyncInternal{Source: src, Dest: dst, Exclude: c.Exclude, Delete: c.Delete}
-		if _, err := ecSingle.Sync(ctx); err != nil {
-			return resp, ec.errorFmt("can't sync %s to %s %s: %w", src, ec.hostAddr, dst, err)
+	if owner := tmpl.apply(ec.cmd.Template.Owner); owner != "" {
+		changed, e := ec.chown(ctx, dst, owner, false)
+		if e != nil {
+			return resp, e
+		}
+		if changed {
+			resp.status = cmdChanged
 		}
 	}
-	resp.details = fmt.Sprintf(" {sync: %s}", strings.Join(msgs, ", "))
 	return resp, nil
 }
 
-// checkDeleteExclude validates the exclude option against the other delete flags for the given location.
-// Exclude requires a recursive delete (it filters directory contents) and cannot be combined with sudo,
-// as sudo deletion runs a plain rm that cannot apply exclusion patterns. Returns an error naming the
-// offending location, or nil if the combination is valid.
-func (ec *execCmd) checkDeleteExclude(loc string, del config.DeleteInternal) error {
-	if len(del.Exclude) == 0 {
-		return nil
+// renderTemplate renders local go template file with the given data. Missing fields are reported as errors.
+func (ec *execCmd) renderTemplate(src string, data map[string]any) ([]byte, error) {
+	body, err := os.ReadFile(src) // nolint
+	if err != nil {
+		return nil, err
 	}
-	if !del.Recursive {
-		return ec.errorFmt("delete with exclude requires recursive delete (recur: true) for %q", loc)
+	t, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(body))
+	if err != nil {
+		return nil, err
 	}
-	if ec.cmd.Options.Sudo {
-		return ec.errorFmt("delete with exclude is not supported with sudo for %q", loc)
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
 	}
-	return nil
+	return buf.Bytes(), nil
 }
 
-// Delete deletes files on a target host. If sudo option is set, it will execute a sudo rm commands.
-func (ec *execCmd) Delete(ctx context.Context) (resp execCmdResp, err error) {
-	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
-	loc := tmpl.apply(ec.cmd.Delete.Location)
-
-	if e := ec.checkDeleteExclude(loc, ec.cmd.Delete); e != nil {
-		return resp, e
+// templateData makes data for the template command. Environment and registered variables are already
+// in the command environment, SPOT_* values are the same as used by templater.
+func (ec *execCmd) templateData(tmpl templater) map[string]any {
+	data := make(map[string]any, len(ec.cmd.Environment)+10)
+	for k, v := range ec.cmd.Environment {
+		data[k] = strings.TrimPrefix(v, "__SQ__:")
+	}
+	for k, v := range tmpl.spotVars() {
+		data[k] = v
 	}
 
-	if !ec.cmd.Options.Sudo {
-		// if sudo is not set, we can delete the file directly
-		opts := &executor.DeleteOpts{Recursive: ec.cmd.Delete.Recursive, Exclude: ec.cmd.Delete.Exclude}
-		if err := ec.exec.Delete(ctx, loc, opts); err != nil {
-			return resp, ec.errorFmt("can't delete files on %s: %w", ec.hostAddr, err)
-		}
-		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v}", loc, ec.cmd.Delete.Recursive)
+	secrets := make(map[string]string, len(ec.cmd.Secrets))
+	maps.Copy(secrets, ec.cmd.Secrets)
+	data["Secrets"] = secrets
+
+	host, port := ec.hostAddr, "22"
+	if h, p, err := net.SplitHostPort(ec.hostAddr); err == nil {
+		host, port = h, p
 	}
+	data["Host"] = map[string]any{"Name": ec.hostName, "Host": host, "Port": port, "User": ec.tsk.User, "Tags": ec.hostTags,
+		"Vars": ec.hostVars}
+	return data
+}
 
-	if ec.cmd.Options.Sudo {
-		// if sudo is set, we need to delete the file using sudo by ssh-ing into the host and running the command
-		cmd := fmt.Sprintf("rm -f %s", loc)
-		if ec.cmd.Delete.Recursive {
-			cmd = fmt.Sprintf("rm -rf %s", loc)
+// renderGoTemplates renders go templates in script, copy, sync, line, echo and wait fields of the command, with the
+// same data as the template command gets. Templates are named after task, command and field, so parse and execution
+// errors point at them, with the line number inside the field.
+func (ec *execCmd) renderGoTemplates(tmpl templater) error {
+	data := ec.templateData(tmpl)
+	funcs := ec.templateFuncs()
+	render := func(field string, s *string) error {
+		if !strings.Contains(*s, "{{") {
+			return nil
 		}
-		cmd = ec.wrapWithSudo(cmd)
-		if _, err := ec.exec.Run(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
-			return resp, ec.errorFmt("can't delete file(s) on %s: %w", ec.hostAddr, err)
+		name := fmt.Sprintf("task %q, command %q, %s", ec.tsk.Name, ec.cmd.Name, field)
+		t, err := template.New(name).Option("missingkey=error").Funcs(funcs).Parse(*s)
+		if err != nil {
+			return err
 		}
-		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v, sudo: true}", loc, ec.cmd.Delete.Recursive)
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return err
+		}
+		*s = buf.String()
+		return nil
 	}
 
-	return resp, nil
+	// slices are shared with the task and other hosts, render copies of them
+	ec.cmd.MCopy, ec.cmd.MSync = slices.Clone(ec.cmd.MCopy), slices.Clone(ec.cmd.MSync)
+	type field struct {
+		name string
+		val  *string
+	}
+	fields := []field{
+		{"script", &ec.cmd.Script}, {"echo", &ec.cmd.Echo},
+		{"copy.src", &ec.cmd.Copy.Source}, {"copy.dst", &ec.cmd.Copy.Dest},
+		{"sync.src", &ec.cmd.Sync.Source}, {"sync.dst", &ec.cmd.Sync.Dest},
+		{"line.file", &ec.cmd.Line.File}, {"line.match", &ec.cmd.Line.Match}, {"line.replace", &ec.cmd.Line.Replace},
+		{"line.append", &ec.cmd.Line.Append}, {"line.insert_after", &ec.cmd.Line.InsertAfter},
+		{"line.insert_before", &ec.cmd.Line.InsertBefore},
+		{"wait.cmd", &ec.cmd.Wait.Command}, {"wait.http.url", &ec.cmd.Wait.HTTP.URL}, {"wait.tcp", &ec.cmd.Wait.TCP},
+	}
+	for i := range ec.cmd.MCopy {
+		fields = append(fields, field{fmt.Sprintf("mcopy[%d].src", i), &ec.cmd.MCopy[i].Source},
+			field{fmt.Sprintf("mcopy[%d].dst", i), &ec.cmd.MCopy[i].Dest})
+	}
+	for i := range ec.cmd.MSync {
+		fields = append(fields, field{fmt.Sprintf("msync[%d].src", i), &ec.cmd.MSync[i].Source},
+			field{fmt.Sprintf("msync[%d].dst", i), &ec.cmd.MSync[i].Dest})
+	}
+	for _, f := range fields {
+		if err := render(f.name, f.val); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// MDelete deletes multiple locations on a target host.
-func (ec *execCmd) MDelete(ctx context.Context) (resp execCmdResp, err error) {
-	msgs := []string{}
-	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+// templateFuncs returns helper functions for go templates of command fields
+func (ec *execCmd) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		// default returns def if the value is empty, i.e. {{ env "PORT" | default "8080" }}
+		"default": func(def string, val any) any {
+			if val == nil || val == "" {
+				return def
+			}
+			return val
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"join":  func(sep string, items []string) string { return strings.Join(items, sep) },
+		"split": func(sep, s string) []string { return strings.Split(s, sep) },
+		// env returns the variable from the command environment, empty if not set
+		"env": func(name string) string { return strings.TrimPrefix(ec.cmd.Environment[name], "__SQ__:") },
+		"secret": func(key string) (string, error) {
+			v, ok := ec.cmd.Secrets[key]
+			if !ok {
+				return "", fmt.Errorf("secret %q not loaded", key)
+			}
+			return v, nil
+		},
+		"toJSON": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		// hostVar returns the variable of the host, empty if not set
+		"hostVar": func(name string) string { return ec.hostVars[name] },
+	}
+}
 
-	// validate all locations upfront, before any of them is deleted
-	for _, c := range ec.cmd.MDelete {
-		if e := ec.checkDeleteExclude(tmpl.apply(c.Location), c); e != nil {
-			return resp, e
-		}
+// sameContent checks if the remote file has the given content. Any failure to read the file means it is different.
+// With sudo the file is read with sudo, so files readable by root only are compared as well.
+func (ec *execCmd) sameContent(ctx context.Context, remoteFile string, fi os.FileInfo, statErr error, content []byte) bool {
+	switch {
+	case isDry(ec.exec):
+		return false // dry executor shows the diff on upload instead
+	case statErr == nil && (fi.IsDir() || fi.Size() != int64(len(content))):
+		return false
+	case statErr != nil && (os.IsNotExist(statErr) || !ec.cmd.Options.Sudo):
+		return false // with sudo the file may be not visible to the user, but still readable with sudo
+	}
+	tmpDir, err := os.MkdirTemp("", "spot-template")
+	if err != nil {
+		return false
 	}
+	defer os.RemoveAll(tmpDir) // nolint
+	localFile := filepath.Join(tmpDir, filepath.Base(remoteFile))
 
-	for _, c := range ec.cmd.MDelete {
-		loc := tmpl.apply(c.Location)
-		ecSingle := ec
-		ecSingle.cmd.Delete = config.DeleteInternal{Location: loc, Recursive: c.Recursive, Exclude: c.Exclude}
-		if _, err := ecSingle.Delete(ctx); err != nil {
-			return resp, ec.errorFmt("can't delete %s on %s: %w", loc, ec.hostAddr, err)
+	src := remoteFile // remote file to download, a copy in a private temporary directory with sudo
+	if ec.cmd.Options.Sudo {
+		tmpRemoteDir, cleanup, err := ec.sudoTmpDir(ctx)
+		if err != nil {
+			log.Printf("[DEBUG] can't compare %s on %s, %v", remoteFile, ec.hostAddr, err)
+			return false
 		}
-		msgs = append(msgs, loc)
+		defer cleanup()
+		src = tmpRemoteDir + "/" + filepath.Base(remoteFile)
 	}
-	resp.details = fmt.Sprintf(" {delete: %s}", strings.Join(msgs, ", "))
-	return resp, nil
+	exists, _, err := ec.readRemote(ctx, remoteFile, src, localFile)
+	if err != nil || !exists {
+		log.Printf("[DEBUG] can't read %s from %s to compare, exists: %v, %v", remoteFile, ec.hostAddr, exists, err)
+		return false
+	}
+	current, err := os.ReadFile(localFile) // nolint
+	return err == nil && bytes.Equal(current, content)
 }
 
-// Wait waits for a command to complete on a target hostAddr. It runs the command in a loop with a check duration
-// until the command succeeds or the timeout is exceeded.
-func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
-	single, multiRdr := ec.cmd.GetWait()
-	c, script, teardown, err := ec.prepScript(ctx, single, multiRdr)
+// uploadContent writes content to a local temp file and uploads it to the remote file with copy.
+func (ec *execCmd) uploadContent(ctx context.Context, remoteFile string, content []byte, perm os.FileMode) (execCmdResp, error) {
+	tmpDir, err := os.MkdirTemp("", "spot-template")
 	if err != nil {
-		return resp, ec.errorFmt("can't prepare script on %s: %w", ec.hostAddr, err)
+		return execCmdResp{}, ec.errorFmt("can't create temp dir: %w", err)
 	}
-	defer func() {
-		if teardown == nil {
-			return
-		}
-		if tErr := teardown(); tErr != nil {
-			log.Printf("[WARN] can't teardown script on %s: %v", ec.hostAddr, tErr)
-			if err == nil { // don't overwrite the primary error with teardown error
-				err = ec.error(tErr)
-			}
-		}
-	}()
-
-	timeout, duration := ec.cmd.Wait.Timeout, ec.cmd.Wait.CheckDuration
-	if duration == 0 {
-		duration = 5 * time.Second // default check duration if not set
+	defer os.RemoveAll(tmpDir) // nolint
+	localFile := filepath.Join(tmpDir, filepath.Base(remoteFile))
+	if err := os.WriteFile(localFile, content, perm); err != nil {
+		return execCmdResp{}, ec.errorFmt("can't write rendered file: %w", err)
 	}
-	if timeout == 0 {
-		timeout = time.Hour * 24 // default timeout if not set, wait practically forever
+	if err := os.Chmod(localFile, perm); err != nil { // write file is subject to umask
+		return execCmdResp{}, ec.errorFmt("can't chmod rendered file: %w", err)
 	}
 
-	resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v}",
-		c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
+	cpy := *ec
+	cpy.cmd.Copy = config.CopyInternal{Source: localFile, Dest: remoteFile, Mkdir: true, Force: true}
+	return cpy.copyPush(ctx, localFile, remoteFile)
+}
 
-	waitCmd := fmt.Sprintf("%s -c %q", ec.shell(), c) // run wait command in a shell
-	if ec.cmd.Options.Sudo {
-		resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v, sudo: true}",
-			c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
-		waitCmd = ec.wrapWithSudo(fmt.Sprintf("%s -c %q", ec.shell(), c)) // add sudo if needed
+// chown sets the owner (user, user:group or :group) of the remote file if it differs. Returns true if the owner
+// was changed. With recursive set, the owner is set for the whole directory tree if any of its files has a different owner.
+func (ec *execCmd) chown(ctx context.Context, remoteFile, owner string, recursive bool) (bool, error) {
+	user, group, _ := strings.Cut(owner, ":")
+	match, mismatch := []string{}, []string{}
+	if user != "" {
+		match, mismatch = append(match, "-user "+shellQuote(user)), append(mismatch, "! -user "+shellQuote(user))
+	}
+	if group != "" {
+		match, mismatch = append(match, "-group "+shellQuote(group)), append(mismatch, "! -group "+shellQuote(group))
+	}
+	checkCmd := fmt.Sprintf("find %s -maxdepth 0 %s", shellQuote(remoteFile), strings.Join(match, " "))
+	chownCmd := fmt.Sprintf("chown %s %s", shellQuote(owner), shellQuote(remoteFile))
+	if recursive {
+		// look for the first file with a different owner, none found means the owner is already set
+		cond := mismatch[0]
+		if len(mismatch) > 1 {
+			cond = fmt.Sprintf("\\( %s \\)", strings.Join(mismatch, " -o "))
+		}
+		checkCmd = fmt.Sprintf("find %s %s -print -quit", shellQuote(remoteFile), cond)
+		chownCmd = fmt.Sprintf("chown -R %s %s", shellQuote(owner), shellQuote(remoteFile))
 	}
-	resp.verbose = script
+	if reader := ec.reader(); !isDry(reader) {
+		out, err := reader.Run(ctx, ec.wrapWithSudo(checkCmd), nil)
+		if err == nil && ((!recursive && len(out) > 0) || (recursive && len(out) == 0)) {
+			return false, nil // owner is already set
+		}
+	}
+	if _, err := ec.exec.Run(ctx, ec.wrapWithSudo(chownCmd), nil); err != nil {
+		return false, ec.errorFmt("can't chown %s on %s: %w", remoteFile, ec.hostAddr, err)
+	}
+	return true, nil
+}
 
-	checkTk := time.NewTicker(duration)
-	defer checkTk.Stop()
-	timeoutTk := time.NewTicker(timeout)
-	defer timeoutTk.Stop()
+// Unarchive extracts tar, tar.gz, tar.zst or zip archive to the remote directory. A local archive is extracted locally
+// and synced to the destination, so only new and changed files are uploaded and excluded files are skipped the same
+// way as sync does. An archive already on the remote host (remote: true) is extracted on the host with tar or unzip
+// and copied to the destination if any of its files differs. Extraction is skipped if the creates path exists.
+// Optional mode is applied to the destination directory and owner to all extracted files.
+func (ec *execCmd) Unarchive(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	src := tmpl.apply(ec.cmd.Unarchive.Source)
+	dst := tmpl.apply(ec.cmd.Unarchive.Dest)
+	resp.details = fmt.Sprintf(" {unarchive: %s -> %s}", src, dst)
 
-	for {
-		select {
-		case <-ctx.Done():
-			return resp, ctx.Err()
-		case <-timeoutTk.C:
-			return resp, ec.errorFmt("timeout exceeded")
-		case <-checkTk.C:
-			if _, err := ec.exec.Run(ctx, waitCmd, nil); err == nil {
-				return resp, nil // command succeeded
-			}
+	if creates := tmpl.apply(ec.cmd.Unarchive.Creates); creates != "" {
+		if _, e := ec.exec.Stat(ctx, creates); e == nil {
+			resp.details = fmt.Sprintf(" {unarchive: %s -> %s, skip: %s exists}", src, dst, creates)
+			return resp, nil
 		}
 	}
-}
 
-// Echo prints a message. It enforces the echo command to start with "echo " and adds sudo if needed.
-// It returns the result of the echo command as details string.
-func (ec *execCmd) Echo(ctx context.Context) (resp execCmdResp, err error) {
-	// check the condition if it exists
-	cond, err := ec.checkCondition(ctx)
-	if err != nil {
-		return resp, err
+	var changed bool
+	if ec.cmd.Unarchive.Remote {
+		resp.details = fmt.Sprintf(" {unarchive: %s -> %s, remote: true}", src, dst)
+		if isDry(ec.exec) {
+			// dry run doesn't extract anything, can't tell what the archive would change
+			resp.status = cmdChanged
+			return resp, nil
+		}
+		if changed, err = ec.unarchiveRemote(ctx, src, dst); err != nil {
+			return resp, err
+		}
+	} else {
+		tmpDir, e := os.MkdirTemp("", "spot-unarchive")
+		if e != nil {
+			return resp, ec.errorFmt("can't create temp dir: %w", e)
+		}
+		defer os.RemoveAll(tmpDir) // nolint
+		if changed, err = ec.extractAndSync(ctx, src, filepath.Join(tmpDir, "extracted"), dst,
+			ec.cmd.Unarchive.StripComponents, ec.cmd.Unarchive.Exclude); err != nil {
+			return resp, err
+		}
 	}
-	if !cond {
-		resp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
-		return resp, nil
+	if changed {
+		resp.status = cmdChanged
 	}
 
-	// only proceed with echo if there was no condition or condition passed
-	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
-	echoCmd := tmpl.apply(ec.cmd.Echo)
-	if !strings.HasPrefix(echoCmd, "echo ") {
-		echoCmd = fmt.Sprintf("echo %q", echoCmd)
+	dstInfo, statErr := ec.exec.Stat(ctx, dst)
+	if isDry(ec.exec) && os.IsNotExist(statErr) {
+		return resp, nil // destination would be created by the real run, nothing to check
 	}
-	if ec.cmd.Options.Sudo {
-		echoCmd = ec.wrapWithSudo(fmt.Sprintf("%s -c '%s'", ec.shell(), echoCmd))
+	if ec.cmd.Unarchive.Mode != "" {
+		mode, e := strconv.ParseUint(ec.cmd.Unarchive.Mode, 8, 32)
+		if e != nil {
+			return resp, ec.errorFmt("invalid unarchive mode %q: %w", ec.cmd.Unarchive.Mode, e)
+		}
+		if statErr != nil || dstInfo.Mode().Perm() != os.FileMode(mode) {
+			chmodCmd := ec.wrapWithSudo(fmt.Sprintf("chmod %04o %s", mode, shellQuote(dst)))
+			if _, e := ec.exec.Run(ctx, chmodCmd, &executor.RunOpts{Verbose: ec.verbose}); e != nil {
+				return resp, ec.errorFmt("can't chmod %s on %s: %w", dst, ec.hostAddr, e)
+			}
+			resp.status = cmdChanged
+		}
 	}
-	out, err := ec.exec.Run(ctx, echoCmd, nil)
-	if err != nil {
-		return resp, ec.errorFmt("can't run echo command on %s: %w", ec.hostAddr, err)
+	if owner := tmpl.apply(ec.cmd.Unarchive.Owner); owner != "" {
+		chowned, e := ec.chown(ctx, dst, owner, true)
+		if e != nil {
+			return resp, e
+		}
+		if chowned {
+			resp.status = cmdChanged
+		}
 	}
-	resp.details = fmt.Sprintf(" {echo: %s}", strings.Join(out, "; "))
 	return resp, nil
 }
 
-// Line modifies file content by operating on lines that match a regex pattern.
-// It supports three operations: delete lines, replace lines, or append a line if pattern not found.
-func (ec *execCmd) Line(ctx context.Context) (resp execCmdResp, err error) {
-	// check the condition if it exists
-	cond, err := ec.checkCondition(ctx)
-	if err != nil {
-		return resp, err
+// syncDir syncs the local directory, i.e. extracted archive, to the remote directory. Returns true if any file
+// was uploaded. With sudo, files are synced to a temporary directory first and copied to the destination with sudo,
+// and only if the sync plan shows the destination differs from the local files.
+func (ec *execCmd) syncDir(ctx context.Context, localDir, dst string, exclude []string) (bool, error) {
+	opts := &executor.SyncOpts{Exclude: exclude}
+	if !ec.cmd.Options.Sudo || isDry(ec.exec) {
+		copied, err := ec.exec.Sync(ctx, localDir, dst, opts)
+		if err != nil {
+			return false, ec.errorFmt("can't sync %s to %s: %w", localDir, ec.hostAddr, err)
+		}
+		return len(copied) > 0, nil
 	}
-	if !cond {
-		resp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
-		return resp, nil
+
+	if plan, err := ec.exec.PlanSync(ctx, localDir, dst, opts); err == nil && len(plan.Added)+len(plan.Changed) == 0 {
+		return false, nil
 	}
 
-	// apply templating to all fields
+	tmpRemoteDir := ec.uniqueTmp(tmpRemoteDirPrefix)
+	if _, err := ec.exec.Sync(ctx, localDir, tmpRemoteDir, opts); err != nil {
+		return false, ec.errorFmt("can't sync %s to %s: %w", localDir, ec.hostAddr, err)
+	}
+	defer func() {
+		if e := ec.exec.Delete(ctx, tmpRemoteDir, &executor.DeleteOpts{Recursive: true}); e != nil {
+			log.Printf("[WARN] can't remove temporary directory %q on %s: %v", tmpRemoteDir, ec.hostAddr, e)
+		}
+	}()
+	for _, c := range []string{"mkdir -p " + shellQuote(dst), fmt.Sprintf("cp -a %s/. %s/", tmpRemoteDir, shellQuote(dst))} {
+		if _, err := ec.exec.Run(ctx, ec.wrapWithSudo(c), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			return false, ec.errorFmt("can't copy synced files to %s on %s: %w", dst, ec.hostAddr, err)
+		}
+	}
+	return true, nil
+}
+
+// Fetch downloads the url to the destination file on the remote host with curl or wget, whichever is available.
+// The file is downloaded next to the destination and moved in place after the optional checksum verification.
+// An existing destination is kept if it matches the checksum, or if checksum is not set and force is not set.
+// Header values can refer to secrets loaded by the command, e.g. "Bearer {GITHUB_TOKEN}".
+func (ec *execCmd) Fetch(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	url := tmpl.apply(ec.cmd.Fetch.URL)
+	dst := tmpl.apply(ec.cmd.Fetch.Dest)
+	resp.details = fmt.Sprintf(" {fetch: %s -> %s}", url, dst)
+	algo, sum, err := ec.cmd.GetChecksum()
+	if err != nil {
+		return resp, ec.error(err)
+	}
+
+	if _, e := ec.exec.Stat(ctx, dst); e == nil {
+		switch {
+		case algo != "":
+			if current, e := ec.checksum(ctx, ec.reader(), dst, algo); e == nil && current == sum {
+				resp.details = fmt.Sprintf(" {fetch: %s -> %s, skip: checksum match}", url, dst)
+				return resp, nil
+			}
+		case !ec.cmd.Fetch.Force:
+			resp.details = fmt.Sprintf(" {fetch: %s -> %s, skip: %s exists}", url, dst, dst)
+			return resp, nil
+		}
+	}
+
+	// secrets are available for headers only, logs mask them
+	secretTmpl := ec.withSecrets(tmpl)
+	var curlHeaders, wgetHeaders string
+	for _, k := range slices.Sorted(maps.Keys(ec.cmd.Fetch.Headers)) {
+		h := shellQuote(k + ": " + secretTmpl.apply(ec.cmd.Fetch.Headers[k]))
+		curlHeaders += "-H " + h + " "
+		wgetHeaders += "--header=" + h + " "
+	}
+
+	tmpDst := filepath.Dir(dst) + "/." + filepath.Base(dst) + ".spot-fetch"
+	script := fmt.Sprintf("mkdir -p %s && if command -v curl >/dev/null 2>&1; then curl -fsSL %s-o %s %s; "+
+		"elif command -v wget >/dev/null 2>&1; then wget -q %s-O %s %s; "+
+		"else echo 'curl or wget not found' >&2; exit 1; fi",
+		shellQuote(filepath.Dir(dst)), curlHeaders, shellQuote(tmpDst), shellQuote(url),
+		wgetHeaders, shellQuote(tmpDst), shellQuote(url))
+	if _, err := ec.exec.Run(ctx, ec.shellCmd(script), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		ec.exec.Run(ctx, ec.shellCmd("rm -f "+shellQuote(tmpDst)), nil) // nolint
+		return resp, ec.errorFmt("can't fetch %s on %s: %w", url, ec.hostAddr, err)
+	}
+	resp.status = cmdChanged
+	if isDry(ec.exec) {
+		return resp, nil // nothing downloaded, nothing to verify
+	}
+
+	if algo != "" {
+		current, err := ec.checksum(ctx, ec.exec, tmpDst, algo)
+		if err == nil && current != sum {
+			err = fmt.Errorf("checksum mismatch, expected %s:%s, got %s:%s", algo, sum, algo, current)
+		}
+		if err != nil {
+			ec.exec.Run(ctx, ec.shellCmd("rm -f "+shellQuote(tmpDst)), nil) // nolint
+			return resp, ec.errorFmt("can't verify %s on %s: %w", url, ec.hostAddr, err)
+		}
+	}
+	if _, err := ec.exec.Run(ctx, ec.shellCmd(fmt.Sprintf("mv -f %s %s", shellQuote(tmpDst), shellQuote(dst))), nil); err != nil {
+		return resp, ec.errorFmt("can't move fetched file to %s on %s: %w", dst, ec.hostAddr, err)
+	}
+	return resp, nil
+}
+
+// checksum returns lowercase hex checksum of the remote file, made with sha256sum/sha512sum or shasum.
+func (ec *execCmd) checksum(ctx context.Context, ex executor.Interface, file, algo string) (string, error) {
+	if isDry(ex) {
+		return "", fmt.Errorf("can't calculate checksum in dry run")
+	}
+	bits := strings.TrimPrefix(algo, "sha")
+	script := fmt.Sprintf("if command -v %ssum >/dev/null 2>&1; then %ssum %s; else shasum -a %s %s; fi",
+		algo, algo, shellQuote(file), bits, shellQuote(file))
+	out, err := ex.Run(ctx, ec.shellCmd(script), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(out) == 0 {
+		return "", fmt.Errorf("empty checksum output for %s", file)
+	}
+	fields := strings.Fields(out[len(out)-1])
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum output for %s", file)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// Service manages systemd service. The current state is queried first and systemctl actions run only if needed:
+// start if not active, stop if active, enable or disable if differs. Restarted and reloaded states always act.
+// Optional local unit file is installed to /etc/systemd/system the same way as template does, and its change
+// triggers daemon-reload and restart of the active service with started state.
+func (ec *execCmd) Service(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	svc := ec.cmd.Service
+	name := tmpl.apply(svc.Name)
+	actions := []string{}
+	defer func() {
+		resp.details = fmt.Sprintf(" {service: %s}", name)
+		if len(actions) > 0 {
+			resp.details = fmt.Sprintf(" {service: %s, actions: %s}", name, strings.Join(actions, ", "))
+			resp.status = cmdChanged
+		}
+	}()
+
+	systemctl := func(args ...string) error {
+		c := ec.wrapWithSudo("systemctl " + strings.Join(args, " "))
+		if _, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			return ec.errorFmt("can't run systemctl %s on %s: %w", strings.Join(args, " "), ec.hostAddr, err)
+		}
+		return nil
+	}
+	act := func(action string) error {
+		if err := systemctl(action, shellQuote(name)); err != nil {
+			return err
+		}
+		actions = append(actions, action)
+		return nil
+	}
+
+	unitChanged := false
+	if svc.Unit != "" {
+		if unitChanged, err = ec.installUnit(ctx, tmpl.apply(svc.Unit), name); err != nil {
+			return resp, err
+		}
+		if unitChanged {
+			actions = append(actions, "install")
+		}
+	}
+	if svc.DaemonReload || unitChanged {
+		// daemon-reload alone is not reported as a change, unit file install is
+		if err := systemctl("daemon-reload"); err != nil {
+			return resp, err
+		}
+	}
+
+	if svc.Enabled != nil {
+		// unknown state, i.e. in dry run, is treated as not matching
+		state, ok := ec.systemctlQuery(ctx, "is-enabled", name)
+		enabled := state == "enabled"
+		switch {
+		case *svc.Enabled && (!ok || !enabled):
+			err = act("enable")
+		case !*svc.Enabled && (!ok || enabled):
+			err = act("disable")
+		}
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	state, ok := ec.systemctlQuery(ctx, "is-active", name)
+	active := state == "active"
+	switch svc.State {
+	case "started":
+		switch {
+		case !ok || !active:
+			err = act("start")
+		case unitChanged:
+			err = act("restart") // apply the new unit file
+		}
+	case "stopped":
+		if !ok || active {
+			err = act("stop")
+		}
+	case "restarted":
+		err = act("restart")
+	case "reloaded":
+		if ok && !active {
+			err = act("start")
+		} else {
+			err = act("reload")
+		}
+	}
+	return resp, err
+}
+
+// systemctlQuery runs read-only systemctl query, like is-active, and returns its output.
+// Returns false if the query can't be made, i.e. in dry run.
+func (ec *execCmd) systemctlQuery(ctx context.Context, query, name string) (string, bool) {
+	reader := ec.reader()
+	if isDry(reader) {
+		return "", false
+	}
+	// is-active and is-enabled exit with non-zero code for inactive and disabled services, output is enough
+	out, err := reader.Run(ctx, fmt.Sprintf("systemctl %s %s || true", query, shellQuote(name)), nil)
+	if err != nil || len(out) == 0 {
+		log.Printf("[DEBUG] can't query systemctl %s %s on %s, %v", query, name, ec.hostAddr, err)
+		return "", false
+	}
+	return strings.TrimSpace(out[len(out)-1]), true
+}
+
+// installUnit uploads local unit file to /etc/systemd/system if it differs from the installed one.
+// Returns true if the unit file was changed.
+func (ec *execCmd) installUnit(ctx context.Context, unitFile, name string) (bool, error) {
+	content, err := os.ReadFile(unitFile) // nolint
+	if err != nil {
+		return false, ec.errorFmt("can't read unit file %s: %w", unitFile, err)
+	}
+	if strings.Contains(name, "/") {
+		return false, ec.errorFmt("invalid service name %q for unit file", name)
+	}
+	if !strings.Contains(name, ".") {
+		name += ".service"
+	}
+	dst := "/etc/systemd/system/" + name
+	dstInfo, statErr := ec.exec.Stat(ctx, dst)
+	if ec.sameContent(ctx, dst, dstInfo, statErr, content) {
+		return false, nil
+	}
+	resp, err := ec.uploadContent(ctx, dst, content, 0o644)
+	if err != nil {
+		return false, err
+	}
+	return resp.status == cmdChanged, nil
+}
+
+// File ensures the state of the remote path: directory, absent, touch or link. Touch creates a missing file and
+// doesn't modify an existing one. The current state is checked with the executor's Stat, i.e. with SFTP for remote
+// hosts, and links are checked with readlink. Without sudo, directories, files and modes are changed with the
+// executor too. Links, owners, recursive modes and all changes with sudo are made with shell commands.
+// Optional mode, owner and group are set if they differ, for the whole directory tree with recurse.
+func (ec *execCmd) File(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	f := ec.cmd.File
+	fpath := tmpl.apply(f.Path)
+	resp.details = fmt.Sprintf(" {file: %s, state: %s}", fpath, f.State)
+
+	// change makes the change with the executor directly if possible, otherwise runs the shell command
+	change := func(c string, direct func() error) error {
+		if ec.cmd.Options.Sudo || direct == nil {
+			if _, err := ec.exec.Run(ctx, ec.wrapWithSudo(c), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+				return ec.errorFmt("can't %s on %s: %w", c, ec.hostAddr, err)
+			}
+		} else if err := direct(); err != nil {
+			return ec.errorFmt("can't %s on %s: %w", c, ec.hostAddr, err)
+		}
+		resp.status = cmdChanged
+		return nil
+	}
+
+	fi, statErr := ec.exec.Stat(ctx, fpath)
+	exists := statErr == nil
+	switch f.State {
+	case "absent":
+		// stat follows links, a dangling link is visible to readlink only
+		_, isLink := ec.readLink(ctx, fpath)
+		switch {
+		case isLink:
+			return resp, change(fmt.Sprintf("rm -f %s", shellQuote(fpath)), nil) // delete would follow the link
+		case exists:
+			return resp, change(fmt.Sprintf("rm -rf %s", shellQuote(fpath)), func() error {
+				return ec.exec.Delete(ctx, fpath, &executor.DeleteOpts{Recursive: fi.IsDir()})
+			})
+		}
+		return resp, nil
+	case "link":
+		src := tmpl.apply(f.Source)
+		resp.details = fmt.Sprintf(" {file: %s, state: link, src: %s}", fpath, src)
+		target, isLink := ec.readLink(ctx, fpath)
+		if exists && !isLink && !isDry(ec.reader()) {
+			return resp, ec.errorFmt("%s on %s exists and is not a link", fpath, ec.hostAddr)
+		}
+		if target != src {
+			return resp, change(fmt.Sprintf("ln -sfn %s %s", shellQuote(src), shellQuote(fpath)), nil)
+		}
+		return resp, nil
+	case "directory":
+		if exists && !fi.IsDir() {
+			return resp, ec.errorFmt("%s on %s exists and is not a directory", fpath, ec.hostAddr)
+		}
+		if !exists {
+			if err := change(fmt.Sprintf("mkdir -p %s", shellQuote(fpath)), func() error { return ec.exec.Mkdir(ctx, fpath) }); err != nil {
+				return resp, err
+			}
+		}
+	case "touch":
+		if exists && fi.IsDir() {
+			return resp, ec.errorFmt("%s on %s is a directory", fpath, ec.hostAddr)
+		}
+		if !exists {
+			if err := change(fmt.Sprintf("touch %s", shellQuote(fpath)), func() error { return ec.exec.Touch(ctx, fpath) }); err != nil {
+				return resp, err
+			}
+		}
+	default:
+		return resp, ec.errorFmt("invalid file state %q", f.State)
+	}
+
+	if isDry(ec.exec) && !exists {
+		return resp, nil // path would be created by the real run, nothing to check
+	}
+
+	if f.Mode != "" {
+		mode, e := strconv.ParseUint(f.Mode, 8, 32)
+		if e != nil {
+			return resp, ec.errorFmt("invalid file mode %q: %w", f.Mode, e)
+		}
+		changed, e := ec.chmod(ctx, fpath, uint32(mode), f.Recurse)
+		if e != nil {
+			return resp, e
+		}
+		if changed {
+			resp.status = cmdChanged
+		}
+	}
+
+	if owner := tmpl.apply(f.Owner); owner != "" || f.Group != "" {
+		if group := tmpl.apply(f.Group); group != "" {
+			owner += ":" + group
+		}
+		changed, e := ec.chown(ctx, fpath, owner, f.Recurse)
+		if e != nil {
+			return resp, e
+		}
+		if changed {
+			resp.status = cmdChanged
+		}
+	}
+	return resp, nil
+}
+
+// MFile ensures the state of multiple remote paths, see File
+func (ec *execCmd) MFile(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	msgs := []string{}
+	for _, f := range ec.cmd.MFile {
+		ecSingle := *ec
+		ecSingle.cmd.File = f
+		r, err := ecSingle.File(ctx)
+		if err != nil {
+			return resp, ec.errorFmt("can't set state of %s on %s: %w", tmpl.apply(f.Path), ec.hostAddr, err)
+		}
+		if r.status == cmdChanged {
+			resp.status = cmdChanged
+		}
+		msgs = append(msgs, tmpl.apply(f.Path))
+	}
+	resp.details = fmt.Sprintf(" {file: %s}", strings.Join(msgs, ", "))
+	return resp, nil
+}
+
+// chmod sets the mode of the remote file if it differs. The mode is in the numeric form of chmod, with setuid,
+// setgid and sticky bits, i.e. 04755. Returns true if the mode was changed. Without sudo the mode is set with
+// the executor, i.e. with SFTP. With recursive set, the mode is set with chmod -R for the whole directory tree
+// if any of its files has a different mode.
+func (ec *execCmd) chmod(ctx context.Context, remoteFile string, mode uint32, recursive bool) (bool, error) {
+	chmodCmd := fmt.Sprintf("chmod %04o %s", mode, shellQuote(remoteFile))
+	if recursive {
+		chmodCmd = fmt.Sprintf("chmod -R %04o %s", mode, shellQuote(remoteFile))
+		if reader := ec.reader(); !isDry(reader) {
+			checkCmd := fmt.Sprintf("find %s ! -perm %04o -print -quit", shellQuote(remoteFile), mode)
+			if out, err := reader.Run(ctx, ec.wrapWithSudo(checkCmd), nil); err == nil && len(out) == 0 {
+				return false, nil // mode is already set
+			}
+		}
+	} else {
+		if fi, err := ec.exec.Stat(ctx, remoteFile); err == nil && executor.UnixMode(fi.Mode()) == mode {
+			return false, nil
+		}
+		if !ec.cmd.Options.Sudo {
+			if err := ec.exec.Chmod(ctx, remoteFile, executor.FileMode(mode)); err != nil {
+				return false, ec.errorFmt("can't chmod %s on %s: %w", remoteFile, ec.hostAddr, err)
+			}
+			return true, nil
+		}
+	}
+	if _, err := ec.exec.Run(ctx, ec.wrapWithSudo(chmodCmd), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return false, ec.errorFmt("can't chmod %s on %s: %w", remoteFile, ec.hostAddr, err)
+	}
+	return true, nil
+}
+
+// readLink returns the target of the remote link. Returns false if the path is not a link
+// or the link can't be read, i.e. in dry run.
+func (ec *execCmd) readLink(ctx context.Context, path string) (string, bool) {
+	reader := ec.reader()
+	if isDry(reader) {
+		return "", false
+	}
+	out, err := reader.Run(ctx, ec.wrapWithSudo("readlink "+shellQuote(path)), nil)
+	if err != nil || len(out) == 0 {
+		return "", false
+	}
+	return out[len(out)-1], true
+}
+
+// Git checks out the repository ref (branch, tag or commit sha) to the destination directory on the remote host,
+// cloning it if the directory is not a git repository yet. The checkout is detached and forced, local changes are
+// discarded. Optional deploy key is taken from the secret, uploaded to a temporary location and removed afterwards.
+// The revisions before and after the checkout are set as GIT_BEFORE and GIT_AFTER variables, changed revision
+// is reported as changed status.
+func (ec *execCmd) Git(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	repo, dest, ref := tmpl.apply(ec.cmd.Git.Repo), tmpl.apply(ec.cmd.Git.Dest), tmpl.apply(ec.cmd.Git.Ref)
+	if ref == "" {
+		ref = "HEAD"
+	}
+	resp.details = fmt.Sprintf(" {git: %s -> %s, ref: %s}", repo, dest, ref)
+
+	keyFile := ""
+	if ec.cmd.Git.KeySecret != "" {
+		key, ok := ec.cmd.Secrets[ec.cmd.Git.KeySecret]
+		if !ok || key == "" {
+			return resp, ec.errorFmt("git key secret %q is not loaded", ec.cmd.Git.KeySecret)
+		}
+		tmpRemoteDir := ec.uniqueTmp(tmpRemoteDirPrefix)
+		keyFile = tmpRemoteDir + "/deploy-key"
+		if !isDry(ec.exec) { // dry executor would show the key content
+			if err := ec.uploadKey(ctx, key, keyFile); err != nil {
+				return resp, err
+			}
+			defer func() {
+				if e := ec.exec.Delete(ctx, tmpRemoteDir, &executor.DeleteOpts{Recursive: true}); e != nil {
+					log.Printf("[WARN] can't remove temporary directory %q on %s: %v", tmpRemoteDir, ec.hostAddr, e)
+				}
+			}()
+		}
+	}
+
+	c, _, teardown, err := ec.prepScript(ctx, "", strings.NewReader(gitScript(repo, dest, ref, ec.cmd.Git.Depth, keyFile)))
+	if err != nil {
+		return resp, ec.errorFmt("can't prepare git script on %s: %w", ec.hostAddr, err)
+	}
+	defer func() {
+		if tErr := teardown(); tErr != nil {
+			log.Printf("[WARN] can't teardown git script on %s: %v", ec.hostAddr, tErr)
+		}
+	}()
+	if ec.cmd.Options.Sudo {
+		c = ec.wrapWithSudo(c)
+	}
+	out, err := ec.exec.Run(ctx, c, &executor.RunOpts{Verbose: ec.verbose})
+	if err != nil {
+		return resp, ec.errorFmt("can't checkout %s to %s on %s: %w", repo, dest, ec.hostAddr, err)
+	}
+	if isDry(ec.exec) {
+		resp.status = cmdChanged // nothing fetched, can't tell the new revision
+		return resp, nil
+	}
+
+	var before, after string
+	for _, line := range out {
+		if v, ok := strings.CutPrefix(line, "spot-git-before="); ok {
+			before = v
+		}
+		if v, ok := strings.CutPrefix(line, "spot-git-after="); ok {
+			after = v
+		}
+	}
+	if after == "" {
+		return resp, ec.errorFmt("can't get checked out revision of %s on %s", dest, ec.hostAddr)
+	}
+	resp.vars = map[string]string{"GIT_BEFORE": before, "GIT_AFTER": after}
+	resp.registered = map[string]string{"GIT_BEFORE": before, "GIT_AFTER": after}
+	if before != after {
+		resp.status = cmdChanged
+		resp.details = fmt.Sprintf(" {git: %s -> %s, ref: %s, rev: %s -> %s}", repo, dest, ref, shortRev(before), shortRev(after))
+	}
+	return resp, nil
+}
+
+// uploadKey uploads the deploy key to the remote file readable by the owner only
+func (ec *execCmd) uploadKey(ctx context.Context, key, remoteFile string) error {
+	tmpDir, err := os.MkdirTemp("", "spot-git")
+	if err != nil {
+		return ec.errorFmt("can't create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+	localFile := filepath.Join(tmpDir, "deploy-key")
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n" // ssh rejects keys without the trailing new line
+	}
+	if err := os.WriteFile(localFile, []byte(key), 0o600); err != nil {
+		return ec.errorFmt("can't write deploy key: %w", err)
+	}
+	if err := ec.exec.Upload(ctx, localFile, remoteFile, &executor.UpDownOpts{Mkdir: true}); err != nil {
+		return ec.errorFmt("can't upload deploy key to %s: %w", ec.hostAddr, err)
+	}
+	return nil
+}
+
+// gitScript makes the shell script checking out the ref to the destination. It prints revisions before and after
+// the checkout as spot-git-before and spot-git-after lines. Fetching by commit sha is not allowed by all servers,
+// the script falls back to the full fetch if the ref can't be fetched directly.
+func gitScript(repo, dest, ref string, depth int, keyFile string) string {
+	depthOpt := ""
+	if depth > 0 {
+		depthOpt = fmt.Sprintf("--depth %d ", depth)
+	}
+	lines := []string{"set -e"}
+	if keyFile != "" {
+		lines = append(lines, fmt.Sprintf("export GIT_SSH_COMMAND=%s",
+			shellQuote("ssh -i "+keyFile+" -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new")))
+	}
+	lines = append(lines,
+		"git_dest="+shellQuote(dest),
+		`if [ ! -d "$git_dest/.git" ]; then`,
+		`  if [ -d "$git_dest" ] && [ -n "$(ls -A "$git_dest")" ]; then`,
+		`    echo "$git_dest is not empty and not a git repository" >&2; exit 1`,
+		`  fi`,
+		`  git -c init.defaultBranch=main init -q "$git_dest"`,
+		`  git -C "$git_dest" remote add origin `+shellQuote(repo),
+		`fi`,
+		`git -C "$git_dest" remote set-url origin `+shellQuote(repo),
+		`git_before=$(git -C "$git_dest" rev-parse -q --verify HEAD || true)`,
+		`if git -C "$git_dest" fetch -q `+depthOpt+`origin `+shellQuote(ref)+`; then`,
+		`  git -C "$git_dest" -c advice.detachedHead=false checkout -q -f --detach FETCH_HEAD`,
+		`else`,
+		`  git -C "$git_dest" fetch -q `+depthOpt+`origin`,
+		`  git -C "$git_dest" -c advice.detachedHead=false checkout -q -f --detach `+shellQuote(ref),
+		`fi`,
+		`echo "spot-git-before=$git_before"`,
+		`echo "spot-git-after=$(git -C "$git_dest" rev-parse HEAD)"`,
+	)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// shortRev returns the abbreviated revision, or "none" for empty one
+func shortRev(rev string) string {
+	if rev == "" {
+		return "none"
+	}
+	if len(rev) > 7 {
+		return rev[:7]
+	}
+	return rev
+}
+
+// releaseNameFormat is the layout of release directory names, names sort in the order of deployment.
+// Microseconds keep names unique for deployments made within the same second, i.e. retries.
+const releaseNameFormat = "20060102150405.000000"
+
+// Release deploys to a new timestamped release directory in dir/releases, populated by syncing the local directory
+// or by extracting the archive the same way as unarchive does. Optional check script runs in the new release before
+// the switch, the release is removed if the check fails. The current link is switched to the new release atomically
+// and the oldest releases beyond keep are removed. The new release is set as RELEASE_DIR variable.
+func (ec *execCmd) Release(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	dir, src := tmpl.apply(ec.cmd.Release.Dir), tmpl.apply(ec.cmd.Release.Source)
+	release := filepath.Join(dir, "releases", time.Now().UTC().Format(releaseNameFormat))
+	resp.details = fmt.Sprintf(" {release: %s -> %s}", src, release)
+
+	if _, e := ec.reader().Stat(ctx, release); e == nil {
+		return resp, ec.errorFmt("release %s already exists on %s", release, ec.hostAddr)
+	}
+
+	if isArchive(src) {
+		tmpDir, e := os.MkdirTemp("", "spot-release")
+		if e != nil {
+			return resp, ec.errorFmt("can't create temp dir: %w", e)
+		}
+		defer os.RemoveAll(tmpDir) // nolint
+		_, e = ec.extractAndSync(ctx, src, filepath.Join(tmpDir, "extracted"), release,
+			ec.cmd.Release.StripComponents, ec.cmd.Release.Exclude)
+		if e != nil {
+			return resp, e
+		}
+	} else if _, err := ec.syncDir(ctx, src, release, ec.cmd.Release.Exclude); err != nil {
+		return resp, err
+	}
+	resp.status = cmdChanged
+
+	if check := tmpl.apply(ec.cmd.Release.Check); check != "" {
+		checkCmd := ec.shellCmd(fmt.Sprintf("cd %s && %s", shellQuote(release), check))
+		if _, e := ec.exec.Run(ctx, checkCmd, &executor.RunOpts{Verbose: ec.verbose}); e != nil {
+			if _, rmErr := ec.exec.Run(ctx, ec.wrapWithSudo("rm -rf "+shellQuote(release)), nil); rmErr != nil {
+				log.Printf("[WARN] can't remove failed release %s on %s: %v", release, ec.hostAddr, rmErr)
+			}
+			return resp, ec.errorFmt("release check failed for %s on %s: %w", release, ec.hostAddr, e)
+		}
+	}
+
+	if err := ec.switchCurrent(ctx, dir, release); err != nil {
+		return resp, err
+	}
+	pruned, err := ec.pruneReleases(ctx, dir, release)
+	if err != nil {
+		return resp, err
+	}
+	if pruned > 0 {
+		resp.details = fmt.Sprintf(" {release: %s -> %s, pruned: %d}", src, release, pruned)
+	}
+	resp.vars = map[string]string{"RELEASE_DIR": release}
+	resp.registered = map[string]string{"RELEASE_DIR": release}
+	return resp, nil
+}
+
+// Rollback switches the current link back to the release deployed before the current one. The release rolled back
+// from is kept, so the next rollback goes one more release back. The release switched to is set as RELEASE_DIR variable.
+func (ec *execCmd) Rollback(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	dir := tmpl.apply(ec.cmd.Release.Dir)
+	current := filepath.Join(dir, "current")
+	resp.details = fmt.Sprintf(" {rollback: %s}", current)
+	if isDry(ec.reader()) {
+		// dry run can't read the current release, can't tell which one it would switch to
+		resp.status = cmdChanged
+		return resp, nil
+	}
+
+	target, ok := ec.readLink(ctx, current)
+	if !ok {
+		return resp, ec.errorFmt("no current release link %s on %s", current, ec.hostAddr)
+	}
+	names, err := ec.listReleases(ctx, dir)
+	if err != nil {
+		return resp, err
+	}
+	idx := slices.Index(names, filepath.Base(target))
+	if idx < 1 {
+		return resp, ec.errorFmt("no release before %s to roll back to on %s", target, ec.hostAddr)
+	}
+	prev := filepath.Join(dir, "releases", names[idx-1])
+	if err := ec.switchCurrent(ctx, dir, prev); err != nil {
+		return resp, err
+	}
+	resp.details = fmt.Sprintf(" {rollback: %s -> %s}", current, prev)
+	resp.status = cmdChanged
+	resp.vars = map[string]string{"RELEASE_DIR": prev}
+	resp.registered = map[string]string{"RELEASE_DIR": prev}
+	return resp, nil
+}
+
+// switchCurrent points dir/current link to the release. The new link is made aside and renamed over the current one,
+// so the current link is never missing. mv -T is GNU only, mv -h is the BSD way to replace the link itself.
+func (ec *execCmd) switchCurrent(ctx context.Context, dir, release string) error {
+	current, tmpLink := filepath.Join(dir, "current"), filepath.Join(dir, ".current.spot-tmp")
+	c := fmt.Sprintf("ln -sfn %s %s && { mv -fT %s %s 2>/dev/null || mv -fh %s %s; }", shellQuote(release),
+		shellQuote(tmpLink), shellQuote(tmpLink), shellQuote(current), shellQuote(tmpLink), shellQuote(current))
+	if _, err := ec.exec.Run(ctx, ec.shellCmd(c), &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return ec.errorFmt("can't switch %s to %s on %s: %w", current, release, ec.hostAddr, err)
+	}
+	return nil
+}
+
+// pruneReleases removes the oldest releases in dir/releases, keeping the configured number of them including
+// the just deployed one. Returns the number of removed releases.
+func (ec *execCmd) pruneReleases(ctx context.Context, dir, release string) (int, error) {
+	keep := ec.cmd.Release.Keep
+	if keep == 0 {
+		keep = 5
+	}
+	names, err := ec.listReleases(ctx, dir)
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(names, filepath.Base(release)) {
+		// in dry run and check mode the new release was not created
+		names = append(names, filepath.Base(release))
+		slices.Sort(names)
+	}
+	if len(names) <= keep {
+		return 0, nil
+	}
+	pruned := names[:len(names)-keep]
+	for _, name := range pruned {
+		rmCmd := ec.wrapWithSudo("rm -rf " + shellQuote(filepath.Join(dir, "releases", name)))
+		if _, err := ec.exec.Run(ctx, rmCmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			return 0, ec.errorFmt("can't remove release %s on %s: %w", name, ec.hostAddr, err)
+		}
+	}
+	return len(pruned), nil
+}
+
+// listReleases returns names of the release directories in dir/releases, oldest first. Entries not named
+// as releases are ignored. Returns nothing in dry run, as the directory can't be read.
+func (ec *execCmd) listReleases(ctx context.Context, dir string) ([]string, error) {
+	reader := ec.reader()
+	if isDry(reader) {
+		return nil, nil
+	}
+	releasesDir := filepath.Join(dir, "releases")
+	if _, err := reader.Stat(ctx, releasesDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	out, err := reader.Run(ctx, ec.wrapWithSudo("ls -1 "+shellQuote(releasesDir)), nil)
+	if err != nil {
+		return nil, ec.errorFmt("can't list releases in %s on %s: %w", releasesDir, ec.hostAddr, err)
+	}
+	names := []string{}
+	for _, name := range out {
+		if _, e := time.Parse(releaseNameFormat, name); e == nil {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// Mcopy uploads or downloads multiple files to/from a target host. It calls copy function for each file.
+func (ec *execCmd) Mcopy(ctx context.Context) (resp execCmdResp, err error) {
+	msgs := []string{}
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	for _, c := range ec.cmd.MCopy {
+		src := tmpl.apply(c.Source)
+		dst := tmpl.apply(c.Dest)
+		arrow := "->"
+		if c.Direction == "pull" {
+			arrow = "<-"
+		}
+		msgs = append(msgs, fmt.Sprintf("%s %s %s", src, arrow, dst))
+		ecSingle := ec
+		ecSingle.cmd.Copy = config.CopyInternal{Source: src, Dest: dst, Direction: c.Direction, Mkdir: c.Mkdir,
+			Force: c.Force, ChmodX: c.ChmodX, Exclude: c.Exclude}
+		r, err := ecSingle.Copy(ctx)
+		if err != nil {
+			return resp, ec.errorFmt("can't copy file to %s: %w", ec.hostAddr, err)
+		}
+		if r.status == cmdChanged {
+			resp.status = cmdChanged
+		}
+	}
+	resp.details = fmt.Sprintf(" {copy: %s}", strings.Join(msgs, ", "))
+	return resp, nil
+}
+
+// Sync synchronizes files from a source to a destination on a target host. The command is changed if any file
+// was copied or, with delete set, if any file missing in the source was deleted from the destination.
+func (ec *execCmd) Sync(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	src := tmpl.apply(ec.cmd.Sync.Source)
+	dst := tmpl.apply(ec.cmd.Sync.Dest)
+	resp.details = fmt.Sprintf(" {sync: %s -> %s}", src, dst)
+	opts := &executor.SyncOpts{Delete: ec.cmd.Sync.Delete, Exclude: ec.cmd.Sync.Exclude}
+
+	deleted := 0
+	if opts.Delete {
+		// sync reports copied files only, files to delete are known from the plan
+		plan, e := ec.exec.PlanSync(ctx, src, dst, opts)
+		if e != nil {
+			return resp, ec.errorFmt("can't plan sync of files on %s: %w", ec.hostAddr, e)
+		}
+		deleted = len(plan.Deleted)
+	}
+
+	copied, err := ec.exec.Sync(ctx, src, dst, opts)
+	if err != nil {
+		return resp, ec.errorFmt("can't sync files on %s: %w", ec.hostAddr, err)
+	}
+	if len(copied) > 0 || deleted > 0 {
+		resp.status = cmdChanged
+	}
+	return resp, nil
+}
+
+// Msync synchronizes multiple locations from a source to a destination on a target host.
+func (ec *execCmd) Msync(ctx context.Context) (resp execCmdResp, err error) {
+	msgs := []string{}
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	for _, c := range ec.cmd.MSync {
+		src := tmpl.apply(c.Source)
+		dst := tmpl.apply(c.Dest)
+		msgs = append(msgs, fmt.Sprintf("%s -> %s", src, dst))
+		ecSingle := ec
+		ecSingle.cmd.Sync = config.SyncInternal{Source: src, Dest: dst, Exclude: c.Exclude, Delete: c.Delete}
+		r, err := ecSingle.Sync(ctx)
+		if err != nil {
+			return resp, ec.errorFmt("can't sync %s to %s %s: %w", src, ec.hostAddr, dst, err)
+		}
+		if r.status == cmdChanged {
+			resp.status = cmdChanged
+		}
+	}
+	resp.details = fmt.Sprintf(" {sync: %s}", strings.Join(msgs, ", "))
+	return resp, nil
+}
+
+// checkDeleteExclude validates the exclude option against the other delete flags for the given location.
+// Exclude requires a recursive delete (it filters directory contents) and cannot be combined with sudo,
+// as sudo deletion runs a plain rm that cannot apply exclusion patterns. Returns an error naming the
+// offending location, or nil if the combination is valid.
+func (ec *execCmd) checkDeleteExclude(loc string, del config.DeleteInternal) error {
+	if len(del.Exclude) == 0 {
+		return nil
+	}
+	if !del.Recursive {
+		return ec.errorFmt("delete with exclude requires recursive delete (recur: true) for %q", loc)
+	}
+	if ec.cmd.Options.Sudo {
+		return ec.errorFmt("delete with exclude is not supported with sudo for %q", loc)
+	}
+	return nil
+}
+
+// Delete deletes files on a target host. If sudo option is set, it will execute a sudo rm commands.
+func (ec *execCmd) Delete(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	loc := tmpl.apply(ec.cmd.Delete.Location)
+
+	if e := ec.checkDeleteExclude(loc, ec.cmd.Delete); e != nil {
+		return resp, e
+	}
+
+	// deleting an existing location is a change, a missing one is not. unknown state and globs reported as changed
+	if _, e := ec.exec.Stat(ctx, loc); !errors.Is(e, os.ErrNotExist) || strings.ContainsAny(loc, "*?[") {
+		resp.status = cmdChanged
+	}
+
+	if !ec.cmd.Options.Sudo {
+		// if sudo is not set, we can delete the file directly
+		opts := &executor.DeleteOpts{Recursive: ec.cmd.Delete.Recursive, Exclude: ec.cmd.Delete.Exclude}
+		if err := ec.exec.Delete(ctx, loc, opts); err != nil {
+			return resp, ec.errorFmt("can't delete files on %s: %w", ec.hostAddr, err)
+		}
+		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v}", loc, ec.cmd.Delete.Recursive)
+	}
+
+	if ec.cmd.Options.Sudo {
+		// if sudo is set, we need to delete the file using sudo by ssh-ing into the host and running the command
+		cmd := fmt.Sprintf("rm -f %s", loc)
+		if ec.cmd.Delete.Recursive {
+			cmd = fmt.Sprintf("rm -rf %s", loc)
+		}
+		cmd = ec.wrapWithSudo(cmd)
+		if _, err := ec.exec.Run(ctx, cmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+			return resp, ec.errorFmt("can't delete file(s) on %s: %w", ec.hostAddr, err)
+		}
+		resp.details = fmt.Sprintf(" {delete: %s, recursive: %v, sudo: true}", loc, ec.cmd.Delete.Recursive)
+	}
+
+	return resp, nil
+}
+
+// MDelete deletes multiple locations on a target host.
+func (ec *execCmd) MDelete(ctx context.Context) (resp execCmdResp, err error) {
+	msgs := []string{}
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+
+	// validate all locations upfront, before any of them is deleted
+	for _, c := range ec.cmd.MDelete {
+		if e := ec.checkDeleteExclude(tmpl.apply(c.Location), c); e != nil {
+			return resp, e
+		}
+	}
+
+	for _, c := range ec.cmd.MDelete {
+		loc := tmpl.apply(c.Location)
+		ecSingle := ec
+		ecSingle.cmd.Delete = config.DeleteInternal{Location: loc, Recursive: c.Recursive, Exclude: c.Exclude}
+		r, err := ecSingle.Delete(ctx)
+		if err != nil {
+			return resp, ec.errorFmt("can't delete %s on %s: %w", loc, ec.hostAddr, err)
+		}
+		if r.status == cmdChanged {
+			resp.status = cmdChanged
+		}
+		msgs = append(msgs, loc)
+	}
+	resp.details = fmt.Sprintf(" {delete: %s}", strings.Join(msgs, ", "))
+	return resp, nil
+}
+
+// Wait waits for a command to complete on a target hostAddr. It runs the command in a loop with a check duration
+// until the command succeeds or the timeout is exceeded.
+func (ec *execCmd) Wait(ctx context.Context) (resp execCmdResp, err error) {
+	if ec.cmd.Wait.HTTP.URL != "" || ec.cmd.Wait.TCP != "" {
+		return ec.waitConn(ctx)
+	}
+	single, multiRdr := ec.cmd.GetWait()
+	c, script, teardown, err := ec.prepScript(ctx, single, multiRdr)
+	if err != nil {
+		return resp, ec.errorFmt("can't prepare script on %s: %w", ec.hostAddr, err)
+	}
+	defer func() {
+		if teardown == nil {
+			return
+		}
+		if tErr := teardown(); tErr != nil {
+			log.Printf("[WARN] can't teardown script on %s: %v", ec.hostAddr, tErr)
+			if err == nil { // don't overwrite the primary error with teardown error
+				err = ec.error(tErr)
+			}
+		}
+	}()
+
+	timeout, duration := ec.waitTimings()
+	resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v}",
+		c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
+
+	waitCmd := fmt.Sprintf("%s -c %q", ec.shell(), c) // run wait command in a shell
+	if ec.cmd.Options.Sudo {
+		resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v, sudo: true}",
+			c, timeout.Truncate(100*time.Millisecond), duration.Truncate(100*time.Millisecond))
+		waitCmd = ec.wrapWithSudo(fmt.Sprintf("%s -c %q", ec.shell(), c)) // add sudo if needed
+	}
+	resp.verbose = script
+
+	checkTk := time.NewTicker(duration)
+	defer checkTk.Stop()
+	timeoutTk := time.NewTicker(timeout)
+	defer timeoutTk.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case <-timeoutTk.C:
+			return resp, ec.errorFmt("timeout exceeded")
+		case <-checkTk.C:
+			if _, err := ec.exec.Run(ctx, waitCmd, nil); err == nil {
+				return resp, nil // command succeeded
+			}
+		}
+	}
+}
+
+// waitTimings returns the wait timeout and check interval, with defaults for not set ones
+func (ec *execCmd) waitTimings() (timeout, interval time.Duration) {
+	timeout, interval = ec.cmd.Wait.Timeout, ec.cmd.Wait.CheckDuration
+	if interval == 0 {
+		interval = 5 * time.Second // default check duration if not set
+	}
+	if timeout == 0 {
+		timeout = time.Hour * 24 // default timeout if not set, wait practically forever
+	}
+	return timeout, interval
+}
+
+// connDialer is implemented by executors making network connections from the host they run commands on
+type connDialer interface {
+	Dial(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// waitConn waits for the http endpoint to respond as expected or for the tcp port to accept connections.
+// Checks are made from the remote host through the ssh connection, so nothing has to be installed there,
+// or from the local host for local commands. Each check is limited by the interval, the reason of the last
+// failed check is reported on timeout. Dry run doesn't check anything.
+func (ec *execCmd) waitConn(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	timeout, interval := ec.waitTimings()
+
+	target, check := "tcp: "+tmpl.apply(ec.cmd.Wait.TCP), waitTCP(tmpl.apply(ec.cmd.Wait.TCP))
+	if ec.cmd.Wait.HTTP.URL != "" {
+		h := ec.cmd.Wait.HTTP
+		headers := map[string]string{}
+		secretTmpl := ec.withSecrets(tmpl) // secrets are available for headers only, logs mask them
+		for k, v := range h.Headers {
+			headers[k] = secretTmpl.apply(v)
+		}
+		var body *regexp.Regexp
+		if h.Body != "" {
+			if body, err = regexp.Compile(h.Body); err != nil {
+				return resp, ec.errorFmt("invalid wait http body regex %q: %w", h.Body, err)
+			}
+		}
+		target, check = "http: "+tmpl.apply(h.URL), waitHTTP(tmpl.apply(h.URL), headers, h.Status, body)
+	}
+	resp.details = fmt.Sprintf(" {wait: %s, timeout: %v, duration: %v}",
+		target, timeout.Truncate(100*time.Millisecond), interval.Truncate(100*time.Millisecond))
+
+	dialer, ok := ec.exec.(connDialer)
+	if !ok {
+		return resp, nil // dry run, nothing to connect with
+	}
+
+	checkTk := time.NewTicker(interval)
+	defer checkTk.Stop()
+	timeoutTk := time.NewTicker(timeout)
+	defer timeoutTk.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case <-timeoutTk.C:
+			if lastErr == nil {
+				return resp, ec.errorFmt("timeout exceeded")
+			}
+			return resp, ec.errorFmt("timeout exceeded, last check failed: %w", lastErr)
+		case <-checkTk.C:
+			checkCtx, cancel := context.WithTimeout(ctx, interval)
+			lastErr = check(checkCtx, dialer)
+			cancel()
+			if lastErr == nil {
+				return resp, nil
+			}
+			log.Printf("[DEBUG] wait %s on %s: %v", target, ec.hostAddr, lastErr)
+		}
+	}
+}
+
+// waitTCP makes the check connecting to the tcp address
+func waitTCP(addr string) func(context.Context, connDialer) error {
+	return func(ctx context.Context, dialer connDialer) error {
+		conn, err := dialer.Dial(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// waitHTTP makes the check requesting the url with GET and checking the response status, any 2xx if status
+// is not set, and the response body if body regex is set. Host header sets the request host.
+func waitHTTP(url string, headers map[string]string, status int, body *regexp.Regexp) func(context.Context, connDialer) error {
+	return func(ctx context.Context, dialer connDialer) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+		if err != nil {
+			return err
+		}
+		for k, v := range headers {
+			if strings.EqualFold(k, "host") {
+				req.Host = v
+				continue
+			}
+			req.Header.Set(k, v)
+		}
+		client := http.Client{Transport: &http.Transport{DialContext: dialer.Dial, DisableKeepAlives: true}}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close() // nolint
+
+		switch {
+		case status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299):
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		case status != 0 && resp.StatusCode != status:
+			return fmt.Errorf("unexpected status %d, expected %d", resp.StatusCode, status)
+		}
+		if body == nil {
+			return nil
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		if err != nil {
+			return fmt.Errorf("can't read response body: %w", err)
+		}
+		if !body.Match(data) {
+			return fmt.Errorf("response body doesn't match %q", body.String())
+		}
+		return nil
+	}
+}
+
+// Echo prints a message. It enforces the echo command to start with "echo " and adds sudo if needed.
+// It returns the result of the echo command as details string.
+func (ec *execCmd) Echo(ctx context.Context) (resp execCmdResp, err error) {
+	// check the condition if it exists
+	cond, err := ec.checkCondition(ctx)
+	if err != nil {
+		return resp, err
+	}
+	if !cond {
+		resp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
+		resp.status = cmdSkipped
+		return resp, nil
+	}
+
+	// only proceed with echo if there was no condition or condition passed
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	echoCmd := tmpl.apply(ec.cmd.Echo)
+	if !strings.HasPrefix(echoCmd, "echo ") {
+		echoCmd = fmt.Sprintf("echo %q", echoCmd)
+	}
+	if ec.cmd.Options.Sudo {
+		echoCmd = ec.wrapWithSudo(fmt.Sprintf("%s -c '%s'", ec.shell(), echoCmd))
+	}
+	out, err := ec.exec.Run(ctx, echoCmd, nil)
+	if err != nil {
+		return resp, ec.errorFmt("can't run echo command on %s: %w", ec.hostAddr, err)
+	}
+	resp.details = fmt.Sprintf(" {echo: %s}", strings.Join(out, "; "))
+	return resp, nil
+}
+
+// Line modifies file content by operating on lines that match a regex pattern. The file is read, changed in go
+// and written back only if the content differs, see editFile. Supported operations: delete matching lines,
+// replace matching lines (with optional backreferences), append a line if nothing matches,
+// and insert a line before or after the last matching line if the line is not in the file yet.
+func (ec *execCmd) Line(ctx context.Context) (resp execCmdResp, err error) {
+	// check the condition if it exists
+	cond, err := ec.checkCondition(ctx)
+	if err != nil {
+		return resp, err
+	}
+	if !cond {
+		resp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
+		resp.status = cmdSkipped
+		return resp, nil
+	}
+
+	// apply templating to all fields
 	tmpl := templater{
 		hostAddr: ec.hostAddr,
 		hostName: ec.hostName,
@@ -588,68 +1976,669 @@ func (ec *execCmd) Line(ctx context.Context) (resp execCmdResp, err error) {
 	}
 	file := tmpl.apply(ec.cmd.Line.File)
 	match := tmpl.apply(ec.cmd.Line.Match)
-	replace := tmpl.apply(ec.cmd.Line.Replace)
-	appendLine := tmpl.apply(ec.cmd.Line.Append)
 
-	// determine the operation and build the command
-	var operation string
-	var operationCmd string
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return resp, ec.errorFmt("invalid line match %q: %w", match, err)
+	}
+	le := &lineEdit{
+		re:           re,
+		delete:       ec.cmd.Line.Delete,
+		replace:      tmpl.apply(ec.cmd.Line.Replace),
+		backrefs:     ec.cmd.Line.Backrefs,
+		append:       tmpl.apply(ec.cmd.Line.Append),
+		insertAfter:  tmpl.apply(ec.cmd.Line.InsertAfter),
+		insertBefore: tmpl.apply(ec.cmd.Line.InsertBefore),
+	}
+	operation := le.operation()
+	if operation == "" {
+		return resp, ec.errorFmt("invalid line command configuration: no operation specified")
+	}
+
+	changed, err := ec.editFile(ctx, file, le.apply)
+	if err != nil {
+		return resp, ec.errorFmt("can't execute line %s on %s: %w", operation, ec.hostAddr, err)
+	}
+
+	resp.details = fmt.Sprintf(" {line: %s, %s: %s}", file, operation, match)
+	switch {
+	case operation == "delete":
+		resp.details = fmt.Sprintf(" {line: %s, delete: %s, removed: %d}", file, match, le.removed)
+	case operation == "append" && !changed:
+		resp.details = fmt.Sprintf(" {line: %s, match: %s, skip: pattern found}", file, match)
+	}
+	if changed {
+		resp.status = cmdChanged
+	}
+	return resp, nil
+}
+
+// lineEdit is a line operation of the line command
+type lineEdit struct {
+	re           *regexp.Regexp
+	delete       bool
+	replace      string
+	backrefs     bool // expand $1, ${name} in replace with submatches
+	append       string
+	insertAfter  string
+	insertBefore string
+
+	removed int // number of deleted lines, set by apply
+}
 
+// operation returns the name of the operation, empty if nothing set
+func (le *lineEdit) operation() string {
 	switch {
-	case ec.cmd.Line.Delete:
-		operation = "delete"
-		// use sed to delete lines matching the pattern
-		operationCmd = fmt.Sprintf("sed -i '\\|%s|d' %s", match, file)
-
-	case replace != "":
-		operation = "replace"
-		// use sed to replace lines matching the pattern.
-		// strip leading ^ and trailing $ from match since sed pattern already wraps with ^.* and .*$
-		sedMatch := strings.TrimPrefix(match, "^")
-		sedMatch = strings.TrimSuffix(sedMatch, "$")
-		operationCmd = fmt.Sprintf("sed -i 's|^.*%s.*$|%s|' %s", sedMatch, replace, file)
-
-	case appendLine != "":
-		operation = "append"
-		// first check if the pattern exists in the file
-		checkCmd := fmt.Sprintf("grep -q '%s' %s", match, file)
-		checkCmd = ec.wrapWithSudo(checkCmd)
-		if _, err := ec.exec.Run(ctx, checkCmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
-			// pattern not found, append the line using tee -a for proper sudo support
-			if ec.cmd.Options.Sudo {
-				operationCmd = fmt.Sprintf("echo '%s' | sudo tee -a %s > /dev/null", appendLine, file)
-			} else {
-				operationCmd = fmt.Sprintf("echo '%s' | tee -a %s > /dev/null", appendLine, file)
+	case le.delete:
+		return "delete"
+	case le.replace != "":
+		return "replace"
+	case le.append != "":
+		return "append"
+	case le.insertAfter != "":
+		return "insert_after"
+	case le.insertBefore != "":
+		return "insert_before"
+	}
+	return ""
+}
+
+// apply returns the content changed by the operation
+func (le *lineEdit) apply(current []byte) ([]byte, error) {
+	lines := splitLines(current)
+
+	switch le.operation() {
+	case "delete":
+		le.removed = 0
+		res := make([]string, 0, len(lines))
+		for _, l := range lines {
+			if le.re.MatchString(trimEOL(l)) {
+				le.removed++
+				continue
 			}
-		} else {
-			// pattern found, skip
-			resp.details = fmt.Sprintf(" {line: %s, match: %s, skip: pattern found}", file, match)
-			return resp, nil
+			res = append(res, l)
+		}
+		return []byte(strings.Join(res, "")), nil
+
+	case "replace":
+		// the whole matching line is replaced, not just the matching part
+		for i, l := range lines {
+			line := trimEOL(l)
+			m := le.re.FindStringSubmatchIndex(line)
+			if m == nil {
+				continue
+			}
+			repl := le.replace
+			if le.backrefs {
+				repl = string(le.re.ExpandString(nil, le.replace, line, m))
+			}
+			lines[i] = repl + l[len(line):] // keep the original line ending
 		}
+		return []byte(strings.Join(lines, "")), nil
 
-	default:
-		return resp, ec.errorFmt("invalid line command configuration: no operation specified")
+	case "append":
+		for _, l := range lines {
+			if le.re.MatchString(trimEOL(l)) {
+				return current, nil // pattern found, nothing to append
+			}
+		}
+		return []byte(strings.Join(insertLines(lines, len(lines), le.append+"\n"), "")), nil
+
+	case "insert_after", "insert_before":
+		text, after := le.insertAfter, true
+		if le.insertBefore != "" {
+			text, after = le.insertBefore, false
+		}
+		pos := len(lines) // no match, add to the end
+		for i := len(lines) - 1; i >= 0; i-- {
+			line := trimEOL(lines[i])
+			if line == text {
+				return current, nil // the line is already in the file
+			}
+			if pos == len(lines) && le.re.MatchString(line) {
+				pos = i
+				if after {
+					pos = i + 1
+				}
+			}
+		}
+		return []byte(strings.Join(insertLines(lines, pos, text+"\n"), "")), nil
+	}
+	return nil, fmt.Errorf("no operation specified")
+}
+
+// splitLines splits content to lines, each line keeps its line ending
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
 	}
+	return lines
+}
+
+// trimEOL removes line ending
+func trimEOL(line string) string {
+	return strings.TrimRight(line, "\r\n")
+}
 
-	// handle sudo if needed (append operation handles sudo internally)
-	if operation != "append" {
-		operationCmd = ec.wrapWithSudo(operationCmd)
+// insertLines inserts new lines at pos, adding missing newline to the previous line
+func insertLines(lines []string, pos int, newLines ...string) []string {
+	if pos > 0 && !strings.HasSuffix(lines[pos-1], "\n") {
+		lines[pos-1] += "\n"
 	}
+	return slices.Concat(lines[:pos], newLines, lines[pos:])
+}
 
-	// execute the operation
-	_, err = ec.exec.Run(ctx, operationCmd, &executor.RunOpts{Verbose: ec.verbose})
+// defaultBlockMarker is the marker of managed blocks, {mark} is replaced by BEGIN and END
+const defaultBlockMarker = "# {mark} SPOT MANAGED BLOCK"
+
+// Block inserts, replaces or removes a block of lines delimited by marker lines. The file is changed only if
+// the resulting content differs, so the command is idempotent and reports changed status accordingly.
+func (ec *execCmd) Block(ctx context.Context) (resp execCmdResp, err error) {
+	cond, err := ec.checkCondition(ctx)
 	if err != nil {
-		return resp, ec.errorFmt("can't execute line %s on %s: %w", operation, ec.hostAddr, err)
+		return resp, err
+	}
+	if !cond {
+		resp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
+		resp.status = cmdSkipped
+		return resp, nil
 	}
 
-	resp.details = fmt.Sprintf(" {line: %s, %s: %s}", file, operation, match)
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	marker := ec.cmd.Block.Marker
+	if marker == "" {
+		marker = defaultBlockMarker
+	}
+	blk := managedBlock{
+		content:      tmpl.apply(ec.cmd.Block.Content),
+		begin:        strings.ReplaceAll(tmpl.apply(marker), "{mark}", "BEGIN"),
+		end:          strings.ReplaceAll(tmpl.apply(marker), "{mark}", "END"),
+		insertAfter:  tmpl.apply(ec.cmd.Block.InsertAfter),
+		insertBefore: tmpl.apply(ec.cmd.Block.InsertBefore),
+		delete:       ec.cmd.Block.Delete,
+	}
+	file := tmpl.apply(ec.cmd.Block.File)
+
+	resp.details = fmt.Sprintf(" {block: %s}", file)
+	if blk.delete {
+		resp.details = fmt.Sprintf(" {block: %s, delete: true}", file)
+	}
+
+	changed, err := ec.editFile(ctx, file, blk.apply)
+	if err != nil {
+		return resp, ec.errorFmt("can't update block in %s on %s: %w", file, ec.hostAddr, err)
+	}
+	if changed {
+		resp.status = cmdChanged
+	}
+	return resp, nil
+}
+
+// managedBlock is a block of lines between begin and end marker lines
+type managedBlock struct {
+	content      string
+	begin, end   string
+	insertAfter  string
+	insertBefore string
+	delete       bool
+}
+
+// apply returns the content with the block inserted, replaced or removed
+func (b managedBlock) apply(current []byte) ([]byte, error) {
+	lines := splitLines(current)
+
+	beginIdx, endIdx := -1, -1
+	for i, l := range lines {
+		if beginIdx < 0 && trimEOL(l) == b.begin {
+			beginIdx = i
+			continue
+		}
+		if beginIdx >= 0 && trimEOL(l) == b.end {
+			endIdx = i
+			break
+		}
+	}
+	if beginIdx >= 0 && endIdx < 0 {
+		return nil, fmt.Errorf("block end marker %q not found", b.end)
+	}
+
+	var block []string
+	if !b.delete {
+		block = append(block, b.begin+"\n")
+		for l := range strings.SplitSeq(strings.TrimSuffix(b.content, "\n"), "\n") {
+			block = append(block, l+"\n")
+		}
+		block = append(block, b.end+"\n")
+	}
+
+	if beginIdx >= 0 { // existing block, replace or remove it
+		return []byte(strings.Join(slices.Concat(lines[:beginIdx], block, lines[endIdx+1:]), "")), nil
+	}
+	if b.delete {
+		return current, nil // nothing to remove
+	}
+
+	pos, err := b.insertPos(lines)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(insertLines(lines, pos, block...), "")), nil
+}
+
+// insertPos returns the line index to insert a new block at. The last matching line is used,
+// the block is appended to the end if nothing matches. BOF and EOF mean the beginning and the end of the file
+// for both insert_after and insert_before.
+func (b managedBlock) insertPos(lines []string) (int, error) {
+	pattern, after := b.insertAfter, true
+	if b.insertBefore != "" {
+		pattern, after = b.insertBefore, false
+	}
+	switch pattern {
+	case "", "EOF":
+		return len(lines), nil
+	case "BOF":
+		return 0, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return 0, fmt.Errorf("invalid insert pattern %q: %w", pattern, err)
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		if !re.MatchString(trimEOL(lines[i])) {
+			continue
+		}
+		if after {
+			return i + 1, nil
+		}
+		return i, nil
+	}
+	return len(lines), nil
+}
+
+// Cron adds, updates or removes the named entry in the user's crontab or in the cron.d file. The entry with its
+// environment lines is kept between marker comments with the entry name, other lines are never changed. The entry
+// in cron.d file has the user field, root if not set. Reports changed only if the crontab or the file was modified.
+func (ec *execCmd) Cron(ctx context.Context) (resp execCmdResp, err error) {
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	c := ec.cmd.Cron
+	name, user := tmpl.apply(c.Name), tmpl.apply(c.User)
+
+	entry := tmpl.apply(c.Schedule)
+	if c.File != "" {
+		if user == "" {
+			user = "root"
+		}
+		entry += " " + user // system crontab files have the user field
+	}
+	lines := make([]string, 0, len(c.Env)+1)
+	for _, e := range c.Env {
+		lines = append(lines, tmpl.apply(e))
+	}
+	blk := managedBlock{
+		content: strings.Join(append(lines, entry+" "+tmpl.apply(c.Job)), "\n"),
+		begin:   "# BEGIN SPOT CRON " + name,
+		end:     "# END SPOT CRON " + name,
+		delete:  c.State == "absent",
+	}
+
+	target, changed := "", false
+	if c.File != "" {
+		file := c.File
+		if !filepath.IsAbs(file) {
+			file = "/etc/cron.d/" + file
+		}
+		target = "file: " + file
+		if changed, err = ec.editFile(ctx, file, blk.apply); err != nil {
+			return resp, ec.errorFmt("can't update cron %s in %s on %s: %w", name, file, ec.hostAddr, err)
+		}
+	} else {
+		target = "crontab: " + user
+		if user == "" {
+			target = "crontab: current user"
+		}
+		if changed, err = ec.editCrontab(ctx, user, blk.apply); err != nil {
+			return resp, ec.errorFmt("can't update cron %s on %s: %w", name, ec.hostAddr, err)
+		}
+	}
+
+	resp.details = fmt.Sprintf(" {cron: %s, %s}", name, target)
+	if blk.delete {
+		resp.details = fmt.Sprintf(" {cron: %s, %s, state: absent}", name, target)
+	}
+	if changed {
+		resp.status = cmdChanged
+	}
+	return resp, nil
+}
+
+// editCrontab changes the crontab of the user, of the current one if not set, with read-modify-write the same way
+// as editFile does. The crontab is read with crontab -l, a missing crontab is passed as empty content. The changed
+// crontab is uploaded to a private temporary directory and installed with crontab command. In dry run the crontab
+// can't be read and is reported as changed, in check mode the diff is shown and nothing is created on the host.
+func (ec *execCmd) editCrontab(ctx context.Context, user string, change func(current []byte) ([]byte, error)) (bool, error) {
+	reader := ec.reader()
+	if isDry(reader) {
+		return true, nil
+	}
+	userOpt := ""
+	if user != "" {
+		userOpt = "-u " + shellQuote(user) + " "
+	}
+
+	current, err := ec.readCrontab(ctx, reader, userOpt)
+	if err != nil {
+		return false, fmt.Errorf("can't read crontab: %w", err)
+	}
+	updated, err := change(current)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(current, updated) {
+		return false, nil
+	}
+	if dry, ok := ec.exec.(*executor.Dry); ok {
+		return true, dry.DiffContent(strings.TrimSpace("crontab "+user), current, updated)
+	}
+
+	localDir, err := os.MkdirTemp("", "spot-cron")
+	if err != nil {
+		return false, fmt.Errorf("can't create temp dir: %w", err)
+	}
+	defer os.RemoveAll(localDir) // nolint
+	localFile := filepath.Join(localDir, "crontab")
+	if err = os.WriteFile(localFile, updated, 0o600); err != nil {
+		return false, err
+	}
+
+	tmpRemoteDir := ec.uniqueTmp(tmpRemoteDirPrefix)
+	if _, err = ec.exec.Run(ctx, fmt.Sprintf("mkdir -p -m 700 %s", tmpRemoteDir), nil); err != nil {
+		return false, fmt.Errorf("can't create temporary directory: %w", err)
+	}
+	defer func() {
+		if _, e := ec.exec.Run(ctx, fmt.Sprintf("rm -rf %s", tmpRemoteDir), nil); e != nil {
+			log.Printf("[WARN] can't remove temporary directory %q on %s: %v", tmpRemoteDir, ec.hostAddr, e)
+		}
+	}()
+	// not using filepath.Join because we want to keep the linux slash
+	newFile := tmpRemoteDir + "/crontab"
+	if err = ec.exec.Upload(ctx, localFile, newFile, &executor.UpDownOpts{Force: true}); err != nil {
+		return false, fmt.Errorf("can't upload crontab: %w", err)
+	}
+	installCmd := ec.wrapWithSudo(fmt.Sprintf("crontab %s%s", userOpt, newFile))
+	if _, err := ec.exec.Run(ctx, installCmd, &executor.RunOpts{Verbose: ec.verbose}); err != nil {
+		return false, fmt.Errorf("can't install crontab: %w", err)
+	}
+	return true, nil
+}
+
+// readCrontab reads the crontab with crontab -l without creating anything on the host, so it is safe in check mode.
+// The crontab is base64 encoded, as executors return the output by lines and drop empty ones.
+// A missing crontab is returned as empty content.
+func (ec *execCmd) readCrontab(ctx context.Context, reader executor.Interface, userOpt string) ([]byte, error) {
+	readCmd := fmt.Sprintf("err=$(crontab %[1]s-l 2>&1 >/dev/null) || { echo \"$err\" | grep -q 'no crontab' && exit 0; "+
+		"echo \"$err\" >&2; exit 1; }; crontab %[1]s-l | base64", userOpt)
+	out, err := reader.Run(ctx, ec.shellCmd(readCmd), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := base64.StdEncoding.DecodeString(strings.Join(out, ""))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode crontab: %w", err)
+	}
+	return res, nil
+}
+
+// editFile changes the remote file with read-modify-write. The file is downloaded, changed by the change function
+// and uploaded back only if the content differs. A missing file is passed as empty content and created.
+// With sudo the file is read and written with a copy in a private temporary directory. The mode of an existing file
+// is kept. In dry run the diff is shown instead. Returns true if the file was (or would be) changed.
+func (ec *execCmd) editFile(ctx context.Context, file string, change func(current []byte) ([]byte, error)) (bool, error) {
+	changed := false
+	track := func(current []byte) ([]byte, error) {
+		res, err := change(current)
+		changed = err == nil && !bytes.Equal(res, current)
+		return res, err
+	}
+
+	if dry, ok := ec.exec.(*executor.Dry); ok {
+		if err := dry.DiffFunc(ctx, file, track); err != nil {
+			return false, err
+		}
+		return changed, nil
+	}
+
+	localDir, err := os.MkdirTemp("", "spot-edit")
+	if err != nil {
+		return false, fmt.Errorf("can't create temp dir: %w", err)
+	}
+	defer os.RemoveAll(localDir) // nolint
+	localFile := filepath.Join(localDir, filepath.Base(file))
+
+	src, dst := file, file // remote file to download from and to upload to
+	if ec.cmd.Options.Sudo {
+		tmpRemoteDir, cleanup, err := ec.sudoTmpDir(ctx)
+		if err != nil {
+			return false, err
+		}
+		defer cleanup()
+		// not using filepath.Join because we want to keep the linux slash
+		src, dst = tmpRemoteDir+"/"+filepath.Base(file), tmpRemoteDir+"/"+filepath.Base(file)+".new"
+	}
+
+	exists, perm, err := ec.readRemote(ctx, file, src, localFile)
+	if err != nil {
+		return false, err
+	}
+	var current []byte
+	if exists {
+		if current, err = os.ReadFile(localFile); err != nil { // nolint
+			return false, err
+		}
+	}
+	updated, err := track(current)
+	if err != nil {
+		return false, err
+	}
+	if !changed || (!exists && len(updated) == 0) {
+		return false, nil
+	}
+
+	if err := os.WriteFile(localFile, updated, perm); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(localFile, perm); err != nil { // write file is subject to umask
+		return false, err
+	}
+	if err := ec.exec.Upload(ctx, localFile, dst, &executor.UpDownOpts{Force: true}); err != nil {
+		return false, fmt.Errorf("can't upload %s: %w", file, err)
+	}
+	if ec.cmd.Options.Sudo {
+		// cp keeps the owner and mode of the existing destination file
+		if _, err := ec.exec.Run(ctx, ec.wrapWithSudo(fmt.Sprintf("cp %s %s", dst, shellQuote(file))), nil); err != nil {
+			return false, fmt.Errorf("can't copy %s: %w", file, err)
+		}
+	}
+	return true, nil
+}
+
+// sudoTmpDir creates a private temporary directory on the remote host for copies of files read and written with sudo.
+// Returns the directory and the function removing it.
+func (ec *execCmd) sudoTmpDir(ctx context.Context) (dir string, cleanup func(), err error) {
+	dir = ec.uniqueTmp(tmpRemoteDirPrefix)
+	if _, err := ec.exec.Run(ctx, fmt.Sprintf("mkdir -p -m 700 %s", dir), nil); err != nil {
+		return "", nil, fmt.Errorf("can't create temporary directory: %w", err)
+	}
+	cleanup = func() {
+		if _, e := ec.exec.Run(ctx, ec.wrapWithSudo(fmt.Sprintf("rm -rf %s", dir)), nil); e != nil {
+			log.Printf("[WARN] can't remove temporary directory %q on %s: %v", dir, ec.hostAddr, e)
+		}
+	}
+	return dir, cleanup, nil
+}
+
+// readRemote downloads the remote file to the local one. With sudo the remote file is copied to src first.
+// Returns false if the remote file doesn't exist and the mode to write the file with.
+func (ec *execCmd) readRemote(ctx context.Context, file, src, localFile string) (exists bool, perm os.FileMode, err error) {
+	perm = 0o644
+	if !ec.cmd.Options.Sudo {
+		fi, err := ec.exec.Stat(ctx, file)
+		if os.IsNotExist(err) {
+			return false, perm, nil
+		}
+		if err != nil {
+			return false, perm, fmt.Errorf("can't stat %s: %w", file, err)
+		}
+		if fi.IsDir() {
+			return false, perm, fmt.Errorf("%s is a directory", file)
+		}
+		perm = fi.Mode().Perm()
+	} else {
+		if _, err := ec.exec.Run(ctx, ec.wrapWithSudo(fmt.Sprintf("test -f %s", shellQuote(file))), nil); err != nil {
+			return false, perm, nil // the file doesn't exist or is not a regular file
+		}
+		for _, c := range []string{fmt.Sprintf("cp %s %s", shellQuote(file), src), fmt.Sprintf("chmod a+r %s", src)} {
+			if _, err := ec.exec.Run(ctx, ec.wrapWithSudo(c), nil); err != nil {
+				return false, perm, fmt.Errorf("can't read %s: %w", file, err)
+			}
+		}
+	}
+	if err := ec.exec.Download(ctx, src, localFile, &executor.UpDownOpts{Force: true}); err != nil {
+		return false, perm, fmt.Errorf("can't download %s: %w", file, err)
+	}
+	return true, perm, nil
+}
+
+// isDry reports if the executor is a dry run one, i.e. nothing is really executed
+func isDry(ex executor.Interface) bool {
+	_, ok := ex.(*executor.Dry)
+	return ok
+}
+
+// applyStatusRules evaluates failed_when and changed_when expressions of the command against its result.
+// failed_when replaces the default "non-zero exit code is a failure" rule of scripts, errors without exit code
+// (e.g. connection failures) are never masked. changed_when replaces the status detected by the command itself.
+func (ec *execCmd) applyStatusRules(resp execCmdResp, runErr error) (execCmdResp, error) {
+	if dry, ok := ec.exec.(*executor.Dry); ok {
+		// nothing was executed, the status is what the real run would do
+		if runErr == nil && resp.status == cmdOk && dry.Changed() {
+			resp.status = cmdChanged
+		}
+		return resp, runErr
+	}
+	if resp.status == cmdSkipped || (ec.cmd.FailedWhen == "" && ec.cmd.ChangedWhen == "") {
+		return resp, runErr
+	}
+	if runErr != nil && (ec.cmd.FailedWhen == "" || resp.exitCode <= 0) {
+		return resp, runErr
+	}
+
+	vars := ec.statusVars(resp)
+	if ec.cmd.FailedWhen != "" {
+		failed, err := expr.Eval(ec.cmd.FailedWhen, vars)
+		if err != nil {
+			return resp, ec.errorFmt("can't check failed_when on %s: %w", ec.hostAddr, err)
+		}
+		if failed && runErr != nil {
+			return resp, runErr
+		}
+		if failed {
+			return resp, ec.errorFmt("failed_when %q is true on %s", ec.cmd.FailedWhen, ec.hostAddr)
+		}
+		if runErr != nil {
+			log.Printf("[DEBUG] exit code %d of %q on %s is not a failure", resp.exitCode, ec.cmd.Name, ec.hostAddr)
+			resp.status = cmdChanged // the script completed, same as a script with zero exit code
+		}
+	}
+
+	if ec.cmd.ChangedWhen != "" {
+		changed, err := expr.Eval(ec.cmd.ChangedWhen, vars)
+		if err != nil {
+			return resp, ec.errorFmt("can't check changed_when on %s: %w", ec.hostAddr, err)
+		}
+		resp.status = cmdOk
+		if changed {
+			resp.status = cmdChanged
+		}
+	}
 	return resp, nil
 }
 
+// statusVars makes variables for failed_when and changed_when expressions. env includes command's environment
+// and variables set by the command itself.
+func (ec *execCmd) statusVars(resp execCmdResp) expr.Vars {
+	env := make(map[string]string, len(ec.cmd.Environment)+len(resp.vars))
+	maps.Copy(env, ec.cmd.Environment)
+	for k, v := range resp.vars {
+		env[k] = strings.TrimPrefix(v, "__SQ__:")
+	}
+	return expr.Vars{
+		"exit_code": resp.exitCode,
+		"stdout":    strings.Join(resp.stdout, "\n"),
+		"changed":   resp.status == cmdChanged,
+		"env":       env,
+	}
+}
+
+// pushDestinations returns remote files affected by upload of src to dst. It follows the executor's upload logic:
+// if src is a glob matching multiple files, dst is a directory with the matched files inside.
+func pushDestinations(src, dst string) []string {
+	matches, err := filepath.Glob(src)
+	if err != nil || len(matches) <= 1 {
+		return []string{dst}
+	}
+	res := make([]string, 0, len(matches))
+	for _, m := range matches {
+		res = append(res, filepath.Join(dst, filepath.Base(m)))
+	}
+	return res
+}
+
+// pullDestinations returns local files affected by download of src to dst. For a glob src this is
+// the content of dst directory, as remote files are not known in advance.
+func pullDestinations(src, dst string) []string {
+	if !strings.ContainsAny(src, "*?[") {
+		return []string{dst}
+	}
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return []string{dst}
+	}
+	res := make([]string, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, filepath.Join(dst, e.Name()))
+	}
+	return res
+}
+
+// filesStamp returns a fingerprint of size, mode and modification time of the files, used to detect changes.
+// Missing files are part of the fingerprint too. ok is false if any file's state can't be determined.
+func filesStamp(files []string, stat func(string) (os.FileInfo, error)) (stamp string, ok bool) {
+	var sb strings.Builder
+	for _, f := range files {
+		fi, err := stat(f)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return "", false
+			}
+			sb.WriteString(f + ":missing\n")
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%s:%d:%v:%d\n", f, fi.Size(), fi.Mode(), fi.ModTime().UnixNano()))
+	}
+	return sb.String(), true
+}
+
 func (ec *execCmd) checkCondition(ctx context.Context) (bool, error) {
 	if ec.cmd.Condition == "" {
 		return true, nil // no condition, always allow
 	}
+	if ec.checker != nil {
+		// check mode, condition is read-only and runs on the real host
+		chk := *ec
+		chk.exec, chk.checker = ec.checker, nil
+		return chk.checkCondition(ctx)
+	}
 
 	single, multiRdr, inverted := ec.cmd.GetCondition()
 	c, _, teardown, err := ec.prepScript(ctx, single, multiRdr)
@@ -801,26 +2790,8 @@ func (tm *templater) apply(inp string) string {
 	}
 
 	res := inp
-	res = apply(res, "SPOT_REMOTE_HOST", tm.hostAddr)
-	res = apply(res, "SPOT_REMOTE_NAME", tm.hostName)
-	res = apply(res, "SPOT_COMMAND", tm.command)
-	res = apply(res, "SPOT_REMOTE_USER", tm.task.User)
-	res = apply(res, "SPOT_TASK", tm.task.Name)
-
-	// split hostAddr to SPOT_REMOTE_ADDR and SPOT_REMOTE_PORT
-	host, port, err := net.SplitHostPort(tm.hostAddr)
-	if err == nil {
-		res = apply(res, "SPOT_REMOTE_ADDR", host)
-		res = apply(res, "SPOT_REMOTE_PORT", port)
-	} else {
-		res = apply(res, "SPOT_REMOTE_ADDR", tm.hostAddr)
-		res = apply(res, "SPOT_REMOTE_PORT", "22") // set to default ssh port
-	}
-
-	if tm.err != nil {
-		res = apply(res, "SPOT_ERROR", tm.err.Error())
-	} else {
-		res = apply(res, "SPOT_ERROR", "")
+	for k, v := range tm.spotVars() {
+		res = apply(res, k, v)
 	}
 
 	for k, v := range tm.env {
@@ -838,6 +2809,29 @@ func (tm *templater) apply(inp string) string {
 	return res
 }
 
+// spotVars returns predefined SPOT_* variables
+func (tm *templater) spotVars() map[string]string {
+	res := map[string]string{
+		"SPOT_REMOTE_HOST": tm.hostAddr,
+		"SPOT_REMOTE_NAME": tm.hostName,
+		"SPOT_COMMAND":     tm.command,
+		"SPOT_REMOTE_USER": tm.task.User,
+		"SPOT_TASK":        tm.task.Name,
+		"SPOT_ERROR":       "",
+	}
+
+	// split hostAddr to SPOT_REMOTE_ADDR and SPOT_REMOTE_PORT
+	res["SPOT_REMOTE_ADDR"], res["SPOT_REMOTE_PORT"] = tm.hostAddr, "22" // default ssh port
+	if host, port, err := net.SplitHostPort(tm.hostAddr); err == nil {
+		res["SPOT_REMOTE_ADDR"], res["SPOT_REMOTE_PORT"] = host, port
+	}
+
+	if tm.err != nil {
+		res["SPOT_ERROR"] = tm.err.Error()
+	}
+	return res
+}
+
 func (ec *execCmd) uniqueTmp(defaultPrefix string) string {
 	prefix := defaultPrefix
 	if ec.sshTmpDir != "" {
@@ -879,6 +2873,39 @@ func (ec *execCmd) shell() string {
 	return ec.sshShell
 }
 
+// shellCmd makes command running the shell script, wrapped with sudo if needed
+func (ec *execCmd) shellCmd(script string) string {
+	if !ec.cmd.Options.Sudo {
+		return script // executors run commands in the shell already
+	}
+	return ec.wrapWithSudo(fmt.Sprintf("%s -c %s", ec.shell(), shellQuote(script)))
+}
+
+// withSecrets returns the templater with secrets added to the environment.
+// Use it for values never shown in logs unmasked, i.e. request headers.
+func (ec *execCmd) withSecrets(tmpl templater) templater {
+	env := maps.Clone(ec.cmd.Environment)
+	if env == nil {
+		env = map[string]string{}
+	}
+	maps.Copy(env, ec.cmd.Secrets)
+	tmpl.env = env
+	return tmpl
+}
+
+// reader returns executor for read-only commands, the real one in check mode
+func (ec *execCmd) reader() executor.Interface {
+	if ec.checker != nil {
+		return ec.checker
+	}
+	return ec.exec
+}
+
+// shellQuote quotes the string with single quotes for the shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // wrapWithSudo wraps a command with sudo, using password if available
 func (ec *execCmd) wrapWithSudo(cmd string) string {
 	if !ec.cmd.Options.Sudo {
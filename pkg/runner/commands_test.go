@@ -1,24 +1,40 @@
 package runner
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/spot/pkg/config"
 	"github.com/umputun/spot/pkg/executor"
+	"github.com/umputun/spot/pkg/runner/mocks"
 )
 
 func Test_templaterApply(t *testing.T) {
@@ -926,7 +942,7 @@ func Test_execLine(t *testing.T) {
 		}
 		resp, err := ec.Line(ctx)
 		require.NoError(t, err)
-		assert.Equal(t, " {line: /tmp/test_line_delete.txt, delete: line2}", resp.details)
+		assert.Equal(t, " {line: /tmp/test_line_delete.txt, delete: line2, removed: 1}", resp.details)
 
 		// verify line was deleted
 		out, err := sess.Run(ctx, fmt.Sprintf("cat %s", testFile), nil)
@@ -1098,7 +1114,7 @@ func Test_execLine(t *testing.T) {
 		}
 		resp, err := ec.Line(ctx)
 		require.NoError(t, err)
-		assert.Equal(t, " {line: /srv/test_line_sudo/test.txt, delete: line2}", resp.details)
+		assert.Equal(t, " {line: /srv/test_line_sudo/test.txt, delete: line2, removed: 1}", resp.details)
 
 		// verify line was deleted
 		out, err := sess.Run(ctx, fmt.Sprintf("sudo cat %s", testFile), nil)
@@ -1677,3 +1693,1764 @@ func TestProcessRegisterWithTemplateVars(t *testing.T) {
 		assert.Equal(t, "env-value", resp.registered["VAR_production"], "Should match processed register var with ENV substitution")
 	})
 }
+
+func Test_execTemplate(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "app.conf.tmpl")
+	require.NoError(t, os.WriteFile(src, []byte("host={{.Host.Name}} addr={{.SPOT_REMOTE_ADDR}} port={{.PORT}}\n"+
+		"tags={{range .Host.Tags}}{{.}} {{end}}\npassword={{.Secrets.DB_PASS}}\n"), 0o600))
+
+	tsk := &config.Task{Name: "test", User: "deploy"}
+	newCmd := func(dst, mode string) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: tsk, hostAddr: "10.0.0.1:2222", hostName: "web1",
+			hostTags: []string{"web", "prod"}, cmd: config.Cmd{Name: "tmpl",
+				Template:    config.TemplateInternal{Source: src, Dest: dst, Mode: mode},
+				Environment: map[string]string{"PORT": "8080"}, Secrets: map[string]string{"DB_PASS": "pass123"}}}
+	}
+
+	t.Run("render new file", func(t *testing.T) {
+		dst := filepath.Join(tmpDir, "sub", "app.conf")
+		ec := newCmd(dst, "")
+		resp, err := ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {template: "+src+" -> "+dst+"}", resp.details)
+		assert.Equal(t, cmdChanged, resp.status)
+
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "host=web1 addr=10.0.0.1 port=8080\ntags=web prod \npassword=pass123\n", string(data))
+		fi, err := os.Stat(dst)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o644), fi.Mode().Perm())
+
+		// second run doesn't change anything
+		resp, err = ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+	})
+
+	t.Run("mode", func(t *testing.T) {
+		dst := filepath.Join(tmpDir, "mode.conf")
+		ec := newCmd(dst, "0600")
+		resp, err := ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		fi, err := os.Stat(dst)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+		// same content, mode differs
+		require.NoError(t, os.Chmod(dst, 0o644))
+		ec = newCmd(dst, "0640")
+		resp, err = ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		fi, err = os.Stat(dst)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o640), fi.Mode().Perm())
+
+		resp, err = ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+	})
+
+	t.Run("owner", func(t *testing.T) {
+		u, err := user.Current()
+		require.NoError(t, err)
+		dst := filepath.Join(tmpDir, "owner dir", "owner.conf")
+		ec := newCmd(dst, "0600")
+		ec.cmd.Template.Owner = u.Username
+		_, err = ec.Template(ctx)
+		require.NoError(t, err)
+		resp, err := ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status, "owner is already set")
+	})
+
+	t.Run("same content read with sudo", func(t *testing.T) {
+		dst := filepath.Join(tmpDir, "root-only.conf")
+		require.NoError(t, os.WriteFile(dst, []byte("host=web1 addr=10.0.0.1 port=8080\ntags=web prod \npassword=pass123\n"), 0o600))
+		local := executor.NewLocal(logs)
+		mock := &mocks.InterfaceMock{
+			StatFunc: func(ctx context.Context, file string) (os.FileInfo, error) { return local.Stat(ctx, file) },
+			RunFunc:  func(context.Context, string, *executor.RunOpts) ([]string, error) { return nil, nil },
+			DownloadFunc: func(_ context.Context, remote, localFile string, _ *executor.UpDownOpts) error {
+				assert.NotEqual(t, dst, remote, "file read from the copy made with sudo")
+				data, err := os.ReadFile(dst)
+				require.NoError(t, err)
+				return os.WriteFile(localFile, data, 0o600)
+			},
+		}
+		ec := newCmd(dst, "")
+		ec.exec, ec.cmd.Options.Sudo = mock, true
+		resp, err := ec.Template(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		assert.Empty(t, mock.UploadCalls(), "same content is not uploaded")
+		require.Len(t, mock.DownloadCalls(), 1)
+		cmds := []string{}
+		for _, c := range mock.RunCalls() {
+			cmds = append(cmds, c.C)
+		}
+		assert.Contains(t, cmds, "sudo cp '"+dst+"' "+mock.DownloadCalls()[0].Remote)
+	})
+
+	t.Run("missing variable", func(t *testing.T) {
+		ec := newCmd(filepath.Join(tmpDir, "missing.conf"), "")
+		ec.cmd.Environment = nil
+		_, err := ec.Template(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't render template "+src)
+		assert.Contains(t, err.Error(), `map has no entry for key "PORT"`)
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		bad := filepath.Join(tmpDir, "bad.tmpl")
+		require.NoError(t, os.WriteFile(bad, []byte("line1\n{{.PORT\n"), 0o600))
+		ec := newCmd(filepath.Join(tmpDir, "bad.conf"), "")
+		ec.cmd.Template.Source = bad
+		_, err := ec.Template(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "bad.tmpl:2")
+	})
+
+	t.Run("dry run shows diff", func(t *testing.T) {
+		dst := filepath.Join(tmpDir, "dry.conf")
+		require.NoError(t, os.WriteFile(dst, []byte("host=old\n"), 0o600))
+		stdout := captureStdOut(t, func() {
+			dryLogs := executor.MakeLogs(false, true, []string{"pass123"})
+			ec := newCmd(dst, "")
+			ec.exec = executor.NewDry(dryLogs).WithReader(executor.NewLocal(dryLogs))
+			_, err := ec.Template(ctx)
+			require.NoError(t, err)
+		})
+		assert.Contains(t, stdout, "-host=old\n")
+		assert.Contains(t, stdout, "+host=web1 addr=10.0.0.1 port=8080\n")
+		assert.Contains(t, stdout, "+password=****\n")
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, "host=old\n", string(data))
+	})
+}
+
+func Test_execCmd_renderGoTemplates(t *testing.T) {
+	tsk := &config.Task{Name: "deploy", User: "app"}
+	newCmd := func(cmd config.Cmd) execCmd {
+		cmd.Environment = map[string]string{"SERVICES": "api,worker", "PORT": "", "NAME": "__SQ__:my$app"}
+		cmd.Secrets = map[string]string{"TOKEN": "secret123"}
+		return execCmd{tsk: tsk, hostAddr: "10.0.0.1:22", hostName: "web1", hostVars: map[string]string{"REGION": "eu"},
+			cmd: cmd}
+	}
+
+	t.Run("fields and helpers", func(t *testing.T) {
+		ec := newCmd(config.Cmd{Name: "start",
+			Script: `echo {{ env "PORT" | default "8080" }} {{ .SERVICES | upper }} {{ split "," .SERVICES | join ";" }} ` +
+				`{{ hostVar "REGION" }} {{ secret "TOKEN" }} {{ .Host.Name | lower }} {{ toJSON .Host.Vars }} {{ env "NAME" }}`,
+			Echo:  "{{ .SPOT_TASK }}@{{ .SPOT_REMOTE_ADDR }}",
+			Copy:  config.CopyInternal{Source: "conf/{{ .Host.Name }}.conf", Dest: "/etc/app.conf"},
+			MCopy: []config.CopyInternal{{Source: "a", Dest: "/opt/{{ hostVar \"REGION\" }}/a"}},
+			Line:  config.LineInternal{File: "/etc/hosts", Match: "^api", Replace: "{{ .SPOT_REMOTE_ADDR }} api"},
+			Wait:  config.WaitInternal{TCP: "{{ .SPOT_REMOTE_ADDR }}:{{ env \"PORT\" | default \"80\" }}"},
+		})
+		mcopy := ec.cmd.MCopy
+		require.NoError(t, ec.renderGoTemplates(templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: tsk,
+			command: ec.cmd.Name, env: ec.cmd.Environment}))
+		assert.Equal(t, `echo 8080 API,WORKER api;worker eu secret123 web1 {"REGION":"eu"} my$app`, ec.cmd.Script)
+		assert.Equal(t, "deploy@10.0.0.1", ec.cmd.Echo)
+		assert.Equal(t, "conf/web1.conf", ec.cmd.Copy.Source)
+		assert.Equal(t, "/opt/eu/a", ec.cmd.MCopy[0].Dest)
+		assert.Equal(t, "/opt/{{ hostVar \"REGION\" }}/a", mcopy[0].Dest, "original slice not changed")
+		assert.Equal(t, "10.0.0.1 api", ec.cmd.Line.Replace)
+		assert.Equal(t, "^api", ec.cmd.Line.Match)
+		assert.Equal(t, "10.0.0.1:80", ec.cmd.Wait.TCP)
+	})
+
+	t.Run("parse error points at task, command and line", func(t *testing.T) {
+		ec := newCmd(config.Cmd{Name: "start", Script: "echo 1\necho {{ unknown }}"})
+		err := ec.renderGoTemplates(templater{task: tsk, env: ec.cmd.Environment})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `template: task "deploy", command "start", script:2: function "unknown" not defined`)
+	})
+
+	t.Run("missing variable", func(t *testing.T) {
+		ec := newCmd(config.Cmd{Name: "start", Echo: "{{ .MISSING }}"})
+		err := ec.renderGoTemplates(templater{task: tsk, env: ec.cmd.Environment})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `task "deploy", command "start", echo:1:3: executing`)
+		assert.Contains(t, err.Error(), `map has no entry for key "MISSING"`)
+	})
+
+	t.Run("missing secret", func(t *testing.T) {
+		ec := newCmd(config.Cmd{Name: "start", Script: `echo {{ secret "NOPE" }}`})
+		err := ec.renderGoTemplates(templater{task: tsk, env: ec.cmd.Environment})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `secret "NOPE" not loaded`)
+	})
+}
+
+func Test_managedBlockApply(t *testing.T) {
+	begin, end := "# BEGIN SPOT MANAGED BLOCK", "# END SPOT MANAGED BLOCK"
+	tbl := []struct {
+		name    string
+		blk     managedBlock
+		inp     string
+		want    string
+		wantErr string
+	}{
+		{"append to empty", managedBlock{content: "a\nb"}, "", begin + "\na\nb\n" + end + "\n", ""},
+		{"append to the end", managedBlock{content: "a"}, "l1\nl2\n", "l1\nl2\n" + begin + "\na\n" + end + "\n", ""},
+		{"append to the end without newline", managedBlock{content: "a\n"}, "l1", "l1\n" + begin + "\na\n" + end + "\n", ""},
+		{"replace existing", managedBlock{content: "new"}, "l1\n" + begin + "\nold1\nold2\n" + end + "\nl2\n",
+			"l1\n" + begin + "\nnew\n" + end + "\nl2\n", ""},
+		{"same block", managedBlock{content: "a"}, "l1\n" + begin + "\na\n" + end + "\n", "l1\n" + begin + "\na\n" + end + "\n", ""},
+		{"delete existing", managedBlock{delete: true}, "l1\n" + begin + "\na\n" + end + "\nl2\n", "l1\nl2\n", ""},
+		{"delete missing", managedBlock{delete: true}, "l1\nl2\n", "l1\nl2\n", ""},
+		{"insert after last match", managedBlock{content: "a", insertAfter: "^Host"}, "Host 1\nx\nHost 2\ny\n",
+			"Host 1\nx\nHost 2\n" + begin + "\na\n" + end + "\ny\n", ""},
+		{"insert before last match", managedBlock{content: "a", insertBefore: "^Match"}, "l1\nMatch all\nl2\n",
+			"l1\n" + begin + "\na\n" + end + "\nMatch all\nl2\n", ""},
+		{"insert before BOF", managedBlock{content: "a", insertBefore: "BOF"}, "l1\n", begin + "\na\n" + end + "\nl1\n", ""},
+		{"insert after BOF", managedBlock{content: "a", insertAfter: "BOF"}, "l1\n", begin + "\na\n" + end + "\nl1\n", ""},
+		{"insert before EOF", managedBlock{content: "a", insertBefore: "EOF"}, "l1\n", "l1\n" + begin + "\na\n" + end + "\n", ""},
+		{"insert after no match", managedBlock{content: "a", insertAfter: "^none"}, "l1\n", "l1\n" + begin + "\na\n" + end + "\n", ""},
+		{"invalid insert pattern", managedBlock{content: "a", insertAfter: "(["}, "l1\n", "", "invalid insert pattern"},
+		{"no end marker", managedBlock{content: "a"}, "l1\n" + begin + "\nx\n", "", "block end marker"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.blk.begin, tt.blk.end = begin, end
+			res, err := tt.blk.apply([]byte(tt.inp))
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(res))
+		})
+	}
+}
+
+func Test_execBlock(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+	file := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(file, []byte("127.0.0.1 localhost\n"), 0o640))
+
+	newCmd := func(blk config.BlockInternal) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "block", Block: blk, Environment: map[string]string{"DB": "10.0.0.2"}}}
+	}
+
+	ec := newCmd(config.BlockInternal{File: file, Content: "10.0.0.1 app\n{DB} db", Marker: "# {mark} hosts"})
+	resp, err := ec.Block(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, " {block: "+file+"}", resp.details)
+	assert.Equal(t, cmdChanged, resp.status)
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n# BEGIN hosts\n10.0.0.1 app\n10.0.0.2 db\n# END hosts\n", string(data))
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), fi.Mode().Perm(), "mode is kept")
+
+	resp, err = ec.Block(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, cmdOk, resp.status, "second run changes nothing")
+
+	t.Run("dry run", func(t *testing.T) {
+		stdout := captureStdOut(t, func() {
+			dryLogs := executor.MakeLogs(false, true, nil)
+			ec := newCmd(config.BlockInternal{File: file, Marker: "# {mark} hosts", Delete: true})
+			ec.exec = executor.NewDry(dryLogs).WithReader(executor.NewLocal(dryLogs))
+			resp, err := ec.Block(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, cmdChanged, resp.status)
+		})
+		assert.Contains(t, stdout, "-10.0.0.1 app\n")
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "10.0.0.1 app")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ec := newCmd(config.BlockInternal{File: file, Marker: "# {mark} hosts", Delete: true})
+		resp, err := ec.Block(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {block: "+file+", delete: true}", resp.details)
+		assert.Equal(t, cmdChanged, resp.status)
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1 localhost\n", string(data))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "new.conf")
+		del := newCmd(config.BlockInternal{File: missing, Delete: true})
+		resp, err := del.Block(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		_, err = os.Stat(missing)
+		assert.ErrorIs(t, err, os.ErrNotExist, "nothing to delete, file not created")
+
+		ec := newCmd(config.BlockInternal{File: missing, Content: "key=value"})
+		resp, err = ec.Block(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		data, err := os.ReadFile(missing)
+		require.NoError(t, err)
+		assert.Equal(t, "# BEGIN SPOT MANAGED BLOCK\nkey=value\n# END SPOT MANAGED BLOCK\n", string(data))
+	})
+
+	t.Run("condition false", func(t *testing.T) {
+		ec := newCmd(config.BlockInternal{File: file, Content: "x"})
+		ec.cmd.Condition = "false"
+		resp, err := ec.Block(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdSkipped, resp.status)
+	})
+}
+
+func Test_lineEditApply(t *testing.T) {
+	tbl := []struct {
+		name    string
+		le      lineEdit
+		inp     string
+		want    string
+		removed int
+	}{
+		{"delete", lineEdit{re: regexp.MustCompile(`^#`), delete: true}, "#c1\nkey=1\n#c2\n", "key=1\n", 2},
+		{"delete nothing", lineEdit{re: regexp.MustCompile(`^#`), delete: true}, "key=1\n", "key=1\n", 0},
+		{"delete with quotes and slashes", lineEdit{re: regexp.MustCompile(`path='/usr/local/bin'`), delete: true},
+			"a\nexport path='/usr/local/bin'\n", "a\n", 1},
+		{"replace whole line", lineEdit{re: regexp.MustCompile(`port=`), replace: "port=8080"},
+			"host=a\n  port=80\r\n", "host=a\nport=8080\r\n", 0},
+		{"replace literal dollar", lineEdit{re: regexp.MustCompile(`^PS1=`), replace: "PS1=$HOME"}, "PS1=x\n", "PS1=$HOME\n", 0},
+		{"replace with backrefs", lineEdit{re: regexp.MustCompile(`^(\w+)=(\d+)$`), replace: "${1}=[$2]", backrefs: true},
+			"a=1\nb=x\nc=3", "a=[1]\nb=x\nc=[3]", 0},
+		{"append", lineEdit{re: regexp.MustCompile(`^debug=`), append: "debug=true"}, "a=1", "a=1\ndebug=true\n", 0},
+		{"append to empty", lineEdit{re: regexp.MustCompile(`^debug=`), append: "debug=true"}, "", "debug=true\n", 0},
+		{"append found", lineEdit{re: regexp.MustCompile(`^debug=`), append: "debug=true"}, "debug=false\n", "debug=false\n", 0},
+		{"insert after last match", lineEdit{re: regexp.MustCompile(`^\[`), insertAfter: "port=1"},
+			"[a]\nx=1\n[b]\ny=2\n", "[a]\nx=1\n[b]\nport=1\ny=2\n", 0},
+		{"insert before last match", lineEdit{re: regexp.MustCompile(`^Match`), insertBefore: "PermitRootLogin no"},
+			"Port 22\nMatch user x\n", "Port 22\nPermitRootLogin no\nMatch user x\n", 0},
+		{"insert existing line", lineEdit{re: regexp.MustCompile(`^Match`), insertBefore: "Port 22"},
+			"Port 22\nMatch user x\n", "Port 22\nMatch user x\n", 0},
+		{"insert without match", lineEdit{re: regexp.MustCompile(`^none`), insertAfter: "z"}, "a\n", "a\nz\n", 0},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := tt.le.apply([]byte(tt.inp))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(res))
+			assert.Equal(t, tt.removed, tt.le.removed)
+		})
+	}
+}
+
+func Test_execLineLocal(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+	file := filepath.Join(t.TempDir(), "app.conf")
+	require.NoError(t, os.WriteFile(file, []byte("# comment 1\nhost=localhost\n# comment 2\nport=80\n"), 0o600))
+
+	run := func(line config.LineInternal) (execCmdResp, error) {
+		line.File = file
+		ec := execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, cmd: config.Cmd{Name: "line", Line: line}}
+		return ec.Line(ctx)
+	}
+
+	resp, err := run(config.LineInternal{Match: "^#", Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, " {line: "+file+", delete: ^#, removed: 2}", resp.details)
+	assert.Equal(t, cmdChanged, resp.status)
+
+	resp, err = run(config.LineInternal{Match: "^#", Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, " {line: "+file+", delete: ^#, removed: 0}", resp.details)
+	assert.Equal(t, cmdOk, resp.status)
+
+	resp, err = run(config.LineInternal{Match: `^port=(\d+)$`, Replace: "port=${1}80", Backrefs: true})
+	require.NoError(t, err)
+	assert.Equal(t, cmdChanged, resp.status)
+
+	resp, err = run(config.LineInternal{Match: "^host=", InsertAfter: "user='app' # quoted/slashed"})
+	require.NoError(t, err)
+	assert.Equal(t, " {line: "+file+", insert_after: ^host=}", resp.details)
+	assert.Equal(t, cmdChanged, resp.status)
+
+	resp, err = run(config.LineInternal{Match: "^debug=", Append: "debug=true"})
+	require.NoError(t, err)
+	assert.Equal(t, cmdChanged, resp.status)
+	resp, err = run(config.LineInternal{Match: "^debug=", Append: "debug=true"})
+	require.NoError(t, err)
+	assert.Equal(t, " {line: "+file+", match: ^debug=, skip: pattern found}", resp.details)
+	assert.Equal(t, cmdOk, resp.status)
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "host=localhost\nuser='app' # quoted/slashed\nport=8080\ndebug=true\n", string(data))
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm(), "mode is kept")
+
+	_, err = run(config.LineInternal{Match: "([", Delete: true})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid line match")
+}
+
+func Test_execUnarchive(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+	files := map[string]string{"app/bin/app": "binary", "app/conf/app.yml": "port: 8080", "app/README.md": "readme"}
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	archives := map[string]string{}
+	for _, ext := range []string{".tar", ".tar.gz", ".tar.zst", ".zip"} {
+		archives[ext] = makeTestArchive(t, "app"+ext, files, mtime)
+	}
+
+	newCmd := func(src, dst string) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "unarchive", Unarchive: config.UnarchiveInternal{Source: src, Dest: dst}}}
+	}
+
+	for ext, archive := range archives {
+		t.Run("extract "+ext, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "srv")
+			ec := newCmd(archive, dst)
+			ec.cmd.Unarchive.StripComponents = 1
+			resp, err := ec.Unarchive(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, " {unarchive: "+archive+" -> "+dst+"}", resp.details)
+			assert.Equal(t, cmdChanged, resp.status)
+
+			data, err := os.ReadFile(filepath.Join(dst, "conf", "app.yml"))
+			require.NoError(t, err)
+			assert.Equal(t, "port: 8080", string(data))
+			fi, err := os.Stat(filepath.Join(dst, "bin", "app"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+			assert.True(t, fi.ModTime().Equal(mtime))
+
+			// second run uploads nothing
+			resp, err = ec.Unarchive(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, cmdOk, resp.status)
+		})
+	}
+
+	t.Run("exclude and mode", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "srv")
+		ec := newCmd(archives[".tar.gz"], dst)
+		ec.cmd.Unarchive.Exclude = []string{"app/conf", "app/*.md"}
+		ec.cmd.Unarchive.Mode = "0750"
+		resp, err := ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+
+		_, err = os.Stat(filepath.Join(dst, "app", "bin", "app"))
+		require.NoError(t, err)
+		_, err = os.Stat(filepath.Join(dst, "app", "conf"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(filepath.Join(dst, "app", "README.md"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		fi, err := os.Stat(dst)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o750), fi.Mode().Perm())
+
+		resp, err = ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+	})
+
+	t.Run("owner", func(t *testing.T) {
+		u, err := user.Current()
+		require.NoError(t, err)
+		dst := filepath.Join(t.TempDir(), "srv")
+		ec := newCmd(archives[".zip"], dst)
+		ec.cmd.Unarchive.Owner = u.Username
+		_, err = ec.Unarchive(ctx)
+		require.NoError(t, err)
+		resp, err := ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status, "owner already set")
+	})
+
+	t.Run("creates guard", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "srv")
+		require.NoError(t, os.MkdirAll(filepath.Join(dst, "app"), 0o750))
+		ec := newCmd(archives[".tar"], dst)
+		ec.cmd.Unarchive.Creates = filepath.Join(dst, "app")
+		resp, err := ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		assert.Contains(t, resp.details, "skip: "+filepath.Join(dst, "app")+" exists")
+		_, err = os.Stat(filepath.Join(dst, "app", "README.md"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("symlinks", func(t *testing.T) {
+		linked := map[string]string{"app/bin/app": "binary", "app/current": "symlink:bin", "app/bin/run": "symlink:app"}
+		for _, ext := range []string{".tar.gz", ".zip"} {
+			dst := filepath.Join(t.TempDir(), "srv")
+			ec := newCmd(makeTestArchive(t, "links"+ext, linked, mtime), dst)
+			ec.cmd.Unarchive.StripComponents = 1
+			resp, err := ec.Unarchive(ctx)
+			require.NoError(t, err, ext)
+			assert.Equal(t, cmdChanged, resp.status, ext)
+			for link, target := range map[string]string{"current": "bin", "bin/run": "app"} {
+				res, err := os.Readlink(filepath.Join(dst, link))
+				require.NoError(t, err, ext)
+				assert.Equal(t, target, res, ext)
+			}
+			data, err := os.ReadFile(filepath.Join(dst, "current", "app"))
+			require.NoError(t, err)
+			assert.Equal(t, "binary", string(data))
+
+			resp, err = ec.Unarchive(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, cmdOk, resp.status, "links are already set, "+ext)
+		}
+	})
+
+	t.Run("symlink outside destination", func(t *testing.T) {
+		for _, target := range []string{"../../etc", "/etc/passwd"} {
+			archive := makeTestArchive(t, "bad.tar", map[string]string{"app/conf": "symlink:" + target}, mtime)
+			ec := newCmd(archive, t.TempDir())
+			_, err := ec.Unarchive(ctx)
+			require.ErrorContains(t, err, `link "app/conf" in archive points outside of the destination to "`+target+`"`)
+		}
+	})
+
+	t.Run("unsupported entry", func(t *testing.T) {
+		archive := filepath.Join(t.TempDir(), "fifo.tar")
+		fh, err := os.Create(archive)
+		require.NoError(t, err)
+		tw := tar.NewWriter(fh)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "app/fifo", Mode: 0o644, Typeflag: tar.TypeFifo}))
+		require.NoError(t, tw.Close())
+		require.NoError(t, fh.Close())
+		ec := newCmd(archive, t.TempDir())
+		_, err = ec.Unarchive(ctx)
+		require.ErrorContains(t, err, `unsupported entry "app/fifo" of type '6' in archive`)
+	})
+
+	t.Run("remote archive", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "srv")
+		ec := newCmd(archives[".tar.zst"], dst)
+		ec.cmd.Unarchive.Remote = true
+		ec.cmd.Unarchive.StripComponents = 2
+		resp, err := ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, " {unarchive: "+archives[".tar.zst"]+" -> "+dst+", remote: true}", resp.details)
+		data, err := os.ReadFile(filepath.Join(dst, "app"))
+		require.NoError(t, err)
+		assert.Equal(t, "binary", string(data))
+
+		resp, err = ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status, "nothing changed")
+
+		require.NoError(t, os.WriteFile(filepath.Join(dst, "app"), []byte("modified"), 0o600))
+		resp, err = ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		data, err = os.ReadFile(filepath.Join(dst, "app"))
+		require.NoError(t, err)
+		assert.Equal(t, "binary", string(data))
+	})
+
+	t.Run("remote archive with exclude and links", func(t *testing.T) {
+		linked := map[string]string{"app/bin/app": "binary", "app/conf/app.yml": "port: 8080", "app/my notes.md": "notes",
+			"app/current": "symlink:bin"}
+		for _, ext := range []string{".tar", ".tar.gz", ".zip"} {
+			dst := filepath.Join(t.TempDir(), "srv dir")
+			ec := newCmd(makeTestArchive(t, "remote"+ext, linked, mtime), dst)
+			ec.cmd.Unarchive.Remote = true
+			ec.cmd.Unarchive.StripComponents = 1
+			ec.cmd.Unarchive.Exclude = []string{"conf", "my notes.*"}
+			resp, err := ec.Unarchive(ctx)
+			require.NoError(t, err, ext)
+			assert.Equal(t, cmdChanged, resp.status, ext)
+
+			data, err := os.ReadFile(filepath.Join(dst, "current", "app"))
+			require.NoError(t, err, ext)
+			assert.Equal(t, "binary", string(data))
+			_, err = os.Stat(filepath.Join(dst, "conf"))
+			assert.ErrorIs(t, err, os.ErrNotExist, ext)
+			_, err = os.Stat(filepath.Join(dst, "my notes.md"))
+			assert.ErrorIs(t, err, os.ErrNotExist, ext)
+
+			resp, err = ec.Unarchive(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, cmdOk, resp.status, ext)
+		}
+	})
+
+	t.Run("remote archive missing", func(t *testing.T) {
+		ec := newCmd(filepath.Join(t.TempDir(), "missing.tar.gz"), t.TempDir())
+		ec.cmd.Unarchive.Remote = true
+		_, err := ec.Unarchive(ctx)
+		require.ErrorContains(t, err, "can't extract archive")
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "srv")
+		ec := newCmd(archives[".tar.gz"], dst)
+		ec.exec = executor.NewDry(logs).WithReader(executor.NewLocal(logs))
+		resp, err := ec.Unarchive(ctx)
+		require.NoError(t, err)
+		assert.True(t, ec.exec.(*executor.Dry).Changed())
+		assert.Equal(t, cmdChanged, resp.status, "sync plan has files to upload")
+		_, err = os.Stat(dst)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("unsupported format", func(t *testing.T) {
+		src := filepath.Join(t.TempDir(), "app.rar")
+		require.NoError(t, os.WriteFile(src, []byte("rar"), 0o600))
+		ec := newCmd(src, t.TempDir())
+		_, err := ec.Unarchive(ctx)
+		require.ErrorContains(t, err, "unsupported archive format")
+	})
+
+	t.Run("path outside destination", func(t *testing.T) {
+		archive := makeTestArchive(t, "bad.tar.gz", map[string]string{"../evil.txt": "evil"}, mtime)
+		ec := newCmd(archive, t.TempDir())
+		_, err := ec.Unarchive(ctx)
+		require.ErrorContains(t, err, `invalid path "../evil.txt" in archive`)
+	})
+}
+
+// makeTestArchive creates archive of the format matching the name with the given files,
+// files under bin are executable. Content "symlink:target" makes a symbolic link to the target.
+func makeTestArchive(t *testing.T, name string, files map[string]string, mtime time.Time) string {
+	t.Helper()
+	res := filepath.Join(t.TempDir(), name)
+	fh, err := os.Create(res)
+	require.NoError(t, err)
+	defer fh.Close()
+
+	names := slices.Sorted(maps.Keys(files))
+	mode := func(name string) int64 {
+		if strings.Contains(name, "/bin/") {
+			return 0o755
+		}
+		return 0o644
+	}
+
+	if strings.HasSuffix(name, ".zip") {
+		zw := zip.NewWriter(fh)
+		for _, n := range names {
+			hdr := &zip.FileHeader{Name: n, Method: zip.Deflate, Modified: mtime}
+			hdr.SetMode(os.FileMode(mode(n)))
+			content := files[n]
+			if target, ok := strings.CutPrefix(content, "symlink:"); ok {
+				hdr.SetMode(os.ModeSymlink | 0o777)
+				content = target
+			}
+			w, err := zw.CreateHeader(hdr)
+			require.NoError(t, err)
+			_, err = w.Write([]byte(content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+		return res
+	}
+
+	var wr io.WriteCloser = fh
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		wr = gzip.NewWriter(fh)
+	case strings.HasSuffix(name, ".tar.zst"):
+		wr, err = zstd.NewWriter(fh)
+		require.NoError(t, err)
+	}
+	tw := tar.NewWriter(wr)
+	for _, n := range names {
+		if target, ok := strings.CutPrefix(files[n], "symlink:"); ok {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: n, Mode: 0o777, Linkname: target, ModTime: mtime,
+				Typeflag: tar.TypeSymlink}))
+			continue
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: n, Mode: mode(n), Size: int64(len(files[n])),
+			ModTime: mtime, Typeflag: tar.TypeReg}))
+		_, err = tw.Write([]byte(files[n]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, wr.Close())
+	return res
+}
+
+func Test_execFetch(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+	body := []byte("release binary")
+	sum256 := fmt.Sprintf("%x", sha256.Sum256(body))
+	sum512 := fmt.Sprintf("%x", sha512.Sum512(body))
+
+	var reqs atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs.Add(1)
+		if r.URL.Path == "/private" && r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	newCmd := func(url, dst, checksum string) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "fetch", Fetch: config.FetchInternal{URL: url, Dest: dst, Checksum: checksum}}}
+	}
+
+	t.Run("download with checksum", func(t *testing.T) {
+		reqs.Store(0)
+		dst := filepath.Join(t.TempDir(), "bin", "app")
+		ec := newCmd(ts.URL+"/app", dst, "sha256:"+sum256)
+		resp, err := ec.Fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {fetch: "+ts.URL+"/app -> "+dst+"}", resp.details)
+		assert.Equal(t, cmdChanged, resp.status)
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, body, data)
+
+		// destination matches, nothing downloaded
+		ec = newCmd(ts.URL+"/app", dst, "sha512:"+sum512)
+		resp, err = ec.Fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		assert.Contains(t, resp.details, "skip: checksum match")
+		assert.Equal(t, int32(1), reqs.Load())
+
+		// destination differs, downloaded again
+		require.NoError(t, os.WriteFile(dst, []byte("old"), 0o600))
+		resp, err = ec.Fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, int32(2), reqs.Load())
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(ts.URL+"/app", dst, "sha256:"+strings.Repeat("0", 64))
+		_, err := ec.Fetch(ctx)
+		require.ErrorContains(t, err, "checksum mismatch, expected sha256:"+strings.Repeat("0", 64)+", got sha256:"+sum256)
+		_, err = os.Stat(dst)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		files, err := os.ReadDir(filepath.Dir(dst))
+		require.NoError(t, err)
+		assert.Empty(t, files, "temporary file removed")
+	})
+
+	t.Run("existing destination without checksum", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "app")
+		require.NoError(t, os.WriteFile(dst, []byte("old"), 0o600))
+		ec := newCmd(ts.URL+"/app", dst, "")
+		resp, err := ec.Fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		assert.Contains(t, resp.details, "skip: "+dst+" exists")
+
+		ec.cmd.Fetch.Force = true
+		resp, err = ec.Fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		data, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, body, data)
+	})
+
+	t.Run("headers from secrets", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(ts.URL+"/private", dst, "")
+		_, err := ec.Fetch(ctx)
+		require.ErrorContains(t, err, "can't fetch "+ts.URL+"/private")
+
+		ec.cmd.Fetch.Headers = map[string]string{"Authorization": "Bearer {TOKEN}"}
+		ec.cmd.Secrets = map[string]string{"TOKEN": "s3cret"}
+		resp, err := ec.Fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.NotContains(t, resp.details, "s3cret")
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		reqs.Store(0)
+		dst := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(ts.URL+"/app", dst, "sha256:"+sum256)
+		ec.exec = executor.NewDry(logs).WithReader(executor.NewLocal(logs))
+		resp, err := ec.Fetch(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, int32(0), reqs.Load())
+		_, err = os.Stat(dst)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func Test_execService(t *testing.T) {
+	ctx := context.Background()
+	boolPtr := func(b bool) *bool { return &b }
+
+	// fakeSystemd keeps the service state and reacts to systemctl commands
+	type fakeSystemd struct {
+		active, enabled bool
+		commands        []string
+		files           map[string]os.FileInfo // uploaded files
+	}
+	newExec := func(sd *fakeSystemd) *mocks.InterfaceMock {
+		sd.files = map[string]os.FileInfo{}
+		return &mocks.InterfaceMock{
+			RunFunc: func(_ context.Context, c string, _ *executor.RunOpts) ([]string, error) {
+				switch {
+				case strings.HasPrefix(c, "systemctl is-active"):
+					if sd.active {
+						return []string{"active"}, nil
+					}
+					return []string{"inactive"}, nil
+				case strings.HasPrefix(c, "systemctl is-enabled"):
+					if sd.enabled {
+						return []string{"enabled"}, nil
+					}
+					return []string{"disabled"}, nil
+				}
+				sd.commands = append(sd.commands, c)
+				switch {
+				case strings.Contains(c, "systemctl start"), strings.Contains(c, "systemctl restart"):
+					sd.active = true
+				case strings.Contains(c, "systemctl stop"):
+					sd.active = false
+				case strings.Contains(c, "systemctl enable"):
+					sd.enabled = true
+				case strings.Contains(c, "systemctl disable"):
+					sd.enabled = false
+				}
+				return nil, nil
+			},
+			StatFunc: func(_ context.Context, remote string) (os.FileInfo, error) {
+				if fi, ok := sd.files[remote]; ok {
+					return fi, nil
+				}
+				return nil, os.ErrNotExist
+			},
+			UploadFunc: func(_ context.Context, local, remote string, _ *executor.UpDownOpts) error {
+				fi, err := os.Stat(local)
+				if err != nil {
+					return err
+				}
+				sd.files[remote] = fi
+				return nil
+			},
+			DeleteFunc: func(context.Context, string, *executor.DeleteOpts) error { return nil },
+		}
+	}
+	newCmd := func(ex executor.Interface, svc config.ServiceInternal) execCmd {
+		return execCmd{exec: ex, tsk: &config.Task{Name: "test"}, hostAddr: "host1:22",
+			cmd: config.Cmd{Name: "service", Service: svc}}
+	}
+
+	tbl := []struct {
+		name     string
+		sd       fakeSystemd
+		svc      config.ServiceInternal
+		details  string
+		commands []string
+		changed  bool
+	}{
+		{name: "start and enable", sd: fakeSystemd{},
+			svc:      config.ServiceInternal{Name: "nginx", State: "started", Enabled: boolPtr(true)},
+			details:  " {service: nginx, actions: enable, start}",
+			commands: []string{"systemctl enable 'nginx'", "systemctl start 'nginx'"}, changed: true},
+		{name: "already started and enabled", sd: fakeSystemd{active: true, enabled: true},
+			svc:     config.ServiceInternal{Name: "nginx", State: "started", Enabled: boolPtr(true)},
+			details: " {service: nginx}"},
+		{name: "stop and disable", sd: fakeSystemd{active: true, enabled: true},
+			svc:      config.ServiceInternal{Name: "nginx", State: "stopped", Enabled: boolPtr(false)},
+			details:  " {service: nginx, actions: disable, stop}",
+			commands: []string{"systemctl disable 'nginx'", "systemctl stop 'nginx'"}, changed: true},
+		{name: "already stopped", sd: fakeSystemd{},
+			svc:     config.ServiceInternal{Name: "nginx", State: "stopped"},
+			details: " {service: nginx}"},
+		{name: "restarted always", sd: fakeSystemd{active: true},
+			svc:      config.ServiceInternal{Name: "nginx", State: "restarted"},
+			details:  " {service: nginx, actions: restart}",
+			commands: []string{"systemctl restart 'nginx'"}, changed: true},
+		{name: "reloaded active", sd: fakeSystemd{active: true},
+			svc:      config.ServiceInternal{Name: "nginx", State: "reloaded"},
+			details:  " {service: nginx, actions: reload}",
+			commands: []string{"systemctl reload 'nginx'"}, changed: true},
+		{name: "reloaded inactive starts", sd: fakeSystemd{},
+			svc:      config.ServiceInternal{Name: "nginx", State: "reloaded"},
+			details:  " {service: nginx, actions: start}",
+			commands: []string{"systemctl start 'nginx'"}, changed: true},
+		{name: "daemon reload only", sd: fakeSystemd{active: true},
+			svc:      config.ServiceInternal{Name: "nginx", State: "started", DaemonReload: true},
+			details:  " {service: nginx}",
+			commands: []string{"systemctl daemon-reload"}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := tt.sd
+			ec := newCmd(newExec(&sd), tt.svc)
+			resp, err := ec.Service(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tt.details, resp.details)
+			assert.Equal(t, tt.commands, sd.commands)
+			assert.Equal(t, tt.changed, resp.status == cmdChanged)
+		})
+	}
+
+	t.Run("sudo", func(t *testing.T) {
+		sd := fakeSystemd{}
+		ec := newCmd(newExec(&sd), config.ServiceInternal{Name: "nginx", State: "started"})
+		ec.cmd.Options.Sudo = true
+		_, err := ec.Service(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"sudo systemctl start 'nginx'"}, sd.commands)
+	})
+
+	t.Run("name quoted", func(t *testing.T) {
+		sd := fakeSystemd{}
+		ex := newExec(&sd)
+		ec := newCmd(ex, config.ServiceInternal{Name: "{SVC}", State: "started", Enabled: boolPtr(true)})
+		ec.cmd.Environment = map[string]string{"SVC": "app; touch /tmp/x"}
+		_, err := ec.Service(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"systemctl enable 'app; touch /tmp/x'", "systemctl start 'app; touch /tmp/x'"}, sd.commands)
+		require.Len(t, ex.RunCalls(), 4)
+		assert.Equal(t, "systemctl is-enabled 'app; touch /tmp/x' || true", ex.RunCalls()[0].C)
+		assert.Equal(t, "systemctl is-active 'app; touch /tmp/x' || true", ex.RunCalls()[2].C)
+	})
+
+	t.Run("unit with invalid name", func(t *testing.T) {
+		unit := filepath.Join(t.TempDir(), "app.service")
+		require.NoError(t, os.WriteFile(unit, []byte("[Service]\n"), 0o600))
+		ec := newCmd(newExec(&fakeSystemd{}), config.ServiceInternal{Name: "../../app", State: "started", Unit: unit})
+		_, err := ec.Service(ctx)
+		require.ErrorContains(t, err, `invalid service name "../../app" for unit file`)
+	})
+
+	t.Run("install unit", func(t *testing.T) {
+		unit := filepath.Join(t.TempDir(), "app.service")
+		require.NoError(t, os.WriteFile(unit, []byte("[Service]\nExecStart=/usr/bin/app\n"), 0o600))
+		sd := fakeSystemd{active: true}
+		ex := newExec(&sd)
+		ec := newCmd(ex, config.ServiceInternal{Name: "app", State: "started", Unit: unit})
+		resp, err := ec.Service(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {service: app, actions: install, restart}", resp.details)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, []string{"systemctl daemon-reload", "systemctl restart 'app'"}, sd.commands)
+		require.Len(t, ex.UploadCalls(), 1)
+		assert.Equal(t, "/etc/systemd/system/app.service", ex.UploadCalls()[0].Remote)
+	})
+
+	t.Run("dry run without state reader", func(t *testing.T) {
+		dry := executor.NewDry(executor.MakeLogs(false, false, nil))
+		ec := newCmd(dry, config.ServiceInternal{Name: "nginx", State: "stopped", Enabled: boolPtr(false)})
+		resp, err := ec.Service(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {service: nginx, actions: disable, stop}", resp.details, "unknown state shows all actions")
+		assert.True(t, dry.Changed())
+	})
+
+	t.Run("check mode", func(t *testing.T) {
+		sd := fakeSystemd{active: true}
+		ec := newCmd(executor.NewDry(executor.MakeLogs(false, false, nil)), config.ServiceInternal{Name: "nginx", State: "started"})
+		ec.checker = newExec(&sd)
+		resp, err := ec.Service(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {service: nginx}", resp.details, "state queried on the real host")
+		assert.Equal(t, cmdOk, resp.status)
+	})
+}
+
+func Test_execSync(t *testing.T) {
+	ctx := context.Background()
+	src, dst := t.TempDir(), t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "f1.txt"), []byte("f1"), 0o600))
+	ec := execCmd{exec: executor.NewLocal(executor.MakeLogs(false, false, nil)), tsk: &config.Task{Name: "test"},
+		hostAddr: "localhost", cmd: config.Cmd{Name: "sync", Sync: config.SyncInternal{Source: src, Dest: dst, Delete: true}}}
+
+	resp, err := ec.Sync(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, cmdChanged, resp.status, "file copied")
+	resp, err = ec.Sync(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, cmdOk, resp.status, "nothing to copy or delete")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "extra.txt"), []byte("extra"), 0o600))
+	resp, err = ec.Sync(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, cmdChanged, resp.status, "extra file deleted")
+	assert.NoFileExists(t, filepath.Join(dst, "extra.txt"))
+	resp, err = ec.Sync(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, cmdOk, resp.status)
+}
+
+func Test_execFile(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+	newCmd := func(f config.FileInternal) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "file", File: f}}
+	}
+	// run executes the command twice, the second run should change nothing
+	run := func(t *testing.T, f config.FileInternal) execCmdResp {
+		t.Helper()
+		ec := newCmd(f)
+		resp, err := ec.File(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		again, err := ec.File(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, again.status, "second run changes nothing")
+		return resp
+	}
+
+	t.Run("directory with mode", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "a", "b")
+		resp := run(t, config.FileInternal{Path: dir, State: "directory", Mode: "0750"})
+		assert.Equal(t, " {file: "+dir+", state: directory}", resp.details)
+		fi, err := os.Stat(dir)
+		require.NoError(t, err)
+		assert.True(t, fi.IsDir())
+		assert.Equal(t, os.FileMode(0o750), fi.Mode().Perm())
+	})
+
+	t.Run("directory recurse", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "f.txt"), []byte("f"), 0o644))
+		run(t, config.FileInternal{Path: dir, State: "directory", Mode: "0700", Recurse: true})
+		fi, err := os.Stat(filepath.Join(dir, "sub", "f.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o700), fi.Mode().Perm())
+	})
+
+	t.Run("directory over file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "f.txt")
+		require.NoError(t, os.WriteFile(file, []byte("f"), 0o644))
+		ec := newCmd(config.FileInternal{Path: file, State: "directory"})
+		_, err := ec.File(ctx)
+		require.ErrorContains(t, err, "exists and is not a directory")
+	})
+
+	t.Run("touch", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "f.txt")
+		run(t, config.FileInternal{Path: file, State: "touch", Mode: "0600"})
+		fi, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	})
+
+	t.Run("special mode bits", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "shared")
+		run(t, config.FileInternal{Path: dir, State: "directory", Mode: "1777"})
+		fi, err := os.Stat(dir)
+		require.NoError(t, err)
+		assert.Equal(t, os.ModeSticky|0o777, fi.Mode()&(os.ModeSticky|os.ModePerm))
+
+		file := filepath.Join(dir, "tool")
+		run(t, config.FileInternal{Path: file, State: "touch", Mode: "4755"})
+		fi, err = os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.ModeSetuid|0o755, fi.Mode()&(os.ModeSetuid|os.ModePerm))
+	})
+
+	t.Run("changes without sudo go through executor", func(t *testing.T) {
+		dir := t.TempDir()
+		local := executor.NewLocal(logs)
+		mock := &mocks.InterfaceMock{
+			StatFunc:   local.Stat,
+			MkdirFunc:  local.Mkdir,
+			TouchFunc:  local.Touch,
+			ChmodFunc:  local.Chmod,
+			DeleteFunc: local.Delete,
+			RunFunc: func(ctx context.Context, c string, opts *executor.RunOpts) ([]string, error) {
+				if strings.HasPrefix(c, "readlink ") { // read-only check, allowed
+					return local.Run(ctx, c, opts)
+				}
+				return nil, fmt.Errorf("unexpected command %q", c)
+			},
+		}
+		for _, f := range []config.FileInternal{
+			{Path: filepath.Join(dir, "a", "b"), State: "directory", Mode: "0750"},
+			{Path: filepath.Join(dir, "a", "b", "f.txt"), State: "touch", Mode: "0600"},
+			{Path: filepath.Join(dir, "a"), State: "absent"},
+		} {
+			ec := newCmd(f)
+			ec.exec = mock
+			resp, err := ec.File(ctx)
+			require.NoError(t, err, f.State)
+			assert.Equal(t, cmdChanged, resp.status, f.State)
+		}
+		assert.Len(t, mock.MkdirCalls(), 1)
+		assert.Len(t, mock.TouchCalls(), 1)
+		assert.Len(t, mock.ChmodCalls(), 2)
+		assert.Len(t, mock.DeleteCalls(), 1)
+		for _, c := range mock.RunCalls() {
+			assert.True(t, strings.HasPrefix(c.C, "readlink "), c.C)
+		}
+		_, err := os.Stat(filepath.Join(dir, "a"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("link", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "r1"), 0o755))
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "r2"), 0o755))
+		link := filepath.Join(dir, "current")
+		resp := run(t, config.FileInternal{Path: link, State: "link", Source: filepath.Join(dir, "r1")})
+		assert.Equal(t, " {file: "+link+", state: link, src: "+filepath.Join(dir, "r1")+"}", resp.details)
+		run(t, config.FileInternal{Path: link, State: "link", Source: filepath.Join(dir, "r2")})
+		target, err := os.Readlink(link)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "r2"), target)
+
+		ec := newCmd(config.FileInternal{Path: filepath.Join(dir, "r1"), State: "link", Source: "/tmp"})
+		_, err = ec.File(ctx)
+		require.ErrorContains(t, err, "exists and is not a link")
+	})
+
+	t.Run("absent", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "d", "sub"), 0o755))
+		run(t, config.FileInternal{Path: filepath.Join(dir, "d"), State: "absent"})
+		_, err := os.Stat(filepath.Join(dir, "d"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		dangling := filepath.Join(dir, "dangling")
+		require.NoError(t, os.Symlink(filepath.Join(dir, "missing"), dangling))
+		run(t, config.FileInternal{Path: dangling, State: "absent"})
+		_, err = os.Lstat(dangling)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("owner and group", func(t *testing.T) {
+		u, err := user.Current()
+		require.NoError(t, err)
+		g, err := user.LookupGroupId(u.Gid)
+		require.NoError(t, err)
+		dir := t.TempDir()
+		ec := newCmd(config.FileInternal{Path: dir, State: "directory", Owner: u.Username, Group: g.Name, Recurse: true})
+		resp, err := ec.File(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status, "owner already set")
+	})
+
+	t.Run("multiple paths", func(t *testing.T) {
+		dir := t.TempDir()
+		ec := newCmd(config.FileInternal{})
+		ec.cmd.MFile = []config.FileInternal{{Path: filepath.Join(dir, "d"), State: "directory"},
+			{Path: filepath.Join(dir, "d", "f"), State: "touch"}}
+		resp, err := ec.MFile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, " {file: "+filepath.Join(dir, "d")+", "+filepath.Join(dir, "d", "f")+"}", resp.details)
+		_, err = os.Stat(filepath.Join(dir, "d", "f"))
+		require.NoError(t, err)
+
+		resp, err = ec.MFile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "d")
+		dry := executor.NewDry(logs).WithReader(executor.NewLocal(logs))
+		ec := newCmd(config.FileInternal{Path: dir, State: "directory", Mode: "0700"})
+		ec.exec = dry
+		_, err := ec.File(ctx)
+		require.NoError(t, err)
+		assert.True(t, dry.Changed())
+		_, err = os.Stat(dir)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func Test_execGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+
+	// make bare repo with two commits on main, tag v1 on the first one
+	tmpDir := t.TempDir()
+	repo, work := filepath.Join(tmpDir, "repo.git"), filepath.Join(tmpDir, "work")
+	gitCmd := func(args ...string) string {
+		t.Helper()
+		c := exec.Command("git", args...)
+		c.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := c.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(content string) string {
+		t.Helper()
+		require.NoError(t, os.WriteFile(filepath.Join(work, "version.txt"), []byte(content), 0o600))
+		gitCmd("-C", work, "add", ".")
+		gitCmd("-C", work, "commit", "-q", "-m", content)
+		gitCmd("-C", work, "push", "-q", "origin", "HEAD:main")
+		return gitCmd("-C", work, "rev-parse", "HEAD")
+	}
+	gitCmd("init", "-q", "--bare", "-b", "main", repo)
+	gitCmd("clone", "-q", repo, work)
+	rev1 := commit("v1")
+	gitCmd("-C", work, "tag", "v1")
+	gitCmd("-C", work, "push", "-q", "origin", "v1")
+	rev2 := commit("v2")
+
+	newCmd := func(dest, ref string) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "git", Git: config.GitInternal{Repo: repo, Dest: dest, Ref: ref}}}
+	}
+	readVersion := func(dest string) string {
+		data, err := os.ReadFile(filepath.Join(dest, "version.txt"))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	t.Run("clone default branch and update", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(dest, "")
+		resp, err := ec.Git(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, fmt.Sprintf(" {git: %s -> %s, ref: HEAD, rev: none -> %s}", repo, dest, rev2[:7]), resp.details)
+		assert.Equal(t, map[string]string{"GIT_BEFORE": "", "GIT_AFTER": rev2}, resp.registered)
+		assert.Equal(t, "v2", readVersion(dest))
+
+		resp, err = ec.Git(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		assert.Equal(t, map[string]string{"GIT_BEFORE": rev2, "GIT_AFTER": rev2}, resp.vars)
+
+		ec = newCmd(dest, "v1")
+		resp, err = ec.Git(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, map[string]string{"GIT_BEFORE": rev2, "GIT_AFTER": rev1}, resp.vars)
+		assert.Equal(t, "v1", readVersion(dest))
+	})
+
+	t.Run("commit sha with depth", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(dest, rev1)
+		ec.cmd.Git.Depth = 1
+		resp, err := ec.Git(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, rev1, resp.vars["GIT_AFTER"])
+		assert.Equal(t, "v1", readVersion(dest))
+	})
+
+	t.Run("branch discards local changes", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(dest, "main")
+		_, err := ec.Git(ctx)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dest, "version.txt"), []byte("local"), 0o600))
+		resp, err := ec.Git(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		assert.Equal(t, "v2", readVersion(dest))
+	})
+
+	t.Run("not empty destination", func(t *testing.T) {
+		dest := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dest, "f.txt"), []byte("f"), 0o600))
+		ec := newCmd(dest, "")
+		_, err := ec.Git(ctx)
+		require.ErrorContains(t, err, "can't checkout")
+	})
+
+	t.Run("missing key secret", func(t *testing.T) {
+		ec := newCmd(t.TempDir(), "")
+		ec.cmd.Git.KeySecret = "DEPLOY_KEY"
+		_, err := ec.Git(ctx)
+		require.EqualError(t, err, `git key secret "DEPLOY_KEY" is not loaded`)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(dest, "")
+		ec.exec = executor.NewDry(logs).WithReader(executor.NewLocal(logs))
+		resp, err := ec.Git(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		_, err = os.Stat(dest)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func Test_gitScript(t *testing.T) {
+	script := gitScript("git@example.com:org/app.git", "/srv/app", "v1.2.3", 1, "/tmp/.spot-1/deploy-key")
+	assert.Contains(t, script, `export GIT_SSH_COMMAND='ssh -i /tmp/.spot-1/deploy-key -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new'`)
+	assert.Contains(t, script, `git -C "$git_dest" fetch -q --depth 1 origin 'v1.2.3'`)
+	assert.Contains(t, script, `git -C "$git_dest" remote add origin 'git@example.com:org/app.git'`)
+
+	script = gitScript("/srv/repo.git", "/srv/app", "main", 0, "")
+	assert.NotContains(t, script, "GIT_SSH_COMMAND")
+	assert.NotContains(t, script, "--depth")
+}
+
+func Test_execRelease(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "app.txt"), []byte("v2"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "debug.log"), []byte("log"), 0o600))
+
+	// base dir with three old releases, the last one is current, and a directory not named as release
+	makeBase := func(t *testing.T) string {
+		t.Helper()
+		dir := t.TempDir()
+		for _, name := range []string{"20240101000000.000000", "20240102000000.000000", "20240103000000.000000", "shared"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(dir, "releases", name), 0o750))
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "releases", name, "app.txt"), []byte(name), 0o600))
+		}
+		require.NoError(t, os.Symlink(filepath.Join(dir, "releases", "20240103000000.000000"), filepath.Join(dir, "current")))
+		return dir
+	}
+	newCmd := func(rel config.ReleaseInternal) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "release", Release: rel}}
+	}
+	readCurrent := func(t *testing.T, dir string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, "current", "app.txt"))
+		require.NoError(t, err)
+		return string(data)
+	}
+	releases := func(t *testing.T, dir string) []string {
+		t.Helper()
+		entries, err := os.ReadDir(filepath.Join(dir, "releases"))
+		require.NoError(t, err)
+		res := []string{}
+		for _, e := range entries {
+			res = append(res, e.Name())
+		}
+		return res
+	}
+
+	t.Run("deploy directory, switch and prune", func(t *testing.T) {
+		dir := makeBase(t)
+		ec := newCmd(config.ReleaseInternal{Dir: dir, Source: src, Exclude: []string{"*.log"}, Check: "test -f app.txt", Keep: 2})
+		resp, err := ec.Release(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		release := resp.vars["RELEASE_DIR"]
+		assert.Equal(t, fmt.Sprintf(" {release: %s -> %s, pruned: 2}", src, release), resp.details)
+		assert.Equal(t, map[string]string{"RELEASE_DIR": release}, resp.registered)
+
+		assert.Equal(t, "v2", readCurrent(t, dir))
+		assert.NoFileExists(t, filepath.Join(release, "debug.log"))
+		link, err := os.Readlink(filepath.Join(dir, "current"))
+		require.NoError(t, err)
+		assert.Equal(t, release, link)
+		assert.Equal(t, []string{"20240103000000.000000", filepath.Base(release), "shared"}, releases(t, dir))
+		assert.NoFileExists(t, filepath.Join(dir, ".current.spot-tmp"))
+	})
+
+	t.Run("deploys within the same second", func(t *testing.T) {
+		dir := makeBase(t)
+		ec := newCmd(config.ReleaseInternal{Dir: dir, Source: src, Keep: 10})
+		resp1, err := ec.Release(ctx)
+		require.NoError(t, err)
+		resp2, err := ec.Release(ctx)
+		require.NoError(t, err)
+		first, second := filepath.Base(resp1.vars["RELEASE_DIR"]), filepath.Base(resp2.vars["RELEASE_DIR"])
+		assert.Less(t, first, second, "names sort in the order of deployment")
+		link, err := os.Readlink(filepath.Join(dir, "current"))
+		require.NoError(t, err)
+		assert.Equal(t, second, filepath.Base(link))
+		names, err := ec.listReleases(ctx, dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"20240101000000.000000", "20240102000000.000000", "20240103000000.000000", first, second}, names)
+	})
+
+	t.Run("deploy archive to the new base dir", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "app")
+		archive := makeTestArchive(t, "app.tar.gz", map[string]string{"app-1.0/app.txt": "v3"}, time.Now())
+		ec := newCmd(config.ReleaseInternal{Dir: dir, Source: archive, StripComponents: 1})
+		resp, err := ec.Release(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, fmt.Sprintf(" {release: %s -> %s}", archive, resp.vars["RELEASE_DIR"]), resp.details)
+		assert.Equal(t, "v3", readCurrent(t, dir))
+	})
+
+	t.Run("failed check keeps current release", func(t *testing.T) {
+		dir := makeBase(t)
+		ec := newCmd(config.ReleaseInternal{Dir: dir, Source: src, Check: "test -f missing.txt"})
+		_, err := ec.Release(ctx)
+		require.ErrorContains(t, err, "release check failed")
+		assert.Equal(t, "20240103000000.000000", readCurrent(t, dir))
+		assert.Equal(t, []string{"20240101000000.000000", "20240102000000.000000", "20240103000000.000000", "shared"}, releases(t, dir))
+	})
+
+	t.Run("rollback to previous releases", func(t *testing.T) {
+		dir := makeBase(t)
+		ec := newCmd(config.ReleaseInternal{Dir: dir, Source: src})
+		ec.rollback = true
+		resp, err := ec.Rollback(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		prev := filepath.Join(dir, "releases", "20240102000000.000000")
+		assert.Equal(t, fmt.Sprintf(" {rollback: %s -> %s}", filepath.Join(dir, "current"), prev), resp.details)
+		assert.Equal(t, map[string]string{"RELEASE_DIR": prev}, resp.vars)
+		assert.Equal(t, "20240102000000.000000", readCurrent(t, dir))
+
+		_, err = ec.Rollback(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "20240101000000.000000", readCurrent(t, dir))
+
+		_, err = ec.Rollback(ctx)
+		require.ErrorContains(t, err, "no release before")
+		assert.Equal(t, "20240101000000.000000", readCurrent(t, dir))
+		assert.Len(t, releases(t, dir), 4, "rollback keeps all releases")
+	})
+
+	t.Run("rollback without current release", func(t *testing.T) {
+		ec := newCmd(config.ReleaseInternal{Dir: t.TempDir(), Source: src})
+		_, err := ec.Rollback(ctx)
+		require.ErrorContains(t, err, "no current release link")
+	})
+
+	t.Run("check mode", func(t *testing.T) {
+		dir := makeBase(t)
+		ec := newCmd(config.ReleaseInternal{Dir: dir, Source: src, Keep: 3})
+		ec.exec = executor.NewDry(logs).WithReader(executor.NewLocal(logs))
+		ec.checker = executor.NewLocal(logs)
+		resp, err := ec.Release(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Contains(t, resp.details, "pruned: 1")
+		assert.Equal(t, "20240103000000.000000", readCurrent(t, dir))
+		assert.Len(t, releases(t, dir), 4)
+
+		ec.exec, ec.checker = executor.NewDry(logs), nil
+		resp, err = ec.Rollback(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, "20240103000000.000000", readCurrent(t, dir))
+	})
+}
+
+func Test_execWaitConn(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"status": "ready", "host": "` + r.Host + `"}`))
+	}))
+	defer ts.Close()
+
+	newCmd := func(wait config.WaitInternal) execCmd {
+		wait.Timeout, wait.CheckDuration = time.Second, 10*time.Millisecond
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "wait", Wait: wait, Secrets: map[string]string{"TOKEN": "secret-token"}}}
+	}
+
+	t.Run("http ready after retries", func(t *testing.T) {
+		requests.Store(0)
+		ec := newCmd(config.WaitInternal{HTTP: config.WaitHTTP{URL: ts.URL + "/health", Body: `"status": "ready"`,
+			Headers: map[string]string{"Authorization": "Bearer {TOKEN}"}}})
+		resp, err := ec.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(" {wait: http: %s/health, timeout: 1s, duration: 0s}", ts.URL), resp.details)
+		assert.Equal(t, int32(3), requests.Load())
+	})
+
+	t.Run("http host header", func(t *testing.T) {
+		requests.Store(10)
+		ec := newCmd(config.WaitInternal{HTTP: config.WaitHTTP{URL: ts.URL, Body: `"host": "app.example.com"`,
+			Headers: map[string]string{"Authorization": "Bearer {TOKEN}", "Host": "app.example.com"}}})
+		_, err := ec.Wait(ctx)
+		require.NoError(t, err)
+	})
+
+	t.Run("http unexpected status", func(t *testing.T) {
+		ec := newCmd(config.WaitInternal{HTTP: config.WaitHTTP{URL: ts.URL}})
+		ec.cmd.Wait.Timeout = 100 * time.Millisecond
+		_, err := ec.Wait(ctx)
+		require.EqualError(t, err, "timeout exceeded, last check failed: unexpected status 401")
+
+		ec.cmd.Wait.HTTP.Status = http.StatusOK
+		_, err = ec.Wait(ctx)
+		require.EqualError(t, err, "timeout exceeded, last check failed: unexpected status 401, expected 200")
+
+		ec.cmd.Wait.HTTP.Status = http.StatusUnauthorized
+		_, err = ec.Wait(ctx)
+		require.NoError(t, err)
+	})
+
+	t.Run("http body mismatch", func(t *testing.T) {
+		requests.Store(10)
+		ec := newCmd(config.WaitInternal{HTTP: config.WaitHTTP{URL: ts.URL, Body: "^ok$",
+			Headers: map[string]string{"Authorization": "Bearer {TOKEN}"}}})
+		ec.cmd.Wait.Timeout = 100 * time.Millisecond
+		_, err := ec.Wait(ctx)
+		require.EqualError(t, err, `timeout exceeded, last check failed: response body doesn't match "^ok$"`)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := lis.Addr().String()
+		ec := newCmd(config.WaitInternal{TCP: addr})
+		resp, err := ec.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, " {wait: tcp: "+addr+", timeout: 1s, duration: 0s}", resp.details)
+
+		require.NoError(t, lis.Close())
+		ec.cmd.Wait.Timeout = 100 * time.Millisecond
+		_, err = ec.Wait(ctx)
+		require.ErrorContains(t, err, "timeout exceeded, last check failed: dial tcp "+addr)
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		ec := newCmd(config.WaitInternal{TCP: "127.0.0.1:1"})
+		ec.exec = executor.NewDry(logs)
+		_, err := ec.Wait(ctx)
+		require.NoError(t, err)
+	})
+}
+
+func Test_execCron(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+
+	// fake crontab keeps crontabs in files, crontab.<user> for -u user
+	store := t.TempDir()
+	binDir := t.TempDir()
+	fake := fmt.Sprintf(`#!/bin/sh
+store=%s/crontab
+if [ "$1" = "-u" ]; then store="$store.$2"; shift 2; fi
+if [ "$1" = "-l" ]; then
+  [ -d "$store" ] && { echo "permission denied" >&2; exit 1; }
+  [ -f "$store" ] || { echo "no crontab for user" >&2; exit 1; }
+  cat "$store"; exit 0
+fi
+cp "$1" "$store"
+`, store)
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "crontab"), []byte(fake), 0o700)) // nolint
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	newCmd := func(cron config.CronInternal) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "cron", Cron: cron, Environment: map[string]string{"APP": "/srv/app"}}}
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(store, name)) // nolint
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	t.Run("add, keep and update entry in user crontab", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(store, "crontab.app"), []byte("MAILTO=\"\"\n\n@reboot /bin/true\n"), 0o600))
+		ec := newCmd(config.CronInternal{Name: "backup", Schedule: "0 3 * * *", Job: "{APP}/backup.sh", User: "app",
+			Env: []string{"BACKUP_DIR=/var/backup"}})
+		resp, err := ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, " {cron: backup, crontab: app}", resp.details)
+		expected := "MAILTO=\"\"\n\n@reboot /bin/true\n# BEGIN SPOT CRON backup\nBACKUP_DIR=/var/backup\n" +
+			"0 3 * * * /srv/app/backup.sh\n# END SPOT CRON backup\n"
+		assert.Equal(t, expected, read("crontab.app"))
+
+		resp, err = ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+		assert.Equal(t, expected, read("crontab.app"))
+
+		ec.cmd.Cron.Schedule = "@daily"
+		resp, err = ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Contains(t, read("crontab.app"), "BACKUP_DIR=/var/backup\n@daily /srv/app/backup.sh\n# END")
+	})
+
+	t.Run("missing crontab of current user", func(t *testing.T) {
+		ec := newCmd(config.CronInternal{Name: "ping", Schedule: "*/5 * * * *", Job: "curl -s localhost/ping"})
+		resp, err := ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, " {cron: ping, crontab: current user}", resp.details)
+		assert.Equal(t, "# BEGIN SPOT CRON ping\n*/5 * * * * curl -s localhost/ping\n# END SPOT CRON ping\n", read("crontab"))
+
+		ec.cmd.Cron.State = "absent"
+		resp, err = ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, " {cron: ping, crontab: current user, state: absent}", resp.details)
+		assert.Empty(t, read("crontab"))
+
+		resp, err = ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+	})
+
+	t.Run("system cron file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "app")
+		ec := newCmd(config.CronInternal{Name: "cleanup", Schedule: "@hourly", Job: "find /tmp -mtime +1 -delete", File: file})
+		resp, err := ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, " {cron: cleanup, file: "+file+"}", resp.details)
+		data, err := os.ReadFile(file) // nolint
+		require.NoError(t, err)
+		assert.Equal(t, "# BEGIN SPOT CRON cleanup\n@hourly root find /tmp -mtime +1 -delete\n# END SPOT CRON cleanup\n", string(data))
+		fi, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o644), fi.Mode().Perm())
+
+		resp, err = ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status)
+	})
+
+	t.Run("crontab read error", func(t *testing.T) {
+		ec := newCmd(config.CronInternal{Name: "ping", Schedule: "@daily", Job: "true", User: "denied"})
+		require.NoError(t, os.Mkdir(filepath.Join(store, "crontab.denied"), 0o700)) // fake crontab fails to read it
+		_, err := ec.Cron(ctx)
+		require.ErrorContains(t, err, "can't read crontab")
+	})
+
+	t.Run("dry run and check mode", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(store, "crontab.dry"), []byte("@reboot /bin/true\n"), 0o600))
+		ec := newCmd(config.CronInternal{Name: "ping", Schedule: "@daily", Job: "true", User: "dry"})
+		ec.exec = executor.NewDry(logs)
+		resp, err := ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status, "dry run can't read crontab")
+
+		local := executor.NewLocal(logs)
+		checker := &mocks.InterfaceMock{RunFunc: local.Run} // any other call panics, i.e. upload or download
+		ec.exec = executor.NewDry(logs).WithReader(checker)
+		ec.checker = checker
+		resp, err = ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdChanged, resp.status)
+		assert.Equal(t, "@reboot /bin/true\n", read("crontab.dry"), "check mode doesn't change crontab")
+		require.Len(t, checker.RunCalls(), 1, "crontab read with a single command")
+		assert.NotContains(t, checker.RunCalls()[0].C, "mkdir", "nothing created on the host")
+
+		ec.cmd.Cron.Schedule = "@reboot"
+		ec.cmd.Cron.Job = "/bin/true"
+		ec.cmd.Cron.State = "absent"
+		resp, err = ec.Cron(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, cmdOk, resp.status, "nothing to remove")
+	})
+}
+
+func Test_execScriptRegisterJSON(t *testing.T) {
+	ctx := context.Background()
+	logs := executor.MakeLogs(false, false, nil)
+	dir := t.TempDir()
+	pods := filepath.Join(dir, "pods.json")
+	require.NoError(t, os.WriteFile(pods, []byte(`{
+  "items": [
+    {"metadata": {"name": "web-1", "uid": 12345678901234567890}, "spec": {"nodeName": "n1", "ports": [80, 443]}},
+    {"metadata": {"name": "web-2"}, "status": {"ready": true, "reason": null, "msg": "a<b"}}
+  ]
+}`), 0o600))
+
+	newCmd := func(script string, paths map[string]string) execCmd {
+		return execCmd{exec: executor.NewLocal(logs), tsk: &config.Task{Name: "test"}, hostAddr: "localhost",
+			cmd: config.Cmd{Name: "pods", Script: script, RegisterJSON: paths, Environment: map[string]string{"KIND": "POD"}}}
+	}
+
+	ec := newCmd("cat "+pods, map[string]string{
+		"POD":         "$.items[0].metadata.name",
+		"UID":         "$.items[0].metadata.uid",
+		"SPEC":        "$.items[0].spec",
+		"PORTS":       "$.items[0].spec.ports",
+		"NAMES":       "$.items[*].metadata.name",
+		"READY":       "$.items[1].status.ready",
+		"REASON":      "$.items[1].status.reason",
+		"MSG":         "$['items'][-1].status.msg",
+		"{KIND}_LAST": "$.items[-1].metadata.name",
+	})
+	resp, err := ec.Script(ctx)
+	require.NoError(t, err)
+	expected := map[string]string{
+		"POD":      "web-1",
+		"UID":      "12345678901234567890",
+		"SPEC":     `{"nodeName":"n1","ports":[80,443]}`,
+		"PORTS":    "[80,443]",
+		"NAMES":    `["web-1","web-2"]`,
+		"READY":    "true",
+		"REASON":   "",
+		"MSG":      "a<b",
+		"POD_LAST": "web-2",
+	}
+	assert.Equal(t, expected, resp.vars)
+	assert.Equal(t, expected, resp.registered)
+
+	t.Run("output with setvar lines", func(t *testing.T) {
+		file := filepath.Join(dir, "b.json")
+		require.NoError(t, os.WriteFile(file, []byte("{\"a\": {\"b\": \"c\"}}\n"), 0o600))
+		ec := newCmd("cat "+file+"\nexport X=1", map[string]string{"B": "$.a.b"})
+		ec.cmd.Register = []string{"X"}
+		resp, err := ec.Script(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"B": "c", "X": "1"}, resp.registered)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tbl := []struct {
+			name, out, path, err string
+		}{
+			{"not json", "not json", "$.a", "output is not valid json: invalid character 'o' in literal null (expecting 'u')"},
+			{"empty output", "", "$.a", "output is empty, expected json"},
+			{"trailing data", `{"a": 1} {"b": 2}`, "$.a", "output is not valid json: unexpected data after json value"},
+			{"path not found", `{"a": 1}`, "$.b", `path "$.b" not found, no value for $.b`},
+		}
+		for _, tt := range tbl {
+			t.Run(tt.name, func(t *testing.T) {
+				file := filepath.Join(t.TempDir(), "out.json")
+				require.NoError(t, os.WriteFile(file, []byte(tt.out), 0o600))
+				ec := newCmd("cat "+file, map[string]string{"V": tt.path})
+				_, err := ec.Script(ctx)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), `can't register json output of "pods" on localhost: `+tt.err)
+			})
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		ec := newCmd("cat "+pods, map[string]string{"POD": "$.items[0].metadata.name"})
+		ec.exec = executor.NewDry(logs)
+		resp, err := ec.Script(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, resp.registered)
+	})
+}
@@ -0,0 +1,273 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pkgz/syncs"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/executor"
+)
+
+// factPrefix is the prefix of environment variables with facts of the host
+const factPrefix = "SPOT_FACT_"
+
+// factsScript gathers all facts of the host in a single run. It prints facts as KEY=VALUE lines,
+// facts not available on the host are skipped or left empty. The script has no single quotes, so it is passed
+// to sh -c as a single-quoted argument as is.
+const factsScript = `echo "OS=$(uname -s | tr A-Z a-z)"
+echo "KERNEL=$(uname -r)"
+echo "ARCH=$(uname -m)"
+echo "HOSTNAME=$(hostname 2>/dev/null || uname -n)"
+if [ -r /etc/os-release ]; then
+  (. /etc/os-release; echo "DISTRO=$ID"; echo "DISTRO_VERSION=$VERSION_ID"; echo "DISTRO_NAME=$PRETTY_NAME")
+fi
+echo "CPUS=$(nproc 2>/dev/null || getconf _NPROCESSORS_ONLN 2>/dev/null || sysctl -n hw.ncpu 2>/dev/null)"
+if [ -r /proc/meminfo ]; then
+  awk "/^MemTotal:/ {print \"MEM_TOTAL_MB=\" int(\$2/1024)} /^MemAvailable:/ {print \"MEM_FREE_MB=\" int(\$2/1024)}" /proc/meminfo
+fi
+df -Pk / 2>/dev/null | awk "NR==2 {print \"DISK_ROOT_TOTAL_MB=\" int(\$2/1024); print \"DISK_ROOT_FREE_MB=\" int(\$4/1024)}"
+echo "DISKS=$(echo $(lsblk -dno NAME 2>/dev/null))"
+ips=$(hostname -I 2>/dev/null || ip -o addr show scope global 2>/dev/null | awk "{split(\$4, a, \"/\"); print a[1]}")
+echo "IPS=$(echo $ips)"
+echo "IP=$(echo $ips | cut -d" " -f1)"`
+
+// FactsCache keeps facts gathered from hosts, so each host is probed once per run. If File is set, facts are
+// also persisted to it and reused by the next runs while they are younger than TTL.
+type FactsCache struct {
+	File string
+	TTL  time.Duration
+
+	mu     sync.Mutex
+	hosts  map[string]map[string]string // facts gathered in this run, by host address
+	stored map[string]storedFacts       // facts loaded from the file, by host address
+}
+
+// storedFacts is a record of the facts cache file
+type storedFacts struct {
+	Gathered time.Time         `json:"gathered"`
+	Facts    map[string]string `json:"facts"`
+}
+
+// HostFacts holds facts gathered from a host
+type HostFacts struct {
+	Host  config.Destination
+	Facts map[string]string
+}
+
+// NewFactsCache makes facts cache, persisted to the file if it is not empty.
+func NewFactsCache(file string, ttl time.Duration) *FactsCache {
+	return &FactsCache{File: file, TTL: ttl}
+}
+
+// get returns facts of the host gathered in this run, or stored in the cache file and not expired
+func (c *FactsCache) get(addr string) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	if facts, ok := c.hosts[addr]; ok {
+		return facts, true
+	}
+	if rec, ok := c.stored[addr]; ok && time.Since(rec.Gathered) < c.TTL {
+		log.Printf("[DEBUG] use cached facts of %s gathered at %s", addr, rec.Gathered.Format(time.RFC3339))
+		c.hosts[addr] = rec.Facts
+		return rec.Facts, true
+	}
+	return nil, false
+}
+
+// put keeps facts of the host for this run and writes them to the cache file if it is set
+func (c *FactsCache) put(addr string, facts map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	c.hosts[addr] = facts
+	if c.File == "" {
+		return
+	}
+	c.stored[addr] = storedFacts{Gathered: time.Now(), Facts: facts}
+	data, err := json.MarshalIndent(c.stored, "", "  ")
+	if err != nil {
+		log.Printf("[WARN] can't marshal facts cache: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.File), 0o700); err != nil {
+		log.Printf("[WARN] can't make facts cache directory: %v", err)
+		return
+	}
+	if err := os.WriteFile(c.File, data, 0o600); err != nil {
+		log.Printf("[WARN] can't write facts cache %s: %v", c.File, err)
+	}
+}
+
+// load reads the cache file once. Missing or broken file is not an error, facts are gathered again.
+func (c *FactsCache) load() {
+	if c.hosts == nil {
+		c.hosts = make(map[string]map[string]string)
+	}
+	if c.stored != nil {
+		return
+	}
+	c.stored = make(map[string]storedFacts)
+	if c.File == "" {
+		return
+	}
+	data, err := os.ReadFile(c.File)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[WARN] can't read facts cache %s: %v", c.File, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &c.stored); err != nil {
+		log.Printf("[WARN] can't parse facts cache %s: %v", c.File, err)
+		c.stored = make(map[string]storedFacts)
+	}
+}
+
+// GatherFacts gathers facts from all hosts of the target, with the same concurrency as tasks run.
+// Facts are taken from the cache if they are already known. Returns facts in the order of target hosts.
+func (p *Process) GatherFacts(ctx context.Context, target string) ([]HostFacts, error) {
+	targetHosts, err := p.Playbook.TargetHosts(target)
+	if err != nil {
+		return nil, fmt.Errorf("can't get target %s: %w", target, err)
+	}
+	if p.Local {
+		targetHosts = []config.Destination{localDestination(targetHosts)}
+	}
+
+	res := make([]HostFacts, len(targetHosts))
+	wg := syncs.NewErrSizedGroup(p.Concurrency, syncs.Context(ctx), syncs.Preemptive)
+	for i, host := range targetHosts {
+		wg.Go(func() error {
+			var remote executor.Interface
+			defer func() {
+				if remote != nil {
+					remote.Close() // nolint
+				}
+			}()
+			facts, err := p.hostFacts(ctx, host, func() (executor.Interface, error) {
+				hostAddr := fmt.Sprintf("%s:%d", host.Host, host.Port)
+				conn, err := p.Connector.Connect(ctx, hostAddr, host.Name, host.User)
+				if err != nil {
+					return nil, fmt.Errorf("can't connect to %s: %w", hostAddr, err)
+				}
+				remote = conn
+				return conn, nil
+			})
+			res[i] = HostFacts{Host: host, Facts: facts}
+			return err
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// hostFacts returns facts of the host from the cache, or gathers them with the executor made by connect.
+// In local mode facts are gathered from the local host.
+func (p *Process) hostFacts(ctx context.Context, host config.Destination,
+	connect func() (executor.Interface, error)) (map[string]string, error) {
+	addr := fmt.Sprintf("%s:%d", host.Host, host.Port)
+	if p.Local {
+		addr = "localhost"
+	}
+	if p.FactsCache != nil {
+		if facts, ok := p.FactsCache.get(addr); ok {
+			return facts, nil
+		}
+	}
+
+	var ex executor.Interface = executor.NewLocal(p.Logs.WithHost("localhost", ""))
+	if !p.Local {
+		var err error
+		if ex, err = connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	st := time.Now()
+	out, err := ex.Run(ctx, fmt.Sprintf("sh -c %s", shellQuote(factsScript)), &executor.RunOpts{Verbose: p.Verbose2})
+	if err != nil {
+		return nil, fmt.Errorf("can't gather facts of %s: %w", addr, err)
+	}
+	facts := parseFacts(out)
+	log.Printf("[DEBUG] gathered %d facts of %s in %v", len(facts), addr, time.Since(st).Truncate(time.Millisecond))
+	if p.FactsCache != nil {
+		p.FactsCache.put(addr, facts)
+	}
+	return facts, nil
+}
+
+// parseFacts parses KEY=VALUE lines printed by facts script, other lines are ignored
+func parseFacts(lines []string) map[string]string {
+	res := make(map[string]string)
+	for _, line := range lines {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || k == "" || strings.ToUpper(k) != k || strings.ContainsAny(k, " \t") {
+			continue
+		}
+		res[k] = strings.TrimSpace(v)
+	}
+	return res
+}
+
+// setFacts sets facts of the host as SPOT_FACT_* environment variables of all task's commands and handlers.
+// Facts are predefined variables, like other SPOT_* ones, and override the environment.
+func setFacts(tsk *config.Task, facts map[string]string) {
+	if len(facts) == 0 {
+		return
+	}
+	for _, cmds := range [][]config.Cmd{tsk.Commands, tsk.Handlers} {
+		for i := range cmds {
+			if cmds[i].Environment == nil {
+				cmds[i].Environment = make(map[string]string, len(facts))
+			}
+			for k, v := range facts {
+				cmds[i].Environment[factPrefix+k] = v
+			}
+		}
+	}
+}
+
+// factsVars returns facts from the command environment for when expressions, keyed by lowercase fact name
+func factsVars(env map[string]string) map[string]any {
+	res := make(map[string]any)
+	for k, v := range env {
+		if name, ok := strings.CutPrefix(k, factPrefix); ok {
+			res[strings.ToLower(name)] = v
+		}
+	}
+	return res
+}
+
+// FormatFacts writes facts of hosts as a human-readable list, facts of each host sorted by name
+func FormatFacts(hostsFacts []HostFacts) string {
+	var sb strings.Builder
+	for _, hf := range hostsFacts {
+		name := hf.Host.Name
+		if name == "" {
+			name = hf.Host.Host
+		}
+		fmt.Fprintf(&sb, "%s (%s:%d)\n", name, hf.Host.Host, hf.Host.Port)
+		keys := make([]string, 0, len(hf.Facts))
+		for k := range hf.Facts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&sb, "  %s%s=%s\n", factPrefix, k, hf.Facts[k])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,203 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/config/deepcopy"
+	"github.com/umputun/spot/pkg/executor"
+	"github.com/umputun/spot/pkg/runner/mocks"
+)
+
+func Test_parseFacts(t *testing.T) {
+	out := []string{"OS=linux", "DISTRO_NAME=Debian GNU/Linux 12 (bookworm)", "CPUS= 4 ", "IPS=", "motd line",
+		"lower=case", "=empty", "WITH SPACE=1"}
+	assert.Equal(t, map[string]string{"OS": "linux", "DISTRO_NAME": "Debian GNU/Linux 12 (bookworm)", "CPUS": "4", "IPS": ""},
+		parseFacts(out))
+}
+
+func TestFactsCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache", "facts.json")
+
+	c := NewFactsCache(file, time.Hour)
+	_, ok := c.get("h1:22")
+	assert.False(t, ok, "empty cache")
+	c.put("h1:22", map[string]string{"OS": "linux"})
+	facts, ok := c.get("h1:22")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"OS": "linux"}, facts)
+
+	t.Run("persisted to file", func(t *testing.T) {
+		c2 := NewFactsCache(file, time.Hour)
+		facts, ok := c2.get("h1:22")
+		require.True(t, ok)
+		assert.Equal(t, map[string]string{"OS": "linux"}, facts)
+	})
+
+	t.Run("expired in file", func(t *testing.T) {
+		c2 := NewFactsCache(file, time.Nanosecond)
+		_, ok := c2.get("h1:22")
+		assert.False(t, ok)
+	})
+
+	t.Run("broken file ignored", func(t *testing.T) {
+		broken := filepath.Join(t.TempDir(), "facts.json")
+		require.NoError(t, os.WriteFile(broken, []byte("not json"), 0o600))
+		c2 := NewFactsCache(broken, time.Hour)
+		_, ok := c2.get("h1:22")
+		assert.False(t, ok)
+		c2.put("h1:22", map[string]string{"OS": "darwin"})
+		data, err := os.ReadFile(broken)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"OS": "darwin"`)
+	})
+
+	t.Run("no file, kept for the run only", func(t *testing.T) {
+		c2 := &FactsCache{}
+		c2.put("h1:22", map[string]string{"OS": "linux"})
+		_, ok := c2.get("h1:22")
+		assert.True(t, ok)
+	})
+}
+
+func TestProcess_Run_GatherFacts(t *testing.T) {
+	dir := t.TempDir()
+	marker, cacheFile := filepath.Join(dir, "marker.txt"), filepath.Join(dir, "facts.json")
+	tsk := config.Task{Name: "t", GatherFacts: true, Commands: []config.Cmd{
+		{Name: "print", Script: "echo {SPOT_FACT_OS}-$SPOT_FACT_DISTRO >> " + marker},
+		{Name: "plan9 only", Script: "echo plan9 >> " + marker, When: `facts.os == "plan9"`},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "web", Port: 22}}, nil
+		},
+	}
+	writeCache := func(gathered time.Time) {
+		data, err := json.Marshal(map[string]storedFacts{
+			"localhost": {Gathered: gathered, Facts: map[string]string{"OS": "plan9", "DISTRO": "bell"}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(cacheFile, data, 0o600))
+	}
+
+	t.Run("cached facts", func(t *testing.T) {
+		writeCache(time.Now())
+		p := &Process{Concurrency: 1, Playbook: pbook, Local: true, Logs: executor.MakeLogs(false, false, nil),
+			FactsCache: NewFactsCache(cacheFile, time.Hour)}
+		res, err := p.Run(context.Background(), "t", "all")
+		require.NoError(t, err)
+		assert.Equal(t, 2, res.Commands)
+		data, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "plan9-bell\nplan9\n", string(data))
+	})
+
+	t.Run("expired facts gathered again", func(t *testing.T) {
+		require.NoError(t, os.Remove(marker))
+		writeCache(time.Now().Add(-2 * time.Hour))
+		p := &Process{Concurrency: 1, Playbook: pbook, Local: true, Logs: executor.MakeLogs(false, false, nil),
+			FactsCache: NewFactsCache(cacheFile, time.Hour)}
+		res, err := p.Run(context.Background(), "t", "all")
+		require.NoError(t, err)
+		assert.Equal(t, 1, res.Skipped)
+		data, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), runtime.GOOS+"-")
+
+		c := NewFactsCache(cacheFile, time.Hour)
+		facts, ok := c.get("localhost")
+		require.True(t, ok, "gathered facts are stored")
+		assert.Equal(t, runtime.GOOS, facts["OS"])
+		assert.NotEmpty(t, facts["ARCH"])
+	})
+
+	t.Run("host connected for facts", func(t *testing.T) {
+		tsk.Commands = []config.Cmd{{Name: "local", Script: "echo 1", Options: config.CmdOptions{Local: true}}}
+		connector := &mocks.ConnectorMock{
+			ConnectFunc: func(_ context.Context, hostAddr, _, _ string) (*executor.Remote, error) {
+				return nil, errors.New("no route to " + hostAddr)
+			},
+		}
+		p := &Process{Concurrency: 1, Playbook: pbook, Connector: connector, Logs: executor.MakeLogs(false, false, nil)}
+		_, err := p.Run(context.Background(), "t", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "can't connect to web, user: : no route to h1:22")
+		assert.Len(t, connector.ConnectCalls(), 1)
+	})
+}
+
+func TestProcess_GatherFacts(t *testing.T) {
+	pbook := &mocks.PlaybookMock{
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "web", Port: 22, Tags: []string{"app"}}}, nil
+		},
+	}
+	p := &Process{Concurrency: 2, Playbook: pbook, Local: true, Logs: executor.MakeLogs(false, false, nil),
+		FactsCache: NewFactsCache("", time.Hour)}
+	res, err := p.GatherFacts(context.Background(), "all")
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "localhost", res[0].Host.Host)
+	assert.Equal(t, []string{"app"}, res[0].Host.Tags, "same destination as local task run")
+	assert.Equal(t, runtime.GOOS, res[0].Facts["OS"])
+
+	out := FormatFacts([]HostFacts{{Host: config.Destination{Host: "h1", Name: "web", Port: 22},
+		Facts: map[string]string{"OS": "linux", "ARCH": "x86_64"}}})
+	assert.Equal(t, "web (h1:22)\n  SPOT_FACT_ARCH=x86_64\n  SPOT_FACT_OS=linux\n", out)
+
+	t.Run("connect error", func(t *testing.T) {
+		connector := &mocks.ConnectorMock{
+			ConnectFunc: func(_ context.Context, hostAddr, _, _ string) (*executor.Remote, error) {
+				return nil, errors.New("no route to " + hostAddr)
+			},
+		}
+		p := &Process{Concurrency: 1, Playbook: pbook, Connector: connector, Logs: executor.MakeLogs(false, false, nil)}
+		_, err := p.GatherFacts(context.Background(), "all")
+		require.ErrorContains(t, err, "can't connect to h1:22: no route to h1:22")
+	})
+}
+
+func TestProcess_RunGatherFactsRemote(t *testing.T) {
+	ctx := context.Background()
+	testingHostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	logs := executor.MakeLogs(false, false, nil)
+	connector, err := executor.NewConnector("testdata/test_ssh_key", time.Second*10, logs)
+	require.NoError(t, err)
+
+	tsk := config.Task{Name: "t", GatherFacts: true, Commands: []config.Cmd{
+		{Name: "facts", Script: "export FACTS={SPOT_FACT_OS}-$SPOT_FACT_DISTRO", Register: []string{"FACTS"}},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			host, port, _ := net.SplitHostPort(testingHostAndPort)
+			portNum, _ := strconv.Atoi(port)
+			return []config.Destination{{Host: host, Port: portNum, Name: "test", User: "test"}}, nil
+		},
+	}
+	p := Process{Concurrency: 1, Connector: connector, Playbook: pbook, Logs: logs, FactsCache: NewFactsCache("", time.Hour)}
+	res, err := p.Run(ctx, "t", "all")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"FACTS": "linux-alpine"}, res.Registered)
+}
@@ -5,6 +5,7 @@ package mocks
 
 import (
 	"context"
+	"os"
 	"sync"
 
 	"github.com/umputun/spot/pkg/executor"
@@ -16,6 +17,9 @@ import (
 //
 //		// make and configure a mocked executor.Interface
 //		mockedInterface := &InterfaceMock{
+//			ChmodFunc: func(ctx context.Context, remoteFile string, mode os.FileMode) error {
+//				panic("mock out the Chmod method")
+//			},
 //			CloseFunc: func() error {
 //				panic("mock out the Close method")
 //			},
@@ -25,12 +29,24 @@ import (
 //			DownloadFunc: func(ctx context.Context, remote string, local string, opts *executor.UpDownOpts) error {
 //				panic("mock out the Download method")
 //			},
+//			MkdirFunc: func(ctx context.Context, remoteDir string) error {
+//				panic("mock out the Mkdir method")
+//			},
+//			PlanSyncFunc: func(ctx context.Context, localDir string, remoteDir string, opts *executor.SyncOpts) (executor.SyncPlan, error) {
+//				panic("mock out the PlanSync method")
+//			},
 //			RunFunc: func(ctx context.Context, c string, opts *executor.RunOpts) ([]string, error) {
 //				panic("mock out the Run method")
 //			},
+//			StatFunc: func(ctx context.Context, remoteFile string) (os.FileInfo, error) {
+//				panic("mock out the Stat method")
+//			},
 //			SyncFunc: func(ctx context.Context, localDir string, remoteDir string, opts *executor.SyncOpts) ([]string, error) {
 //				panic("mock out the Sync method")
 //			},
+//			TouchFunc: func(ctx context.Context, remoteFile string) error {
+//				panic("mock out the Touch method")
+//			},
 //			UploadFunc: func(ctx context.Context, local string, remote string, opts *executor.UpDownOpts) error {
 //				panic("mock out the Upload method")
 //			},
@@ -41,6 +57,9 @@ import (
 //
 //	}
 type InterfaceMock struct {
+	// ChmodFunc mocks the Chmod method.
+	ChmodFunc func(ctx context.Context, remoteFile string, mode os.FileMode) error
+
 	// CloseFunc mocks the Close method.
 	CloseFunc func() error
 
@@ -50,17 +69,38 @@ type InterfaceMock struct {
 	// DownloadFunc mocks the Download method.
 	DownloadFunc func(ctx context.Context, remote string, local string, opts *executor.UpDownOpts) error
 
+	// MkdirFunc mocks the Mkdir method.
+	MkdirFunc func(ctx context.Context, remoteDir string) error
+
+	// PlanSyncFunc mocks the PlanSync method.
+	PlanSyncFunc func(ctx context.Context, localDir string, remoteDir string, opts *executor.SyncOpts) (executor.SyncPlan, error)
+
 	// RunFunc mocks the Run method.
 	RunFunc func(ctx context.Context, c string, opts *executor.RunOpts) ([]string, error)
 
+	// StatFunc mocks the Stat method.
+	StatFunc func(ctx context.Context, remoteFile string) (os.FileInfo, error)
+
 	// SyncFunc mocks the Sync method.
 	SyncFunc func(ctx context.Context, localDir string, remoteDir string, opts *executor.SyncOpts) ([]string, error)
 
+	// TouchFunc mocks the Touch method.
+	TouchFunc func(ctx context.Context, remoteFile string) error
+
 	// UploadFunc mocks the Upload method.
 	UploadFunc func(ctx context.Context, local string, remote string, opts *executor.UpDownOpts) error
 
 	// calls tracks calls to the methods.
 	calls struct {
+		// Chmod holds details about calls to the Chmod method.
+		Chmod []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// RemoteFile is the remoteFile argument value.
+			RemoteFile string
+			// Mode is the mode argument value.
+			Mode os.FileMode
+		}
 		// Close holds details about calls to the Close method.
 		Close []struct {
 		}
@@ -84,6 +124,24 @@ type InterfaceMock struct {
 			// Opts is the opts argument value.
 			Opts *executor.UpDownOpts
 		}
+		// Mkdir holds details about calls to the Mkdir method.
+		Mkdir []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// RemoteDir is the remoteDir argument value.
+			RemoteDir string
+		}
+		// PlanSync holds details about calls to the PlanSync method.
+		PlanSync []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// LocalDir is the localDir argument value.
+			LocalDir string
+			// RemoteDir is the remoteDir argument value.
+			RemoteDir string
+			// Opts is the opts argument value.
+			Opts *executor.SyncOpts
+		}
 		// Run holds details about calls to the Run method.
 		Run []struct {
 			// Ctx is the ctx argument value.
@@ -93,6 +151,13 @@ type InterfaceMock struct {
 			// Opts is the opts argument value.
 			Opts *executor.RunOpts
 		}
+		// Stat holds details about calls to the Stat method.
+		Stat []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// RemoteFile is the remoteFile argument value.
+			RemoteFile string
+		}
 		// Sync holds details about calls to the Sync method.
 		Sync []struct {
 			// Ctx is the ctx argument value.
@@ -104,6 +169,13 @@ type InterfaceMock struct {
 			// Opts is the opts argument value.
 			Opts *executor.SyncOpts
 		}
+		// Touch holds details about calls to the Touch method.
+		Touch []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// RemoteFile is the remoteFile argument value.
+			RemoteFile string
+		}
 		// Upload holds details about calls to the Upload method.
 		Upload []struct {
 			// Ctx is the ctx argument value.
@@ -116,14 +188,59 @@ type InterfaceMock struct {
 			Opts *executor.UpDownOpts
 		}
 	}
+	lockChmod    sync.RWMutex
 	lockClose    sync.RWMutex
 	lockDelete   sync.RWMutex
 	lockDownload sync.RWMutex
+	lockMkdir    sync.RWMutex
+	lockPlanSync sync.RWMutex
 	lockRun      sync.RWMutex
+	lockStat     sync.RWMutex
 	lockSync     sync.RWMutex
+	lockTouch    sync.RWMutex
 	lockUpload   sync.RWMutex
 }
 
+// Chmod calls ChmodFunc.
+func (mock *InterfaceMock) Chmod(ctx context.Context, remoteFile string, mode os.FileMode) error {
+	if mock.ChmodFunc == nil {
+		panic("InterfaceMock.ChmodFunc: method is nil but Interface.Chmod was just called")
+	}
+	callInfo := struct {
+		Ctx        context.Context
+		RemoteFile string
+		Mode       os.FileMode
+	}{
+		Ctx:        ctx,
+		RemoteFile: remoteFile,
+		Mode:       mode,
+	}
+	mock.lockChmod.Lock()
+	mock.calls.Chmod = append(mock.calls.Chmod, callInfo)
+	mock.lockChmod.Unlock()
+	return mock.ChmodFunc(ctx, remoteFile, mode)
+}
+
+// ChmodCalls gets all the calls that were made to Chmod.
+// Check the length with:
+//
+//	len(mockedInterface.ChmodCalls())
+func (mock *InterfaceMock) ChmodCalls() []struct {
+	Ctx        context.Context
+	RemoteFile string
+	Mode       os.FileMode
+} {
+	var calls []struct {
+		Ctx        context.Context
+		RemoteFile string
+		Mode       os.FileMode
+	}
+	mock.lockChmod.RLock()
+	calls = mock.calls.Chmod
+	mock.lockChmod.RUnlock()
+	return calls
+}
+
 // Close calls CloseFunc.
 func (mock *InterfaceMock) Close() error {
 	if mock.CloseFunc == nil {
@@ -235,6 +352,86 @@ func (mock *InterfaceMock) DownloadCalls() []struct {
 	return calls
 }
 
+// Mkdir calls MkdirFunc.
+func (mock *InterfaceMock) Mkdir(ctx context.Context, remoteDir string) error {
+	if mock.MkdirFunc == nil {
+		panic("InterfaceMock.MkdirFunc: method is nil but Interface.Mkdir was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		RemoteDir string
+	}{
+		Ctx:       ctx,
+		RemoteDir: remoteDir,
+	}
+	mock.lockMkdir.Lock()
+	mock.calls.Mkdir = append(mock.calls.Mkdir, callInfo)
+	mock.lockMkdir.Unlock()
+	return mock.MkdirFunc(ctx, remoteDir)
+}
+
+// MkdirCalls gets all the calls that were made to Mkdir.
+// Check the length with:
+//
+//	len(mockedInterface.MkdirCalls())
+func (mock *InterfaceMock) MkdirCalls() []struct {
+	Ctx       context.Context
+	RemoteDir string
+} {
+	var calls []struct {
+		Ctx       context.Context
+		RemoteDir string
+	}
+	mock.lockMkdir.RLock()
+	calls = mock.calls.Mkdir
+	mock.lockMkdir.RUnlock()
+	return calls
+}
+
+// PlanSync calls PlanSyncFunc.
+func (mock *InterfaceMock) PlanSync(ctx context.Context, localDir string, remoteDir string, opts *executor.SyncOpts) (executor.SyncPlan, error) {
+	if mock.PlanSyncFunc == nil {
+		panic("InterfaceMock.PlanSyncFunc: method is nil but Interface.PlanSync was just called")
+	}
+	callInfo := struct {
+		Ctx       context.Context
+		LocalDir  string
+		RemoteDir string
+		Opts      *executor.SyncOpts
+	}{
+		Ctx:       ctx,
+		LocalDir:  localDir,
+		RemoteDir: remoteDir,
+		Opts:      opts,
+	}
+	mock.lockPlanSync.Lock()
+	mock.calls.PlanSync = append(mock.calls.PlanSync, callInfo)
+	mock.lockPlanSync.Unlock()
+	return mock.PlanSyncFunc(ctx, localDir, remoteDir, opts)
+}
+
+// PlanSyncCalls gets all the calls that were made to PlanSync.
+// Check the length with:
+//
+//	len(mockedInterface.PlanSyncCalls())
+func (mock *InterfaceMock) PlanSyncCalls() []struct {
+	Ctx       context.Context
+	LocalDir  string
+	RemoteDir string
+	Opts      *executor.SyncOpts
+} {
+	var calls []struct {
+		Ctx       context.Context
+		LocalDir  string
+		RemoteDir string
+		Opts      *executor.SyncOpts
+	}
+	mock.lockPlanSync.RLock()
+	calls = mock.calls.PlanSync
+	mock.lockPlanSync.RUnlock()
+	return calls
+}
+
 // Run calls RunFunc.
 func (mock *InterfaceMock) Run(ctx context.Context, c string, opts *executor.RunOpts) ([]string, error) {
 	if mock.RunFunc == nil {
@@ -275,6 +472,42 @@ func (mock *InterfaceMock) RunCalls() []struct {
 	return calls
 }
 
+// Stat calls StatFunc.
+func (mock *InterfaceMock) Stat(ctx context.Context, remoteFile string) (os.FileInfo, error) {
+	if mock.StatFunc == nil {
+		panic("InterfaceMock.StatFunc: method is nil but Interface.Stat was just called")
+	}
+	callInfo := struct {
+		Ctx        context.Context
+		RemoteFile string
+	}{
+		Ctx:        ctx,
+		RemoteFile: remoteFile,
+	}
+	mock.lockStat.Lock()
+	mock.calls.Stat = append(mock.calls.Stat, callInfo)
+	mock.lockStat.Unlock()
+	return mock.StatFunc(ctx, remoteFile)
+}
+
+// StatCalls gets all the calls that were made to Stat.
+// Check the length with:
+//
+//	len(mockedInterface.StatCalls())
+func (mock *InterfaceMock) StatCalls() []struct {
+	Ctx        context.Context
+	RemoteFile string
+} {
+	var calls []struct {
+		Ctx        context.Context
+		RemoteFile string
+	}
+	mock.lockStat.RLock()
+	calls = mock.calls.Stat
+	mock.lockStat.RUnlock()
+	return calls
+}
+
 // Sync calls SyncFunc.
 func (mock *InterfaceMock) Sync(ctx context.Context, localDir string, remoteDir string, opts *executor.SyncOpts) ([]string, error) {
 	if mock.SyncFunc == nil {
@@ -319,6 +552,42 @@ func (mock *InterfaceMock) SyncCalls() []struct {
 	return calls
 }
 
+// Touch calls TouchFunc.
+func (mock *InterfaceMock) Touch(ctx context.Context, remoteFile string) error {
+	if mock.TouchFunc == nil {
+		panic("InterfaceMock.TouchFunc: method is nil but Interface.Touch was just called")
+	}
+	callInfo := struct {
+		Ctx        context.Context
+		RemoteFile string
+	}{
+		Ctx:        ctx,
+		RemoteFile: remoteFile,
+	}
+	mock.lockTouch.Lock()
+	mock.calls.Touch = append(mock.calls.Touch, callInfo)
+	mock.lockTouch.Unlock()
+	return mock.TouchFunc(ctx, remoteFile)
+}
+
+// TouchCalls gets all the calls that were made to Touch.
+// Check the length with:
+//
+//	len(mockedInterface.TouchCalls())
+func (mock *InterfaceMock) TouchCalls() []struct {
+	Ctx        context.Context
+	RemoteFile string
+} {
+	var calls []struct {
+		Ctx        context.Context
+		RemoteFile string
+	}
+	mock.lockTouch.RLock()
+	calls = mock.calls.Touch
+	mock.lockTouch.RUnlock()
+	return calls
+}
+
 // Upload calls UploadFunc.
 func (mock *InterfaceMock) Upload(ctx context.Context, local string, remote string, opts *executor.UpDownOpts) error {
 	if mock.UploadFunc == nil {
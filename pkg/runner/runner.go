@@ -11,7 +11,10 @@ import (
 	"log"
 	"maps"
 	"net"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
@@ -23,11 +26,15 @@ import (
 	"github.com/umputun/spot/pkg/config"
 	"github.com/umputun/spot/pkg/config/deepcopy"
 	"github.com/umputun/spot/pkg/executor"
+	"github.com/umputun/spot/pkg/expr"
 )
 
 //go:generate moq -out mocks/connector.go -pkg mocks -skip-ensure -fmt goimports . Connector
 //go:generate moq -out mocks/playbook.go -pkg mocks -skip-ensure -fmt goimports . Playbook
 
+// maxCallDepth limits nesting of tasks called by call command, prevents endless recursion
+const maxCallDepth = 10
+
 // Process is a struct that holds the information needed to run a process.
 // It responsible for running a task on a target hosts.
 type Process struct {
@@ -38,9 +45,13 @@ type Process struct {
 	Verbose     bool
 	Verbose2    bool
 	Dry         bool
+	Check       bool // like dry run, but conditions, wait, echo and check_safe commands run on the real hosts
 	Local       bool
+	Rollback    bool // run release commands only, switching back to the previous release
 	SSHShell    string
 	SSHTempDir  string
+	FactsCache  *FactsCache       // facts of hosts gathered by tasks with gather_facts, if nil facts are gathered for each task
+	Inputs      map[string]string // arguments for inputs of the task running directly, not by call command
 
 	Skip []string
 	Only []string
@@ -68,6 +79,9 @@ type ProcResp struct {
 	Registered map[string]string
 	Commands   int
 	Hosts      int
+	Changed    int // commands reported as changed, across all hosts
+	Skipped    int // commands skipped by condition, across all hosts
+	Failed     int // commands failed with ignored errors, across all hosts
 }
 
 // taskOnHostResp is the response from runTaskOnHost.
@@ -75,6 +89,29 @@ type taskOnHostResp struct {
 	count      int
 	vars       map[string]string
 	registered map[string]string
+	stats      cmdStats
+}
+
+// cmdStats counts commands by status
+type cmdStats struct {
+	ok, changed, skipped, failed int
+}
+
+func (s *cmdStats) add(status cmdStatus) {
+	switch status {
+	case cmdChanged:
+		s.changed++
+	case cmdSkipped:
+		s.skipped++
+	case cmdFailed:
+		s.failed++
+	default:
+		s.ok++
+	}
+}
+
+func (s cmdStats) String() string {
+	return fmt.Sprintf("ok: %d, changed: %d, skipped: %d, failed: %d", s.ok, s.changed, s.skipped, s.failed)
 }
 
 // Run runs a task for a set of target hosts. Runs in parallel with limited concurrency,
@@ -86,6 +123,9 @@ func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err
 		return ProcResp{}, fmt.Errorf("can't get task %s: %w", task, err)
 	}
 	log.Printf("[DEBUG] task %q has %d commands", task, len(tsk.Commands))
+	if err = setInputs(tsk, p.Inputs); err != nil {
+		return ProcResp{}, err
+	}
 
 	allVars := make(map[string]string)
 	allRegistered := make(map[string]string)
@@ -94,16 +134,18 @@ func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err
 		return ProcResp{}, fmt.Errorf("can't get target %s: %w", target, err)
 	}
 
-	// in local mode, replace all target hosts with single localhost entry
+	// in local mode, replace all target hosts with single localhost entry, keeping vars and tags of the first one
 	if p.Local {
-		targetHosts = []config.Destination{{Host: "localhost", Name: "localhost", Port: 0, User: ""}}
+		targetHosts = []config.Destination{localDestination(targetHosts)}
 		log.Printf("[DEBUG] local mode - using localhost as single target")
 	}
 	log.Printf("[DEBUG] target hosts (%d) %+v", len(targetHosts), targetHosts)
 
 	maxCommands := 0
+	stats := cmdStats{}
 	lock := sync.Mutex{}
 
+	once := newRunOnce(targetHosts)
 	wg := syncs.NewErrSizedGroup(p.Concurrency, syncs.Context(ctx), syncs.Preemptive)
 	for _, host := range targetHosts {
 		wg.Go(func() error {
@@ -111,11 +153,14 @@ func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err
 			if tsk.User != "" {
 				user = tsk.User // override user from task if any set
 			}
-			resp, e := p.runTaskOnHost(ctx, tsk, fmt.Sprintf("%s:%d", host.Host, host.Port), host.Name, user)
+			resp, e := p.runTaskOnHost(ctx, tsk, host, user, once)
 
 			lock.Lock()
 			// report the fullest run across hosts, since a host may skip or fail some commands
 			maxCommands = max(maxCommands, resp.count)
+			stats.changed += resp.stats.changed
+			stats.skipped += resp.stats.skipped
+			stats.failed += resp.stats.failed
 			if e != nil {
 				errLog := p.Logs.WithHost(host.Host, host.Name).Err
 				errLog.Write([]byte(e.Error())) // nolint
@@ -139,6 +184,9 @@ func (p *Process) Run(ctx context.Context, task, target string) (s ProcResp, err
 		Commands:   maxCommands,
 		Vars:       allVars,
 		Registered: allRegistered,
+		Changed:    stats.changed,
+		Skipped:    stats.skipped,
+		Failed:     stats.failed,
 	}, err
 }
 
@@ -176,117 +224,442 @@ func (p *Process) Gen(targets []string, tmplRdr io.Reader, respWr io.Writer) err
 	return nil
 }
 
-// runTaskOnHost executes all commands of a task on a target host. hostAddr can be a remote host or localhost with port.
+// runTaskOnHost executes all commands of a task on a target host. host can be a remote host or localhost with port.
+// once coordinates commands with run_once option between hosts of the same run.
 // returns number of executed commands, vars from all commands and error if any.
-func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, hostAddr, hostName, user string) (taskOnHostResp, error) {
-	report := func(hostAddr, hostName, f string, vals ...any) {
-		p.Logs.WithHost(hostAddr, hostName).Info.Printf(f, vals...)
-	}
-	since := func(st time.Time) time.Duration { return time.Since(st).Truncate(time.Millisecond) }
-
+func (p *Process) runTaskOnHost(ctx context.Context, tsk *config.Task, host config.Destination, user string,
+	once *runOnce) (taskOnHostResp, error) {
 	stTask := time.Now()
+	h := newHostRun(p, tsk, host, user, once)
+	defer h.finish(ctx, tsk.Name)
 
-	var remote executor.Interface
-	if p.anyRemoteCommand(tsk) && !p.Local {
-		// make remote executor only if there is a remote command in the task and not in local mode
-		var err error
-		remote, err = p.Connector.Connect(ctx, hostAddr, hostName, user)
-		if err != nil {
-			if hostName != "" {
-				return taskOnHostResp{}, fmt.Errorf("can't connect to %s, user: %s: %w", hostName, user, err)
-			}
-			return taskOnHostResp{}, err
-		}
-		defer remote.Close()
-		report(hostAddr, hostName, "run task %q, commands: %d\n", tsk.Name, len(tsk.Commands))
+	if h.remoteTask {
+		h.report(h.hostAddr, h.hostName, "run task %q, commands: %d\n", tsk.Name, len(tsk.Commands))
 	} else {
-		report("localhost", "", "run task %q, commands: %d (local)\n", tsk.Name, len(tsk.Commands))
+		h.report("localhost", "", "run task %q, commands: %d (local)\n", tsk.Name, len(tsk.Commands))
 	}
 
-	resp := taskOnHostResp{vars: make(map[string]string), registered: make(map[string]string)}
-
 	// copy task to prevent one task on hostA modifying task on hostB as it does updateVars
 	activeTask := deepcopy.Copy(*tsk).(config.Task)
 	// set the active user to the task itself. this is done to match the passed user for any upstream handlers,
 	// for example, SPOT_REMOTE_USER env var is using task.User and expected to be set to the one used to connect to the host
 	activeTask.User = user
+	setVars(&activeTask, host.Vars)
 
-	onExitCmds := []execCmd{}
-	defer func() {
-		// run on-exit commands if any. it is executed after all commands of the task are done or on error
-		if len(onExitCmds) > 0 {
-			log.Printf("[INFO] run %d on-exit commands for %q on %s", len(onExitCmds), tsk.Name, hostAddr)
-			for _, ec := range onExitCmds {
-				if _, err := ec.Script(ctx); err != nil {
-					report(ec.hostAddr, ec.hostName, "failed on-exit command %q (%v)", ec.cmd.Name, err)
-				}
+	// facts are gathered before any command, they are set to the environment of all commands of the task
+	if tsk.GatherFacts {
+		facts, err := p.hostFacts(ctx, host, func() (executor.Interface, error) {
+			if err := h.connect(ctx); err != nil {
+				return nil, err
 			}
+			return h.remote, nil
+		})
+		if err != nil {
+			return h.resp, err
 		}
-	}()
+		h.facts = facts
+		setFacts(&activeTask, facts)
+	}
 
-	for _, cmd := range activeTask.Commands {
-		if !p.shouldRunCmd(cmd, hostName, hostAddr) {
-			continue
+	if _, err := h.runCmds(ctx, &activeTask, 0); err != nil {
+		return h.resp, err
+	}
+
+	if p.anyRemoteCommand(&activeTask) && !p.Local {
+		h.report(h.hostAddr, h.hostName, "completed task %q, commands: %d, %s (%v)\n",
+			activeTask.Name, h.resp.count, h.resp.stats, since(stTask))
+	} else {
+		h.report("localhost", "", "completed task %q, commands: %d, %s (%v)\n",
+			activeTask.Name, h.resp.count, h.resp.stats, since(stTask))
+	}
+
+	return h.resp, nil
+}
+
+// hostRun holds the state of a task run on a single host, shared by commands of the task and of the tasks
+// it calls. It is used by a single goroutine, only once is shared with other hosts of the run.
+type hostRun struct {
+	p                  *Process
+	host               config.Destination
+	hostAddr, hostName string
+	user               string
+	once               *runOnce // coordinates run_once commands between hosts of the same run
+	facts              map[string]string
+
+	// remote executor is made only if there is a remote command in the task and not in local mode.
+	// it connects on the first remote command to run, so the host is not connected if all of them are skipped by when
+	remoteTask bool
+	remote     executor.Interface
+	// connections to hosts of delegate_to commands, owned by this host only as executors are not thread-safe
+	delegates map[string]executor.Interface
+
+	onExitCmds []execCmd
+	resp       taskOnHostResp
+}
+
+func newHostRun(p *Process, tsk *config.Task, host config.Destination, user string, once *runOnce) *hostRun {
+	return &hostRun{
+		p:          p,
+		host:       host,
+		hostAddr:   fmt.Sprintf("%s:%d", host.Host, host.Port),
+		hostName:   host.Name,
+		user:       user,
+		once:       once,
+		remoteTask: (p.anyRemoteCommand(tsk) || tsk.GatherFacts) && !p.Local,
+		delegates:  make(map[string]executor.Interface),
+		resp:       taskOnHostResp{vars: make(map[string]string), registered: make(map[string]string)},
+	}
+}
+
+// finish runs on-exit commands collected by the task, releases run_once commands not executed on this host
+// by now, so they will not be executed at all, and closes connections of the host.
+func (h *hostRun) finish(ctx context.Context, taskName string) {
+	if len(h.onExitCmds) > 0 {
+		log.Printf("[INFO] run %d on-exit commands for %q on %s", len(h.onExitCmds), taskName, h.hostAddr)
+		for _, ec := range h.onExitCmds {
+			if _, err := ec.Script(ctx); err != nil {
+				h.report(ec.hostAddr, ec.hostName, "failed on-exit command %q (%v)", ec.cmd.Name, err)
+			}
 		}
+	}
+	h.once.release(h.host)
+	if h.remote != nil {
+		h.remote.Close() // nolint
+	}
+	for _, d := range h.delegates {
+		d.Close() // nolint
+	}
+}
 
-		log.Printf("[INFO] %s", p.infoMessage(cmd, hostAddr, hostName))
-		stCmd := time.Now()
+func (h *hostRun) report(hostAddr, hostName, f string, vals ...any) {
+	h.p.Logs.WithHost(hostAddr, hostName).Info.Printf(f, vals...)
+}
 
-		ec := execCmd{cmd: cmd, hostAddr: hostAddr, hostName: hostName, tsk: &activeTask, exec: remote,
-			verbose: p.Verbose, verbose2: p.Verbose2, sshShell: p.SSHShell, sshTmpDir: p.SSHTempDir, onExit: cmd.OnExit}
-		ec = p.pickCmdExecutor(cmd, ec, hostAddr, hostName) // pick executor on dry run or local command
+// connect makes the remote executor of the host on the first call, does nothing if the task has no remote commands
+func (h *hostRun) connect(ctx context.Context) error {
+	if h.remote != nil || !h.remoteTask {
+		return nil
+	}
+	conn, err := h.p.Connector.Connect(ctx, h.hostAddr, h.hostName, h.user)
+	if err != nil {
+		if h.hostName != "" {
+			return fmt.Errorf("can't connect to %s, user: %s: %w", h.hostName, h.user, err)
+		}
+		return err
+	}
+	h.remote = conn
+	return nil
+}
 
-		repHostAddr, repHostName := ec.hostAddr, ec.hostName
-		if cmd.Options.Local || p.Local {
-			repHostAddr = "localhost"
-			repHostName = ""
+// runCmds executes all commands of the task and the notified handlers after them, once per host and
+// in the order of definition. depth is the nesting level of called tasks. returns variables registered by the commands.
+func (h *hostRun) runCmds(ctx context.Context, tsk *config.Task, depth int) (map[string]string, error) {
+	registered := make(map[string]string)
+	notified := make(map[string]bool) // handlers notified by changed commands
+	for _, cmd := range tsk.Commands {
+		if h.p.Rollback && cmd.Release.Dir == "" && cmd.Call.Task == "" {
+			log.Printf("[DEBUG] skip command %q, rollback runs release commands only", cmd.Name)
+			continue
+		}
+		reg, err := h.runCmd(ctx, cmd, tsk, notified, depth)
+		if err != nil {
+			return registered, err
+		}
+		maps.Copy(registered, reg)
+	}
+	for _, hdl := range tsk.Handlers {
+		if !notified[hdl.Name] {
+			continue
 		}
+		log.Printf("[DEBUG] run handler %q on %s", hdl.Name, h.hostAddr)
+		reg, err := h.runCmd(ctx, hdl, tsk, notified, depth)
+		if err != nil {
+			return registered, err
+		}
+		maps.Copy(registered, reg)
+	}
+	return registered, nil
+}
+
+// runCmd executes a command or handler of the task if it should run on the host, once or for each loop item.
+// handlers notified by changed command are added to notified.
+// returns registered variables and error only if the command failed and errors are not ignored.
+func (h *hostRun) runCmd(ctx context.Context, cmd config.Cmd, tsk *config.Task, notified map[string]bool,
+	depth int) (map[string]string, error) {
+	if !h.p.shouldRunCmd(cmd, h.hostName, h.hostAddr) {
+		return nil, nil
+	}
+	if !cmd.Loop.IsSet() {
+		return h.runShared(ctx, cmd, tsk, notified, depth)
+	}
+	return h.runLoop(ctx, cmd, tsk, notified, depth)
+}
 
-		if ec.verbose {
-			report(repHostAddr, repHostName, "run command %q", cmd.Name)
+// runLoop executes the command for each loop item, every iteration is reported separately.
+// cond and ignore_errors apply per item, the item and its index are set as ITEM and ITEM_INDEX variables.
+func (h *hostRun) runLoop(ctx context.Context, cmd config.Cmd, tsk *config.Task, notified map[string]bool,
+	depth int) (map[string]string, error) {
+	tmpl := templater{hostAddr: h.hostAddr, hostName: h.hostName, task: tsk, command: cmd.Name, env: cmd.Environment}
+	items, err := loopItems(cmd, tmpl)
+	if err != nil {
+		if !cmd.Options.IgnoreErrors {
+			return nil, fmt.Errorf("failed command %q on host %s (%s): %w", cmd.Name, h.hostAddr, h.hostName, err)
+		}
+		h.report(h.hostAddr, h.hostName, "failed command %q {loop: %v}", cmd.Name, err)
+		h.resp.stats.add(cmdFailed)
+		return nil, nil
+	}
+	log.Printf("[DEBUG] loop command %q over %d items", cmd.Name, len(items))
+	registered := make(map[string]string)
+	for i, item := range items {
+		itemCmd := cmd
+		itemCmd.Name = fmt.Sprintf("%s [%s]", cmd.Name, item)
+		itemCmd.Environment = maps.Clone(cmd.Environment)
+		if itemCmd.Environment == nil {
+			itemCmd.Environment = make(map[string]string, 2)
 		}
+		itemCmd.Environment["ITEM"], itemCmd.Environment["ITEM_INDEX"] = item, strconv.Itoa(i)
+		reg, err := h.runShared(ctx, itemCmd, tsk, notified, depth)
+		if err != nil {
+			return registered, err
+		}
+		maps.Copy(registered, reg)
+	}
+	return registered, nil
+}
+
+// runShared executes the command with run_once option on the first selected host only. Other hosts wait
+// for it and get the variables set and registered by the command. Commands without run_once run as usual.
+func (h *hostRun) runShared(ctx context.Context, cmd config.Cmd, tsk *config.Task, notified map[string]bool,
+	depth int) (map[string]string, error) {
+	if !cmd.Options.RunOnce {
+		_, reg, err := h.runSingle(ctx, cmd, tsk, notified, depth)
+		return reg, err
+	}
+	owner := h.p.onceOwner(cmd, h.once.hosts)
+	res := h.once.result(tsk.Name+"/"+cmd.Name, owner)
+	if owner == hostKey(h.host) {
+		vars, reg, err := h.runSingle(ctx, cmd, tsk, notified, depth)
+		h.once.complete(res, vars, reg, err)
+		return reg, err
+	}
 
-		exResp, err := p.execCommand(ctx, ec)
-		if exResp.onExit.cmd.Name != "" { // we have on-exit command, save it for later execution
-			// this is intentionally before error check, we want to run on-exit command even if the main command failed
-			onExitCmds = append(onExitCmds, exResp.onExit)
+	log.Printf("[DEBUG] wait for run_once command %q on %s", cmd.Name, owner)
+	select {
+	case <-res.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !res.executed {
+		log.Printf("[DEBUG] run_once command %q was not executed on %s, skip", cmd.Name, owner)
+		return nil, nil
+	}
+	if res.err != nil {
+		if cmd.Options.IgnoreErrors {
+			return nil, nil
 		}
+		return nil, fmt.Errorf("failed command %q on host %s (%s): run_once command failed on %s",
+			cmd.Name, h.hostAddr, h.hostName, owner)
+	}
+	h.p.updateVars(res.vars, cmd, tsk)
+	maps.Copy(h.resp.registered, res.registered)
+	maps.Copy(h.resp.vars, res.vars)
+	h.report(h.hostAddr, h.hostName, "completed command %q {run_once: %s}", cmd.Name, owner)
+	return res.registered, nil
+}
+
+// runSingle executes a single command, or a single iteration of the command with loop.
+// returns variables set and registered by the command.
+func (h *hostRun) runSingle(ctx context.Context, cmd config.Cmd, tsk *config.Task, notified map[string]bool,
+	depth int) (vars, reg map[string]string, err error) {
+	p := h.p
+	log.Printf("[INFO] %s", p.infoMessage(cmd, h.hostAddr, h.hostName))
+	stCmd := time.Now()
+
+	if cmd.When != "" {
+		ok, err := expr.Eval(cmd.When, whenVars(cmd, tsk, h.host, h.resp.registered))
 		if err != nil {
-			if !cmd.Options.IgnoreErrors {
-				return resp, fmt.Errorf("failed command %q on host %s (%s): %w", cmd.Name, ec.hostAddr, ec.hostName, err)
+			return nil, nil, fmt.Errorf("failed command %q on host %s (%s): %w", cmd.Name, h.hostAddr, h.hostName, err)
+		}
+		if !ok {
+			repHostAddr, repHostName := h.hostAddr, h.hostName
+			if cmd.Options.Local || p.Local {
+				repHostAddr, repHostName = "localhost", ""
 			}
-			report(ec.hostAddr, ec.hostName, "failed command %q%s (%v)", cmd.Name, exResp.details, since(stCmd))
-			continue
+			h.report(repHostAddr, repHostName, "completed command %q {when: %s} [%s] (%v)", cmd.Name, cmd.When, cmdSkipped, since(stCmd))
+			h.resp.count++
+			h.resp.stats.add(cmdSkipped)
+			return nil, nil, nil
+		}
+	}
+
+	if !cmd.Options.Local && cmd.Options.DelegateTo == "" && cmd.Call.Task == "" {
+		if err := h.connect(ctx); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		p.updateVars(exResp.vars, cmd, &activeTask)   // set variables from command output to all commands env in task
-		maps.Copy(resp.registered, exResp.registered) // store registered variables from command output
-		if exResp.verbose != "" && ec.verbose2 {
-			report(repHostAddr, repHostName, exResp.verbose)
+	ec := execCmd{cmd: cmd, hostAddr: h.hostAddr, hostName: h.hostName, hostTags: h.host.Tags, hostVars: h.host.Vars, tsk: tsk,
+		exec: h.remote, verbose: p.Verbose, verbose2: p.Verbose2, sshShell: p.SSHShell, sshTmpDir: p.SSHTempDir,
+		onExit: cmd.OnExit, rollback: p.Rollback}
+	delegatedTo := ""
+	if cmd.Options.DelegateTo != "" && !p.Local {
+		// run on delegate_to host, templates and reports still refer to the current host
+		if ec.exec, delegatedTo, err = h.delegate(ctx, cmd, tsk); err != nil {
+			return nil, nil, fmt.Errorf("failed command %q on host %s (%s): %w", cmd.Name, h.hostAddr, h.hostName, err)
 		}
+	}
+	ec = p.pickCmdExecutor(cmd, ec, h.hostAddr, h.hostName) // pick executor on dry run or local command
 
-		// we don't want to print multiline script name in logs
-		// from: completed command "test" {script: /bin/sh -c /tmp/.spot-7113416067113199616/spot-script2358478823} (17ms)
-		// we make: completed command "test" {script: /bin/sh -c [multiline script]} (17ms)
-		pattern := `(\{script: .+ -c ).+/spot-script.+}`
-		re := regexp.MustCompile(pattern)
-		details := re.ReplaceAllString(exResp.details, "${1}[multiline script]}")
-		report(repHostAddr, repHostName, "completed command %q%s (%v)", cmd.Name, details, since(stCmd))
+	repHostAddr, repHostName := ec.hostAddr, ec.hostName
+	if cmd.Options.Local || p.Local {
+		repHostAddr = "localhost"
+		repHostName = ""
+	}
 
-		resp.count++
-		maps.Copy(resp.vars, exResp.vars)
+	if ec.verbose {
+		h.report(repHostAddr, repHostName, "run command %q", cmd.Name)
 	}
 
-	if p.anyRemoteCommand(&activeTask) && !p.Local {
-		report(hostAddr, hostName, "completed task %q, commands: %d (%v)\n", activeTask.Name, resp.count, since(stTask))
+	var exResp execCmdResp
+	if cmd.Call.Task != "" {
+		exResp, err = h.callTask(ctx, ec, depth)
 	} else {
-		report("localhost", "", "completed task %q, commands: %d (%v)\n",
-			activeTask.Name, resp.count, since(stTask))
+		exResp, err = p.execCommand(ctx, ec)
+	}
+	if exResp.onExit.cmd.Name != "" { // we have on-exit command, save it for later execution
+		// this is intentionally before error check, we want to run on-exit command even if the main command failed
+		h.onExitCmds = append(h.onExitCmds, exResp.onExit)
+	}
+	if err != nil {
+		if !cmd.Options.IgnoreErrors {
+			return nil, nil, fmt.Errorf("failed command %q on host %s (%s): %w", cmd.Name, ec.hostAddr, ec.hostName, err)
+		}
+		h.report(ec.hostAddr, ec.hostName, "failed command %q%s (%v)", cmd.Name, exResp.details, since(stCmd))
+		h.resp.stats.add(cmdFailed)
+		return nil, nil, nil
+	}
+
+	p.updateVars(exResp.vars, cmd, tsk)             // set variables from command output to all commands env in task
+	maps.Copy(h.resp.registered, exResp.registered) // store registered variables from command output
+	if exResp.verbose != "" && ec.verbose2 {
+		h.report(repHostAddr, repHostName, exResp.verbose)
+	}
+
+	// we don't want to print multiline script name in logs
+	// from: completed command "test" {script: /bin/sh -c /tmp/.spot-7113416067113199616/spot-script2358478823} (17ms)
+	// we make: completed command "test" {script: /bin/sh -c [multiline script]} (17ms)
+	pattern := `(\{script: .+ -c ).+/spot-script.+}`
+	re := regexp.MustCompile(pattern)
+	details := re.ReplaceAllString(exResp.details, "${1}[multiline script]}")
+	if delegatedTo != "" {
+		details += fmt.Sprintf(" {delegate_to: %s}", delegatedTo)
 	}
+	status := exResp.status.String()
+	if _, isDry := ec.exec.(*executor.Dry); isDry && exResp.status == cmdChanged {
+		status = "would change" // nothing was changed in dry run or check mode
+	}
+	h.report(repHostAddr, repHostName, "completed command %q%s [%s] (%v)", cmd.Name, details, status, since(stCmd))
+
+	h.resp.count++
+	h.resp.stats.add(exResp.status)
+	maps.Copy(h.resp.vars, exResp.vars)
 
-	return resp, nil
+	if exResp.status == cmdChanged {
+		for _, hdl := range cmd.Notify {
+			notified[hdl] = true
+		}
+	}
+	return exResp.vars, exResp.registered, nil
 }
 
+// callTask runs commands of the task called by call command, with arguments set as environment variables.
+// variables registered by the called task are returned to the caller.
+func (h *hostRun) callTask(ctx context.Context, ec execCmd, depth int) (callResp execCmdResp, err error) {
+	callResp.details = fmt.Sprintf(" {call: %s}", ec.cmd.Call.Task)
+	if depth >= maxCallDepth {
+		return callResp, fmt.Errorf("call depth limit %d exceeded, task %q", maxCallDepth, ec.cmd.Call.Task)
+	}
+	cond, err := ec.checkCondition(ctx)
+	if err != nil {
+		return callResp, err
+	}
+	if !cond {
+		callResp.details = fmt.Sprintf(" {skip: %s}", ec.cmd.Name)
+		callResp.status = cmdSkipped
+		return callResp, nil
+	}
+
+	called, err := h.p.Playbook.Task(ec.cmd.Call.Task)
+	if err != nil {
+		return callResp, fmt.Errorf("can't get called task: %w", err)
+	}
+	called.User = ec.tsk.User // called task runs with the same connection
+
+	tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+	args := make(map[string]string, len(ec.cmd.Call.Args))
+	for k, v := range ec.cmd.Call.Args {
+		args[k] = tmpl.apply(v)
+	}
+	env, err := called.InputValues(args)
+	if err != nil {
+		return callResp, err
+	}
+	for _, cmds := range [][]config.Cmd{called.Commands, called.Handlers} {
+		for i := range cmds {
+			if cmds[i].Environment == nil {
+				cmds[i].Environment = make(map[string]string, len(env))
+			}
+			maps.Copy(cmds[i].Environment, env) // arguments override the task's own environment
+		}
+	}
+	setVars(called, h.host.Vars)
+	setFacts(called, h.facts)
+
+	stCall := time.Now()
+	changedBefore := h.resp.stats.changed
+	log.Printf("[DEBUG] call task %q from %q on %s, depth %d", called.Name, ec.tsk.Name, h.hostAddr, depth+1)
+	registered, err := h.runCmds(ctx, called, depth+1)
+	callResp.vars, callResp.registered = registered, registered
+	if err != nil {
+		return callResp, fmt.Errorf("called task %q failed: %w", called.Name, err)
+	}
+	callResp.details = fmt.Sprintf(" {call: %s, duration: %v}", called.Name, since(stCall))
+	if h.resp.stats.changed > changedBefore {
+		callResp.status = cmdChanged // any command of the called task changed something
+	}
+	return callResp, nil
+}
+
+// delegate returns executor for the delegate_to host of the command, connected once per host of the task.
+// the delegate_to value may be templated, it must resolve to a single host. returns the executor and its address.
+func (h *hostRun) delegate(ctx context.Context, cmd config.Cmd, tsk *config.Task) (executor.Interface, string, error) {
+	tmpl := templater{hostAddr: h.hostAddr, hostName: h.hostName, task: tsk, command: cmd.Name, env: cmd.Environment}
+	name := tmpl.apply(cmd.Options.DelegateTo)
+	hosts, err := h.p.Playbook.TargetHosts(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't get delegate_to host %q: %w", name, err)
+	}
+	if len(hosts) != 1 {
+		return nil, "", fmt.Errorf("delegate_to %q matches %d hosts, must be a single host", name, len(hosts))
+	}
+	dlgAddr := fmt.Sprintf("%s:%d", hosts[0].Host, hosts[0].Port)
+	key := dlgAddr + ":" + hosts[0].User
+	if ex, ok := h.delegates[key]; ok {
+		return ex, dlgAddr, nil
+	}
+	conn, err := h.p.Connector.Connect(ctx, dlgAddr, hosts[0].Name, hosts[0].User)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't connect to delegate_to host %s: %w", dlgAddr, err)
+	}
+	log.Printf("[DEBUG] connected to delegate_to host %s for %s", dlgAddr, h.hostAddr)
+	h.delegates[key] = conn
+	return conn, dlgAddr, nil
+}
+
+// since returns duration from the start time, truncated to milliseconds for reports
+func since(st time.Time) time.Duration { return time.Since(st).Truncate(time.Millisecond) }
+
 // execCommand executes a single command on a target host.
 // It detects the command type based on the fields what are set.
 // Even if multiple fields for multiple commands are set, only one will be executed.
@@ -305,51 +678,115 @@ func (p *Process) execCommand(ctx context.Context, ec execCmd) (resp execCmdResp
 		}()
 	}
 
+	if ec.cmd.Options.GoTemplate {
+		tmpl := templater{hostAddr: ec.hostAddr, hostName: ec.hostName, task: ec.tsk, command: ec.cmd.Name, env: ec.cmd.Environment}
+		if err := ec.renderGoTemplates(tmpl); err != nil {
+			return execCmdResp{}, ec.errorFmt("can't render go template: %w", err)
+		}
+	}
+
 	switch {
 	case ec.cmd.Script != "":
 		log.Printf("[DEBUG] execute script %q on %s", ec.cmd.Name, ec.hostAddr)
-		return ec.Script(ctx)
+		resp, err = ec.Script(ctx)
 	case ec.cmd.Copy.Source != "" && ec.cmd.Copy.Dest != "":
 		log.Printf("[DEBUG] copy file to %s", ec.hostAddr)
-		return ec.Copy(ctx)
+		resp, err = ec.Copy(ctx)
 	case len(ec.cmd.MCopy) > 0:
 		log.Printf("[DEBUG] copy multiple files to %s", ec.hostAddr)
-		return ec.Mcopy(ctx)
+		resp, err = ec.Mcopy(ctx)
 	case ec.cmd.Sync.Source != "" && ec.cmd.Sync.Dest != "":
 		log.Printf("[DEBUG] sync files to %s", ec.hostAddr)
-		return ec.Sync(ctx)
+		resp, err = ec.Sync(ctx)
 	case len(ec.cmd.MSync) > 0:
 		log.Printf("[DEBUG] sync multiple locations to %s", ec.hostAddr)
-		return ec.Msync(ctx)
+		resp, err = ec.Msync(ctx)
 	case ec.cmd.Delete.Location != "":
 		log.Printf("[DEBUG] delete files on %s", ec.hostAddr)
-		return ec.Delete(ctx)
+		resp, err = ec.Delete(ctx)
 	case len(ec.cmd.MDelete) > 0:
 		log.Printf("[DEBUG] delete multiple files on %s", ec.hostAddr)
-		return ec.MDelete(ctx)
-	case ec.cmd.Wait.Command != "":
+		resp, err = ec.MDelete(ctx)
+	case ec.cmd.Wait.IsSet():
 		log.Printf("[DEBUG] wait for command on %s", ec.hostAddr)
-		return ec.Wait(ctx)
+		resp, err = ec.Wait(ctx)
 	case ec.cmd.Echo != "":
 		log.Printf("[DEBUG] echo on %s", ec.hostAddr)
-		return ec.Echo(ctx)
+		resp, err = ec.Echo(ctx)
+	case ec.cmd.Block.File != "":
+		log.Printf("[DEBUG] block manipulation on %s", ec.hostAddr)
+		resp, err = ec.Block(ctx)
+	case ec.cmd.Template.Source != "" && ec.cmd.Template.Dest != "":
+		log.Printf("[DEBUG] render template to %s", ec.hostAddr)
+		resp, err = ec.Template(ctx)
+	case ec.cmd.Unarchive.Source != "" && ec.cmd.Unarchive.Dest != "":
+		log.Printf("[DEBUG] unarchive to %s", ec.hostAddr)
+		resp, err = ec.Unarchive(ctx)
+	case ec.cmd.Fetch.URL != "" && ec.cmd.Fetch.Dest != "":
+		log.Printf("[DEBUG] fetch on %s", ec.hostAddr)
+		resp, err = ec.Fetch(ctx)
+	case ec.cmd.Service.Name != "":
+		log.Printf("[DEBUG] service management on %s", ec.hostAddr)
+		resp, err = ec.Service(ctx)
+	case ec.cmd.File.Path != "":
+		log.Printf("[DEBUG] file state on %s", ec.hostAddr)
+		resp, err = ec.File(ctx)
+	case len(ec.cmd.MFile) > 0:
+		log.Printf("[DEBUG] multiple file states on %s", ec.hostAddr)
+		resp, err = ec.MFile(ctx)
+	case ec.cmd.Git.Repo != "" && ec.cmd.Git.Dest != "":
+		log.Printf("[DEBUG] git checkout on %s", ec.hostAddr)
+		resp, err = ec.Git(ctx)
+	case ec.cmd.Release.Dir != "" && ec.rollback:
+		log.Printf("[DEBUG] rollback release on %s", ec.hostAddr)
+		resp, err = ec.Rollback(ctx)
+	case ec.cmd.Release.Dir != "" && ec.cmd.Release.Source != "":
+		log.Printf("[DEBUG] release deployment on %s", ec.hostAddr)
+		resp, err = ec.Release(ctx)
+	case ec.cmd.Cron.Name != "":
+		log.Printf("[DEBUG] cron entry on %s", ec.hostAddr)
+		resp, err = ec.Cron(ctx)
 	case ec.cmd.Line.File != "" && ec.cmd.Line.Match != "":
 		log.Printf("[DEBUG] line manipulation on %s", ec.hostAddr)
-		return ec.Line(ctx)
+		resp, err = ec.Line(ctx)
 	default:
 		return execCmdResp{}, fmt.Errorf("unknown command %q", ec.cmd.Name)
 	}
+	return ec.applyStatusRules(resp, err)
 }
 
-// pickCmdExecutor returns executor for dry run or local command, otherwise returns the default executor.
+// pickCmdExecutor returns executor for dry run, check mode or local command, otherwise returns the default executor.
 func (p *Process) pickCmdExecutor(cmd config.Cmd, ec execCmd, hostAddr, hostName string) execCmd {
+	if p.Check {
+		target := ec.exec
+		if cmd.Options.Local || p.Local {
+			target = executor.NewLocal(p.Logs.WithHost("localhost", ""))
+		}
+		if cmd.Options.CheckSafe || cmd.Wait.IsSet() || cmd.Echo != "" {
+			log.Printf("[DEBUG] run check-safe command %q", cmd.Name)
+			ec.exec = target
+			return ec
+		}
+		log.Printf("[DEBUG] check command %q", cmd.Name)
+		logs := p.Logs.WithHost(hostAddr, hostName)
+		if cmd.Options.Local || p.Local {
+			logs = p.Logs.WithHost("localhost", "")
+		}
+		ec.exec, ec.checker = executor.NewDry(logs).WithReader(target), target
+		return ec
+	}
 	if p.Dry {
 		log.Printf("[DEBUG] run dry command %q", cmd.Name)
+		// dry executor reads the current state from the real target to show diffs, nothing is modified
 		if cmd.Options.Local || p.Local {
-			ec.exec = executor.NewDry(p.Logs.WithHost("localhost", ""))
-		} else {
-			ec.exec = executor.NewDry(p.Logs.WithHost(hostAddr, hostName))
+			ec.exec = executor.NewDry(p.Logs.WithHost("localhost", "")).WithReader(executor.NewLocal(p.Logs.WithHost("localhost", "")))
+			return ec
+		}
+		dry := executor.NewDry(p.Logs.WithHost(hostAddr, hostName))
+		if ec.exec != nil {
+			dry = dry.WithReader(ec.exec)
 		}
+		ec.exec = dry
 		return ec
 	}
 	if cmd.Options.Local || p.Local {
@@ -360,6 +797,183 @@ func (p *Process) pickCmdExecutor(cmd config.Cmd, ec execCmd, hostAddr, hostName
 	return ec
 }
 
+// setInputs sets inputs of the task running directly, not by call command. Inputs are set from the given arguments,
+// arguments not declared as inputs are ignored. Passed arguments override the environment of commands, defaults
+// are used for the rest and set only if not defined by the command. Returns error if a required input is not set.
+func setInputs(tsk *config.Task, args map[string]string) error {
+	if len(tsk.Inputs) == 0 {
+		return nil
+	}
+	inputArgs := make(map[string]string, len(tsk.Inputs))
+	for _, in := range tsk.Inputs {
+		if v, ok := args[in.Name]; ok {
+			inputArgs[in.Name] = v
+		}
+	}
+	env, err := tsk.InputValues(inputArgs)
+	if err != nil {
+		return err
+	}
+	for _, cmds := range [][]config.Cmd{tsk.Commands, tsk.Handlers} {
+		for i := range cmds {
+			if cmds[i].Environment == nil {
+				cmds[i].Environment = make(map[string]string, len(env))
+			}
+			for k, v := range env {
+				_, passed := inputArgs[k]
+				if _, ok := cmds[i].Environment[k]; !ok || passed {
+					cmds[i].Environment[k] = v
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// runOnce coordinates commands with run_once option between hosts of a single run. The command is executed
+// on the first selected host, other hosts wait for the result and share variables set and registered by it.
+type runOnce struct {
+	hosts    []config.Destination
+	mu       sync.Mutex
+	results  map[string]*onceResult // results by task and command name
+	released map[string]bool        // hosts completed the task, their pending commands will not be executed
+}
+
+// onceResult is the result of run_once command, done is closed when the command completed or will not be executed
+type onceResult struct {
+	owner      string
+	done       chan struct{}
+	closed     bool
+	executed   bool
+	vars       map[string]string
+	registered map[string]string
+	err        error
+}
+
+// localDestination makes the localhost destination used in local mode instead of the target hosts. It keeps vars
+// and tags of the first target host, other hosts are ignored as their vars may conflict.
+func localDestination(hosts []config.Destination) config.Destination {
+	res := config.Destination{Host: "localhost", Name: "localhost"}
+	if len(hosts) == 0 {
+		return res
+	}
+	if len(hosts) > 1 {
+		log.Printf("[WARN] local mode uses vars and tags of the first target host %s, %d other hosts ignored",
+			hosts[0].Host, len(hosts)-1)
+	}
+	res.Tags = slices.Clone(hosts[0].Tags)
+	res.Vars = maps.Clone(hosts[0].Vars)
+	return res
+}
+
+func newRunOnce(hosts []config.Destination) *runOnce {
+	return &runOnce{hosts: hosts, results: make(map[string]*onceResult), released: make(map[string]bool)}
+}
+
+// result returns the result of the command, made on the first request. If the owner host has already completed
+// the task, the result is done without execution.
+func (o *runOnce) result(key, owner string) *onceResult {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if res, ok := o.results[key]; ok {
+		return res
+	}
+	res := &onceResult{owner: owner, done: make(chan struct{})}
+	if owner == "" || o.released[owner] {
+		res.closed = true
+		close(res.done)
+	}
+	o.results[key] = res
+	return res
+}
+
+// complete sets the result of the executed command and unblocks waiting hosts
+func (o *runOnce) complete(res *onceResult, vars, registered map[string]string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if res.closed {
+		return
+	}
+	res.executed, res.vars, res.registered, res.err = true, vars, registered, err
+	res.closed = true
+	close(res.done)
+}
+
+// release marks the host as completed and unblocks hosts waiting for its commands
+func (o *runOnce) release(host config.Destination) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := hostKey(host)
+	o.released[key] = true
+	for _, res := range o.results {
+		if res.owner == key && !res.closed {
+			res.closed = true
+			close(res.done)
+		}
+	}
+}
+
+// onceOwner returns key of the first host selected to run the command, empty if the command is not selected for any
+func (p *Process) onceOwner(cmd config.Cmd, hosts []config.Destination) string {
+	for _, h := range hosts {
+		if p.shouldRunCmd(cmd, h.Name, fmt.Sprintf("%s:%d", h.Host, h.Port)) {
+			return hostKey(h)
+		}
+	}
+	return ""
+}
+
+// hostKey identifies the target host, the same host may be used with different users
+func hostKey(h config.Destination) string {
+	return fmt.Sprintf("%s:%d:%s", h.Host, h.Port, h.User)
+}
+
+// whenVars makes variables for when expressions. env is the command environment, including vars and registered
+// variables, registered has variables registered on the host so far and host is the target host.
+// Facts of the host, if gathered, are taken from the environment.
+func whenVars(cmd config.Cmd, tsk *config.Task, host config.Destination, registered map[string]string) expr.Vars {
+	env := make(map[string]string, len(cmd.Environment))
+	for k, v := range cmd.Environment {
+		env[k] = strings.TrimPrefix(v, "__SQ__:")
+	}
+	tags := host.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return expr.Vars{
+		"env":        env,
+		"registered": maps.Clone(registered),
+		"task":       tsk.Name,
+		"host": map[string]any{"name": host.Name, "host": host.Host, "port": host.Port, "user": tsk.User, "tags": tags,
+			"vars": maps.Clone(host.Vars)},
+		"facts": factsVars(env),
+	}
+}
+
+// setVars sets variables of the task and the host to the environment of all task's commands and handlers.
+// Host variables override task variables, and both never override the environment already set for the command,
+// including the overrides passed from the command line.
+func setVars(tsk *config.Task, hostVars map[string]string) {
+	vars := make(map[string]string, len(tsk.Vars)+len(hostVars))
+	maps.Copy(vars, tsk.Vars)
+	maps.Copy(vars, hostVars)
+	if len(vars) == 0 {
+		return
+	}
+	for _, cmds := range [][]config.Cmd{tsk.Commands, tsk.Handlers} {
+		for i := range cmds {
+			if cmds[i].Environment == nil {
+				cmds[i].Environment = make(map[string]string, len(vars))
+			}
+			for k, v := range vars {
+				if _, ok := cmds[i].Environment[k]; !ok {
+					cmds[i].Environment[k] = v
+				}
+			}
+		}
+	}
+}
+
 // onError executes on-error command locally if any error occurred during task execution and on-error command is defined
 func (p *Process) onError(ctx context.Context, err error) {
 
@@ -416,8 +1030,27 @@ func (p *Process) onError(ctx context.Context, err error) {
 }
 
 func (p *Process) anyRemoteCommand(tsk *config.Task) bool {
-	for _, cmd := range tsk.Commands {
-		if !cmd.Options.Local {
+	return p.anyRemoteCommandDepth(tsk, 0)
+}
+
+// anyRemoteCommandDepth checks commands of the task, and of the tasks it calls, for remote commands.
+// call command itself runs nothing, it is remote if the called task has a remote command.
+func (p *Process) anyRemoteCommandDepth(tsk *config.Task, depth int) bool {
+	for _, cmd := range slices.Concat(tsk.Commands, tsk.Handlers) {
+		if cmd.Call.Task == "" {
+			if !cmd.Options.Local {
+				return true
+			}
+			continue
+		}
+		if depth >= maxCallDepth {
+			continue
+		}
+		called, err := p.Playbook.Task(cmd.Call.Task)
+		if err != nil {
+			return true // let the call command report the error
+		}
+		if p.anyRemoteCommandDepth(called, depth+1) {
 			return true
 		}
 	}
@@ -435,6 +1068,40 @@ func (p *Process) infoMessage(cmd config.Cmd, hostAddr, hostName string) string
 	return infoMsg
 }
 
+// loopItems returns items of the command's loop. Literal items and glob are templated with the command variables,
+// value of the loop variable is split by commas and newlines. Glob matches local files, sorted by name.
+func loopItems(cmd config.Cmd, tmpl templater) ([]string, error) {
+	switch {
+	case len(cmd.Loop.Items) > 0:
+		res := make([]string, 0, len(cmd.Loop.Items))
+		for _, item := range cmd.Loop.Items {
+			res = append(res, tmpl.apply(item))
+		}
+		return res, nil
+	case cmd.Loop.Var != "":
+		name := strings.Trim(strings.TrimPrefix(cmd.Loop.Var, "$"), "{}")
+		val, ok := cmd.Environment[name]
+		if !ok {
+			return nil, fmt.Errorf("loop variable %q is not set", name)
+		}
+		val = strings.TrimPrefix(val, "__SQ__:") // marker of single-quoted value set by script
+		res := []string{}
+		for _, item := range strings.FieldsFunc(val, func(r rune) bool { return r == ',' || r == '\n' }) {
+			if item = strings.TrimSpace(item); item != "" {
+				res = append(res, item)
+			}
+		}
+		return res, nil
+	case cmd.Loop.Glob != "":
+		matches, err := filepath.Glob(tmpl.apply(cmd.Loop.Glob))
+		if err != nil {
+			return nil, fmt.Errorf("can't match loop glob %q: %w", cmd.Loop.Glob, err)
+		}
+		return matches, nil
+	}
+	return nil, nil
+}
+
 // updateVars sets variables from command output to all commands environment in the same task.
 func (p *Process) updateVars(vars map[string]string, cmd config.Cmd, tsk *config.Task) {
 	if len(vars) == 0 {
@@ -443,16 +1110,18 @@ func (p *Process) updateVars(vars map[string]string, cmd config.Cmd, tsk *config
 
 	log.Printf("[DEBUG] set %d variables from command %q: %+v", len(vars), cmd.Name, vars)
 	for k, v := range vars {
-		for i, c := range tsk.Commands {
-			env := c.Environment
-			if env == nil {
-				env = make(map[string]string)
-			}
-			if _, ok := env[k]; ok { // don't allow override variables
-				continue
+		for _, cmds := range [][]config.Cmd{tsk.Commands, tsk.Handlers} {
+			for i, c := range cmds {
+				env := c.Environment
+				if env == nil {
+					env = make(map[string]string)
+				}
+				if _, ok := env[k]; ok { // don't allow override variables
+					continue
+				}
+				env[k] = v
+				cmds[i].Environment = env
 			}
-			env[k] = v
-			tsk.Commands[i].Environment = env
 		}
 	}
 }
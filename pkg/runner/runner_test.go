@@ -3,10 +3,14 @@ package runner
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -18,6 +22,7 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 
 	"github.com/umputun/spot/pkg/config"
+	"github.com/umputun/spot/pkg/config/deepcopy"
 	"github.com/umputun/spot/pkg/executor"
 	"github.com/umputun/spot/pkg/runner/mocks"
 	"github.com/umputun/spot/pkg/secrets"
@@ -1484,6 +1489,693 @@ func TestProcess_Run_CommandCountAcrossHosts(t *testing.T) {
 	assert.Equal(t, 2, res.Commands, "should report the fuller host's command count, not host 0's")
 }
 
+func TestProcess_Run_CommandStatus(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "src.txt")
+	require.NoError(t, os.WriteFile(srcFile, []byte("content"), 0o600))
+	dstFile := filepath.Join(tmpDir, "dst.txt")
+
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t", Commands: []config.Cmd{
+		{Name: "script", Script: "echo done", Options: local},
+		{Name: "not changed", Script: "echo already exists", ChangedWhen: `!(stdout contains "already")`, Options: local},
+		{Name: "exit 2 is fine", Script: "exit 2", FailedWhen: "exit_code > 2", Options: local},
+		{Name: "skipped", Script: "echo skipped", Condition: "false", Options: local},
+		{Name: "ignored failure", Script: "exit 1", Options: config.CmdOptions{Local: true, IgnoreErrors: true}},
+		{Name: "copy", Copy: config.CopyInternal{Source: srcFile, Dest: dstFile}, Options: local},
+		{Name: "copy again", Copy: config.CopyInternal{Source: srcFile, Dest: dstFile}, Options: local},
+		{Name: "delete", Delete: config.DeleteInternal{Location: dstFile}, Options: local},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) { return &tsk, nil },
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}}, nil
+		},
+	}
+
+	var res ProcResp
+	stdout := captureStdOut(t, func() {
+		p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil)} // logs inside capture
+		var err error
+		res, err = p.Run(context.Background(), "t", "all")
+		require.NoError(t, err)
+	})
+	// script details depend on the local shell, check the status only
+	assert.Regexp(t, `completed command "script" \{script: .*echo done.*\} \[changed\]`, stdout)
+	assert.Regexp(t, `completed command "not changed" \{script: .*echo already exists.*\} \[ok\]`, stdout)
+	assert.Regexp(t, `completed command "exit 2 is fine" \{script: .*exit 2.*\} \[changed\]`, stdout)
+	assert.Contains(t, stdout, `completed command "skipped" {skip: skipped} [skipped]`)
+	assert.Contains(t, stdout, `failed command "ignored failure"`)
+	assert.Contains(t, stdout, fmt.Sprintf(`completed command "copy" {copy: %s -> %s} [changed]`, srcFile, dstFile))
+	assert.Contains(t, stdout, fmt.Sprintf(`completed command "copy again" {copy: %s -> %s} [ok]`, srcFile, dstFile))
+	assert.Contains(t, stdout, `completed command "delete" {delete: `+dstFile+`, recursive: false} [changed]`)
+	assert.Contains(t, stdout, `completed task "t", commands: 7, ok: 2, changed: 4, skipped: 1, failed: 1`)
+	assert.Equal(t, 4, res.Changed)
+	assert.Equal(t, 1, res.Skipped)
+	assert.Equal(t, 1, res.Failed)
+}
+
+func TestProcess_Run_FailedWhen(t *testing.T) {
+	tbl := []struct {
+		name string
+		cmd  config.Cmd
+		err  string
+	}{
+		{"non-zero exit is a failure by default", config.Cmd{Name: "c", Script: "exit 1"}, "can't run script"},
+		{"exit code allowed", config.Cmd{Name: "c", Script: "exit 1", FailedWhen: "exit_code > 1"}, ""},
+		{"exit code still failed", config.Cmd{Name: "c", Script: "exit 3", FailedWhen: "exit_code > 1"}, "can't run script"},
+		{"failed by output", config.Cmd{Name: "c", Script: "echo ERROR: bad", FailedWhen: `stdout contains "ERROR"`},
+			`failed_when "stdout contains \"ERROR\"" is true`},
+		{"failed by env", config.Cmd{Name: "c", Script: "echo ok", Environment: map[string]string{"MODE": "strict"},
+			FailedWhen: `env.MODE == "strict"`}, `failed_when "env.MODE == \"strict\"" is true`},
+		{"failed by setvar", config.Cmd{Name: "c", Script: "echo ok\nexport RES=bad", FailedWhen: `env.RES == "bad"`},
+			`failed_when "env.RES == \"bad\"" is true`},
+		{"unknown variable", config.Cmd{Name: "c", Script: "echo ok", FailedWhen: "foo == 1"},
+			`can't check failed_when on localhost:0: can't evaluate expression "foo == 1": unknown variable "foo"`},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cmd.Options.Local = true
+			tsk := config.Task{Name: "t", Commands: []config.Cmd{tt.cmd}}
+			pbook := &mocks.PlaybookMock{
+				TaskFunc:        func(string) (*config.Task, error) { return &tsk, nil },
+				TargetHostsFunc: func(string) ([]config.Destination, error) { return nil, nil },
+			}
+			p := &Process{Concurrency: 1, Playbook: pbook, Local: true, Logs: executor.MakeLogs(false, false, nil)}
+			_, err := p.Run(context.Background(), "t", "all")
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestProcess_Run_Handlers(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "src.txt")
+	require.NoError(t, os.WriteFile(srcFile, []byte("content"), 0o600))
+	marker := filepath.Join(tmpDir, "marker.txt")
+
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t",
+		Commands: []config.Cmd{
+			{Name: "copy", Copy: config.CopyInternal{Source: srcFile, Dest: tmpDir + "/{SPOT_REMOTE_NAME}.txt"},
+				Options: local, Notify: []string{"second", "first"}},
+			{Name: "copy again", Copy: config.CopyInternal{Source: srcFile, Dest: tmpDir + "/{SPOT_REMOTE_NAME}.txt"},
+				Options: local, Notify: []string{"not notified"}},
+			{Name: "script", Script: "echo done", ChangedWhen: "true", Options: local, Notify: []string{"first"}},
+		},
+		Handlers: []config.Cmd{
+			{Name: "first", Script: "echo first {SPOT_REMOTE_NAME} >> " + marker, Options: local},
+			{Name: "not notified", Script: "echo not notified >> " + marker, Options: local},
+			{Name: "second", Script: "echo second {SPOT_REMOTE_NAME} >> " + marker, Options: local},
+		},
+	}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) { return &tsk, nil },
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}, {Host: "h2", Name: "h2", Port: 22}}, nil
+		},
+	}
+
+	p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil)}
+	res, err := p.Run(context.Background(), "t", "all")
+	require.NoError(t, err)
+	assert.Equal(t, 5, res.Commands, "3 commands and 2 handlers")
+
+	// each notified handler runs once per host, in the order of definition
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "first h1\nsecond h1\nfirst h2\nsecond h2\n", string(data))
+
+	t.Run("nothing changed, no handlers", func(t *testing.T) {
+		require.NoError(t, os.Remove(marker))
+		tsk.Commands = tsk.Commands[:2] // copy and copy again, both files are in place already
+		_, err := p.Run(context.Background(), "t", "all")
+		require.NoError(t, err)
+		_, err = os.Stat(marker)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("failed command, no handlers", func(t *testing.T) {
+		tsk.Commands = []config.Cmd{
+			{Name: "script", Script: "echo done", Options: local, Notify: []string{"first"}},
+			{Name: "fail", Script: "exit 1", Options: local},
+		}
+		_, err := p.Run(context.Background(), "t", "all")
+		require.Error(t, err)
+		_, err = os.Stat(marker)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestProcess_Run_Rollback(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"20240101000000.000000", "20240102000000.000000"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "releases", name), 0o750))
+	}
+	current := filepath.Join(tmpDir, "current")
+	require.NoError(t, os.Symlink(filepath.Join(tmpDir, "releases", "20240102000000.000000"), current))
+	marker := filepath.Join(tmpDir, "marker.txt")
+
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t",
+		Commands: []config.Cmd{
+			{Name: "build", Script: "echo build >> " + marker, Options: local},
+			{Name: "release", Release: config.ReleaseInternal{Dir: tmpDir, Source: "dist"}, Options: local,
+				Notify: []string{"restart"}},
+		},
+		Handlers: []config.Cmd{{Name: "restart", Script: "echo restart $RELEASE_DIR >> " + marker, Options: local}},
+	}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) { return &tsk, nil },
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}}, nil
+		},
+	}
+
+	p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil), Rollback: true}
+	res, err := p.Run(context.Background(), "t", "all")
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Commands, "release command and notified handler, build skipped")
+
+	link, err := os.Readlink(current)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(tmpDir, "releases", "20240101000000.000000"), link)
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "restart "+link+"\n", string(data))
+}
+
+func TestProcess_Run_Call(t *testing.T) {
+	tmpDir := t.TempDir()
+	marker := filepath.Join(tmpDir, "marker.txt")
+
+	tasks := map[string]config.Task{
+		"main": {Name: "main", Commands: []config.Cmd{
+			{Name: "deploy api", Call: config.CallInternal{Task: "deploy_service",
+				Args: map[string]string{"SERVICE": "api", "PORT": "{SPOT_TASK}-8080"}}},
+			{Name: "after", Script: "echo after $RESULT >> " + marker},
+		}},
+		"deploy_service": {Name: "deploy_service",
+			Inputs: []config.Input{{Name: "SERVICE", Required: true}, {Name: "PORT", Default: "80"}, {Name: "LEVEL", Default: "info"}},
+			Commands: []config.Cmd{
+				{Name: "deploy", Script: "echo $SERVICE:$PORT:$LEVEL >> " + marker, Notify: []string{"restart"}},
+				{Name: "result", Script: "export RESULT=done-$SERVICE", Register: []string{"RESULT"}},
+			},
+			Handlers: []config.Cmd{{Name: "restart", Script: "echo restart $SERVICE >> " + marker}},
+		},
+		"missing": {Name: "missing", Commands: []config.Cmd{
+			{Name: "no args", Call: config.CallInternal{Task: "deploy_service"}},
+		}},
+		"loop": {Name: "loop", Commands: []config.Cmd{
+			{Name: "again", Call: config.CallInternal{Task: "loop"}},
+		}},
+	}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(name string) (*config.Task, error) {
+			tsk, ok := tasks[name]
+			if !ok {
+				return nil, fmt.Errorf("task %q not found", name)
+			}
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}}, nil
+		},
+	}
+	p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil), Local: true}
+
+	t.Run("call with args", func(t *testing.T) {
+		res, err := p.Run(context.Background(), "main", "all")
+		require.NoError(t, err)
+		assert.Equal(t, 5, res.Commands, "call, called commands with handler and command after call")
+		assert.Equal(t, "done-api", res.Registered["RESULT"])
+		data, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "api:main-8080:info\nrestart api\nafter done-api\n", string(data))
+	})
+
+	t.Run("called task run directly gets defaults", func(t *testing.T) {
+		require.NoError(t, os.Remove(marker))
+		tsk := tasks["deploy_service"]
+		tsk.Inputs = []config.Input{{Name: "SERVICE", Default: "web"}, {Name: "PORT", Default: "80"}, {Name: "LEVEL", Default: "info"}}
+		tasks["direct"] = tsk
+		_, err := p.Run(context.Background(), "direct", "all")
+		require.NoError(t, err)
+		data, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "web:80:info\nrestart web\n", string(data))
+	})
+
+	t.Run("called task run directly with inputs", func(t *testing.T) {
+		require.NoError(t, os.Remove(marker))
+		tsk := tasks["deploy_service"]
+		tsk.Commands = deepcopy.Copy(tsk.Commands).([]config.Cmd)
+		tsk.Commands[0].Environment = map[string]string{"LEVEL": "debug", "PORT": "81"}
+		tasks["direct_inputs"] = tsk
+		pi := *p
+		pi.Inputs = map[string]string{"SERVICE": "db", "PORT": "5432", "OTHER": "ignored"}
+		_, err := pi.Run(context.Background(), "direct_inputs", "all")
+		require.NoError(t, err)
+		data, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "db:5432:debug\nrestart db\n", string(data), "passed input overrides command env, default doesn't")
+	})
+
+	t.Run("required input", func(t *testing.T) {
+		_, err := p.Run(context.Background(), "missing", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `missing required argument "SERVICE" for task "deploy_service"`)
+
+		_, err = p.Run(context.Background(), "deploy_service", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `missing required argument "SERVICE" for task "deploy_service"`)
+	})
+
+	t.Run("recursion limited", func(t *testing.T) {
+		_, err := p.Run(context.Background(), "loop", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `call depth limit 10 exceeded, task "loop"`)
+	})
+}
+
+func TestProcess_Run_Loop(t *testing.T) {
+	tmpDir := t.TempDir()
+	marker := filepath.Join(tmpDir, "marker.txt")
+	for _, name := range []string{"b.conf", "a.conf", "skip.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), nil, 0o600))
+	}
+
+	tsk := config.Task{Name: "t", Commands: []config.Cmd{
+		{Name: "services", Script: `export SERVICES="api, worker"`, Register: []string{"SERVICES"}},
+		{Name: "restart", Script: "echo {ITEM_INDEX}:$ITEM >> " + marker, Loop: config.LoopInternal{Var: "SERVICES"}},
+		{Name: "mkdir", Script: "echo dir-{ITEM} >> " + marker, Condition: `[ "{ITEM}" != "skip" ]`,
+			Loop: config.LoopInternal{Items: []string{"a", "skip", "b"}}},
+		{Name: "may fail", Script: `[ "$ITEM" != "fail" ] && echo ok-$ITEM >> ` + marker,
+			Loop: config.LoopInternal{Items: []string{"x", "fail", "y"}}, Options: config.CmdOptions{IgnoreErrors: true}},
+		{Name: "configs", Script: "echo $(basename {ITEM}) >> " + marker, Loop: config.LoopInternal{Glob: tmpDir + "/*.conf"}},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}}, nil
+		},
+	}
+	p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil), Local: true}
+
+	t.Run("loop items", func(t *testing.T) {
+		res, err := p.Run(context.Background(), "t", "all")
+		require.NoError(t, err)
+		assert.Equal(t, 10, res.Commands, "each iteration counted, failed iteration is not")
+		assert.Equal(t, 1, res.Skipped, "skipped by cond")
+		assert.Equal(t, 1, res.Failed, "failed with ignored error")
+		data, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		assert.Equal(t, "0:api\n1:worker\ndir-a\ndir-b\nok-x\nok-y\na.conf\nb.conf\n", string(data))
+	})
+
+	t.Run("loop variable not set", func(t *testing.T) {
+		tsk.Commands = []config.Cmd{{Name: "restart", Script: "echo $ITEM", Loop: config.LoopInternal{Var: "$SERVICES"}}}
+		_, err := p.Run(context.Background(), "t", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `failed command "restart" on host localhost:0 (localhost): loop variable "SERVICES" is not set`)
+	})
+}
+
+func TestProcess_Run_Vars(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker.txt")
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t", Vars: map[string]string{"LEVEL": "task", "APP": "spot", "MODE": "task"},
+		Commands: []config.Cmd{
+			{Name: "vars", Script: "echo {APP}:$LEVEL:$MODE:{REGION} >> " + marker, Options: local,
+				Environment: map[string]string{"MODE": "cmd"}},
+			{Name: "call", Call: config.CallInternal{Task: "called"}, Options: local},
+		},
+	}
+	called := config.Task{Name: "called", Vars: map[string]string{"APP": "called"},
+		Commands: []config.Cmd{{Name: "called vars", Script: "echo called-$APP:$LEVEL >> " + marker, Options: local}}}
+
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(name string) (*config.Task, error) {
+			src := tsk
+			if name == "called" {
+				src = called
+			}
+			cp := deepcopy.Copy(src).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{
+				{Host: "h1", Name: "h1", Port: 22, Vars: map[string]string{"LEVEL": "host", "REGION": "us-east"}},
+			}, nil
+		},
+	}
+	p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil)}
+
+	res, err := p.Run(context.Background(), "t", "all")
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Commands)
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "spot:host:cmd:us-east\ncalled-called:host\n", string(data),
+		"host vars override task vars, command env overrides both")
+
+	require.NoError(t, os.Remove(marker))
+	p.Local = true
+	_, err = p.Run(context.Background(), "t", "all")
+	require.NoError(t, err)
+	data, err = os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "spot:host:cmd:us-east\ncalled-called:host\n", string(data), "host vars kept in local mode")
+}
+
+func Test_localDestination(t *testing.T) {
+	res := localDestination([]config.Destination{
+		{Host: "h1", Name: "web1", Port: 22, User: "app", Tags: []string{"web"}, Vars: map[string]string{"A": "1", "B": "1"}},
+		{Host: "h2", Name: "web2", Port: 22, Tags: []string{"web", "eu"}, Vars: map[string]string{"B": "2"}},
+	})
+	assert.Equal(t, config.Destination{Host: "localhost", Name: "localhost", Tags: []string{"web"},
+		Vars: map[string]string{"A": "1", "B": "1"}}, res, "first host only")
+
+	assert.Equal(t, config.Destination{Host: "localhost", Name: "localhost"}, localDestination(nil))
+}
+
+func TestProcess_Run_GoTemplate(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker.txt")
+	tsk := config.Task{Name: "t", Commands: []config.Cmd{
+		{Name: "tmpl", Script: `echo {{ .ITEM | upper }}-{{ env "MODE" | default "dev" }} >> ` + marker,
+			Loop: config.LoopInternal{Items: []string{"a", "b"}}, Options: config.CmdOptions{GoTemplate: true}},
+		{Name: "plain", Script: `echo "{{ .ITEM }}" >> ` + marker},
+		{Name: "bad", Script: "echo {{ .ITEM", Options: config.CmdOptions{GoTemplate: true}},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}}, nil
+		},
+	}
+	p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil), Local: true}
+
+	_, err := p.Run(context.Background(), "t", "all")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `can't render go template: template: task "t", command "bad", script:1: unclosed action`)
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "A-dev\nB-dev\n{{ .ITEM }}\n", string(data), "without option templates are kept as is")
+}
+
+func TestProcess_Run_When(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker.txt")
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t", Commands: []config.Cmd{
+		{Name: "register", Script: "export STATE=ready", Register: []string{"STATE"}, Options: local},
+		{Name: "all hosts", Script: "echo all-{SPOT_REMOTE_NAME} >> " + marker, Options: local,
+			When: `registered.STATE == "ready" && env.ENV == "prod"`},
+		{Name: "db only", Script: "echo db-{SPOT_REMOTE_NAME} >> " + marker, Options: local,
+			When: `host.tags contains "db" and host.vars.ROLE == "primary"`},
+		{Name: "loop", Script: "echo item-{ITEM}-{SPOT_REMOTE_NAME} >> " + marker, Options: local,
+			Loop: config.LoopInternal{Items: []string{"a", "b"}}, When: `env.ITEM != "a" && host.name == "web"`},
+		{Name: "remote", Script: "echo remote", When: `"db" in host.tags`},
+	}, Vars: map[string]string{"ENV": "prod"}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{
+				{Host: "h1", Name: "web", Port: 22},
+				{Host: "h2", Name: "db", Port: 22, Tags: []string{"db"}, Vars: map[string]string{"ROLE": "primary"}},
+			}, nil
+		},
+	}
+	connector := &mocks.ConnectorMock{
+		ConnectFunc: func(_ context.Context, hostAddr, _, _ string) (*executor.Remote, error) {
+			return nil, errors.New("no route to " + hostAddr)
+		},
+	}
+	p := &Process{Concurrency: 1, Playbook: pbook, Connector: connector, Logs: executor.MakeLogs(false, false, nil)}
+
+	_, err := p.Run(context.Background(), "t", "all")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't connect to db, user: : no route to h2:22")
+	require.Len(t, connector.ConnectCalls(), 1, "web host is not connected, its remote command is skipped")
+	assert.Equal(t, "h2:22", connector.ConnectCalls()[0].HostAddr)
+
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "all-web\nitem-b-web\nall-db\ndb-db\n", string(data))
+
+	t.Run("invalid expression fails the command", func(t *testing.T) {
+		tsk.Commands = []config.Cmd{{Name: "bad", Script: "echo 1", Options: local, When: "unknown == 1"}}
+		_, err := p.Run(context.Background(), "t", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `failed command "bad" on host h1:22 (web): can't evaluate expression "unknown == 1"`)
+	})
+}
+
+func TestProcess_Run_RunOnce(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker.txt")
+	local := config.CmdOptions{Local: true}
+	once := config.CmdOptions{Local: true, RunOnce: true}
+	tasks := map[string]config.Task{
+		"ok": {Name: "ok", Commands: []config.Cmd{
+			{Name: "migrate", Script: "echo migrate-{SPOT_REMOTE_NAME} >> " + marker + "\nexport VERSION=v2-{SPOT_REMOTE_NAME}",
+				Register: []string{"VERSION"}, Options: once},
+			{Name: "skipped", Script: "echo never >> " + marker, Options: once, When: `host.name != "h1"`},
+			{Name: "after", Script: "echo after-{SPOT_REMOTE_NAME}-$VERSION >> " + marker, Options: local},
+		}},
+		"failed": {Name: "failed", Commands: []config.Cmd{
+			{Name: "migrate", Script: "exit 1", Options: once},
+			{Name: "after", Script: "echo after >> " + marker, Options: local},
+		}},
+	}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(name string) (*config.Task, error) {
+			cp := deepcopy.Copy(tasks[name]).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}, {Host: "h2", Name: "h2", Port: 22},
+				{Host: "h3", Name: "h3", Port: 22}}, nil
+		},
+	}
+	p := &Process{Concurrency: 3, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil)}
+
+	t.Run("executed on first host, shared with others", func(t *testing.T) {
+		res, err := p.Run(context.Background(), "ok", "all")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"VERSION": "v2-h1"}, res.Registered)
+		data, err := os.ReadFile(marker)
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		sort.Strings(lines)
+		assert.Equal(t, []string{"after-h1-v2-h1", "after-h2-v2-h1", "after-h3-v2-h1", "migrate-h1"}, lines)
+	})
+
+	t.Run("failed on first host fails all", func(t *testing.T) {
+		require.NoError(t, os.Remove(marker))
+		_, err := p.Run(context.Background(), "failed", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `failed command "migrate" on host h1:22 (h1)`)
+		assert.Contains(t, err.Error(), `failed command "migrate" on host h2:22 (h2): run_once command failed on h1:22:`)
+		_, err = os.Stat(marker)
+		assert.True(t, os.IsNotExist(err), "no commands after failed run_once")
+	})
+}
+
+func TestProcess_Run_DelegateTo(t *testing.T) {
+	tsk := config.Task{Name: "t", Commands: []config.Cmd{
+		{Name: "drain", Script: "drain {SPOT_REMOTE_NAME}", Options: config.CmdOptions{DelegateTo: "{LB}"},
+			Environment: map[string]string{"LB": "lb"}},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(name string) ([]config.Destination, error) {
+			switch name {
+			case "lb":
+				return []config.Destination{{Host: "lb1", Name: "lb", Port: 2222, User: "admin"}}, nil
+			case "many":
+				return []config.Destination{{Host: "lb1", Port: 22}, {Host: "lb2", Port: 22}}, nil
+			}
+			return []config.Destination{{Host: "h1", Name: "web1", Port: 22}, {Host: "h2", Name: "web2", Port: 22}}, nil
+		},
+	}
+	connector := &mocks.ConnectorMock{
+		ConnectFunc: func(_ context.Context, hostAddr, _, _ string) (*executor.Remote, error) {
+			return nil, errors.New("no route to " + hostAddr)
+		},
+	}
+	p := &Process{Concurrency: 1, Playbook: pbook, Connector: connector, Logs: executor.MakeLogs(false, false, nil)}
+
+	t.Run("connects to delegate host only", func(t *testing.T) {
+		_, err := p.Run(context.Background(), "t", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `failed command "drain" on host h1:22 (web1): can't connect to delegate_to host lb1:2222`)
+		require.Len(t, connector.ConnectCalls(), 2, "each host makes its own connection to the delegate host")
+		for _, call := range connector.ConnectCalls() {
+			assert.Equal(t, "lb1:2222", call.HostAddr)
+			assert.Equal(t, "admin", call.User)
+		}
+	})
+
+	t.Run("delegate to multiple hosts", func(t *testing.T) {
+		tsk.Commands[0].Environment["LB"] = "many"
+		_, err := p.Run(context.Background(), "t", "all")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `delegate_to "many" matches 2 hosts, must be a single host`)
+	})
+}
+
+func TestProcess_RunDelegateToRemote(t *testing.T) {
+	ctx := context.Background()
+	testingHostAndPort, teardown := startTestContainer(t)
+	defer teardown()
+
+	logs := executor.MakeLogs(false, false, nil)
+	connector, err := executor.NewConnector("testdata/test_ssh_key", time.Second*10, logs)
+	require.NoError(t, err)
+
+	tsk := config.Task{Name: "t", Commands: []config.Cmd{
+		{Name: "drain", Script: "export DRAINED=$(whoami)-{SPOT_REMOTE_NAME}", Register: []string{"DRAINED"},
+			Options: config.CmdOptions{DelegateTo: testingHostAndPort}},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(name string) ([]config.Destination, error) {
+			if name == testingHostAndPort {
+				host, port, _ := net.SplitHostPort(testingHostAndPort)
+				portNum, _ := strconv.Atoi(port)
+				return []config.Destination{{Host: host, Port: portNum, User: "test"}}, nil
+			}
+			// not reachable, never connected as all commands are delegated
+			return []config.Destination{{Host: "10.255.255.1", Name: "web1", Port: 22, User: "test"}}, nil
+		},
+	}
+	p := Process{Concurrency: 1, Connector: connector, Playbook: pbook, Logs: logs}
+	res, err := p.Run(ctx, "t", "all")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"DRAINED": "test-web1"}, res.Registered)
+}
+
+func TestProcess_Run_DryDiff(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "src.conf")
+	require.NoError(t, os.WriteFile(srcFile, []byte("key=new\n"), 0o600))
+	dstFile := filepath.Join(tmpDir, "dst.conf")
+	require.NoError(t, os.WriteFile(dstFile, []byte("key=old\nremove me\n"), 0o600))
+	sudoFile := filepath.Join(tmpDir, "sudo.conf")
+	require.NoError(t, os.WriteFile(sudoFile, []byte("key=sudo\n"), 0o600))
+
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t",
+		Commands: []config.Cmd{
+			{Name: "copy", Copy: config.CopyInternal{Source: srcFile, Dest: dstFile}, Options: local},
+			{Name: "copy sudo", Copy: config.CopyInternal{Source: srcFile, Dest: sudoFile},
+				Options: config.CmdOptions{Local: true, Sudo: true}},
+			{Name: "line delete", Line: config.LineInternal{File: dstFile, Match: "^remove", Delete: true}, Options: local},
+			{Name: "line append", Line: config.LineInternal{File: dstFile, Match: "^added", Append: "added line"}, Options: local},
+		},
+	}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) { return &tsk, nil },
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}}, nil
+		},
+	}
+
+	stdout := captureStdOut(t, func() {
+		p := &Process{Concurrency: 1, Playbook: pbook, Dry: true, Logs: executor.MakeLogs(false, true, nil)}
+		_, err := p.Run(context.Background(), "t", "all")
+		require.NoError(t, err)
+	})
+	t.Log(stdout)
+	assert.Contains(t, stdout, "-key=old\n")
+	assert.Contains(t, stdout, "+key=new\n")
+	assert.Contains(t, stdout, "--- a"+sudoFile+"\n", "sudo copy diffed against the destination")
+	assert.Contains(t, stdout, "-key=sudo\n")
+	assert.Contains(t, stdout, "-remove me\n")
+	assert.Contains(t, stdout, "+added line\n")
+	assert.Contains(t, stdout, `completed command "line append" {line: `+dstFile+`, append: ^added} [would change]`)
+
+	data, err := os.ReadFile(dstFile)
+	require.NoError(t, err)
+	assert.Equal(t, "key=old\nremove me\n", string(data), "dry run should not modify the file")
+}
+
+func TestProcess_Run_CheckMode(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "src.conf")
+	require.NoError(t, os.WriteFile(srcFile, []byte("key=new\n"), 0o600))
+	dstFile := filepath.Join(tmpDir, "dst.conf")
+	require.NoError(t, os.WriteFile(dstFile, []byte("key=old\n"), 0o600))
+	marker := filepath.Join(tmpDir, "marker.txt")
+
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t",
+		Commands: []config.Cmd{
+			{Name: "safe", Script: "export SAFE_VAR=value", Register: []string{"SAFE_VAR"},
+				Options: config.CmdOptions{Local: true, CheckSafe: true}},
+			{Name: "unsafe", Script: "echo unsafe >> " + marker, Options: local},
+			{Name: "skipped by cond", Script: "echo skipped >> " + marker, Condition: "test -f " + marker, Options: local},
+			{Name: "copy", Copy: config.CopyInternal{Source: srcFile, Dest: dstFile}, Options: local},
+			{Name: "copy same", Copy: config.CopyInternal{Source: srcFile, Dest: srcFile}, Options: local},
+			{Name: "wait", Wait: config.WaitInternal{Command: "test -f " + srcFile, CheckDuration: time.Millisecond},
+				Options: local},
+		},
+	}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) { return &tsk, nil },
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "h1", Port: 22}}, nil
+		},
+		UpdateRegisteredVarsFunc: func(map[string]string) {},
+	}
+
+	var res ProcResp
+	stdout := captureStdOut(t, func() {
+		p := &Process{Concurrency: 1, Playbook: pbook, Check: true, Logs: executor.MakeLogs(false, true, nil)}
+		var err error
+		res, err = p.Run(context.Background(), "t", "all")
+		require.NoError(t, err)
+	})
+	t.Log(stdout)
+
+	assert.Equal(t, map[string]string{"SAFE_VAR": "value"}, res.Registered, "check_safe command executed")
+	assert.Contains(t, stdout, `completed command "unsafe" {script: `)
+	assert.Contains(t, stdout, `completed command "skipped by cond" {skip: skipped by cond} [skipped]`)
+	assert.Contains(t, stdout, `completed command "copy" {copy: `+srcFile+` -> `+dstFile+`} [would change]`)
+	assert.Contains(t, stdout, `completed command "copy same" {copy: `+srcFile+` -> `+srcFile+`} [ok]`)
+	assert.Contains(t, stdout, "+key=new\n")
+	assert.Regexp(t, `completed command "wait" .* \[ok\]`, stdout)
+	assert.Equal(t, 3, res.Changed, "safe script, unsafe script and copy")
+	assert.Equal(t, 1, res.Skipped)
+
+	_, err := os.Stat(marker)
+	assert.ErrorIs(t, err, os.ErrNotExist, "unsafe command should not run in check mode")
+	data, err := os.ReadFile(dstFile)
+	require.NoError(t, err)
+	assert.Equal(t, "key=old\n", string(data), "check mode should not modify the file")
+}
+
 func startTestContainer(t *testing.T) (hostAndPort string, teardown func()) {
 	return startTestContainerWithCustomUser(t, "test")
 }
@@ -1537,3 +2229,31 @@ func captureStdOut(t *testing.T, f func()) string {
 	io.Copy(&buf, r)
 	return buf.String()
 }
+
+func TestProcess_Run_RegisterJSON(t *testing.T) {
+	dir := t.TempDir()
+	out, marker := filepath.Join(dir, "out.json"), filepath.Join(dir, "marker.txt")
+	require.NoError(t, os.WriteFile(out, []byte(`{"items": [{"name": "web-1"}, {"name": "web-2"}]}`+"\n"), 0o600))
+	local := config.CmdOptions{Local: true}
+	tsk := config.Task{Name: "t", Commands: []config.Cmd{
+		{Name: "get pods", Script: "cat " + out, Options: local,
+			RegisterJSON: map[string]string{"POD": "$.items[0].name", "PODS": "$.items[*].name"}},
+		{Name: "use pod", Script: "echo $POD {PODS} >> " + marker, Options: local},
+	}}
+	pbook := &mocks.PlaybookMock{
+		TaskFunc: func(string) (*config.Task, error) {
+			cp := deepcopy.Copy(tsk).(config.Task)
+			return &cp, nil
+		},
+		TargetHostsFunc: func(string) ([]config.Destination, error) {
+			return []config.Destination{{Host: "h1", Name: "web", Port: 22}}, nil
+		},
+	}
+	p := &Process{Concurrency: 1, Playbook: pbook, Logs: executor.MakeLogs(false, false, nil)}
+	res, err := p.Run(context.Background(), "t", "all")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"POD": "web-1", "PODS": `["web-1","web-2"]`}, res.Registered)
+	data, err := os.ReadFile(marker)
+	require.NoError(t, err)
+	assert.Equal(t, "web-1 [web-1,web-2]\n", string(data))
+}